@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rys/gitsync/pkg/gitsync"
+)
+
+var githubActions bool
+
+// setGitHubActions turns on GitHub Actions output when -github-actions was
+// given, which it is by default inside a workflow run.
+func setGitHubActions(enabled bool) {
+	githubActions = enabled
+}
+
+// workflowCommand prints a GitHub Actions workflow command, such as ::error,
+// with its title escaped as a property and its message as data.
+func workflowCommand(command, title, message string) {
+	data := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	property := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C")
+
+	fmt.Fprintf(output, "::%s title=%s::%s\n", command, property.Replace(title), data.Replace(message))
+}
+
+// annotateRun annotates the workflow run with an error for every branch that
+// failed and a warning for every branch that was skipped, and appends a
+// table of the run to the job summary.
+func annotateRun(run *gitsync.RunResult) {
+	if !githubActions {
+		return
+	}
+
+	if run.Err != nil {
+		workflowCommand("error", "gitsync run "+run.ID, run.Err.Error())
+	}
+
+	for _, result := range run.Syncs {
+		// A sync entry can fail before any of its branches is tried, such
+		// as when its remotes are down.
+		if len(result.Branches) == 0 && result.Err != nil {
+			workflowCommand("error", result.Source+" → "+result.Target, result.Err.Error())
+		}
+
+		for _, branch := range result.Branches {
+			message := branch.Branch + " was " + branch.Status
+
+			if branch.Err != nil {
+				message = branch.Err.Error()
+			}
+
+			switch branch.Status {
+			case gitsync.StatusFailed:
+				workflowCommand("error", result.Source+" → "+result.Target+": "+branch.Branch, message)
+			case gitsync.StatusSkipped:
+				workflowCommand("warning", result.Source+" → "+result.Target+": "+branch.Branch, message)
+			}
+		}
+	}
+
+	var summary strings.Builder
+
+	fmt.Fprintf(&summary, "### gitsync run `%s`\n\n", run.ID)
+
+	if run.Err != nil {
+		fmt.Fprintf(&summary, ":x: %s\n\n", markdownCell(run.Err.Error()))
+	}
+
+	if len(run.Syncs) > 0 {
+		summary.WriteString("| Source | Target | Branch | Result | Old | New | Commits | Duration | Error |\n")
+		summary.WriteString("| --- | --- | --- | --- | --- | --- | ---: | ---: | --- |\n")
+	}
+
+	for _, result := range run.Syncs {
+		if len(result.Branches) == 0 && result.Err != nil {
+			fmt.Fprintf(&summary, "| %s | %s | | %s | | | | | %s |\n", markdownCell(result.Source), markdownCell(result.Target),
+				statusEmoji(result.Status), markdownCell(result.Err.Error()))
+		}
+
+		for _, branch := range result.Branches {
+			errText := ""
+
+			if branch.Err != nil {
+				errText = branch.Err.Error()
+			}
+
+			fmt.Fprintf(&summary, "| %s | %s | `%s` | %s | `%s` | `%s` | %d | %s | %s |\n",
+				markdownCell(result.Source), markdownCell(result.Target), markdownCell(branch.Branch), statusEmoji(branch.Status),
+				gitsync.ShortSHA(branch.OldSHA), gitsync.ShortSHA(branch.NewSHA), branch.Commits,
+				branch.Duration.Round(time.Millisecond), markdownCell(errText))
+		}
+	}
+
+	appendJobSummary(summary.String())
+}
+
+// annotateDrift annotates the workflow run with a warning for every branch
+// that is stale or missing from its target and an error for every branch
+// that couldn't be checked, and appends a table of them to the job summary.
+func annotateDrift(drifts []*gitsync.Drift) {
+	if !githubActions {
+		return
+	}
+
+	var summary strings.Builder
+
+	summary.WriteString("### gitsync check\n\n")
+	summary.WriteString("| Source | Target | Branch | State | Source SHA | Target SHA | Error |\n")
+	summary.WriteString("| --- | --- | --- | --- | --- | --- | --- |\n")
+
+	for _, drift := range drifts {
+		errText := ""
+
+		if drift.Err != nil {
+			errText = drift.Err.Error()
+		}
+
+		switch drift.State {
+		case gitsync.DriftStale, gitsync.DriftMissing:
+			workflowCommand("warning", drift.Source+" → "+drift.Target+": "+drift.Branch, drift.Branch+" is "+drift.State+" on "+drift.Target)
+		case gitsync.DriftError:
+			workflowCommand("error", drift.Source+" → "+drift.Target+": "+drift.Branch, errText)
+		}
+
+		fmt.Fprintf(&summary, "| %s | %s | `%s` | %s | `%s` | `%s` | %s |\n",
+			markdownCell(drift.Source), markdownCell(drift.Target), markdownCell(drift.Branch), statusEmoji(drift.State),
+			gitsync.ShortSHA(drift.SourceSHA), gitsync.ShortSHA(drift.TargetSHA), markdownCell(errText))
+	}
+
+	appendJobSummary(summary.String())
+}
+
+// appendJobSummary appends markdown to the job summary file GitHub Actions
+// gives each step in $GITHUB_STEP_SUMMARY, if it gave one.
+func appendJobSummary(markdown string) {
+	path := os.Getenv("GITHUB_STEP_SUMMARY")
+
+	if path == "" {
+		return
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+
+	if err != nil {
+		errorPrintf("could not write the job summary: %s\n", err)
+		return
+	}
+
+	defer file.Close()
+
+	if _, err := file.WriteString(markdown + "\n"); err != nil {
+		errorPrintf("could not write the job summary: %s\n", err)
+	}
+}
+
+// statusEmoji prefixes a sync or drift status with an emoji of how good it
+// is, as the summary's colors do on a terminal.
+func statusEmoji(status string) string {
+	switch status {
+	case gitsync.StatusSynced, gitsync.StatusUpToDate, gitsync.DriftInSync:
+		return ":white_check_mark: " + status
+	case gitsync.StatusSkipped, gitsync.DriftStale, gitsync.DriftMissing:
+		return ":warning: " + status
+	case gitsync.StatusFailed, gitsync.DriftError:
+		return ":x: " + status
+	}
+
+	return status
+}
+
+// markdownCell keeps text from breaking out of a markdown table cell.
+func markdownCell(text string) string {
+	return strings.NewReplacer("|", "\\|", "\r", " ", "\n", " ").Replace(text)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+
+	"github.com/rys/gitsync/pkg/gitsync"
+)
+
+// Every color code is the same length so that colored tabwriter cells stay
+// aligned: a header cell gets colorDefault to match the cells beneath it.
+const (
+	colorRed     string = "\x1b[31m"
+	colorGreen   string = "\x1b[32m"
+	colorYellow  string = "\x1b[33m"
+	colorDefault string = "\x1b[39m"
+	colorReset   string = "\x1b[0m"
+)
+
+var colorEnabled bool
+
+// setColor turns on colored output when stdout is a terminal, unless
+// -no-color was given or NO_COLOR is set (https://no-color.org).
+func setColor(noColor bool) {
+	colorEnabled = !noColor && os.Getenv("NO_COLOR") == "" && gitsync.StdoutIsTerminal()
+}
+
+func colorize(color, text string) string {
+	if !colorEnabled {
+		return text
+	}
+
+	return color + text + colorReset
+}
+
+// colorStatus colors a sync, drift or plan status by how good it is.
+func colorStatus(status string) string {
+	switch status {
+	case gitsync.StatusSynced, gitsync.StatusUpToDate, gitsync.DriftInSync, gitsync.PlanNone:
+		return colorize(colorGreen, status)
+	case gitsync.StatusSkipped, gitsync.DriftStale, gitsync.DriftMissing, gitsync.PlanCreate, gitsync.PlanFastForward:
+		return colorize(colorYellow, status)
+	case gitsync.StatusFailed, gitsync.DriftError, gitsync.PlanForce:
+		return colorize(colorRed, status)
+	}
+
+	return colorize(colorDefault, status)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+const configDiscover string = "discover"
+
+// gsSourceRemoteNames are what remotes synced from are usually called, most
+// likely first.
+var gsSourceRemoteNames = []string{"upstream", "origin", "source", "github"}
+
+// gsTargetRemoteWords are in the names of remotes that are usually synced
+// to.
+var gsTargetRemoteWords = []string{"mirror", "backup", "target", "downstream", "internal", "private", "ci"}
+
+// runConfigCommand runs one of the config subcommands, which work on configs
+// rather than sync.
+func runConfigCommand(args []string) int {
+	if len(args) == 0 {
+		errorPrintf("config needs a subcommand: %s\n", strings.Join([]string{configDiscover, configAddSync, configRemoveSync, configSet}, ", "))
+		return 1
+	}
+
+	switch args[0] {
+	case configDiscover:
+		return runConfigDiscover(args[1:])
+	case configAddSync:
+		return runConfigAddSync(args[1:])
+	case configRemoveSync:
+		return runConfigRemoveSync(args[1:])
+	case configSet:
+		return runConfigSet(args[1:])
+	}
+
+	errorPrintf("unknown config subcommand %s\n", args[0])
+	return 1
+}
+
+// configDiscoverFlags defines the config discover command's flags.
+func configDiscoverFlags(repoDir, out *string) *flag.FlagSet {
+	flags := flag.NewFlagSet("config discover", flag.ExitOnError)
+	flags.StringVar(repoDir, "repodir", getCwd(), "path to the git repository whose remotes are paired")
+	flags.StringVar(out, "out", "-", "file to write the config to (- for stdout)")
+
+	return flags
+}
+
+// runConfigDiscover writes a starter config for the repository's remotes,
+// pairing them by their names and syncing the branches each pair has in
+// common, going by what was last fetched from them.
+func runConfigDiscover(args []string) int {
+	var repoDir string
+	var out string
+
+	configDiscoverFlags(&repoDir, &out).Parse(args)
+
+	repo, err := git.PlainOpenWithOptions(repoDir, &git.PlainOpenOptions{DetectDotGit: true})
+
+	if err != nil {
+		errorPrintf("%s: %s\n", repoDir, err)
+		return 1
+	}
+
+	remotes, err := repo.Remotes()
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	config := starterConfig{Remotes: map[string]starterRemote{}, Sync: []starterSync{}}
+	var names []string
+
+	for _, remote := range remotes {
+		names = append(names, remote.Config().Name)
+	}
+
+	source, targets := pairRemotes(names)
+
+	if source == "" || len(targets) == 0 {
+		errorPrintf("could not tell which of the remotes (%s) to sync to which: name the ones to sync to after what they are, e.g. mirror\n", strings.Join(names, ", "))
+		return 1
+	}
+
+	for _, remote := range remotes {
+		if name := remote.Config().Name; (name == source || slices.Contains(targets, name)) && len(remote.Config().URLs) > 0 {
+			config.Remotes[name] = starterRemote{URL: remote.Config().URLs[0]}
+		}
+	}
+
+	sourceBranches := trackedBranches(repo, source)
+
+	for _, target := range targets {
+		var branches []string
+
+		for _, branch := range trackedBranches(repo, target) {
+			if slices.Contains(sourceBranches, branch) {
+				branches = append(branches, branch)
+			}
+		}
+
+		if len(branches) == 0 {
+			branch := defaultBranch(repo, source)
+
+			if branch == "" {
+				errorPrintf("%s has no branches fetched from it to sync to %s: fetch it first\n", source, target)
+				return 1
+			}
+
+			fmt.Fprintf(os.Stderr, "%s has none of %s's branches yet, syncing %s\n", target, source, branch)
+			branches = []string{branch}
+		}
+
+		fmt.Fprintf(os.Stderr, "syncing %s to %s: %s\n", source, target, strings.Join(branches, ", "))
+		config.Sync = append(config.Sync, starterSync{Source: source, Target: target, Branches: branches})
+	}
+
+	if err := writeStarterConfig(out, config); err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// pairRemotes picks the remote to sync from and those to sync to among
+// names: remotes named like mirrors are synced to, from upstream, origin or
+// whichever is left. Without any such names, upstream is synced to origin,
+// as in a fork, and either of two remotes to the other.
+func pairRemotes(names []string) (string, []string) {
+	var targets, others []string
+
+	for _, name := range names {
+		lower := strings.ToLower(name)
+
+		if slices.ContainsFunc(gsTargetRemoteWords, func(word string) bool { return strings.Contains(lower, word) }) {
+			targets = append(targets, name)
+		} else {
+			others = append(others, name)
+		}
+	}
+
+	named := func(want string) string {
+		index := slices.IndexFunc(others, func(name string) bool { return strings.EqualFold(name, want) })
+
+		if index < 0 {
+			return ""
+		}
+
+		return others[index]
+	}
+
+	source := ""
+
+	for _, name := range gsSourceRemoteNames {
+		if source = named(name); source != "" {
+			break
+		}
+	}
+
+	if source == "" && len(others) == 1 {
+		source = others[0]
+	}
+
+	if origin := named("origin"); len(targets) == 0 && strings.EqualFold(source, "upstream") && origin != "" {
+		targets = []string{origin}
+	}
+
+	if len(targets) == 0 && len(names) == 2 && source != "" {
+		targets = slices.DeleteFunc(slices.Clone(names), func(name string) bool { return name == source })
+	}
+
+	slices.Sort(targets)
+
+	return source, targets
+}
+
+// trackedBranches are the branches last fetched from remote, going by its
+// remote-tracking refs.
+func trackedBranches(repo *git.Repository, remote string) []string {
+	var branches []string
+
+	refs, err := repo.References()
+
+	if err != nil {
+		return nil
+	}
+
+	prefix := "refs/remotes/" + remote + "/"
+
+	refs.ForEach(func(ref *plumbing.Reference) error {
+		if branch, found := strings.CutPrefix(ref.Name().String(), prefix); found && branch != "HEAD" && ref.Type() == plumbing.HashReference {
+			branches = append(branches, branch)
+		}
+
+		return nil
+	})
+
+	slices.Sort(branches)
+
+	return branches
+}
+
+// defaultBranch is remote's default branch as last fetched, main or master
+// if it doesn't say, or empty if nothing was fetched from it.
+func defaultBranch(repo *git.Repository, remote string) string {
+	if head, err := repo.Reference(plumbing.ReferenceName("refs/remotes/"+remote+"/HEAD"), false); err == nil && head.Type() == plumbing.SymbolicReference {
+		return strings.TrimPrefix(head.Target().String(), "refs/remotes/"+remote+"/")
+	}
+
+	branches := trackedBranches(repo, remote)
+
+	for _, branch := range []string{"main", "master"} {
+		if slices.Contains(branches, branch) {
+			return branch
+		}
+	}
+
+	if len(branches) > 0 {
+		return branches[0]
+	}
+
+	return ""
+}
@@ -0,0 +1,683 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rys/gitsync/pkg/gitsync"
+)
+
+const (
+	configAddSync    string = "add-sync"
+	configRemoveSync string = "remove-sync"
+	configSet        string = "set"
+)
+
+// jsonObject is a JSON object that keeps its keys in the order they were
+// in, so that editing a config leaves the rest of it as it was.
+type jsonObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newJSONObject() *jsonObject {
+	return &jsonObject{values: map[string]interface{}{}}
+}
+
+// get returns the value of key, or nil if it isn't set.
+func (o *jsonObject) get(key string) interface{} {
+	return o.values[key]
+}
+
+// set sets key, adding it at the end if it isn't set yet.
+func (o *jsonObject) set(key string, value interface{}) {
+	if _, found := o.values[key]; !found {
+		o.keys = append(o.keys, key)
+	}
+
+	o.values[key] = value
+}
+
+// editedConfig is a config file being edited, with how it was indented so
+// it can be written back the same way.
+type editedConfig struct {
+	path   string
+	root   *jsonObject
+	indent string
+	// newline is whether the file ends in a newline.
+	newline bool
+	exists  bool
+}
+
+// syncEditOptions are the config add-sync and remove-sync commands' flags.
+type syncEditOptions struct {
+	configFile string
+	source     string
+	target     string
+	branches   string
+}
+
+// configAddSyncFlags defines the config add-sync command's flags.
+func configAddSyncFlags(opts *syncEditOptions) *flag.FlagSet {
+	flags := flag.NewFlagSet("config add-sync", flag.ExitOnError)
+	flags.StringVar(&opts.configFile, "config", gsConfigFile, "config file to edit, created if it doesn't exist")
+	flags.StringVar(&opts.source, "source", "", "remote to sync from")
+	flags.StringVar(&opts.target, "target", "", "remote to sync to")
+	flags.StringVar(&opts.branches, "branches", "", "comma-separated branches to sync")
+
+	return flags
+}
+
+// configRemoveSyncFlags defines the config remove-sync command's flags.
+func configRemoveSyncFlags(opts *syncEditOptions) *flag.FlagSet {
+	flags := flag.NewFlagSet("config remove-sync", flag.ExitOnError)
+	flags.StringVar(&opts.configFile, "config", gsConfigFile, "config file to edit")
+	flags.StringVar(&opts.source, "source", "", "remote synced from")
+	flags.StringVar(&opts.target, "target", "", "remote synced to")
+	flags.StringVar(&opts.branches, "branches", "", "comma-separated branches to stop syncing, rather than the whole entry")
+
+	return flags
+}
+
+// configSetFlags defines the config set command's flags.
+func configSetFlags(configFile *string) *flag.FlagSet {
+	flags := flag.NewFlagSet("config set", flag.ExitOnError)
+	flags.StringVar(configFile, "config", gsConfigFile, "config file to edit, created if it doesn't exist")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: gitsync config set [flags] key.path value\n")
+		flags.PrintDefaults()
+	}
+
+	return flags
+}
+
+// runConfigAddSync adds a sync entry, or the branches it doesn't have yet
+// to the entry that already syncs the source to the target.
+func runConfigAddSync(args []string) int {
+	var opts syncEditOptions
+
+	configAddSyncFlags(&opts).Parse(args)
+
+	configFile, source, target, branches := opts.configFile, opts.source, opts.target, opts.branches
+
+	if source == "" || target == "" || len(splitList(branches)) == 0 {
+		errorPrintf("config add-sync needs -source, -target and -branches\n")
+		return 1
+	}
+
+	config, err := readEditedConfig(configFile)
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	entries, err := config.syncEntries()
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	entry := findSyncEntry(entries, source, target)
+
+	if entry == nil {
+		entry = newJSONObject()
+		entry.set("source_remote", source)
+		entry.set("target_remote", target)
+		entry.set("branches", []interface{}{})
+		entries = append(entries, entry)
+	}
+
+	synced, ok := entry.get("branches").([]interface{})
+
+	if !ok && entry.get("branches") != nil {
+		errorPrintf("%s: the entry syncing %s to %s has branches that aren't a list\n", configFile, source, target)
+		return 1
+	}
+
+	added := 0
+
+	for _, branch := range splitList(branches) {
+		if !slices.Contains(synced, interface{}(branch)) {
+			synced = append(synced, branch)
+			added++
+		}
+	}
+
+	if added == 0 {
+		infoPrintf("%s already syncs %s to %s: %s\n", configFile, source, target, branches)
+		return 0
+	}
+
+	entry.set("branches", synced)
+	config.root.set("sync", entries)
+
+	if err := config.write(); err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// runConfigRemoveSync removes the entry that syncs the source to the
+// target, or only some of its branches, and the entry with the last of
+// them.
+func runConfigRemoveSync(args []string) int {
+	var opts syncEditOptions
+
+	configRemoveSyncFlags(&opts).Parse(args)
+
+	configFile, source, target, branches := opts.configFile, opts.source, opts.target, opts.branches
+
+	if source == "" || target == "" {
+		errorPrintf("config remove-sync needs -source and -target\n")
+		return 1
+	}
+
+	config, err := readEditedConfig(configFile)
+
+	if err == nil && !config.exists {
+		err = fmt.Errorf("%s doesn't exist", configFile)
+	}
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	entries, err := config.syncEntries()
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	entry := findSyncEntry(entries, source, target)
+
+	if entry == nil {
+		errorPrintf("%s has no entry syncing %s to %s\n", configFile, source, target)
+		return 1
+	}
+
+	if remove := splitList(branches); len(remove) > 0 {
+		synced, _ := entry.get("branches").([]interface{})
+		kept := slices.DeleteFunc(slices.Clone(synced), func(branch interface{}) bool {
+			name, _ := branch.(string)
+			return slices.Contains(remove, name)
+		})
+
+		if len(kept) == len(synced) {
+			errorPrintf("%s doesn't sync %s from %s to %s\n", configFile, branches, source, target)
+			return 1
+		}
+
+		entry.set("branches", kept)
+
+		if len(kept) > 0 {
+			entry = nil
+		}
+	}
+
+	if entry != nil {
+		entries = slices.DeleteFunc(entries, func(other interface{}) bool { return other == entry })
+	}
+
+	config.root.set("sync", entries)
+
+	if err := config.write(); err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// runConfigSet sets a setting by its path of keys, separated by dots, with
+// numbers indexing lists, to a value that is JSON or else a string.
+func runConfigSet(args []string) int {
+	var configFile string
+
+	flags := configSetFlags(&configFile)
+	flags.Parse(args)
+
+	if flags.NArg() != 2 || flags.Arg(0) == "" {
+		flags.Usage()
+		return 1
+	}
+
+	var value interface{} = flags.Arg(1)
+
+	if parsed, err := decodeJSON([]byte(flags.Arg(1))); err == nil {
+		value = parsed
+	}
+
+	config, err := readEditedConfig(configFile)
+
+	if err == nil {
+		err = setPath(config.root, strings.Split(flags.Arg(0), "."), value)
+	}
+
+	if err == nil {
+		err = config.write()
+	}
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// readEditedConfig reads a config file to edit, or starts an empty one if
+// it doesn't exist.
+func readEditedConfig(path string) (*editedConfig, error) {
+	if strings.Contains(path, "://") {
+		return nil, fmt.Errorf("%s isn't a file: only config files can be edited", path)
+	}
+
+	data, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return &editedConfig{path: path, root: newJSONObject(), indent: "  ", newline: true}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := decodeJSON(data)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	root, ok := value.(*jsonObject)
+
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a JSON object", path)
+	}
+
+	return &editedConfig{path: path, root: root, indent: detectIndent(data), newline: bytes.HasSuffix(data, []byte("\n")), exists: true}, nil
+}
+
+// syncEntries returns the config's sync entries.
+func (c *editedConfig) syncEntries() ([]interface{}, error) {
+	entries, ok := c.root.get("sync").([]interface{})
+
+	if !ok && c.root.get("sync") != nil {
+		return nil, fmt.Errorf("%s: sync isn't a list", c.path)
+	}
+
+	return entries, nil
+}
+
+// findSyncEntry finds the entry syncing source to target.
+func findSyncEntry(entries []interface{}, source, target string) *jsonObject {
+	for _, entry := range entries {
+		if object, ok := entry.(*jsonObject); ok && object.get("source_remote") == source && object.get("target_remote") == target {
+			return object
+		}
+	}
+
+	return nil
+}
+
+// setPath sets the value at path in object, creating the objects on the
+// way that don't exist yet. Numbers index lists, and one past the end
+// appends to them.
+func setPath(object *jsonObject, path []string, value interface{}) error {
+	key := path[0]
+
+	if len(path) == 1 {
+		object.set(key, value)
+		return nil
+	}
+
+	child, err := childAt(object.get(key), path[1:], value)
+
+	if err != nil {
+		return fmt.Errorf("%s.%w", key, err)
+	}
+
+	object.set(key, child)
+
+	return nil
+}
+
+// childAt sets the value at path in parent, an object, list or nil, and
+// returns parent, or the object created for a nil one.
+func childAt(parent interface{}, path []string, value interface{}) (interface{}, error) {
+	switch parent := parent.(type) {
+	case nil:
+		return childAt(newJSONObject(), path, value)
+	case *jsonObject:
+		return parent, setPath(parent, path, value)
+	case []interface{}:
+		index, err := strconv.Atoi(path[0])
+
+		if err != nil || index < 0 || index > len(parent) {
+			return nil, fmt.Errorf("%s isn't an index of the list, which has %d items", path[0], len(parent))
+		}
+
+		if index == len(parent) {
+			parent = append(parent, nil)
+		}
+
+		if len(path) == 1 {
+			parent[index] = value
+			return parent, nil
+		}
+
+		child, err := childAt(parent[index], path[1:], value)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s.%w", path[0], err)
+		}
+
+		parent[index] = child
+
+		return parent, nil
+	}
+
+	return nil, fmt.Errorf("%s can't be set, as what it is in isn't an object or list", path[0])
+}
+
+// write checks the edited config still reads as a config, then replaces
+// the file with it, with the same permissions and owner. A new file is
+// only readable by its owner, like a starter config.
+func (c *editedConfig) write() error {
+	var buf bytes.Buffer
+
+	if err := encodeJSON(&buf, c.root, c.indent, ""); err != nil {
+		return err
+	}
+
+	data := buf.Bytes()
+
+	if c.newline {
+		data = append(data, '\n')
+	}
+
+	var config gitsync.Config
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("%s would no longer be a valid config: %w", c.path, err)
+	}
+
+	if !c.exists {
+		if err := writeFile(c.path, data, 0o600); err != nil {
+			return err
+		}
+
+		infoPrintf("created %s\n", c.path)
+		return nil
+	}
+
+	path, err := filepath.EvalSymlinks(c.path)
+
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Chmod(tmp.Name(), info.Mode().Perm())
+	}
+
+	if err == nil {
+		err = keepOwner(tmp.Name(), info)
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not write %s: %w", c.path, err)
+	}
+
+	for _, signature := range []string{c.path + ".sig", c.path + ".asc"} {
+		if _, err := os.Stat(signature); err == nil {
+			warnPrintf("%s no longer matches %s: sign it again\n", signature, c.path)
+		}
+	}
+
+	infoPrintf("updated %s\n", c.path)
+
+	return nil
+}
+
+// writeFile writes a new file, failing if it already exists.
+func writeFile(path string, data []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// keepOwner gives a replacement file the owner and group of the one it
+// replaces, when they differ, as they do when root edits someone else's
+// config.
+func keepOwner(path string, original os.FileInfo) error {
+	uid, gid, ok := fileOwnership(original)
+
+	if !ok {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return err
+	}
+
+	if newUID, newGID, _ := fileOwnership(info); newUID == uid && newGID == gid {
+		return nil
+	}
+
+	return os.Chown(path, uid, gid)
+}
+
+// detectIndent is the indent of the first indented line in data, or empty
+// when it is all on one line.
+func detectIndent(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		if trimmed := strings.TrimLeft(line, " \t"); trimmed != line && trimmed != "" {
+			return line[:len(line)-len(trimmed)]
+		}
+	}
+
+	return ""
+}
+
+// decodeJSON decodes a single JSON value, with objects as *jsonObject and
+// numbers as json.Number, so they are written back as they were.
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	value, err := decodeValue(decoder)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+
+	return value, nil
+}
+
+func decodeValue(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		object := newJSONObject()
+
+		for decoder.More() {
+			key, err := decoder.Token()
+
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := decodeValue(decoder)
+
+			if err != nil {
+				return nil, err
+			}
+
+			object.set(key.(string), value)
+		}
+
+		_, err := decoder.Token()
+
+		return object, err
+	case json.Delim('['):
+		list := []interface{}{}
+
+		for decoder.More() {
+			value, err := decodeValue(decoder)
+
+			if err != nil {
+				return nil, err
+			}
+
+			list = append(list, value)
+		}
+
+		_, err := decoder.Token()
+
+		return list, err
+	}
+
+	return token, nil
+}
+
+// encodeJSON writes value with indent for each level of nesting, or all on
+// one line when indent is empty.
+func encodeJSON(w *bytes.Buffer, value interface{}, indent, prefix string) error {
+	newline := func(prefix string) {
+		if indent != "" {
+			w.WriteString("\n" + prefix)
+		}
+	}
+
+	switch value := value.(type) {
+	case *jsonObject:
+		if len(value.keys) == 0 {
+			w.WriteString("{}")
+			return nil
+		}
+
+		w.WriteByte('{')
+
+		for i, key := range value.keys {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+
+			newline(prefix + indent)
+			encodeScalar(w, key)
+
+			if indent != "" {
+				w.WriteString(": ")
+			} else {
+				w.WriteByte(':')
+			}
+
+			if err := encodeJSON(w, value.values[key], indent, prefix+indent); err != nil {
+				return err
+			}
+		}
+
+		newline(prefix)
+		w.WriteByte('}')
+	case []interface{}:
+		if len(value) == 0 {
+			w.WriteString("[]")
+			return nil
+		}
+
+		w.WriteByte('[')
+
+		for i, item := range value {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+
+			newline(prefix + indent)
+
+			if err := encodeJSON(w, item, indent, prefix+indent); err != nil {
+				return err
+			}
+		}
+
+		newline(prefix)
+		w.WriteByte(']')
+	default:
+		return encodeScalar(w, value)
+	}
+
+	return nil
+}
+
+// encodeScalar writes a string, number, boolean or null, leaving <, > and &
+// as they are.
+func encodeScalar(w *bytes.Buffer, value interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(value); err != nil {
+		return err
+	}
+
+	w.Truncate(w.Len() - 1)
+
+	return nil
+}
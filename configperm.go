@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// How strictly the config file's permissions are checked, as set by
+// -config-perm-policy.
+const (
+	permPolicyStrict   string = "strict"
+	permPolicyOwner    string = "owner"
+	permPolicyReadOnly string = "read-only"
+	permPolicyNone     string = "none"
+)
+
+var gsPermPolicies = map[string]bool{
+	permPolicyStrict:   true,
+	permPolicyOwner:    true,
+	permPolicyReadOnly: true,
+	permPolicyNone:     true,
+}
+
+// What to do when the config file is a symlink, as set by -config-symlinks.
+const (
+	symlinksFollow string = "follow"
+	symlinksRefuse string = "refuse"
+)
+
+var gsSymlinkPolicies = map[string]bool{
+	symlinksFollow: true,
+	symlinksRefuse: true,
+}
+
+var errConfigSymlink = errors.New("is a symlink, see -config-symlinks")
+
+// statConfig returns the config file's permissions to check. A symlink,
+// like the ones Kubernetes mounts secrets and ConfigMaps with, is refused,
+// or followed to the file it ends at, whose permissions are the ones that
+// matter.
+func statConfig(path string, symlinks string) (os.FileInfo, error) {
+	info, err := configFS.Lstat(path)
+
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return info, err
+	}
+
+	if symlinks == symlinksRefuse {
+		return nil, fmt.Errorf("config %s %w", path, errConfigSymlink)
+	}
+
+	info, err = configFS.Stat(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("config %s is a broken symlink: %w", path, err)
+	}
+
+	return info, nil
+}
+
+// checkConfigPerms returns why the config file at path doesn't satisfy
+// policy, or nil if it does:
+//
+//	strict     read only by its owner (r--------)
+//	owner      read or read and write by its owner (r-------- or rw-------),
+//	           who must be the invoking user or root
+//	read-only  writable by no one, like a 0444 container mount, and owned
+//	           by the invoking user or root
+//	none       anything
+func checkConfigPerms(path string, info os.FileInfo, policy string) error {
+	if policy == permPolicyNone {
+		return nil
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("config %s is not a regular file", path)
+	}
+
+	perm := info.Mode().Perm()
+
+	switch policy {
+	case permPolicyStrict:
+		if perm != 0400 {
+			return fmt.Errorf("config %s is %s, not read only by its owner (r--------)", path, perm)
+		}
+
+		return nil
+	case permPolicyOwner:
+		if perm != 0400 && perm != 0600 {
+			return fmt.Errorf("config %s is %s, not r-------- or rw-------", path, perm)
+		}
+	case permPolicyReadOnly:
+		if perm&0222 != 0 {
+			return fmt.Errorf("config %s is %s, which can be written to", path, perm)
+		}
+	}
+
+	if uid, known := fileOwner(info); known && uid != 0 && uid != os.Getuid() {
+		return fmt.Errorf("config %s is owned by uid %d, not by the invoking user (uid %d) or root", path, uid, os.Getuid())
+	}
+
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build windows || plan9
+
+package main
+
+import "os"
+
+// fileOwner can't tell who owns a file on this platform, so ownership isn't
+// checked.
+func fileOwner(info os.FileInfo) (int, bool) {
+	return 0, false
+}
+
+// fileOwnership can't tell who owns a file on this platform, so edited
+// configs keep whatever owner they get.
+func fileOwnership(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
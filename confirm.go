@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rys/gitsync/pkg/gitsync"
+)
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// canConfirm reports whether there is someone at a terminal to ask.
+func canConfirm() bool {
+	info, err := os.Stdin.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0 && gitsync.StdoutIsTerminal()
+}
+
+// confirmOnTerminal asks whether to go ahead with a destructive change,
+// taking anything but yes as a no.
+func confirmOnTerminal(action string) bool {
+	fmt.Fprintf(output, "\ngitsync is about to %s. Go ahead? [y/N] ", action)
+
+	answer, _ := stdinReader.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/rys/gitsync/pkg/gitsync"
+)
+
+const (
+	commandDocs  string = "docs"
+	docsMan      string = "man"
+	docsMarkdown string = "markdown"
+)
+
+// commandDoc describes a command for the generated docs. Commands without
+// flags of their own take gitsync's flags.
+type commandDoc struct {
+	name     string
+	synopsis string
+	summary  string
+	flags    func() *flag.FlagSet
+}
+
+// gsCommandDocs are the commands, in the order they are documented.
+var gsCommandDocs = []commandDoc{
+	{commandSync, "[flags]", "sync every configured branch from its source remote to its target remote, the default", nil},
+	{commandCheck, "[flags]", "report the branches whose target is behind, ahead of or missing what the source has, without pushing", nil},
+	{commandStatus, "[flags]", "show each branch's source and target tips, how far apart they are and its last run in the history", nil},
+	{commandExplain, "[source target] branch [flags]", "tell why a branch was skipped or failed in its last run, and what would stop it syncing now", nil},
+	{commandBench, "[flags]", "measure how long each phase of a sync takes", nil},
+	{commandPlan, "plan.json [flags]", "work out what a sync would do and write it to a plan, without pushing", nil},
+	{commandApply, "plan.json [flags]", "sync the branches a plan changes, if they haven't moved since it was made", nil},
+	{commandBundle, "create dir | apply bundle... [flags]", "write the sources' branches to bundles, or sync the targets from bundles, across an air gap", nil},
+	{commandPatches, "create dir | apply patches... [flags]", "write the sources' new commits as format-patch mboxes, or apply them to the targets, across an air gap", nil},
+	{commandHistory, "[flags]", "query the runs recorded in a -history-db database", func() *flag.FlagSet { return historyFlags(&historyOptions{}) }},
+	{commandImport + " " + importGitLab, "[flags]", "write a config for every pull mirror in a GitLab group", func() *flag.FlagSet { return importGitLabFlags(&importOptions{}) }},
+	{commandConfig + " " + configDiscover, "[flags]", "write a starter config for a repository's remotes", func() *flag.FlagSet { return configDiscoverFlags(new(string), new(string)) }},
+	{commandConfig + " " + configAddSync, "[flags]", "add a sync entry to a config file, or branches to one", func() *flag.FlagSet { return configAddSyncFlags(&syncEditOptions{}) }},
+	{commandConfig + " " + configRemoveSync, "[flags]", "remove a sync entry from a config file, or branches from one", func() *flag.FlagSet { return configRemoveSyncFlags(&syncEditOptions{}) }},
+	{commandConfig + " " + configSet, "[flags] key.path value", "set a setting in a config file", func() *flag.FlagSet { return configSetFlags(new(string)) }},
+	{commandDocs, "man | markdown [flags]", "write man pages, or a markdown reference, for the commands, their flags and the config's keys", func() *flag.FlagSet { return docsFlags(new(string)) }},
+}
+
+// gsDocDefaults are what flags whose defaults depend on where gitsync runs
+// default to, as the docs say it, or "" when their usage already says.
+var gsDocDefaults = map[string]string{
+	"repodir":        "the working directory",
+	"github-actions": "",
+}
+
+// flagDoc is a flag as documented.
+type flagDoc struct {
+	name     string
+	typeName string
+	usage    string
+	defValue string
+}
+
+// configKeyDoc is a config key as documented, by its path of keys.
+type configKeyDoc struct {
+	path     string
+	typeName string
+}
+
+// docsFlags defines the docs command's flags.
+func docsFlags(out *string) *flag.FlagSet {
+	flags := flag.NewFlagSet("docs", flag.ExitOnError)
+	flags.StringVar(out, "out", "", "directory to write the man pages to, or file to write the markdown reference to, - for stdout (defaults to the working directory for man pages and stdout for markdown)")
+
+	return flags
+}
+
+// runDocsCommand writes the docs for the commands, taking their flags from
+// the flag sets they parse and the config's keys from the config's types,
+// so the docs always describe the gitsync that wrote them. gitsync's own
+// flags are those defined on the command line flag set.
+func runDocsCommand(args []string) int {
+	if len(args) == 0 || args[0] != docsMan && args[0] != docsMarkdown {
+		errorPrintf("docs needs what to write: %s or %s\n", docsMan, docsMarkdown)
+		return 1
+	}
+
+	var out string
+
+	docsFlags(&out).Parse(args[1:])
+
+	for name := range gsCommands {
+		if !documented(name) {
+			errorPrintf("%s has no docs\n", name)
+			return 1
+		}
+	}
+
+	var err error
+
+	if args[0] == docsMan {
+		err = writeManPages(out)
+	} else {
+		err = writeMarkdownReference(out)
+	}
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// documented reports whether a command is in gsCommandDocs.
+func documented(name string) bool {
+	for _, command := range gsCommandDocs {
+		if command.name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// flagDocs documents the flags in a flag set, in the order it lists them.
+func flagDocs(flags *flag.FlagSet) []flagDoc {
+	var docs []flagDoc
+
+	flags.VisitAll(func(f *flag.Flag) {
+		typeName, usage := flag.UnquoteUsage(f)
+		doc := flagDoc{name: f.Name, typeName: typeName, usage: usage}
+
+		if defValue, found := gsDocDefaults[f.Name]; found {
+			doc.defValue = defValue
+		} else if !isZeroFlag(f) {
+			doc.defValue = f.DefValue
+		}
+
+		docs = append(docs, doc)
+	})
+
+	return docs
+}
+
+// isZeroFlag reports whether a flag defaults to its type's zero value,
+// which isn't worth documenting.
+func isZeroFlag(f *flag.Flag) bool {
+	switch f.DefValue {
+	case "", "0", "0s", "false":
+		return true
+	}
+
+	return false
+}
+
+// configKeyDocs documents every key a config can have.
+func configKeyDocs() []configKeyDoc {
+	var docs []configKeyDoc
+
+	addConfigKeys(&docs, "", reflect.TypeOf(gitsync.Config{}), map[reflect.Type]bool{})
+
+	return docs
+}
+
+// addConfigKeys documents the keys of a struct type, under prefix, and of
+// the structs in it. seen stops types that contain themselves.
+func addConfigKeys(docs *[]configKeyDoc, prefix string, t reflect.Type, seen map[reflect.Type]bool) {
+	if seen[t] {
+		return
+	}
+
+	seen[t] = true
+	defer delete(seen, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+
+		if !field.IsExported() || key == "-" {
+			continue
+		}
+
+		if field.Anonymous && key == "" && field.Type.Kind() == reflect.Struct {
+			addConfigKeys(docs, prefix, field.Type, seen)
+			continue
+		}
+
+		if key == "" {
+			key = field.Name
+		}
+
+		addConfigKey(docs, prefix+key, field.Type, seen)
+	}
+}
+
+// addConfigKey documents a key, and those of the structs in it: a map's
+// values are under <name> and a list's items under [].
+func addConfigKey(docs *[]configKeyDoc, path string, t reflect.Type, seen map[reflect.Type]bool) {
+	t = derefType(t)
+
+	*docs = append(*docs, configKeyDoc{path: path, typeName: configTypeName(t)})
+
+	switch t.Kind() {
+	case reflect.Struct:
+		addConfigKeys(docs, path+".", t, seen)
+	case reflect.Map:
+		if elem := derefType(t.Elem()); elem.Kind() == reflect.Struct {
+			addConfigKeys(docs, path+".<name>.", elem, seen)
+		}
+	case reflect.Slice:
+		if elem := derefType(t.Elem()); elem.Kind() == reflect.Struct {
+			addConfigKeys(docs, path+"[].", elem, seen)
+		}
+	}
+}
+
+func derefType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	return t
+}
+
+// configTypeName is what a key's value is in JSON terms.
+func configTypeName(t reflect.Type) string {
+	t = derefType(t)
+
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Struct:
+		return "object"
+	case reflect.Map:
+		return "object of " + pluralTypeName(t.Elem())
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "string"
+		}
+
+		return "list of " + pluralTypeName(t.Elem())
+	}
+
+	return "any"
+}
+
+func pluralTypeName(t reflect.Type) string {
+	name := configTypeName(t)
+
+	switch {
+	case name == "any":
+		return "values"
+	case strings.Contains(name, " of "):
+		return name[:strings.Index(name, " ")] + "s" + name[strings.Index(name, " "):]
+	}
+
+	return name + "s"
+}
+
+// commandPageName is the name of a command's man page.
+func commandPageName(command commandDoc) string {
+	return "gitsync-" + strings.ReplaceAll(command.name, " ", "-")
+}
+
+// writeManPages writes gitsync(1), with the commands that take gitsync's
+// flags, a page for each of the others and gitsync.conf(5) for the
+// config's keys to dir.
+func writeManPages(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+
+	var pages []string
+
+	write := func(name string, section int, body func(w *bufio.Writer)) error {
+		path := filepath.Join(dir, fmt.Sprintf("%s.%d", name, section))
+		f, err := os.Create(path)
+
+		if err != nil {
+			return err
+		}
+
+		w := bufio.NewWriter(f)
+		fmt.Fprintf(w, ".TH %s %d %s %s\n", roffQuote(strings.ToUpper(name)), section, roffQuote(BuildDate), roffQuote(strings.TrimSpace("gitsync "+gitsync.Version)))
+		body(w)
+
+		if err := w.Flush(); err != nil {
+			f.Close()
+			return err
+		}
+
+		pages = append(pages, path)
+
+		return f.Close()
+	}
+
+	var others []commandDoc
+
+	for _, command := range gsCommandDocs {
+		if command.flags != nil {
+			others = append(others, command)
+		}
+	}
+
+	err := write("gitsync", 1, func(w *bufio.Writer) {
+		fmt.Fprintf(w, ".SH NAME\ngitsync \\- sync branches between git remotes\n")
+		fmt.Fprintf(w, ".SH SYNOPSIS\n.B gitsync\n[\\fIcommand\\fR] [\\fIflags\\fR]\n")
+		fmt.Fprintf(w, ".SH DESCRIPTION\nSyncs the branches a config lists from their source remotes to their target remotes.\n")
+		fmt.Fprintf(w, "The command may come before or after the flags, and defaults to sync.\n")
+		fmt.Fprintf(w, ".SH COMMANDS\n")
+
+		for _, command := range gsCommandDocs {
+			if command.flags == nil {
+				fmt.Fprintf(w, ".TP\n.B gitsync %s\n%s\n", roffEscape(command.name+" "+command.synopsis), roffEscape(command.summary))
+			}
+		}
+
+		for _, command := range others {
+			fmt.Fprintf(w, ".TP\n.B gitsync %s\n%s; see \\fB%s\\fR(1).\n", roffEscape(command.name), roffEscape(command.summary), roffEscape(commandPageName(command)))
+		}
+
+		fmt.Fprintf(w, ".SH OPTIONS\n")
+		writeManFlags(w, flagDocs(flag.CommandLine))
+		writeManSeeAlso(w, append(manPageNames(others), "gitsync.conf(5)"))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, command := range others {
+		err := write(commandPageName(command), 1, func(w *bufio.Writer) {
+			fmt.Fprintf(w, ".SH NAME\n%s \\- %s\n", roffEscape(commandPageName(command)), roffEscape(command.summary))
+			fmt.Fprintf(w, ".SH SYNOPSIS\n.B gitsync %s\n%s\n", roffEscape(command.name), roffEscape(command.synopsis))
+			fmt.Fprintf(w, ".SH OPTIONS\n")
+			writeManFlags(w, flagDocs(command.flags()))
+			writeManSeeAlso(w, []string{"gitsync(1)"})
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = write("gitsync.conf", 5, func(w *bufio.Writer) {
+		fmt.Fprintf(w, ".SH NAME\ngitsync.conf \\- gitsync configuration file\n")
+		fmt.Fprintf(w, ".SH DESCRIPTION\nA JSON object with these keys, by their path of keys: a map's values are under \\fI<name>\\fR and a list's items under \\fI[]\\fR.\n")
+		fmt.Fprintf(w, ".SH KEYS\n")
+
+		for _, key := range configKeyDocs() {
+			fmt.Fprintf(w, ".TP\n.B %s\n%s\n", roffEscape(key.path), roffEscape(key.typeName))
+		}
+
+		writeManSeeAlso(w, []string{"gitsync(1)", "gitsync-config-set(1)"})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	infoPrintf("wrote %s\n", strings.Join(pages, ", "))
+
+	return nil
+}
+
+func manPageNames(commands []commandDoc) []string {
+	var names []string
+
+	for _, command := range commands {
+		names = append(names, commandPageName(command)+"(1)")
+	}
+
+	return names
+}
+
+func writeManFlags(w io.Writer, flags []flagDoc) {
+	for _, f := range flags {
+		fmt.Fprintf(w, ".TP\n.B \\-%s", roffEscape(f.name))
+
+		if f.typeName != "" {
+			fmt.Fprintf(w, " \\fI%s\\fR", roffEscape(f.typeName))
+		}
+
+		fmt.Fprintf(w, "\n%s", roffEscape(f.usage))
+
+		if f.defValue != "" {
+			fmt.Fprintf(w, " (default %s)", roffEscape(f.defValue))
+		}
+
+		fmt.Fprintf(w, "\n")
+	}
+}
+
+func writeManSeeAlso(w io.Writer, pages []string) {
+	var refs []string
+
+	for _, page := range pages {
+		name, section, _ := strings.Cut(page, "(")
+		refs = append(refs, fmt.Sprintf("\\fB%s\\fR(%s", roffEscape(name), section))
+	}
+
+	fmt.Fprintf(w, ".SH SEE ALSO\n%s\n", strings.Join(refs, ",\n"))
+}
+
+// roffEscape escapes text for roff: backslashes, hyphens, which would
+// otherwise be typeset as hyphens rather than minus signs, and lines
+// starting with a control character.
+func roffEscape(text string) string {
+	text = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(text)
+
+	if strings.HasPrefix(text, ".") || strings.HasPrefix(text, "'") {
+		text = `\&` + text
+	}
+
+	return text
+}
+
+// roffQuote makes text a single quoted roff argument.
+func roffQuote(text string) string {
+	return `"` + strings.ReplaceAll(roffEscape(text), `"`, `""`) + `"`
+}
+
+// writeMarkdownReference writes a markdown reference of the commands, their
+// flags and the config's keys to path, or stdout for - or "".
+func writeMarkdownReference(path string) error {
+	var buf strings.Builder
+	w := &buf
+
+	fmt.Fprintf(w, "# gitsync reference\n\n")
+	fmt.Fprintf(w, "Written by `gitsync docs markdown` from %s; regenerate it rather than editing it.\n\n", strings.TrimSpace("gitsync "+gitsync.Version))
+	fmt.Fprintf(w, "## Commands\n\n")
+
+	for _, command := range gsCommandDocs {
+		fmt.Fprintf(w, "### gitsync %s\n\n`gitsync %s %s`\n\n%s.\n\n", command.name, command.name, command.synopsis, capitalize(command.summary))
+
+		if command.flags == nil {
+			fmt.Fprintf(w, "Takes gitsync's [flags](#flags).\n\n")
+		} else {
+			writeMarkdownFlags(w, flagDocs(command.flags()))
+		}
+	}
+
+	fmt.Fprintf(w, "## Flags\n\n")
+	writeMarkdownFlags(w, flagDocs(flag.CommandLine))
+
+	fmt.Fprintf(w, "## Config keys\n\n")
+	fmt.Fprintf(w, "Keys are given by their path: a map's values are under `<name>` and a list's items under `[]`.\n\n")
+	fmt.Fprintf(w, "| Key | Type |\n| --- | --- |\n")
+
+	for _, key := range configKeyDocs() {
+		fmt.Fprintf(w, "| `%s` | %s |\n", key.path, key.typeName)
+	}
+
+	if path == "" || path == "-" {
+		_, err := os.Stdout.WriteString(buf.String())
+		return err
+	}
+
+	if err := os.WriteFile(path, []byte(buf.String()), 0o644); err != nil {
+		return err
+	}
+
+	infoPrintf("wrote %s\n", path)
+
+	return nil
+}
+
+func writeMarkdownFlags(w io.Writer, flags []flagDoc) {
+	fmt.Fprintf(w, "| Flag | Type | Default | Description |\n| --- | --- | --- | --- |\n")
+
+	for _, f := range flags {
+		defValue := f.defValue
+
+		if _, described := gsDocDefaults[f.name]; defValue != "" && !described {
+			defValue = "`" + defValue + "`"
+		}
+
+		fmt.Fprintf(w, "| `-%s` | %s | %s | %s |\n", f.name, f.typeName, defValue, strings.ReplaceAll(f.usage, "|", `\|`))
+	}
+
+	fmt.Fprintf(w, "\n")
+}
+
+func capitalize(text string) string {
+	if text == "" {
+		return text
+	}
+
+	return strings.ToUpper(text[:1]) + text[1:]
+}
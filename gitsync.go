@@ -1,17 +1,22 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/config"
-	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/rys/gitsync/pkg/gitsync"
 )
 
 var BuildVersion string
@@ -20,258 +25,1003 @@ var GitRevision string
 var GitDate string
 var BuildUser string
 
-type GitsyncConfiguration struct {
-	Sync []struct {
-		Source   string   `json:"source_remote"`
-		Target   string   `json:"target_remote"`
-		Branches []string `json:"branches"`
-	} `json:"sync"`
-}
-
 const gsStartupBanner string = "gitsync version %s built on %s by %s (git %s %s)\n"
 const gsConfigFile string = ".gitsync.conf"
+
+// configFS is where the config file is read from: the OS filesystem, with
+// relative paths relative to the working directory.
+var configFS interface {
+	billy.Basic
+	billy.Symlink
+} = osfs.Default
+
+// output is where the log, banners, tables and prompts go: stdout, unless a
+// report is written there, which then has stdout to itself and they go to
+// stderr. Only one report can be.
+var output io.Writer = os.Stdout
+
 const gsConfigPathBanner string = "config path: %s\n"
+const gsConfigWatchRetry = 30 * time.Second
 const gsEndOfSync string = "gitsync has finished processing"
+const gsShutdown string = "gitsync was asked to stop, shutting down"
+const gsAuditVerified string = "audit log %s verified\n"
+const gsAuditBroken string = "audit log broken at line %d: %s. Exiting..."
+const gsUnknownCommand string = "unknown command %s. Exiting..."
+const gsFatalErrorSymlinkPolicy string = "unknown -config-symlinks %s, it must be follow or refuse. Exiting..."
+const gsFatalErrorPermPolicy string = "unknown -config-perm-policy %s, it must be strict, owner, read-only or none. Exiting..."
+
+const (
+	commandSync    string = "sync"
+	commandCheck   string = "check"
+	commandBench   string = "bench"
+	commandPlan    string = "plan"
+	commandApply   string = "apply"
+	commandBundle  string = "bundle"
+	commandPatches string = "patches"
+	commandStatus  string = "status"
+	commandExplain string = "explain"
+	commandHistory string = "history"
+	commandImport  string = "import"
+	commandConfig  string = "config"
+)
+
+var gsCommands = map[string]bool{
+	commandSync:    true,
+	commandCheck:   true,
+	commandBench:   true,
+	commandPlan:    true,
+	commandApply:   true,
+	commandBundle:  true,
+	commandPatches: true,
+	commandStatus:  true,
+	commandExplain: true,
+}
 
 type GitsyncError string
 
 const (
-	gsFatalErrorCwd              GitsyncError = "can't get current working directory, Exiting..."
-	gsFatalErrorDirNotExist      GitsyncError = "directory to work in does not exist. Exiting..."
-	gsFatalErrorConfigNotExist   GitsyncError = "config file does not exist. Exiting..."
-	gsFatalErrorConfigStat       GitsyncError = "could not stat config file. Exiting..."
-	gsFatalErrorInsecureConfig   GitsyncError = "config file is not read only (r------). Exiting..."
-	gsFatalErrorUnreadableConfig GitsyncError = "could not read config file records. Exiting..."
-	gsFatalErrorInvalidJSON      GitsyncError = "could not process config file. Invalid JSON? Exiting..."
+	gsFatalErrorCwd                   GitsyncError = "can't get current working directory, Exiting..."
+	gsFatalErrorDirNotExist           GitsyncError = "directory to work in does not exist. Exiting..."
+	gsFatalErrorConfigNotExist        GitsyncError = "config file does not exist. Exiting..."
+	gsFatalErrorConfigStat            GitsyncError = "could not stat config file. Exiting..."
+	gsFatalErrorInsecureConfig        GitsyncError = "config file is not safe to read, see -config-perm-policy and -config-symlinks. Exiting..."
+	gsFatalErrorUnreadableConfig      GitsyncError = "could not read config file records. Exiting..."
+	gsFatalErrorInvalidJSON           GitsyncError = "could not process config file. Invalid JSON? Exiting..."
+	gsFatalErrorConfigProvider        GitsyncError = "could not understand config location. Exiting..."
+	gsFatalErrorMetricsNeedInterval   GitsyncError = "-metrics-addr only makes sense with -interval. Exiting..."
+	gsFatalErrorPprofNeedsInterval    GitsyncError = "-pprof-addr only makes sense with -interval. Exiting..."
+	gsFatalErrorProfile               GitsyncError = "could not start profiling. Exiting..."
+	gsFatalErrorSignedConfigNeedsKeys GitsyncError = "-require-signed-config needs -config-keys. Exiting..."
+	gsFatalErrorSignedConfigNotFile   GitsyncError = "only config files can be signed. Exiting..."
+	gsFatalErrorConfigKeys            GitsyncError = "could not read the trusted config keys. Exiting..."
+	gsFatalErrorApplyNeedsPlan        GitsyncError = "apply needs the plan file to apply. Exiting..."
+	gsFatalErrorBundleUsage           GitsyncError = "bundle needs create and the directory to write bundles to, or apply and the bundles to apply. Exiting..."
+	gsFatalErrorPatchesUsage          GitsyncError = "patches needs create and the directory to write patches to, or apply and the patch series to apply. Exiting..."
+	gsFatalErrorWebhookNeedsInterval  GitsyncError = "-webhook-addr only makes sense with -interval. Exiting..."
+	gsFatalErrorExplainUsage          GitsyncError = "explain needs the branch to explain, after its source and target remotes to only explain their sync entry. Exiting..."
+	gsFatalErrorReportsOnStdout       GitsyncError = "-report-json and -report-junit can't both be written to stdout. Exiting..."
 )
 
-var gitsyncConfig GitsyncConfiguration
+func getCwd() string {
+	cwd, err := os.Getwd()
 
-var repoRemotes = map[string]string{}
-var repoBranches = map[string]string{}
+	if err != nil {
+		log.Fatal(gsFatalErrorCwd)
+	}
 
-var pathToRepo string = ""
+	return cwd
+}
 
-var debug bool = false
+func main() {
+	log.SetOutput(os.Stdout)
+	gitsync.Version = BuildVersion
 
-func debugPrintln(msg string) {
-	if debug {
-		log.Println(msg)
+	var configFile string
+	var printVersion bool
+	var allowInsecureConfig bool
+	var permPolicy string
+	var symlinkPolicy string
+	var configKeys string
+	var requireSignedConfig bool
+	var logLevelName string
+	var debug bool
+	var quiet bool
+	var verbose bool
+	var veryVerbose bool
+	var logFile string
+	var logMaxSize int64
+	var logMaxAge time.Duration
+	var logMaxBackups int
+	var logStdout bool
+	var logSyslog bool
+	var syslogFacility string
+	var syslogTag string
+	var interval time.Duration
+	var metricsAddr string
+	var pprofAddr string
+	var webhookAddr string
+	var cpuProfile string
+	var memProfile string
+	var otlpEndpoint string
+	var reportJSON string
+	var reportJUnit string
+	var auditLog string
+	var auditVerify bool
+	var historyPath string
+	var progress string
+	var progressInterval time.Duration
+	var noColor bool
+	var githubActionsOutput bool
+	var failFast bool
+	var fetchesPerHost int
+	var confirmLargeChange bool
+	var allowPushURLs string
+	var assumeYes bool
+	var benchRounds int
+	var benchBranches int
+	var denyPushURLs string
+	var pathToRepo string
+	var workdir string
+
+	flag.StringVar(&cpuProfile, "cpuprofile", "", "write a CPU profile of the whole of gitsync to this file")
+	flag.StringVar(&configFile, "config", gsConfigFile, "config file path, or a consul://, etcd:// or configmap:// location")
+	flag.StringVar(&auditLog, "audit-log", "", "append every ref change to this hash-chained audit log")
+	flag.BoolVar(&auditVerify, "audit-verify", false, "verify the -audit-log hash chain and exit")
+	flag.IntVar(&benchRounds, "bench-rounds", 3, "how many times bench measures each phase")
+	flag.IntVar(&benchBranches, "bench-branches", 0, "how many synthetic branches bench pushes to each target a round (defaults to one per branch synced to it)")
+	flag.StringVar(&historyPath, "history-db", "", "record every run's results in this SQLite database")
+	flag.BoolVar(&printVersion, "version", false, "print version and build information and exit")
+	flag.BoolVar(&debug, "debug", false, "print debug information to stdout (same as -log-level debug)")
+	flag.StringVar(&logLevelName, "log-level", "", "log level: error, warn, info, debug or trace (defaults to info on a terminal, warn otherwise)")
+	flag.BoolVar(&quiet, "quiet", false, "only log errors (same as -log-level error)")
+	flag.BoolVar(&verbose, "v", false, "log progress (same as -log-level info)")
+	flag.BoolVar(&veryVerbose, "vv", false, "log progress and details (same as -log-level debug)")
+	flag.BoolVar(&noColor, "no-color", false, "don't color the summary, even on a terminal (also set by $NO_COLOR)")
+	flag.BoolVar(&allowInsecureConfig, "insecure", false, "allow reading an insecure config file (same as -config-perm-policy none)")
+	flag.StringVar(&symlinkPolicy, "config-symlinks", symlinksFollow, "what to do when the config file is a symlink: follow it and check what it points at, or refuse it")
+	flag.StringVar(&permPolicy, "config-perm-policy", permPolicyStrict, "how to check the config file's permissions: strict, owner, read-only or none")
+	flag.StringVar(&configKeys, "config-keys", "", "verify the config file's detached signature against these OpenPGP public keys")
+	flag.BoolVar(&requireSignedConfig, "require-signed-config", false, "refuse a config file without a good signature from one of -config-keys")
+	flag.StringVar(&logFile, "log-file", "", "write the log to this file instead of stdout")
+	flag.Int64Var(&logMaxSize, "log-max-size", 10, "rotate the log file once it exceeds this many megabytes (0 disables)")
+	flag.DurationVar(&logMaxAge, "log-max-age", 0, "rotate the log file once it is older than this, e.g. 24h (0 disables)")
+	flag.IntVar(&logMaxBackups, "log-max-backups", 5, "number of rotated log files to keep (0 keeps all)")
+	flag.BoolVar(&logStdout, "log-stdout", false, "also write the log to stdout when -log-file or -log-syslog is set")
+	flag.BoolVar(&logSyslog, "log-syslog", false, "send the log to syslog")
+	flag.StringVar(&syslogFacility, "syslog-facility", "daemon", "syslog facility to log to")
+	flag.StringVar(&syslogTag, "syslog-tag", "gitsync", "syslog tag to log with")
+	flag.StringVar(&allowPushURLs, "allow-push-url", "", "only push to targets whose URL matches one of these comma separated patterns")
+	flag.StringVar(&denyPushURLs, "deny-push-url", "", "never push to targets whose URL matches one of these comma separated patterns")
+	flag.BoolVar(&confirmLargeChange, "confirm-large-change", false, "sync changes bigger than the config's max_change allows")
+	flag.BoolVar(&githubActionsOutput, "github-actions", os.Getenv("GITHUB_ACTIONS") == "true", "annotate the GitHub Actions workflow run with failures and write a job summary (defaults to on inside GitHub Actions)")
+	flag.BoolVar(&failFast, "fail-fast", false, "stop at the first branch that fails instead of syncing the rest")
+	flag.IntVar(&fetchesPerHost, "fetches-per-host", 2, "how many source remotes on the same host to fetch from at once")
+	flag.DurationVar(&interval, "interval", 0, "keep running and sync again after this long, e.g. 15m (0 syncs once and exits)")
+	flag.StringVar(&memProfile, "memprofile", "", "write a memory profile to this file when gitsync exits")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "serve Prometheus metrics on this address, e.g. :9100 (requires -interval)")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "export traces to this OTLP/HTTP collector, e.g. http://localhost:4318 (defaults to $OTEL_EXPORTER_OTLP_ENDPOINT)")
+	flag.StringVar(&pprofAddr, "pprof-addr", "", "serve runtime profiles under /debug/pprof/ on this address, e.g. localhost:6060 (requires -interval)")
+	flag.StringVar(&progress, "progress", gitsync.ProgressAuto, "transfer progress: bar, log, none or auto (bar on a terminal, log otherwise)")
+	flag.DurationVar(&progressInterval, "progress-interval", 10*time.Second, "how often to log transfer progress in log mode")
+	flag.StringVar(&reportJSON, "report-json", "", "write a JSON report of the run, of bench's measurements, of status or of explain, to this file (- for stdout)")
+	flag.StringVar(&reportJUnit, "report-junit", "", "write a JUnit XML report of the run to this file (- for stdout)")
+	flag.StringVar(&webhookAddr, "webhook-addr", "", "sync as soon as a source's forge sends a webhook to /webhook/<remote> on this address, e.g. :8080 (requires -interval)")
+	flag.BoolVar(&assumeYes, "yes", false, "force push and delete refs without asking")
+	flag.StringVar(&pathToRepo, "repodir", getCwd(), "path to the git repository checkout you want to sync")
+	flag.StringVar(&workdir, "workdir", "", "sync a bare clone gitsync keeps in this directory instead of the -repodir checkout")
+
+	// history has its own flags as it works without a config or repository.
+	if len(os.Args) > 1 && os.Args[1] == commandHistory {
+		os.Exit(runHistoryCommand(os.Args[2:]))
 	}
-}
 
-func debugPrintf(format string, args ...interface{}) {
-	if debug {
-		log.Printf(format, args...)
+	// So do import, which only talks to a forge, and config, which works on
+	// configs.
+	if len(os.Args) > 1 && os.Args[1] == commandImport {
+		os.Exit(runImportCommand(os.Args[2:]))
 	}
-}
 
-// Utility functions taken from go-git and lightly modified
+	if len(os.Args) > 1 && os.Args[1] == commandConfig {
+		os.Exit(runConfigCommand(os.Args[2:]))
+	}
 
-// CheckArgs should be used to ensure the right command line arguments are
-// passed before executing an example.
-func CheckArgs(arg ...string) {
-	if len(os.Args) < len(arg)+1 {
-		debugPrintf("Usage: %s %s", os.Args[0], strings.Join(arg, " "))
-		os.Exit(1)
+	// docs documents the flags defined above, so comes after them.
+	if len(os.Args) > 1 && os.Args[1] == commandDocs {
+		os.Exit(runDocsCommand(os.Args[2:]))
 	}
-}
 
-// CheckIfError should be used to naively panics if an error is not nil.
-func CheckIfError(err error) {
-	if err == nil {
-		return
+	// The command may come before or after the flags.
+	command := commandSync
+
+	if len(os.Args) > 1 && gsCommands[os.Args[1]] {
+		command = os.Args[1]
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
 	}
 
-	debugPrintf("error: %s", err)
-	os.Exit(1)
-}
+	args := flag.Args()
+
+	if command == commandSync && len(args) > 0 && gsCommands[args[0]] {
+		command, args = args[0], args[1:]
+	}
+
+	// plan and apply take a plan file, which stops flag parsing, so the
+	// flags after it are parsed too.
+	var planFile string
+
+	if (command == commandPlan || command == commandApply) && len(args) > 0 {
+		planFile = args[0]
+		flag.CommandLine.Parse(args[1:])
+		args = flag.Args()
+	}
+
+	// So do bundle and patches, which take create or apply and the
+	// directory or files.
+	var bundleArgs []string
+
+	if command == commandBundle || command == commandPatches {
+		for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			bundleArgs, args = append(bundleArgs, args[0]), args[1:]
+		}
+
+		flag.CommandLine.Parse(args)
+		args = flag.Args()
+	}
+
+	// So does explain, which takes the branch, after the remotes syncing
+	// it if given.
+	var explainArgs []string
+
+	if command == commandExplain {
+		for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			explainArgs, args = append(explainArgs, args[0]), args[1:]
+		}
+
+		flag.CommandLine.Parse(args)
+		args = flag.Args()
+	}
+
+	if len(args) > 0 {
+		log.Fatalf(gsUnknownCommand, strings.Join(args, " "))
+	}
+
+	if command == commandExplain && len(explainArgs) != 1 && len(explainArgs) != 3 {
+		log.Fatal(gsFatalErrorExplainUsage)
+	}
+
+	if reportJSON == "-" && reportJUnit == "-" {
+		log.Fatal(gsFatalErrorReportsOnStdout)
+	}
+
+	if reportJSON == "-" || reportJUnit == "-" {
+		output = os.Stderr
+		log.SetOutput(output)
+	}
+
+	bundleUsage := len(bundleArgs) == 2 && bundleArgs[0] == "create" || len(bundleArgs) > 1 && bundleArgs[0] == "apply"
+
+	if command == commandBundle && !bundleUsage {
+		log.Fatal(gsFatalErrorBundleUsage)
+	}
+
+	if command == commandPatches && !bundleUsage {
+		log.Fatal(gsFatalErrorPatchesUsage)
+	}
+
+	if command == commandApply && planFile == "" {
+		log.Fatal(gsFatalErrorApplyNeedsPlan)
+	}
+
+	if printVersion {
+		fmt.Printf(gsStartupBanner, BuildVersion, BuildDate, BuildUser, GitRevision, GitDate)
+		os.Exit(0)
+	}
+
+	verbosity := 0
+
+	if verbose {
+		verbosity = 1
+	}
+
+	if veryVerbose || debug {
+		verbosity = 2
+	}
+
+	if err := gitsync.SetLogLevel(logLevelName, quiet, verbosity); err != nil {
+		log.Fatal(err)
+	}
+
+	setColor(noColor)
+	setGitHubActions(githubActionsOutput)
+
+	if auditVerify {
+		if line, err := gitsync.VerifyAuditLog(auditLog); err != nil {
+			log.Fatalf(gsAuditBroken, line, err)
+		}
+
+		fmt.Printf(gsAuditVerified, auditLog)
+		os.Exit(0)
+	}
+
+	var logOutputs []io.Writer
+
+	if logFile != "" {
+		rotating, err := newRotatingFile(logFile, logMaxSize*1024*1024, logMaxAge, logMaxBackups)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		logOutputs = append(logOutputs, rotating)
+	}
+
+	if logSyslog {
+		syslogOutput, err := newSyslogWriter(syslogFacility, syslogTag)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		logOutputs = append(logOutputs, syslogOutput)
+	}
+
+	if len(logOutputs) == 0 || logStdout {
+		logOutputs = append(logOutputs, output)
+	}
+
+	log.SetOutput(io.MultiWriter(logOutputs...))
+
+	stopProfiles, err := startProfiles(cpuProfile, memProfile)
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		log.Fatal(gsFatalErrorProfile)
+	}
+
+	// Profiles are only complete once stopped, which os.Exit skips.
+	exit := func(code int) {
+		stopProfiles()
+		os.Exit(code)
+	}
+
+	if gitsync.LogEnabled(gitsync.LevelInfo) {
+		fmt.Fprintf(output, gsStartupBanner, BuildVersion, BuildDate, BuildUser, GitRevision, GitDate)
+	}
+
+	infoPrintf(gsConfigPathBanner, configFile)
+
+	if _, err := os.ReadDir(pathToRepo); workdir == "" && os.IsNotExist(err) {
+		log.Fatal(gsFatalErrorDirNotExist)
+	}
+
+	provider, err := gitsync.NewConfigProvider(configFile)
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		log.Fatal(gsFatalErrorConfigProvider)
+	}
+
+	if !gsPermPolicies[permPolicy] {
+		log.Fatalf(gsFatalErrorPermPolicy, permPolicy)
+	}
+
+	if !gsSymlinkPolicies[symlinkPolicy] {
+		log.Fatalf(gsFatalErrorSymlinkPolicy, symlinkPolicy)
+	}
+
+	if allowInsecureConfig {
+		permPolicy = permPolicyNone
+	}
+
+	fileProvider, isFile := provider.(*gitsync.FileConfigProvider)
+
+	if isFile {
+		checkConfigFile(configFile, permPolicy, symlinkPolicy)
+	}
+
+	if requireSignedConfig && configKeys == "" {
+		log.Fatal(gsFatalErrorSignedConfigNeedsKeys)
+	}
+
+	if configKeys != "" && !isFile {
+		log.Fatal(gsFatalErrorSignedConfigNotFile)
+	}
+
+	if configKeys != "" {
+		keys, err := gitsync.ReadTrustedKeys(configKeys)
+
+		if err != nil {
+			errorPrintf("%s\n", err)
+			log.Fatal(gsFatalErrorConfigKeys)
+		}
+
+		fileProvider.TrustedKeys = keys
+		fileProvider.RequireSignature = requireSignedConfig
+	}
 
-// End of utility functions taken from go-git and lightly modified
+	// SIGINT and SIGTERM cancel the run in flight, or the wait for the next
+	// one, and gitsync exits once it has been reported.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	config, err := provider.Load(ctx)
+
+	if errors.Is(err, gitsync.ErrInvalidConfigJSON) {
+		errorPrintf("%s\n", err)
+		log.Fatal(gsFatalErrorInvalidJSON)
+	}
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		log.Fatal(gsFatalErrorUnreadableConfig)
+	}
+
+	if metricsAddr != "" && interval == 0 {
+		log.Fatal(gsFatalErrorMetricsNeedInterval)
+	}
+
+	if pprofAddr != "" && interval == 0 {
+		log.Fatal(gsFatalErrorPprofNeedsInterval)
+	}
+
+	if webhookAddr != "" && interval == 0 {
+		log.Fatal(gsFatalErrorWebhookNeedsInterval)
+	}
+
+	options := gitsync.Options{
+		RepoDir:            pathToRepo,
+		OTLPEndpoint:       otlpEndpoint,
+		Progress:           progress,
+		ProgressInterval:   progressInterval,
+		FailFast:           failFast,
+		FetchesPerHost:     fetchesPerHost,
+		Workdir:            workdir,
+		ConfirmLargeChange: confirmLargeChange,
+		AllowPushURLs:      splitList(allowPushURLs),
+		DenyPushURLs:       splitList(denyPushURLs),
+		AssumeYes:          assumeYes,
+	}
+
+	if !assumeYes && canConfirm() {
+		options.Confirm = confirmOnTerminal
+	}
+
+	// check, plan, status, explain, bundle create and patches create only
+	// read and bench changes nothing configured, so none of them audits or
+	// records history. status and explain read the history, though.
+	if command != commandCheck && command != commandBench && command != commandPlan && command != commandStatus && command != commandExplain && !((command == commandBundle || command == commandPatches) && bundleArgs[0] == "create") {
+		options.AuditLog = auditLog
+		options.HistoryDB = historyPath
+	}
+
+	if command == commandStatus || command == commandExplain {
+		options.HistoryDB = historyPath
+	}
+
+	syncer, err := gitsync.New(config, options)
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		exit(1)
+	}
+
+	defer syncer.ReportPanic()
+
+	if command == commandCheck {
+		exit(runCheck(ctx, syncer))
+	}
+
+	if command == commandBench {
+		exit(runBench(ctx, syncer, gitsync.BenchOptions{Rounds: benchRounds, SyntheticBranches: benchBranches}, reportJSON))
+	}
+
+	if command == commandStatus {
+		exit(runStatus(ctx, syncer, reportJSON))
+	}
+
+	if command == commandExplain {
+		exit(runExplain(syncer, explainArgs, reportJSON))
+	}
+
+	if command == commandPlan {
+		exit(runPlan(ctx, syncer, planFile))
+	}
+
+	if command == commandApply {
+		exit(runApply(ctx, syncer, planFile, reportJSON, reportJUnit))
+	}
+
+	if command == commandBundle && bundleArgs[0] == "create" {
+		exit(runBundleCreate(ctx, syncer, bundleArgs[1]))
+	}
+
+	if command == commandBundle {
+		exit(runOfflineApply(ctx, syncer, syncer.ApplyBundles, bundleArgs[1:], reportJSON, reportJUnit))
+	}
 
-func checkSyncs() bool {
-	for _, sync := range gitsyncConfig.Sync {
-		if len(sync.Branches) >= 1 &&
-			len(sync.Source) > 1 &&
-			len(sync.Target) > 1 {
+	if command == commandPatches && bundleArgs[0] == "create" {
+		exit(runPatchesCreate(ctx, syncer, bundleArgs[1]))
+	}
+
+	if command == commandPatches {
+		exit(runOfflineApply(ctx, syncer, syncer.ApplyPatches, bundleArgs[1:], reportJSON, reportJUnit))
+	}
+
+	if metricsAddr != "" {
+		go gitsync.ServeMetrics(metricsAddr)
+	}
+
+	if pprofAddr != "" {
+		go serveProfiling(pprofAddr)
+	}
+
+	exitCode := 0
+
+	var configChanges <-chan struct{}
+
+	// The watcher tells the syncer of a change straight away, so a run in
+	// flight can report it; the new config is only loaded once it is done.
+	var current atomic.Pointer[gitsync.Syncer]
+	current.Store(syncer)
+
+	if interval > 0 {
+		configChanges = watchConfig(ctx, provider, func() { current.Load().ConfigChanged() })
+	}
+
+	// Webhooks arriving during a run are held until it is done.
+	triggers := make(chan string, 1)
+
+	if webhookAddr != "" {
+		go serveWebhooks(webhookAddr, &current, triggers)
+	}
+
+	// The Syncers of the GitLab projects gitlab_system_hook added, made
+	// afresh whenever the config is reloaded.
+	projects := map[string]*gitsync.Syncer{}
+
+	for {
+		run, err := syncer.Run(ctx)
+
+		if err != nil {
+			errorPrintf("%s\n", err)
+		}
+
+		printSummary(run)
+		annotateRun(run)
+		writeReport(reportJSON, run.WriteJSON)
+		writeReport(reportJUnit, run.WriteJUnit)
+
+		projectsSynced := syncProjects(ctx, syncer, options, projects)
+		infoPrintf("%s\n", gsEndOfSync)
+
+		if err != nil || run.Failed() || !projectsSynced {
+			exitCode = 1
 		} else {
-			return false
+			exitCode = 0
+		}
+
+		if interval == 0 || ctx.Err() != nil {
+			break
+		}
+
+		infoPrintf("next sync in %s\n", interval)
+
+		select {
+		case <-time.After(interval):
+		case source := <-triggers:
+			infoPrintf("webhook from %s, syncing now\n", source)
+		case <-configChanges:
+			syncer = reloadSyncer(ctx, provider, options, syncer, permPolicy, symlinkPolicy)
+			current.Store(syncer)
+			closeProjects(projects)
+		case <-ctx.Done():
+		}
+
+		if ctx.Err() != nil {
+			infoPrintf("%s\n", gsShutdown)
+			break
 		}
 	}
 
-	return true
+	closeSyncer(syncer)
+	closeProjects(projects)
+	exit(exitCode)
 }
 
-func getCwd() string {
-	cwd, err := os.Getwd()
+// checkConfigFile refuses a config file that is missing or that others
+// could write to.
+func checkConfigFile(configFile string, permPolicy string, symlinkPolicy string) {
+	if _, err := configFS.Stat(configFile); os.IsNotExist(err) {
+		log.Fatal(gsFatalErrorConfigNotExist)
+	}
+
+	f, err := statConfig(configFile, symlinkPolicy)
+
+	if errors.Is(err, errConfigSymlink) {
+		errorPrintf("%s\n", err)
+		log.Fatal(gsFatalErrorInsecureConfig)
+	}
 
 	if err != nil {
-		log.Fatal(gsFatalErrorCwd)
+		errorPrintf("%s\n", err)
+		log.Fatal(gsFatalErrorConfigStat)
 	}
 
-	return cwd
+	if err := checkConfigPerms(configFile, f, permPolicy); err != nil {
+		errorPrintf("%s\n", err)
+		log.Fatal(gsFatalErrorInsecureConfig)
+	}
 }
 
-func openRepoAtPath() *git.Repository {
-	repo, err := git.PlainOpen(pathToRepo)
-	CheckIfError(err)
+// watchConfig signals config changes in daemon mode, calling changed as soon
+// as one is seen, even mid-run. Failing watches are retried, so a provider
+// that is briefly down doesn't stop the syncs.
+func watchConfig(ctx context.Context, provider gitsync.ConfigProvider, changed func()) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		for ctx.Err() == nil {
+			if err := provider.Watch(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+
+				errorPrintf("could not watch config %s: %s\n", provider.Name(), err)
+				time.Sleep(gsConfigWatchRetry)
+				continue
+			}
+
+			changed()
+
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
 
-	return repo
+	return changes
 }
 
-func collectRepoInfo() {
-	repo := openRepoAtPath()
+// reloadSyncer replaces syncer with one for the provider's current config,
+// keeping the old one if the new config can't be read or is invalid.
+func reloadSyncer(ctx context.Context, provider gitsync.ConfigProvider, options gitsync.Options, syncer *gitsync.Syncer, permPolicy string, symlinkPolicy string) *gitsync.Syncer {
+	if _, isFile := provider.(*gitsync.FileConfigProvider); isFile {
+		f, err := statConfig(provider.Name(), symlinkPolicy)
 
-	branches, err := repo.Branches()
-	CheckIfError(err)
+		if err == nil {
+			err = checkConfigPerms(provider.Name(), f, permPolicy)
+		}
 
-	err = branches.ForEach(func(b *plumbing.Reference) error {
-		repoBranches[b.Name().Short()] = b.Name().String()
-		return nil
-	})
-	CheckIfError(err)
+		if err != nil {
+			errorPrintf("%s, keeping the current one\n", err)
+			return syncer
+		}
+	}
+
+	config, err := provider.Load(ctx)
+
+	if err != nil {
+		errorPrintf("could not reload config %s, keeping the current one: %s\n", provider.Name(), err)
+		return syncer
+	}
 
-	remotes, err := repo.Remotes()
-	CheckIfError(err)
+	reloaded, err := gitsync.New(config, options)
 
-	for _, remote := range remotes {
-		repoRemotes[remote.Config().Name] = remote.Config().Name
+	if err != nil {
+		errorPrintf("config %s is invalid, keeping the current one: %s\n", provider.Name(), err)
+		return syncer
 	}
 
-	if debug {
-		log.Println("Repository branches:")
-		log.Println(repoBranches)
-		log.Println("Repository remotes:")
-		log.Println(repoRemotes)
+	if reloaded.ConfigChecksum() == syncer.ConfigChecksum() {
+		closeSyncer(reloaded)
+		infoPrintf("config %s was touched but hasn't changed, keeping the current one\n", provider.Name())
+		return syncer
 	}
+
+	infoPrintf("config %s changed from %s to %s, reloaded\n", provider.Name(), shortChecksum(syncer.ConfigChecksum()), shortChecksum(reloaded.ConfigChecksum()))
+	closeSyncer(syncer)
+
+	return reloaded
 }
 
-func remoteExists(remote string) bool {
-	_, exists := repoRemotes[remote]
-	return exists
+// runCheck prints the drift of every branch, returning 1 if any has drifted
+// or the check couldn't run.
+func runCheck(ctx context.Context, syncer *gitsync.Syncer) int {
+	defer closeSyncer(syncer)
+
+	drifts, err := syncer.Check(ctx)
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	annotateDrift(drifts)
+
+	if !printDrift(drifts) {
+		return 1
+	}
+
+	return 0
 }
 
-func branchExists(branch string) bool {
-	_, exists := repoBranches[branch]
-	return exists
+// runBench prints how long each phase of a sync takes against the
+// configured remotes, returning 1 if any phase failed or bench couldn't run.
+func runBench(ctx context.Context, syncer *gitsync.Syncer, options gitsync.BenchOptions, reportJSON string) int {
+	defer closeSyncer(syncer)
+
+	report, err := syncer.Bench(ctx, options)
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	writeReport(reportJSON, report.WriteJSON)
+
+	if !printBench(report) {
+		return 1
+	}
+
+	return 0
 }
 
-func processSyncs() {
-	for _, sync := range gitsyncConfig.Sync {
-		var wouldFail = false
-		debugPrintf("syncing %d branches between %s and %s\n", len(sync.Branches), sync.Source, sync.Target)
+// runStatus prints where every branch stands, or writes it as JSON to
+// reportJSON, only printing the table when the JSON isn't going to stdout.
+// It returns 1 if any branch isn't in sync or status couldn't run.
+func runStatus(ctx context.Context, syncer *gitsync.Syncer, reportJSON string) int {
+	defer closeSyncer(syncer)
 
-		if !remoteExists(sync.Source) {
-			debugPrintf("%s source remote doesn't exist\n", sync.Source)
-			wouldFail = true
-		}
+	report, err := syncer.Status(ctx)
 
-		if !remoteExists(sync.Target) {
-			debugPrintf("%s target remote doesn't exist\n", sync.Source)
-			wouldFail = true
-		}
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
 
-		for _, branch := range sync.Branches {
-			if !branchExists(branch) {
-				debugPrintf("%s branch doesn't exist\n", branch)
-				wouldFail = true
-			}
-		}
+	writeReport(reportJSON, report.WriteJSON)
 
-		if wouldFail {
-			debugPrintln("Attempting this sync would fail, skipping...")
-			continue
+	inSync := true
+
+	for _, status := range report.Branches {
+		if status.Err != nil || status.SourceSHA != status.TargetSHA {
+			inSync = false
 		}
+	}
 
-		debugPrintln("Processing sync")
+	if reportJSON != "-" {
+		printStatus(report)
+	}
 
-		repo := openRepoAtPath()
+	if !inSync {
+		return 1
+	}
 
-		worktree, err := repo.Worktree()
-		CheckIfError(err)
+	return 0
+}
 
-		for _, branch := range sync.Branches {
-			var branchRef = plumbing.NewBranchReferenceName(branch)
+// runExplain prints why a branch was or wasn't synced by each sync entry
+// with it, or writes it as JSON to reportJSON, returning 1 if anything
+// stops one syncing it.
+func runExplain(syncer *gitsync.Syncer, args []string, reportJSON string) int {
+	defer closeSyncer(syncer)
 
-			debugPrintf("checking out %s as %s\n", branch, branchRef)
-			worktree.Checkout(&git.CheckoutOptions{Branch: branchRef})
-			CheckIfError(err)
+	source, target, branch := "", "", args[0]
 
-			debugPrintf("pulling changes on %s from %s\n", branch, sync.Source)
-			worktree.Pull(&git.PullOptions{RemoteName: sync.Source, ReferenceName: branchRef, SingleBranch: true})
-			CheckIfError(err)
+	if len(args) == 3 {
+		source, target, branch = args[0], args[1], args[2]
+	}
 
-			debugPrintf("pushing changes on %s to %s\n", branch, sync.Target)
+	report, err := syncer.Explain(source, target, branch)
 
-			repo.Push(&git.PushOptions{
-				RemoteName: sync.Target,
-				RefSpecs:   []config.RefSpec{config.RefSpec(branchRef + ":" + branchRef)}})
-			CheckIfError(err)
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	writeReport(reportJSON, report.WriteJSON)
+
+	if reportJSON != "-" {
+		printExplanations(report)
+	}
+
+	for _, explanation := range report.Explanations {
+		if explanation.Cause != "" {
+			return 1
 		}
 	}
+
+	return 0
 }
 
-func main() {
-	log.SetOutput(os.Stdout)
+// runPlan prints the change a sync would make to every branch, and writes
+// the plan to planFile if given one, returning 1 if it couldn't be made.
+func runPlan(ctx context.Context, syncer *gitsync.Syncer, planFile string) int {
+	defer closeSyncer(syncer)
 
-	var configFile string
-	var printVersion bool
-	var allowInsecureConfig bool
+	plan, err := syncer.Plan(ctx)
 
-	flag.StringVar(&configFile, "config", gsConfigFile, "config file path")
-	flag.BoolVar(&printVersion, "version", false, "print version and build information and exit")
-	flag.BoolVar(&debug, "debug", false, "print debug information to stdout")
-	flag.BoolVar(&allowInsecureConfig, "insecure", false, "allow reading an insecure config file")
-	flag.StringVar(&pathToRepo, "repodir", getCwd(), "path to the git repository checkout you want to sync")
-	flag.Parse()
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
 
-	if printVersion {
-		fmt.Printf(gsStartupBanner, BuildVersion, BuildDate, BuildUser, GitRevision, GitDate)
-		os.Exit(0)
+	// A plan written to stdout is all that is printed, so it can be piped.
+	if planFile != "-" {
+		printPlan(plan)
 	}
 
-	fmt.Printf(gsStartupBanner, BuildVersion, BuildDate, BuildUser, GitRevision, GitDate)
-	log.Printf(gsConfigPathBanner, configFile)
+	writeReport(planFile, plan.WriteJSON)
 
-	if _, err := os.ReadDir(pathToRepo); os.IsNotExist(err) {
-		log.Fatal(gsFatalErrorDirNotExist)
+	return 0
+}
+
+// runApply syncs what the plan in planFile says to, reporting it as a run,
+// and returns 1 if the plan couldn't be applied or any of it failed.
+func runApply(ctx context.Context, syncer *gitsync.Syncer, planFile, reportJSON, reportJUnit string) int {
+	defer closeSyncer(syncer)
+
+	f, err := os.Open(planFile)
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
 	}
 
-	if _, err := os.Stat(configFile); os.IsNotExist(err) {
-		log.Fatal(gsFatalErrorConfigNotExist)
+	plan, err := gitsync.ReadPlan(f)
+	f.Close()
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
 	}
 
-	f, err := os.Lstat(configFile)
+	run, err := syncer.Apply(ctx, plan)
 
 	if err != nil {
-		log.Fatal(gsFatalErrorConfigStat)
+		errorPrintf("%s\n", err)
 	}
 
-	if f.Mode() != 0400 {
-		if !allowInsecureConfig {
-			log.Fatal(gsFatalErrorInsecureConfig)
-		}
+	if run == nil {
+		return 1
 	}
 
-	tuples, err := ioutil.ReadFile(configFile)
+	printSummary(run)
+	annotateRun(run)
+	writeReport(reportJSON, run.WriteJSON)
+	writeReport(reportJUnit, run.WriteJUnit)
+	infoPrintf("%s\n", gsEndOfSync)
+
+	if err != nil || run.Failed() {
+		return 1
+	}
+
+	return 0
+}
+
+// runBundleCreate writes a bundle into dir for every sync entry with
+// something new since its last one, returning 1 if they couldn't be made.
+func runBundleCreate(ctx context.Context, syncer *gitsync.Syncer, dir string) int {
+	defer closeSyncer(syncer)
+
+	bundles, err := syncer.CreateBundles(ctx, dir)
+	printBundles(bundles)
 
 	if err != nil {
-		log.Fatal(gsFatalErrorUnreadableConfig)
+		errorPrintf("%s\n", err)
+		return 1
 	}
 
-	err = json.Unmarshal(tuples, &gitsyncConfig)
+	return 0
+}
+
+// runPatchesCreate writes a patch series into dir for every branch with
+// new commits since its last one, returning 1 if they couldn't be made.
+func runPatchesCreate(ctx context.Context, syncer *gitsync.Syncer, dir string) int {
+	defer closeSyncer(syncer)
+
+	series, err := syncer.CreatePatches(ctx, dir)
+	printPatchSeries(series)
 
 	if err != nil {
-		debugPrintln(err.Error())
-		log.Fatal(gsFatalErrorInvalidJSON)
+		errorPrintf("%s\n", err)
+		return 1
 	}
 
-	if checkSyncs() {
-		collectRepoInfo()
-		processSyncs()
-		log.Println(gsEndOfSync)
-		os.Exit(0)
+	return 0
+}
+
+// runOfflineApply syncs what the bundles or patch series at paths carry to
+// their targets with apply, reporting it as a run, and returns 1 if they
+// couldn't be applied or any of it failed.
+func runOfflineApply(ctx context.Context, syncer *gitsync.Syncer, apply func(context.Context, []string) (*gitsync.RunResult, error), paths []string, reportJSON, reportJUnit string) int {
+	defer closeSyncer(syncer)
+
+	run, err := apply(ctx, paths)
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+	}
+
+	if run == nil {
+		return 1
+	}
+
+	printSummary(run)
+	annotateRun(run)
+	writeReport(reportJSON, run.WriteJSON)
+	writeReport(reportJUnit, run.WriteJUnit)
+	infoPrintf("%s\n", gsEndOfSync)
+
+	if err != nil || run.Failed() {
+		return 1
+	}
+
+	return 0
+}
+
+func closeSyncer(syncer *gitsync.Syncer) {
+	if err := syncer.Close(); err != nil {
+		errorPrintf("%s\n", err)
+	}
+}
+
+// writeReport writes a run report to path, or to stdout when path is "-".
+func writeReport(path string, write func(io.Writer) error) {
+	if path == "" {
+		return
+	}
+
+	if path == "-" {
+		if err := write(os.Stdout); err != nil {
+			errorPrintf("could not write report: %s\n", err)
+		}
+
+		return
 	}
 
-	os.Exit(1)
+	f, err := os.Create(path)
+
+	if err != nil {
+		errorPrintf("could not write report %s: %s\n", path, err)
+		return
+	}
+
+	if err := write(f); err != nil {
+		errorPrintf("could not write report %s: %s\n", path, err)
+	}
+
+	f.Close()
+}
+
+// shortChecksum abbreviates a config checksum for logs.
+func shortChecksum(checksum string) string {
+	return checksum[:min(len(checksum), 12)]
+}
+
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func errorPrintf(format string, args ...interface{}) {
+	gitsync.Logf(gitsync.LevelError, format, args...)
+}
+
+func warnPrintf(format string, args ...interface{}) {
+	gitsync.Logf(gitsync.LevelWarn, format, args...)
+}
+
+func infoPrintf(format string, args ...interface{}) {
+	gitsync.Logf(gitsync.LevelInfo, format, args...)
 }
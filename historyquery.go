@@ -0,0 +1,284 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rys/gitsync/pkg/gitsync"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	historyShowRuns     string = "runs"
+	historyShowFailures string = "failures"
+	historyShowMoved    string = "moved"
+)
+
+type historyRun struct {
+	RunID      string `json:"run_id"`
+	Started    string `json:"started"`
+	DurationMs int64  `json:"duration_ms"`
+	Status     string `json:"status"`
+	Host       string `json:"host"`
+	Repository string `json:"repository"`
+	Synced     int    `json:"branches_synced"`
+	NotSynced  int    `json:"branches_not_synced"`
+}
+
+type historyFailure struct {
+	Started string `json:"started"`
+	RunID   string `json:"run_id"`
+	SyncID  string `json:"sync_id"`
+	Source  string `json:"source_remote"`
+	Target  string `json:"target_remote"`
+	Branch  string `json:"branch"`
+	Status  string `json:"status"`
+	Error   string `json:"error"`
+}
+
+type historyMove struct {
+	Source string `json:"source_remote"`
+	Target string `json:"target_remote"`
+	Branch string `json:"branch"`
+	Moved  string `json:"moved"`
+	SHA    string `json:"sha"`
+	RunID  string `json:"run_id"`
+}
+
+// historyFilter narrows the branches table to one sync entry or branch.
+type historyFilter struct {
+	source string
+	target string
+	branch string
+}
+
+func (f historyFilter) where(conditions ...string) (string, []interface{}) {
+	var args []interface{}
+
+	for column, value := range map[string]string{"b.source_remote": f.source, "b.target_remote": f.target, "b.branch": f.branch} {
+		if value != "" {
+			conditions = append(conditions, column+" = ?")
+			args = append(args, value)
+		}
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// historyOptions are the history command's flags.
+type historyOptions struct {
+	path    string
+	show    string
+	format  string
+	limit   int
+	noColor bool
+	filter  historyFilter
+}
+
+// historyFlags defines the history command's flags.
+func historyFlags(opts *historyOptions) *flag.FlagSet {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	flags.StringVar(&opts.path, "history-db", "", "SQLite history database written by -history-db")
+	flags.StringVar(&opts.show, "show", historyShowRuns, "what to show: runs, failures (failed or skipped branches) or moved (when each branch last moved)")
+	flags.StringVar(&opts.format, "format", "table", "output format: table or json")
+	flags.IntVar(&opts.limit, "limit", 20, "show at most this many rows")
+	flags.StringVar(&opts.filter.source, "source", "", "only include this source_remote")
+	flags.StringVar(&opts.filter.target, "target", "", "only include this target_remote")
+	flags.StringVar(&opts.filter.branch, "branch", "", "only include this branch")
+	flags.BoolVar(&opts.noColor, "no-color", false, "don't color results, even on a terminal (also set by $NO_COLOR)")
+
+	return flags
+}
+
+// runHistoryCommand implements "gitsync history", which queries the database
+// written by -history-db. It returns the process exit code.
+func runHistoryCommand(args []string) int {
+	var opts historyOptions
+
+	historyFlags(&opts).Parse(args)
+	setColor(opts.noColor)
+
+	path, show, format, limit, filter := opts.path, opts.show, opts.format, opts.limit, opts.filter
+
+	if path == "" {
+		errorPrintf("history needs -history-db\n")
+		return 1
+	}
+
+	if format != "table" && format != "json" {
+		errorPrintf("unknown history format %s\n", format)
+		return 1
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	db, err := sql.Open("sqlite", path)
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	defer db.Close()
+
+	var rows interface{}
+
+	switch show {
+	case historyShowRuns:
+		rows, err = queryHistoryRuns(db, filter, limit)
+	case historyShowFailures:
+		rows, err = queryHistoryFailures(db, filter, limit)
+	case historyShowMoved:
+		rows, err = queryHistoryMoves(db, filter, limit)
+	default:
+		err = fmt.Errorf("unknown history view %s", show)
+	}
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+
+		if err := encoder.Encode(rows); err != nil {
+			errorPrintf("%s\n", err)
+			return 1
+		}
+
+		return 0
+	}
+
+	printHistory(rows)
+
+	return 0
+}
+
+func queryHistoryRuns(db *sql.DB, filter historyFilter, limit int) ([]historyRun, error) {
+	where, args := filter.where()
+	rows, err := db.Query(`SELECT r.run_id, r.started, r.duration_ms, r.status, r.host, r.repository,
+		COUNT(CASE WHEN b.status IN ('synced', 'up to date') THEN 1 END), COUNT(CASE WHEN b.status NOT IN ('synced', 'up to date') THEN 1 END)
+		FROM runs r LEFT JOIN branches b ON b.run_id = r.run_id`+where+`
+		GROUP BY r.run_id ORDER BY r.started DESC LIMIT ?`, append(args, limit)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	runs := []historyRun{}
+
+	for rows.Next() {
+		var run historyRun
+
+		if err := rows.Scan(&run.RunID, &run.Started, &run.DurationMs, &run.Status, &run.Host, &run.Repository, &run.Synced, &run.NotSynced); err != nil {
+			return nil, err
+		}
+
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+func queryHistoryFailures(db *sql.DB, filter historyFilter, limit int) ([]historyFailure, error) {
+	where, args := filter.where("b.status NOT IN ('synced', 'up to date')")
+	rows, err := db.Query(`SELECT r.started, b.run_id, b.sync_id, b.source_remote, b.target_remote, b.branch, b.status, b.error
+		FROM branches b JOIN runs r ON r.run_id = b.run_id`+where+`
+		ORDER BY r.started DESC LIMIT ?`, append(args, limit)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	failures := []historyFailure{}
+
+	for rows.Next() {
+		var failure historyFailure
+
+		if err := rows.Scan(&failure.Started, &failure.RunID, &failure.SyncID, &failure.Source, &failure.Target, &failure.Branch, &failure.Status, &failure.Error); err != nil {
+			return nil, err
+		}
+
+		failures = append(failures, failure)
+	}
+
+	return failures, rows.Err()
+}
+
+// queryHistoryMoves finds the last run in which each branch got new commits.
+// SQLite returns the other columns from the row MAX picked.
+func queryHistoryMoves(db *sql.DB, filter historyFilter, limit int) ([]historyMove, error) {
+	where, args := filter.where("b.new_sha != ''", "b.old_sha != b.new_sha")
+	rows, err := db.Query(`SELECT b.source_remote, b.target_remote, b.branch, MAX(r.started), b.new_sha, b.run_id
+		FROM branches b JOIN runs r ON r.run_id = b.run_id`+where+`
+		GROUP BY b.source_remote, b.target_remote, b.branch ORDER BY 4 DESC LIMIT ?`, append(args, limit)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	moves := []historyMove{}
+
+	for rows.Next() {
+		var move historyMove
+
+		if err := rows.Scan(&move.Source, &move.Target, &move.Branch, &move.Moved, &move.SHA, &move.RunID); err != nil {
+			return nil, err
+		}
+
+		moves = append(moves, move)
+	}
+
+	return moves, rows.Err()
+}
+
+func printHistory(rows interface{}) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	switch rows := rows.(type) {
+	case []historyRun:
+		fmt.Fprintf(w, "RUN\tSTARTED\tDURATION\t%s\tSYNCED\tNOT SYNCED\tHOST\tREPOSITORY\n", colorize(colorDefault, "STATUS"))
+
+		for _, run := range rows {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n", run.RunID, run.Started,
+				(time.Duration(run.DurationMs) * time.Millisecond).String(), colorStatus(run.Status),
+				run.Synced, run.NotSynced, run.Host, run.Repository)
+		}
+	case []historyFailure:
+		fmt.Fprintf(w, "STARTED\tRUN\tSYNC\tSOURCE\tTARGET\tBRANCH\t%s\tERROR\n", colorize(colorDefault, "RESULT"))
+
+		for _, failure := range rows {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", failure.Started, failure.RunID, failure.SyncID,
+				failure.Source, failure.Target, failure.Branch, colorStatus(failure.Status), failure.Error)
+		}
+	case []historyMove:
+		fmt.Fprintln(w, "SOURCE\tTARGET\tBRANCH\tLAST MOVED\tSHA\tRUN")
+
+		for _, move := range rows {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", move.Source, move.Target, move.Branch, move.Moved, gitsync.ShortSHA(move.SHA), move.RunID)
+		}
+	}
+
+	w.Flush()
+}
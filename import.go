@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/rys/gitsync/pkg/gitsync"
+)
+
+const importGitLab string = "gitlab"
+
+// starterConfig is the part of a config gitsync writes for someone to
+// review and complete, leaving out every setting it doesn't set.
+type starterConfig struct {
+	Remotes map[string]starterRemote `json:"remotes,omitempty"`
+	Sync    []starterSync            `json:"sync"`
+}
+
+type starterRemote struct {
+	URL string `json:"url"`
+}
+
+type starterSync struct {
+	Source    string   `json:"source_remote"`
+	Target    string   `json:"target_remote"`
+	Branches  []string `json:"branches"`
+	OnRewrite string   `json:"on_rewrite,omitempty"`
+}
+
+// writeStarterConfig writes config to path, or to stdout when path is "-".
+// A file is only readable by its owner, as the config permission check
+// wants, and one that exists already is never overwritten.
+func writeStarterConfig(path string, config starterConfig) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// importOptions are the import gitlab command's flags.
+type importOptions struct {
+	apiURL string
+	token  string
+	group  string
+	out    string
+}
+
+// importGitLabFlags defines the import gitlab command's flags.
+func importGitLabFlags(opts *importOptions) *flag.FlagSet {
+	flags := flag.NewFlagSet("import gitlab", flag.ExitOnError)
+	flags.StringVar(&opts.apiURL, "api-url", "", "GitLab API URL, for self-hosted GitLab, e.g. https://gitlab.example.com/api/v4 (defaults to GitLab.com)")
+	flags.StringVar(&opts.token, "token", "", "API token of a maintainer of the group's projects, or a keyring: or file: reference (defaults to $GITLAB_TOKEN)")
+	flags.StringVar(&opts.group, "group", "", "group whose pull mirrors, including its subgroups', are imported")
+	flags.StringVar(&opts.out, "out", ".", "directory to write a config for each mirror to")
+
+	return flags
+}
+
+// runImportCommand writes a config for every mirror defined on a forge, so
+// gitsync can take over from it.
+func runImportCommand(args []string) int {
+	if len(args) == 0 || args[0] != importGitLab {
+		errorPrintf("import needs what to import from: gitlab\n")
+		return 1
+	}
+
+	var opts importOptions
+
+	importGitLabFlags(&opts).Parse(args[1:])
+
+	apiURL, token, group, out := opts.apiURL, opts.token, opts.group, opts.out
+
+	if token == "" {
+		token = os.Getenv("GITLAB_TOKEN")
+	}
+
+	if group == "" || token == "" {
+		errorPrintf("import gitlab needs -group and -token or $GITLAB_TOKEN\n")
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	mirrors, err := gitsync.GitLabMirrors(ctx, apiURL, token, group)
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return 1
+	}
+
+	if len(mirrors) == 0 {
+		fmt.Printf("%s has no pull mirrors\n", group)
+		return 0
+	}
+
+	exitCode := 0
+
+	for _, mirror := range mirrors {
+		if len(mirror.Branches) == 0 {
+			errorPrintf("%s has no branches to sync, skipping it\n", mirror.Project)
+			exitCode = 1
+			continue
+		}
+
+		config := starterConfig{
+			Remotes: map[string]starterRemote{"upstream": {URL: mirror.SourceURL}, "gitlab": {URL: mirror.TargetURL}},
+			Sync:    []starterSync{{Source: "upstream", Target: "gitlab", Branches: mirror.Branches}},
+		}
+
+		// GitLab overwriting diverged branches is what gitsync does when
+		// told to force rewritten ones.
+		if mirror.OverwriteDiverged {
+			config.Sync[0].OnRewrite = "force"
+		}
+
+		path := filepath.Join(out, strings.ReplaceAll(mirror.Project, "/", "-")+".gitsync.conf")
+
+		if err := writeStarterConfig(path, config); err != nil {
+			errorPrintf("%s: %s\n", mirror.Project, err)
+			exitCode = 1
+			continue
+		}
+
+		fmt.Printf("wrote %s for %s, syncing %d branches\n", path, mirror.Project, len(mirror.Branches))
+
+		if mirror.HadCredentials {
+			fmt.Printf("  %s pulls with credentials GitLab doesn't reveal: give the upstream remote its auth\n", mirror.Project)
+		}
+
+		if len(mirror.Wildcards) > 0 {
+			fmt.Printf("  %s mirrors protected branches matching %s: list the matching branches\n", mirror.Project, strings.Join(mirror.Wildcards, ", "))
+		}
+	}
+
+	return exitCode
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rotated files are suffixed with when they were rotated, down to the
+// microsecond so two rotations in one second don't overwrite each other.
+// Files rotated before that have no fraction, and still parse and sort among
+// the rest.
+const (
+	gsLogFileTimeFormat       string = "20060102-150405.000000"
+	gsLogFileSecondTimeFormat string = "20060102-150405"
+)
+
+// gsLogFileStartedSuffix names the file next to the log that records when
+// the log was started. The log's modification time moves with every write,
+// and a log appended to by one short run after another would never get old
+// enough to rotate going by it.
+const gsLogFileStartedSuffix string = ".started"
+
+// rotatingFile is an append-only log file that is rotated once it grows past
+// maxSize bytes or was started more than maxAge ago. Rotated files are
+// renamed with a timestamp suffix and only the newest maxBackups are kept.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	opened     time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	size, opened := info.Size(), time.Now()
+
+	// A log started before its start was recorded is taken to have been
+	// started when it was last written to.
+	if size > 0 {
+		opened = info.ModTime()
+
+		if started, err := os.ReadFile(r.path + gsLogFileStartedSuffix); err == nil {
+			if t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(started))); err == nil {
+				opened = t
+			}
+		}
+	}
+
+	if err := os.WriteFile(r.path+gsLogFileStartedSuffix, []byte(opened.Format(time.RFC3339Nano)+"\n"), 0600); err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file, r.size, r.opened = file, size, opened
+
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.needsRotation(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+
+	return n, err
+}
+
+func (r *rotatingFile) needsRotation(pending int64) bool {
+	if r.size == 0 {
+		return false
+	}
+
+	if r.maxSize > 0 && r.size+pending > r.maxSize {
+		return true
+	}
+
+	return r.maxAge > 0 && time.Since(r.opened) > r.maxAge
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	rotated := fmt.Sprintf("%s.%s", r.path, time.Now().Format(gsLogFileTimeFormat))
+
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+
+	r.pruneBackups()
+
+	return r.open()
+}
+
+func (r *rotatingFile) pruneBackups() {
+	if r.maxBackups <= 0 {
+		return
+	}
+
+	backups, err := filepath.Glob(r.path + ".*")
+
+	if err != nil {
+		return
+	}
+
+	var rotated []string
+
+	for _, backup := range backups {
+		suffix := strings.TrimPrefix(backup, r.path+".")
+
+		if _, err := time.Parse(gsLogFileTimeFormat, suffix); err == nil {
+			rotated = append(rotated, backup)
+		} else if _, err := time.Parse(gsLogFileSecondTimeFormat, suffix); err == nil {
+			rotated = append(rotated, backup)
+		}
+	}
+
+	// The timestamp suffix sorts chronologically, oldest first.
+	sort.Strings(rotated)
+
+	for len(rotated) > r.maxBackups {
+		os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+}
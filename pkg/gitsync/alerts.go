@@ -0,0 +1,399 @@
+package gitsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// gsAlertsFile is where the runs each alerting sync entry has failed in a
+// row, when it last synced and whether it is paging someone are kept, in
+// the repository's git directory.
+const gsAlertsFile string = "gitsync/alerts.json"
+
+// gsDefaultAlertAfter is how many runs in a row a sync entry has to fail
+// before it pages anyone, unless its alert says otherwise.
+const gsDefaultAlertAfter = 3
+
+const gsOpsgenieAPI string = "https://api.opsgenie.com"
+
+// Opsgenie caps alert messages and descriptions at these many characters.
+const (
+	gsOpsgenieMaxMessage     int = 130
+	gsOpsgenieMaxDescription int = 15000
+)
+
+// Alert pages someone through PagerDuty or Opsgenie once a sync entry has
+// failed a number of runs in a row, or hasn't synced for longer than its
+// staleness SLO, and resolves the incident once it syncs again.
+type Alert struct {
+	Type string `json:"type"`
+	// RoutingKey is the PagerDuty Events API v2 integration key, and APIKey
+	// the Opsgenie API integration key.
+	RoutingKey string `json:"routing_key"`
+	APIKey     string `json:"api_key"`
+	// APIURL overrides the Events API endpoint for PagerDuty, or the API
+	// for Opsgenie, e.g. https://api.eu.opsgenie.com.
+	APIURL string `json:"api_url"`
+	// After is how many runs in a row have to fail, defaulting to 3.
+	After int `json:"after"`
+	// StaleAfter pages once the entry hasn't synced for this long, e.g.
+	// "6h", however few runs failed.
+	StaleAfter string `json:"stale_after"`
+	// Severity is PagerDuty's critical, error (the default), warning or
+	// info, or Opsgenie's priority, P1 to P5, defaulting to P3.
+	Severity string `json:"severity"`
+}
+
+// alertState is what alert remembers between runs about each sync entry.
+type alertState struct {
+	Entries []alertEntry `json:"entries"`
+}
+
+type alertEntry struct {
+	Source   string `json:"source_remote"`
+	Target   string `json:"target_remote"`
+	Failures int    `json:"failures"`
+	// LastSynced is when the entry last synced, or when alert started
+	// watching it.
+	LastSynced time.Time `json:"last_synced"`
+	Open       bool      `json:"open,omitempty"`
+}
+
+func checkAlert(where string, settings *Alert) bool {
+	if settings == nil {
+		return true
+	}
+
+	switch settings.Type {
+	case "pagerduty":
+		if settings.RoutingKey == "" {
+			errorPrintf("%s alert has no routing_key\n", where)
+			return false
+		}
+
+		if settings.Severity != "" && settings.Severity != "critical" && settings.Severity != "error" && settings.Severity != "warning" && settings.Severity != "info" {
+			errorPrintf("%s alert has an unknown severity %s, it must be critical, error, warning or info\n", where, settings.Severity)
+			return false
+		}
+	case "opsgenie":
+		if settings.APIKey == "" {
+			errorPrintf("%s alert has no api_key\n", where)
+			return false
+		}
+
+		if priority, err := strconv.Atoi(strings.TrimPrefix(settings.Severity, "P")); settings.Severity != "" && (err != nil || priority < 1 || priority > 5 || settings.Severity[0] != 'P') {
+			errorPrintf("%s alert has an unknown severity %s, it must be P1 to P5\n", where, settings.Severity)
+			return false
+		}
+	default:
+		errorPrintf("%s has an unknown alert type: %s\n", where, settings.Type)
+		return false
+	}
+
+	if settings.After < 0 {
+		errorPrintf("%s alert's after can't be negative\n", where)
+		return false
+	}
+
+	if settings.StaleAfter != "" {
+		if staleAfter, err := time.ParseDuration(settings.StaleAfter); err != nil || staleAfter <= 0 {
+			errorPrintf("%s alert has a bad stale_after: %q\n", where, settings.StaleAfter)
+			return false
+		}
+	}
+
+	return true
+}
+
+// alertFor is the sync entry's alert, or the global one.
+func (s *Syncer) alertFor(sync SyncEntry) *Alert {
+	if sync.Alert != nil {
+		return sync.Alert
+	}
+
+	return s.config.Alert
+}
+
+// raiseAlerts counts the runs in a row each alerting sync entry has failed
+// and how long it has gone without syncing, triggering its incident once
+// either is too much and resolving it once the entry syncs again. Entries
+// the run didn't get to still grow stale. Failing to reach PagerDuty or
+// Opsgenie is only warned about, and tried again next run.
+func (s *Syncer) raiseAlerts(ctx context.Context) {
+	tracked := false
+
+	for _, sync := range s.config.Sync {
+		tracked = tracked || s.alertFor(sync) != nil
+	}
+
+	if !tracked {
+		return
+	}
+
+	dotGit, err := s.dotGit()
+
+	if err != nil {
+		s.warnPrintf("could not check sync entries for alerts: %s\n", err)
+		return
+	}
+
+	var state alertState
+	data, err := util.ReadFile(dotGit, gsAlertsFile)
+
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.warnPrintf("could not read the failures of sync entries, counting afresh: %s\n", err)
+	}
+
+	entries := map[string]*alertEntry{}
+
+	for i := range state.Entries {
+		entries[state.Entries[i].Source+"\x00"+state.Entries[i].Target] = &state.Entries[i]
+	}
+
+	next := alertState{Entries: []alertEntry{}}
+
+	for _, sync := range s.config.Sync {
+		key := sync.Source + "\x00" + sync.Target
+		entry := entries[key]
+		settings := s.alertFor(sync)
+
+		if entry == nil {
+			if _, seen := entries[key]; seen || settings == nil {
+				continue
+			}
+
+			entry = &alertEntry{Source: sync.Source, Target: sync.Target, LastSynced: s.run.Started}
+		}
+
+		// The same source and target are only counted once a run.
+		entries[key] = nil
+
+		if settings != nil {
+			s.updateAlert(ctx, sync, settings, entry)
+			next.Entries = append(next.Entries, *entry)
+		}
+	}
+
+	data, err = json.MarshalIndent(next, "", "  ")
+
+	if err == nil {
+		err = util.WriteFile(dotGit, gsAlertsFile+".tmp", append(data, '\n'), 0o644)
+	}
+
+	if err == nil {
+		err = dotGit.Rename(gsAlertsFile+".tmp", gsAlertsFile)
+	}
+
+	if err != nil {
+		s.warnPrintf("could not save the failures of sync entries: %s\n", err)
+	}
+}
+
+// updateAlert counts the run's result for sync against entry and triggers
+// or resolves its incident to match.
+func (s *Syncer) updateAlert(ctx context.Context, sync SyncEntry, settings *Alert, entry *alertEntry) {
+	after := settings.After
+
+	if after == 0 {
+		after = gsDefaultAlertAfter
+	}
+
+	staleAfter, _ := time.ParseDuration(settings.StaleAfter)
+	result := s.syncResult(sync)
+
+	switch {
+	case result == nil:
+	case result.Status == StatusSynced:
+		entry.Failures, entry.LastSynced = 0, time.Now()
+	default:
+		entry.Failures++
+	}
+
+	stale := time.Since(entry.LastSynced).Round(time.Second)
+	var reason string
+
+	switch {
+	case entry.Failures >= after:
+		reason = fmt.Sprintf("has failed %d runs in a row", entry.Failures)
+	case staleAfter > 0 && stale > staleAfter:
+		reason = fmt.Sprintf("hasn't synced for %s, over its %s SLO", stale, staleAfter)
+	}
+
+	if (reason != "") == entry.Open {
+		return
+	}
+
+	host, _ := os.Hostname()
+	dedupKey := fmt.Sprintf("gitsync/%s/%s/%s/%s", host, s.repoDir, sync.Source, sync.Target)
+	var err error
+
+	if reason == "" {
+		err = sendAlert(ctx, settings, dedupKey, "", nil)
+
+		if err == nil {
+			s.infoPrintf("resolved the %s incident for %s to %s now that it syncs again\n", settings.Type, sync.Source, sync.Target)
+			entry.Open = false
+		}
+	} else {
+		details := map[string]string{
+			"host":          host,
+			"repository":    s.repoDir,
+			"source_remote": sync.Source,
+			"target_remote": sync.Target,
+			"run_id":        s.run.ID,
+			"failures":      strconv.Itoa(entry.Failures),
+			"last_synced":   entry.LastSynced.UTC().Format(time.RFC3339),
+		}
+
+		if result != nil {
+			details["error"] = syncErrors(result)
+		}
+
+		err = sendAlert(ctx, settings, dedupKey, fmt.Sprintf("gitsync on %s: mirroring %s to %s %s", host, sync.Source, sync.Target, reason), details)
+
+		if err == nil {
+			s.infoPrintf("paged through %s as %s to %s %s\n", settings.Type, sync.Source, sync.Target, reason)
+			entry.Open = true
+		}
+	}
+
+	if err != nil {
+		s.warnPrintf("could not update the %s incident for %s to %s: %s\n", settings.Type, sync.Source, sync.Target, err)
+	}
+}
+
+// syncErrors is why a sync entry failed: its own error, or those of its
+// branches, one a line.
+func syncErrors(result *SyncResult) string {
+	if result.Err != nil {
+		return result.Err.Error()
+	}
+
+	var lines []string
+
+	for _, branch := range result.Branches {
+		if branch.Err != nil {
+			lines = append(lines, branch.Branch+": "+branch.Err.Error())
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// sendAlert triggers the incident dedupKey names with summary and details,
+// or resolves it when summary is empty.
+func sendAlert(ctx context.Context, settings *Alert, dedupKey, summary string, details map[string]string) error {
+	if settings.Type == "opsgenie" {
+		return sendOpsgenieAlert(ctx, settings, dedupKey, summary, details)
+	}
+
+	routingKey, err := resolveSecret(settings.RoutingKey)
+
+	if err != nil {
+		return err
+	}
+
+	event := pagerDutyEvent{RoutingKey: routingKey, EventAction: "resolve", DedupKey: dedupKey}
+
+	if summary != "" {
+		severity := settings.Severity
+
+		if severity == "" {
+			severity = "error"
+		}
+
+		if len(summary) > gsPagerDutyMaxSummary {
+			summary = summary[:gsPagerDutyMaxSummary]
+		}
+
+		event.EventAction = "trigger"
+		event.Payload = &pagerDutyPayload{Summary: summary, Source: details["host"], Severity: severity, CustomDetails: details}
+	}
+
+	api := settings.APIURL
+
+	if api == "" {
+		api = gsPagerDutyEventsAPI
+	}
+
+	if status, err := forgeRequest(ctx, http.MethodPost, api, nil, event, nil); err != nil || status/100 != 2 {
+		return forgeError(err, status, "sending the event")
+	}
+
+	return nil
+}
+
+func sendOpsgenieAlert(ctx context.Context, settings *Alert, alias, summary string, details map[string]string) error {
+	apiKey, err := resolveSecret(settings.APIKey)
+
+	if err != nil {
+		return err
+	}
+
+	api := settings.APIURL
+
+	if api == "" {
+		api = gsOpsgenieAPI
+	}
+
+	api = strings.TrimSuffix(api, "/") + "/v2/alerts"
+	headers := map[string]string{"Authorization": "GenieKey " + apiKey}
+	host, _ := os.Hostname()
+
+	if summary == "" {
+		endpoint := api + "/" + url.PathEscape(alias) + "/close?identifierType=alias"
+		request := map[string]string{"source": host, "note": "gitsync synced the entry again"}
+
+		if status, err := forgeRequest(ctx, http.MethodPost, endpoint, headers, request, nil); err != nil || status/100 != 2 {
+			return forgeError(err, status, "closing the alert")
+		}
+
+		return nil
+	}
+
+	priority := settings.Severity
+
+	if priority == "" {
+		priority = "P3"
+	}
+
+	message, description := summary, summary+"\n\n"+details["error"]
+
+	if len(message) > gsOpsgenieMaxMessage {
+		message = message[:gsOpsgenieMaxMessage]
+	}
+
+	if len(description) > gsOpsgenieMaxDescription {
+		description = description[:gsOpsgenieMaxDescription]
+	}
+
+	request := map[string]interface{}{
+		"message":     message,
+		"alias":       alias,
+		"description": description,
+		"source":      host,
+		"priority":    priority,
+		"tags":        []string{"gitsync"},
+		"details":     details,
+	}
+
+	if status, err := forgeRequest(ctx, http.MethodPost, api, headers, request, nil); err != nil || status/100 != 2 {
+		return forgeError(err, status, "creating the alert")
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package gitsync
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// rollBack restores every ref an atomic group pushed to target to what it
+// was before, deleting refs the target didn't have, newest push first. A
+// rolled back branch is failed; one that can't be rolled back, whose roll
+// back isn't confirmed, or that was pushed to again since, keeps what it
+// has and says so.
+func (s *Syncer) rollBack(ctx context.Context, repo *git.Repository, target string, sync *SyncResult) {
+	// The target's refs are listed afresh, so a branch someone else pushed
+	// to since this run did is seen and left alone.
+	s.forgetRemoteRefs(target)
+
+	for i := len(sync.Branches) - 1; i >= 0; i-- {
+		branch := sync.Branches[i]
+
+		if branch.pushedRef == "" || branch.targetOldSHA == branch.NewSHA {
+			continue
+		}
+
+		delete(s.synced, syncedKey(sync.Source, target, branch.Branch))
+
+		if err := s.rollBackBranch(ctx, repo, target, branch); err != nil {
+			s.forgetRemoteRefs(target)
+			s.publish(Event{Type: EventError, Branch: branch, Err: err})
+			branch.Status = StatusFailed
+			branch.Err = err
+
+			continue
+		}
+
+		branch.Status = StatusFailed
+		branch.Err = fmt.Errorf("rolled back %s, another branch of the atomic group failed", rolledBackTo(branch))
+		branch.pushedRef = ""
+	}
+}
+
+// rollBackBranch puts one branch of an atomic group back, if the target
+// still has what the run pushed to it, once confirmed and backed up as any
+// other force push or deletion is.
+func (s *Syncer) rollBackBranch(ctx context.Context, repo *git.Repository, target string, branch *BranchResult) error {
+	ref, restored := branch.pushedRef, rolledBackTo(branch)
+	current, err := s.remoteRefSHA(ctx, target, ref)
+
+	if err != nil {
+		return fmt.Errorf("could not roll back %s on %s, it is left at %s: could not read it: %w", ref.Short(), target, ShortSHA(branch.NewSHA), err)
+	}
+
+	if current != branch.NewSHA {
+		return fmt.Errorf("did not roll back %s on %s, it was pushed to since and is now at %s, not %s", ref.Short(), target, ShortSHA(current), ShortSHA(branch.NewSHA))
+	}
+
+	refSpec := config.RefSpec("+" + branch.targetOldSHA + ":" + ref.String())
+
+	if branch.targetOldSHA == "" {
+		refSpec = config.RefSpec(":" + ref.String())
+	}
+
+	err = s.confirmDestructive(fmt.Sprintf("roll back %s on %s %s", ref.Short(), target, restored))
+
+	if err == nil {
+		var backup plumbing.ReferenceName
+
+		if backup, err = s.backupRef(ctx, repo, target, ref, branch.NewSHA); err == nil {
+			err = s.audit.refChange(s.repoDir, target, backup.String(), "", branch.NewSHA)
+		}
+	}
+
+	if err == nil {
+		s.infoPrintf("rolling back %s on %s %s\n", ref.Short(), target, restored)
+		err = s.pushTo(ctx, repo, target, refSpec, nil)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not roll back %s on %s, it is left at %s: %w", ref.Short(), target, ShortSHA(branch.NewSHA), err)
+	}
+
+	s.pushedRemoteRef(target, ref, branch.targetOldSHA)
+
+	if err := s.audit.refChange(s.repoDir, target, ref.String(), branch.NewSHA, branch.targetOldSHA); err != nil {
+		s.publish(Event{Type: EventError, Branch: branch, Err: err})
+	}
+
+	return nil
+}
+
+// rolledBackTo says what rolling a branch back puts its ref back to.
+func rolledBackTo(branch *BranchResult) string {
+	if branch.targetOldSHA == "" {
+		return "by deleting it"
+	}
+
+	return "to " + ShortSHA(branch.targetOldSHA)
+}
@@ -0,0 +1,112 @@
+package gitsync
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestAtomicRollBack(t *testing.T) {
+	tests := []struct {
+		name string
+		// moved is pushed to main on the target by someone else once the
+		// run has pushed it.
+		moved    bool
+		rollBack bool
+	}{
+		{"rolled back", false, true},
+		{"pushed to since", true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, source, target, initial := testRepos(t, "main", "dev")
+			next := testCommit(t, source, "next", initial)
+			setTestBranch(t, source, "main", next)
+
+			if err := source.Storer.RemoveReference(plumbing.NewBranchReferenceName("dev")); err != nil {
+				t.Fatal(err)
+			}
+
+			config := Config{Sync: []SyncEntry{{Source: "source", Target: "target", Branches: []string{"main", "dev"}, Atomic: true}}}
+			syncer, err := New(config, Options{RepoDir: dir, Progress: ProgressNone, AssumeYes: true})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			theirs := testCommit(t, target, "theirs", initial)
+
+			syncer.Subscribe(func(event Event) {
+				if test.moved && event.Type == EventBranchPushed {
+					setTestBranch(t, target, "main", theirs)
+				}
+			})
+
+			result, _ := syncer.Run(context.Background())
+			branch := testBranchResult(t, result, "main")
+			want := next
+
+			switch {
+			case test.rollBack:
+				want = initial
+			case test.moved:
+				want = theirs
+			}
+
+			if got := testBranchSHA(t, target, "main"); got != want {
+				t.Errorf("target main is %s, want %s", ShortSHA(got.String()), ShortSHA(want.String()))
+			}
+
+			if branch.Status != StatusFailed || (branch.pushedRef == "") != test.rollBack {
+				t.Errorf("main is %s (%v), want it rolled back %t", branch.Status, branch.Err, test.rollBack)
+			}
+
+			backups := 0
+			refs, _ := target.References()
+
+			refs.ForEach(func(ref *plumbing.Reference) error {
+				if strings.HasPrefix(ref.Name().String(), gsBackupPrefix) && ref.Hash() == next {
+					backups++
+				}
+
+				return nil
+			})
+
+			if rolledBack := backups == 1; rolledBack != test.rollBack {
+				t.Errorf("got %d backups of what was pushed, want the roll back backed up %t", backups, test.rollBack)
+			}
+		})
+	}
+}
+
+func TestAtomicNeedsRollBacksConfirmed(t *testing.T) {
+	dir, _, _, _ := testRepos(t, "main", "dev")
+	entry := SyncEntry{Source: "source", Target: "target", Branches: []string{"main", "dev"}, Atomic: true}
+
+	tests := []struct {
+		name    string
+		config  Config
+		options Options
+		ok      bool
+	}{
+		{"unconfirmed", Config{}, Options{}, false},
+		{"allow_destructive", Config{AllowDestructive: true}, Options{}, true},
+		{"-yes", Config{}, Options{AssumeYes: true}, true},
+		{"terminal", Config{}, Options{Confirm: func(string) bool { return true }}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.Sync = []SyncEntry{entry}
+			test.options.RepoDir, test.options.Progress = dir, ProgressNone
+
+			if _, err := New(test.config, test.options); (err == nil) != test.ok || (err != nil && !errors.Is(err, errInvalidConfig)) {
+				t.Errorf("got %v, want ok %t", err, test.ok)
+			}
+		})
+	}
+}
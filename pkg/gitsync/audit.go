@@ -0,0 +1,192 @@
+package gitsync
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// gsAuditGenesisHash is the previous hash of the first record in a new log.
+const gsAuditGenesisHash string = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// gsAuditLocalRemote names the local repository in audit records.
+const gsAuditLocalRemote string = "(local)"
+
+// auditRecord is one ref mutation. Hash covers every other field, including
+// PrevHash, so altering or removing any earlier record breaks the chain.
+type auditRecord struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Repository string    `json:"repository"`
+	Remote     string    `json:"remote"`
+	Ref        string    `json:"ref"`
+	OldSHA     string    `json:"old_sha"`
+	NewSHA     string    `json:"new_sha"`
+	Actor      string    `json:"actor"`
+	PrevHash   string    `json:"prev_hash"`
+	Hash       string    `json:"hash,omitempty"`
+}
+
+// auditLog is an audit log open for appending. The Syncers of GitLab
+// projects share their parent's, so it is locked around each record to keep
+// one chain.
+type auditLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	prevHash string
+	actor    string
+}
+
+// openAuditLog opens the audit log for appending and picks up the chain from
+// its last record.
+func openAuditLog(path string) (*auditLog, error) {
+	audit := &auditLog{prevHash: gsAuditGenesisHash}
+
+	if existing, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(existing)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+		for scanner.Scan() {
+			var record auditRecord
+
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				existing.Close()
+				return nil, fmt.Errorf("audit log %s is corrupt: %w", path, err)
+			}
+
+			audit.prevHash = record.Hash
+		}
+
+		existing.Close()
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	audit.file = file
+
+	host, _ := os.Hostname()
+	username := "unknown"
+
+	if current, err := user.Current(); err == nil {
+		username = current.Username
+	}
+
+	audit.actor = fmt.Sprintf("%s@%s", username, host)
+
+	return audit, nil
+}
+
+func (r auditRecord) computeHash() string {
+	r.Hash = ""
+	encoded, _ := json.Marshal(r)
+	sum := sha256.Sum256(encoded)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// refChange appends a ref mutation to the audit log. An audit record that
+// can't be written stops the run rather than being warned about: the log must
+// be complete.
+func (a *auditLog) refChange(repository, remote, ref, oldSHA, newSHA string) error {
+	if a == nil || oldSHA == newSHA {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	record := auditRecord{
+		Timestamp:  time.Now().UTC(),
+		Repository: repository,
+		Remote:     remote,
+		Ref:        ref,
+		OldSHA:     oldSHA,
+		NewSHA:     newSHA,
+		Actor:      a.actor,
+		PrevHash:   a.prevHash,
+	}
+
+	record.Hash = record.computeHash()
+
+	encoded, err := json.Marshal(record)
+
+	if err != nil {
+		return fmt.Errorf("could not write audit log: %w", err)
+	}
+
+	if _, err := a.file.Write(append(encoded, '\n')); err != nil {
+		return fmt.Errorf("could not write audit log: %w", err)
+	}
+
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("could not write audit log: %w", err)
+	}
+
+	a.prevHash = record.Hash
+
+	return nil
+}
+
+func (a *auditLog) close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.file.Close()
+}
+
+// VerifyAuditLog checks every record's hash and its link to the record
+// before it, returning the line number of the first broken record.
+func VerifyAuditLog(path string) (int, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	prevHash := gsAuditGenesisHash
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		var record auditRecord
+
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return line, err
+		}
+
+		if record.PrevHash != prevHash {
+			return line, fmt.Errorf("record does not follow %s", prevHash)
+		}
+
+		if record.computeHash() != record.Hash {
+			return line, fmt.Errorf("record hash %s does not match its contents", record.Hash)
+		}
+
+		prevHash = record.Hash
+	}
+
+	return 0, scanner.Err()
+}
@@ -0,0 +1,109 @@
+package gitsync
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testAuditLog writes an audit log of count ref changes and returns its
+// path and lines.
+func testAuditLog(t *testing.T, count int) (string, []string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < count; i++ {
+		if err := audit.refChange("/repo", "target", "refs/heads/main", strings.Repeat(string(rune('a'+i)), 40), strings.Repeat(string(rune('b'+i)), 40)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := audit.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(lines []string) []string
+		line   int
+	}{
+		{"intact", func(lines []string) []string { return lines }, 0},
+		{"altered", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], `"remote":"target"`, `"remote":"other"`, 1)
+			return lines
+		}, 2},
+		{"removed", func(lines []string) []string { return append(lines[:1], lines[2:]...) }, 2},
+		{"first removed", func(lines []string) []string { return lines[1:] }, 1},
+		{"reordered", func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, 2},
+		{"corrupt", func(lines []string) []string {
+			lines[2] = "{"
+			return lines
+		}, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, lines := testAuditLog(t, 3)
+
+			if err := os.WriteFile(path, []byte(strings.Join(test.tamper(lines), "\n")+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			line, err := VerifyAuditLog(path)
+
+			if line != test.line || (err == nil) != (test.line == 0) {
+				t.Errorf("got line %d (%v), want line %d", line, err, test.line)
+			}
+		})
+	}
+}
+
+func TestAuditLogChainCarriesOnWhenReopened(t *testing.T) {
+	path, _ := testAuditLog(t, 2)
+	audit, err := openAuditLog(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := audit.refChange("/repo", "target", "refs/heads/dev", "", strings.Repeat("c", 40)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A ref that didn't change isn't recorded.
+	if err := audit.refChange("/repo", "target", "refs/heads/dev", strings.Repeat("c", 40), strings.Repeat("c", 40)); err != nil {
+		t.Fatal(err)
+	}
+
+	audit.close()
+
+	if line, err := VerifyAuditLog(path); err != nil {
+		t.Errorf("line %d: %s", line, err)
+	}
+
+	data, _ := os.ReadFile(path)
+
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("got %d records, want 3", lines)
+	}
+}
@@ -0,0 +1,281 @@
+package gitsync
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	krbclient "github.com/jcmturner/gokrb5/v8/client"
+	krbconfig "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+// Auth chooses how gitsync authenticates to a remote.
+type Auth struct {
+	Type string `json:"type"`
+
+	// kerberos
+	SPN        string `json:"spn"`
+	Krb5Config string `json:"krb5_config"`
+	CCache     string `json:"ccache"`
+
+	// helper, token, bearer
+	Command  string `json:"command"`
+	Username string `json:"username"`
+	Token    string `json:"token"`
+
+	// vault_ssh
+	VaultAddr  string `json:"vault_addr"`
+	VaultToken string `json:"vault_token"`
+	Mount      string `json:"mount"`
+	Role       string `json:"role"`
+	Principals string `json:"principals"`
+
+	// gcp
+	CredentialsFile string `json:"credentials_file"`
+}
+
+const gsDefaultKrb5Config string = "/etc/krb5.conf"
+
+var gsAuthTypes = map[string]bool{
+	"kerberos":  true,
+	"helper":    true,
+	"token":     true,
+	"bearer":    true,
+	"vault_ssh": true,
+	"gcp":       true,
+}
+
+func checkAuth(name string, auth *Auth) bool {
+	if !gsAuthTypes[auth.Type] {
+		errorPrintf("%s remote has an unknown auth type: %s\n", name, auth.Type)
+		return false
+	}
+
+	if auth.Type == "helper" && strings.TrimSpace(auth.Command) == "" {
+		errorPrintf("%s remote helper auth has no command\n", name)
+		return false
+	}
+
+	if (auth.Type == "token" || auth.Type == "bearer") && auth.Token == "" {
+		errorPrintf("%s remote %s auth has no token\n", name, auth.Type)
+		return false
+	}
+
+	if auth.Type == "vault_ssh" && auth.Role == "" {
+		errorPrintf("%s remote vault_ssh auth has no role\n", name)
+		return false
+	}
+
+	return true
+}
+
+// remoteAuth returns the go-git auth method for fetching from or pushing to
+// a remote, or nil to let go-git fall back to its defaults (ssh-agent,
+// anonymous HTTP). Auth methods are cached for the run so that credential
+// helpers and ticket negotiation run once per run rather than once per
+// branch operation, separately for pushing when the remote is pushed to at
+// another URL, so one host's credentials are never sent to the other.
+func (s *Syncer) remoteAuth(remote string, push bool) (transport.AuthMethod, error) {
+	key := preflightCheck{remote: remote, push: push && s.effectiveURL(remote, true) != s.effectiveURL(remote, false)}
+
+	// Remotes are contacted concurrently by the preflight check and
+	// fetches, and each is only asked for credentials once.
+	s.remoteAuthMu.Lock()
+	defer s.remoteAuthMu.Unlock()
+
+	if auth, cached := s.remoteAuthCache[key]; cached {
+		return auth, nil
+	}
+
+	auth, err := s.newRemoteAuth(remote, key.push)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not authenticate to %s: %w", remote, err)
+	}
+
+	s.remoteAuthCache[key] = auth
+
+	return auth, nil
+}
+
+func (s *Syncer) newRemoteAuth(remote string, push bool) (transport.AuthMethod, error) {
+	settings, exists := s.config.Remotes[remote]
+
+	if !exists || settings.Auth == nil {
+		return nil, nil
+	}
+
+	s.debugPrintf("resolving %s auth for %s\n", settings.Auth.Type, remote)
+
+	switch settings.Auth.Type {
+	case "kerberos":
+		return newKerberosAuth(settings.Auth)
+	case "helper":
+		return s.newHelperAuth(s.effectiveURL(remote, push), settings.Auth)
+	case "token":
+		return newTokenAuth(settings.Auth)
+	case "bearer":
+		return newBearerAuth(settings.Auth)
+	case "vault_ssh":
+		return newVaultSSHAuth(settings.Auth)
+	case "gcp":
+		return newGCPAuth(settings.Auth)
+	}
+
+	return nil, fmt.Errorf("unknown auth type %s", settings.Auth.Type)
+}
+
+// newTokenAuth sends an access token as the HTTP basic auth password, which
+// GitHub, GitLab, Gitea and Bitbucket all accept.
+func newTokenAuth(settings *Auth) (transport.AuthMethod, error) {
+	token, err := resolveSecret(settings.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	username := settings.Username
+
+	if username == "" {
+		username = "gitsync"
+	}
+
+	return &githttp.BasicAuth{Username: username, Password: token}, nil
+}
+
+// newBearerAuth sends an access token as an HTTP bearer token, for servers
+// that don't take tokens as passwords, like Bitbucket Data Center with
+// basic auth turned off.
+func newBearerAuth(settings *Auth) (transport.AuthMethod, error) {
+	token, err := resolveSecret(settings.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &githttp.TokenAuth{Token: token}, nil
+}
+
+// newHelperAuth asks a git credential helper for the credentials for
+// remoteURL using the same "get" protocol git itself speaks.
+func (s *Syncer) newHelperAuth(remoteURL string, settings *Auth) (transport.AuthMethod, error) {
+	helperURL, err := url.Parse(remoteURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var request strings.Builder
+	fmt.Fprintf(&request, "protocol=%s\nhost=%s\npath=%s\n", helperURL.Scheme, helperURL.Host, strings.TrimPrefix(helperURL.Path, "/"))
+
+	if settings.Username != "" {
+		fmt.Fprintf(&request, "username=%s\n", settings.Username)
+	}
+
+	request.WriteString("\n")
+
+	args := strings.Fields(settings.Command)
+	cmd := exec.Command(args[0], append(args[1:], "get")...)
+	cmd.Stdin = strings.NewReader(request.String())
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %s failed: %w", args[0], err)
+	}
+
+	auth := &githttp.BasicAuth{Username: settings.Username}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, found := strings.Cut(line, "=")
+
+		if !found {
+			continue
+		}
+
+		switch key {
+		case "username":
+			auth.Username = value
+		case "password":
+			auth.Password = value
+		}
+	}
+
+	if auth.Password == "" {
+		return nil, fmt.Errorf("credential helper %s returned no password for %s", args[0], helperURL.Host)
+	}
+
+	return auth, nil
+}
+
+// kerberosAuth negotiates SPNEGO with HTTPS remotes using the tickets already
+// present in the host's Kerberos credential cache.
+type kerberosAuth struct {
+	client *krbclient.Client
+	spn    string
+}
+
+func newKerberosAuth(settings *Auth) (*kerberosAuth, error) {
+	confPath := settings.Krb5Config
+
+	if confPath == "" {
+		confPath = os.Getenv("KRB5_CONFIG")
+	}
+
+	if confPath == "" {
+		confPath = gsDefaultKrb5Config
+	}
+
+	conf, err := krbconfig.Load(confPath)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not load %s: %w", confPath, err)
+	}
+
+	ccachePath := settings.CCache
+
+	if ccachePath == "" {
+		ccachePath = strings.TrimPrefix(os.Getenv("KRB5CCNAME"), "FILE:")
+	}
+
+	if ccachePath == "" {
+		ccachePath = fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid())
+	}
+
+	ccache, err := credentials.LoadCCache(ccachePath)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not load credential cache %s: %w", ccachePath, err)
+	}
+
+	client, err := krbclient.NewFromCCache(ccache, conf, krbclient.DisablePAFXFAST(true))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &kerberosAuth{client: client, spn: settings.SPN}, nil
+}
+
+func (a *kerberosAuth) Name() string {
+	return "http-negotiate"
+}
+
+func (a *kerberosAuth) String() string {
+	return fmt.Sprintf("%s - %s", a.Name(), a.client.Credentials.UserName())
+}
+
+func (a *kerberosAuth) SetAuth(r *http.Request) {
+	// An empty SPN makes gokrb5 derive HTTP/<host> from the request.
+	if err := spnego.SetSPNEGOHeader(a.client, r, a.spn); err != nil {
+		warnPrintf("kerberos negotiation for %s failed: %s\n", r.URL.Host, err)
+	}
+}
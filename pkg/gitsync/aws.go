@@ -0,0 +1,299 @@
+package gitsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awsCredentials are the keys AWS requests are signed with.
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// loadAWSCredentials finds AWS keys as the AWS CLI does, short of its
+// credential processes, SSO and instance roles: in $AWS_ACCESS_KEY_ID,
+// $AWS_SECRET_ACCESS_KEY and $AWS_SESSION_TOKEN, or else in the
+// $AWS_PROFILE (or default) profile of the shared credentials file.
+func loadAWSCredentials() (awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{accessKeyID: id, secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), sessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+
+	if path == "" {
+		home, err := os.UserHomeDir()
+
+		if err != nil {
+			return awsCredentials{}, err
+		}
+
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+
+	profile := os.Getenv("AWS_PROFILE")
+
+	if profile == "" {
+		profile = "default"
+	}
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	defer file.Close()
+
+	var creds awsCredentials
+	section := ""
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+
+		if !found || section != profile {
+			continue
+		}
+
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.accessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.secretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.sessionToken = strings.TrimSpace(value)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return awsCredentials{}, err
+	}
+
+	if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+		return awsCredentials{}, errors.New("no AWS credentials in the environment or profile " + profile + " of " + path)
+	}
+
+	return creds, nil
+}
+
+// signAWSRequest signs req, whose body is body, with AWS Signature Version 4
+// for service in region.
+func signAWSRequest(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.Host}
+
+	if req.Host == "" {
+		headers["host"] = req.URL.Host
+	}
+
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+
+	if path == "" {
+		path = "/"
+	}
+
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.secretAccessKey)
+
+	for _, part := range []string{amzDate[:8], region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.accessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, stringToSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsJSONRequest calls operation of an AWS JSON API, like CodeCommit's, at
+// endpoint. It returns the response's status and, for errors, the type AWS
+// gives them, e.g. RepositoryDoesNotExistException.
+func awsJSONRequest(ctx context.Context, endpoint, region, service, operation string, body interface{}) (int, string, error) {
+	creds, err := loadAWSCredentials()
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	encoded, err := json.Marshal(body)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(encoded))
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", operation)
+	signAWSRequest(req, encoded, creds, region, service, time.Now())
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return resp.StatusCode, "", nil
+	}
+
+	var failure struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}
+
+	json.NewDecoder(resp.Body).Decode(&failure)
+
+	// The type may be prefixed with its namespace, as in
+	// com.amazonaws.codecommit#RepositoryDoesNotExistException.
+	if _, name, found := strings.Cut(failure.Type, "#"); found {
+		failure.Type = name
+	}
+
+	if failure.Message != "" {
+		return resp.StatusCode, failure.Type, errors.New(failure.Message)
+	}
+
+	return resp.StatusCode, failure.Type, nil
+}
+
+// awsQueryRequest calls action of an AWS query API, like CloudWatch's, at
+// endpoint with params. It returns the response's status and, for errors,
+// the error AWS gives.
+func awsQueryRequest(ctx context.Context, endpoint, region, service, action, version string, params url.Values) (int, error) {
+	creds, err := loadAWSCredentials()
+
+	if err != nil {
+		return 0, err
+	}
+
+	form := url.Values{"Action": {action}, "Version": {version}}
+
+	for name, values := range params {
+		form[name] = values
+	}
+
+	encoded := []byte(form.Encode())
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(encoded))
+
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, encoded, creds, region, service, time.Now())
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return resp.StatusCode, nil
+	}
+
+	var failure struct {
+		Code    string `xml:"Error>Code"`
+		Message string `xml:"Error>Message"`
+	}
+
+	if xml.NewDecoder(resp.Body).Decode(&failure) == nil && failure.Code != "" {
+		return resp.StatusCode, fmt.Errorf("%s: %s", failure.Code, failure.Message)
+	}
+
+	return resp.StatusCode, fmt.Errorf("%s returned %s", action, resp.Status)
+}
+
+// awsRegion is region, or else the one in $AWS_REGION or
+// $AWS_DEFAULT_REGION.
+func awsRegion(region string) string {
+	for _, candidate := range []string{region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")} {
+		if candidate != "" {
+			return candidate
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,152 @@
+package gitsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// snsNotifier publishes events as JSON to an SNS topic, so AWS automation
+// can react to mirrors being updated. url overrides the region's SNS
+// endpoint, e.g. for a VPC endpoint.
+type snsNotifier struct{}
+
+func (n snsNotifier) Check(notification Notification) error {
+	if _, err := snsRegion(notification.TopicARN); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (n snsNotifier) Events() []string {
+	return []string{eventSyncFinished}
+}
+
+func (n snsNotifier) Send(message *NotificationMessage) error {
+	region, _ := snsRegion(message.Notification.TopicARN)
+	endpoint := message.Notification.URL
+
+	if endpoint == "" {
+		endpoint = "https://sns." + region + ".amazonaws.com/"
+	}
+
+	body, err := json.Marshal(eventPayload(message))
+
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{"TopicArn": {message.Notification.TopicARN}, "Message": {string(body)}}
+
+	for i, attribute := range eventAttributes(message) {
+		entry := fmt.Sprintf("MessageAttributes.entry.%d.", i+1)
+		params.Set(entry+"Name", attribute[0])
+		params.Set(entry+"Value.DataType", "String")
+		params.Set(entry+"Value.StringValue", attribute[1])
+	}
+
+	_, err = awsQueryRequest(context.Background(), endpoint, region, "sns", "Publish", "2010-03-31", params)
+
+	return err
+}
+
+// snsRegion is the region of an SNS topic, going by its ARN,
+// arn:aws:sns:<region>:<account>:<topic>.
+func snsRegion(topicARN string) (string, error) {
+	parts := strings.Split(topicARN, ":")
+
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" || parts[3] == "" {
+		return "", errors.New("needs the topic_arn of an SNS topic")
+	}
+
+	return parts[3], nil
+}
+
+// sqsNotifier sends events as JSON to an SQS queue, so AWS automation can
+// react to mirrors being updated.
+type sqsNotifier struct{}
+
+func (n sqsNotifier) Check(notification Notification) error {
+	if _, err := sqsRegion(notification.URL); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (n sqsNotifier) Events() []string {
+	return []string{eventSyncFinished}
+}
+
+func (n sqsNotifier) Send(message *NotificationMessage) error {
+	region, _ := sqsRegion(message.Notification.URL)
+	payload := eventPayload(message)
+	body, err := json.Marshal(payload)
+
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{"MessageBody": {string(body)}}
+
+	for i, attribute := range eventAttributes(message) {
+		entry := fmt.Sprintf("MessageAttribute.%d.", i+1)
+		params.Set(entry+"Name", attribute[0])
+		params.Set(entry+"Value.DataType", "String")
+		params.Set(entry+"Value.StringValue", attribute[1])
+	}
+
+	// FIFO queues keep each sync entry's events in order, and drop
+	// duplicates of the same event of the same run.
+	if strings.HasSuffix(message.Notification.URL, ".fifo") {
+		group, dedup := "run", payload.RunID+"/"+payload.Event
+
+		if payload.Sync != nil {
+			group, dedup = payload.Sync.Source+"/"+payload.Sync.Target, dedup+"/"+payload.Sync.ID
+		}
+
+		params.Set("MessageGroupId", group)
+		params.Set("MessageDeduplicationId", dedup)
+	}
+
+	_, err = awsQueryRequest(context.Background(), message.Notification.URL, region, "sqs", "SendMessage", "2012-11-05", params)
+
+	return err
+}
+
+// sqsRegion is the region of an SQS queue, going by its URL,
+// https://sqs.<region>.amazonaws.com/<account>/<queue>, or the configured
+// region for queues reached some other way.
+func sqsRegion(queueURL string) (string, error) {
+	parsed, err := url.Parse(queueURL)
+
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return "", errors.New("needs the url of an SQS queue, https://sqs.<region>.amazonaws.com/<account>/<queue>")
+	}
+
+	if parts := strings.Split(parsed.Hostname(), "."); len(parts) >= 4 && parts[0] == "sqs" {
+		return parts[1], nil
+	}
+
+	if region := awsRegion(""); region != "" {
+		return region, nil
+	}
+
+	return "", errors.New("needs $AWS_REGION for a queue url that doesn't name its region")
+}
+
+// eventAttributes are the message attributes SNS and SQS events carry, for
+// subscriptions to filter on without reading the message.
+func eventAttributes(message *NotificationMessage) [][2]string {
+	attributes := [][2]string{{"event", message.Event}, {"status", message.Status}}
+
+	if message.Sync != nil {
+		attributes = append(attributes, [2]string{"source_remote", message.Sync.Source}, [2]string{"target_remote", message.Sync.Target})
+	}
+
+	return attributes
+}
@@ -0,0 +1,570 @@
+package gitsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// Git backends a remote's operations can be run with.
+const (
+	BackendGoGit string = "go-git"
+	BackendGit   string = "git"
+)
+
+var gsBackends = map[string]bool{
+	BackendGoGit: true,
+	BackendGit:   true,
+	BackendS3:    true,
+}
+
+// Operations whose backend can be chosen separately.
+const (
+	opPull string = "pull"
+	opPush string = "push"
+)
+
+// backend runs the operations of a sync that talk to a remote. Updating
+// branches and everything else local always goes through go-git. Fetches
+// go into repo, which is on disk at dir: the checkout, or the shared
+// objects.
+type backend interface {
+	fetch(ctx context.Context, repo *git.Repository, dir, remote string, refSpecs []config.RefSpec, progress *progressWriter) error
+	push(ctx context.Context, repo *git.Repository, remote string, refSpec config.RefSpec, progress *progressWriter) error
+	listRefs(ctx context.Context, remote string, push bool) ([]*plumbing.Reference, error)
+}
+
+// backendFor picks the backend for an operation against remote: the
+// remote's per-operation choice, then its backend, then go-git, or git when
+// memory asks for it. Remotes in object storage always use the s3 backend.
+func (s *Syncer) backendFor(remote, op string) backend {
+	if strings.HasPrefix(s.effectiveURL(remote, op == opPush), gsS3Scheme) {
+		return s3Backend{s: s}
+	}
+
+	name := BackendGoGit
+
+	if s.config.Memory != nil && s.config.Memory.GitBackend {
+		name = BackendGit
+	}
+
+	if settings, exists := s.config.Remotes[remote]; exists {
+		if settings.Backend != "" {
+			name = settings.Backend
+		}
+
+		if op == opPull && settings.PullBackend != "" {
+			name = settings.PullBackend
+		}
+
+		if op == opPush && settings.PushBackend != "" {
+			name = settings.PushBackend
+		}
+	}
+
+	switch name {
+	case BackendGit:
+		return systemGitBackend{s: s}
+	case BackendS3:
+		return s3Backend{s: s}
+	}
+
+	return goGitBackend{s: s}
+}
+
+// checkBackends validates a remote's backends, looking up the git binary the
+// first time a remote needs it.
+func (s *Syncer) checkBackends(name string, remote Remote) bool {
+	for _, backend := range []string{remote.Backend, remote.PullBackend, remote.PushBackend} {
+		if backend == "" {
+			continue
+		}
+
+		if !gsBackends[backend] {
+			errorPrintf("%s remote has an unknown backend: %s\n", name, backend)
+			return false
+		}
+
+		if backend == BackendGit && s.fs != nil {
+			errorPrintf("%s remote uses the git backend, which needs the repository on disk\n", name)
+			return false
+		}
+
+		if backend == BackendGit && s.gitBinary == "" {
+			binary, err := exec.LookPath("git")
+
+			if err != nil {
+				errorPrintf("%s remote uses the git backend, but git can't be found: %s\n", name, err)
+				return false
+			}
+
+			s.gitBinary = binary
+		}
+	}
+
+	return true
+}
+
+// goGitBackend runs operations in-process with go-git.
+type goGitBackend struct {
+	s *Syncer
+}
+
+func (b goGitBackend) fetch(ctx context.Context, repo *git.Repository, _, remote string, refSpecs []config.RefSpec, progress *progressWriter) error {
+	opts, err := b.s.fetchOptions(remote, refSpecs)
+
+	if err != nil {
+		return err
+	}
+
+	if progress != nil {
+		opts.Progress = progress
+	}
+
+	// A detached remote, because the shared objects don't have the
+	// repository's remotes configured.
+	detached := git.NewRemote(repo.Storer, &config.RemoteConfig{Name: remote, URLs: []string{b.s.effectiveURL(remote, false)}})
+	b.s.debugPrintf("fetching from %s with go-git, over protocol version 0, the only one it speaks\n", remote)
+
+	return realError(detached.FetchContext(ctx, opts))
+}
+
+func (b goGitBackend) push(ctx context.Context, repo *git.Repository, remote string, refSpec config.RefSpec, progress *progressWriter) error {
+	if err := b.s.pushURLAllowed(b.s.effectiveURL(remote, true)); err != nil {
+		return err
+	}
+
+	opts, err := b.s.pushOptions(remote, refSpec)
+
+	if err != nil {
+		return err
+	}
+
+	if progress != nil {
+		opts.Progress = progress
+	}
+
+	b.s.debugPrintf("pushing to %s with go-git, over protocol version 0, the only one it speaks\n", remote)
+
+	return realError(repo.PushContext(ctx, opts))
+}
+
+// listRefs asks a remote for its refs, like git ls-remote. The URL is
+// rewritten for fetching or pushing as appropriate, which go-git's own
+// Remote.List doesn't do.
+func (b goGitBackend) listRefs(ctx context.Context, remote string, push bool) ([]*plumbing.Reference, error) {
+	rt := b.s.remoteTransports[remote]
+	auth, err := b.s.remoteAuth(remote, push)
+
+	if err != nil {
+		return nil, err
+	}
+
+	detached := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: remote, URLs: []string{b.s.effectiveURL(remote, push)}})
+	refs, err := detached.ListContext(ctx, &git.ListOptions{
+		Auth:            auth,
+		ProxyOptions:    rt.proxy,
+		ClientCert:      rt.clientCert,
+		ClientKey:       rt.clientKey,
+		CABundle:        rt.caBundle,
+		InsecureSkipTLS: rt.insecure,
+	})
+
+	// An empty repository, such as one just created, has no refs, as git
+	// ls-remote has it.
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return nil, nil
+	}
+
+	return refs, err
+}
+
+// systemGitBackend shells out to the git binary, for servers go-git handles
+// poorly: huge packs, auth go-git doesn't speak, LFS. git's own config,
+// credential helpers and hooks apply as usual; gitsync adds the remote's
+// proxy, TLS and auth settings on top through GIT_CONFIG_* variables, so
+// credentials never show up in the process list.
+type systemGitBackend struct {
+	s *Syncer
+}
+
+func (b systemGitBackend) fetch(ctx context.Context, _ *git.Repository, dir, remote string, refSpecs []config.RefSpec, progress *progressWriter) error {
+	return b.fetchWith(ctx, dir, remote, refSpecs, progress)
+}
+
+// fetchWith runs git fetch with extra options.
+func (b systemGitBackend) fetchWith(ctx context.Context, dir, remote string, refSpecs []config.RefSpec, progress *progressWriter, extra ...string) error {
+	args := append([]string{"fetch"}, extra...)
+
+	if progress != nil {
+		args = append(args, "--progress")
+	}
+
+	args = append(args, b.s.transferArgs(remote, false)...)
+	args = append(args, b.s.effectiveURL(remote, false))
+
+	for _, refSpec := range refSpecs {
+		args = append(args, refSpec.String())
+	}
+
+	_, err := b.run(ctx, dir, remote, false, progress, args...)
+
+	return err
+}
+
+// fetchInSteps fetches refSpecs into a shallow repository, step commits of
+// history at a time from their tips, until it has all of it. Each step is
+// kept as it is fetched, so after an interruption, fetching again carries on
+// deepening the repository from where it got to.
+func (b systemGitBackend) fetchInSteps(ctx context.Context, repo *git.Repository, dir, remote string, refSpecs []config.RefSpec, progress *progressWriter, step int) error {
+	shallow, err := repo.Storer.Shallow()
+
+	if err != nil {
+		return err
+	}
+
+	option := fmt.Sprintf("--deepen=%d", step)
+
+	if len(shallow) == 0 {
+		b.s.infoPrintf("fetching %s %d commits of history at a time\n", remote, step)
+		option = fmt.Sprintf("--depth=%d", step)
+	} else {
+		b.s.infoPrintf("resuming the fetch of %s from %d shallow commits\n", remote, len(shallow))
+	}
+
+	for {
+		if err := b.fetchWith(ctx, dir, remote, refSpecs, progress, option); err != nil {
+			return err
+		}
+
+		deeper, err := repo.Storer.Shallow()
+
+		if err != nil || len(deeper) == 0 {
+			return err
+		}
+
+		// A step that didn't move the shallow commits would never end, so
+		// the rest is fetched in one go.
+		if slices.Equal(deeper, shallow) {
+			return b.fetchWith(ctx, dir, remote, refSpecs, progress, "--unshallow")
+		}
+
+		b.s.debugPrintf("fetched %d more commits of history from %s\n", step, remote)
+		shallow, option = deeper, fmt.Sprintf("--deepen=%d", step)
+	}
+}
+
+// gsBackfillBatch is how many missing objects backfill asks for per fetch,
+// keeping the command line short.
+const gsBackfillBatch = 1000
+
+// backfill fetches from source the objects of rev that a target which has
+// old doesn't have and that a partial fetch left out. Missing trees only
+// show what they hold once fetched, so it goes on until nothing is missing.
+func (b systemGitBackend) backfill(ctx context.Context, repo *git.Repository, source, rev, old string) error {
+	args := []string{"rev-list", "--objects", "--missing=print", rev}
+
+	if _, err := repo.CommitObject(plumbing.NewHash(old)); old != "" && err == nil {
+		args = append(args, "^"+old)
+	}
+
+	var previous []string
+
+	for {
+		out, err := b.run(ctx, b.s.repoDir, source, false, nil, args...)
+
+		if err != nil {
+			return err
+		}
+
+		var missing []string
+
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "?") {
+				missing = append(missing, line[1:])
+			}
+		}
+
+		if len(missing) == 0 {
+			return nil
+		}
+
+		if slices.Equal(missing, previous) {
+			return fmt.Errorf("%d objects are still missing after fetching them from %s", len(missing), source)
+		}
+
+		b.s.debugPrintf("fetching %d objects left out of %s from %s\n", len(missing), rev, source)
+
+		for batch := range slices.Chunk(missing, gsBackfillBatch) {
+			var objects []config.RefSpec
+
+			for _, object := range batch {
+				objects = append(objects, config.RefSpec(object))
+			}
+
+			if err := b.fetchWith(ctx, b.s.repoDir, source, objects, nil, "--no-tags", "--no-write-fetch-head"); err != nil {
+				return err
+			}
+		}
+
+		previous = missing
+	}
+}
+
+func (b systemGitBackend) push(ctx context.Context, _ *git.Repository, remote string, refSpec config.RefSpec, progress *progressWriter) error {
+	pushURL, err := b.pushURL(ctx, remote)
+
+	if err != nil {
+		return err
+	}
+
+	if err := b.s.pushURLAllowed(pushURL); err != nil {
+		return err
+	}
+
+	args := []string{"push"}
+
+	if progress != nil {
+		args = append(args, "--progress")
+	}
+
+	args = append(args, b.s.transferArgs(remote, true)...)
+	_, err = b.run(ctx, b.s.repoDir, remote, true, progress, append(args, b.s.effectiveURL(remote, true), refSpec.String())...)
+
+	return err
+}
+
+// pushURL is the URL git really pushes to when given a remote's URL: git
+// rewrites it again with its own insteadOf and pushInsteadOf settings,
+// which can come from system or included config gitsync doesn't read.
+func (b systemGitBackend) pushURL(ctx context.Context, remote string) (string, error) {
+	output, err := b.run(ctx, b.s.repoDir, remote, true, nil, "config", "--get-regexp", `^url\..*\.(push)?insteadof$`)
+
+	// git config exits 1 when nothing matches.
+	if exitErr := (*exec.ExitError)(nil); errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		err = nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	var rules urlRules
+
+	for _, line := range strings.Split(string(output), "\n") {
+		key, prefix, found := strings.Cut(line, " ")
+		dot := strings.LastIndex(key, ".")
+
+		if !found || dot < len("url.") {
+			continue
+		}
+
+		rules = append(rules, urlRule{base: key[len("url."):dot], prefix: prefix, push: key[dot+1:] == "pushinsteadof"})
+	}
+
+	return rules.rewrite(b.s.effectiveURL(remote, true), true), nil
+}
+
+func (b systemGitBackend) listRefs(ctx context.Context, remote string, push bool) ([]*plumbing.Reference, error) {
+	output, err := b.run(ctx, b.s.repoDir, remote, push, nil, "ls-remote", b.s.effectiveURL(remote, push))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []*plumbing.Reference
+
+	for _, line := range strings.Split(string(output), "\n") {
+		sha, name, found := strings.Cut(line, "\t")
+
+		if !found || !plumbing.IsHash(sha) {
+			continue
+		}
+
+		refs = append(refs, plumbing.NewHashReference(plumbing.ReferenceName(name), plumbing.NewHash(sha)))
+	}
+
+	return refs, nil
+}
+
+func (b systemGitBackend) run(ctx context.Context, dir, remote string, push bool, progress *progressWriter, args ...string) ([]byte, error) {
+	settings, err := b.configFor(remote, push)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := commandContext(ctx, b.s.gitBinary, append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(settings)))
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if progress != nil {
+		cmd.Stderr = io.MultiWriter(&stderr, progress)
+	}
+
+	for i, setting := range settings {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, setting[0]), fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, setting[1]))
+	}
+
+	b.s.debugPrintf("running git %s\n", strings.Join(args, " "))
+
+	// git's trace2 events say which protocol version it negotiated with the
+	// server, which is worth knowing when a server misbehaves on one.
+	if LogEnabled(LevelDebug) {
+		if trace, err := os.CreateTemp("", "gitsync-trace2-"); err == nil {
+			trace.Close()
+			defer func() {
+				if version := negotiatedVersion(trace.Name()); version != "" {
+					b.s.debugPrintf("git %s with %s negotiated protocol version %s\n", args[0], remote, version)
+				}
+
+				os.Remove(trace.Name())
+			}()
+
+			cmd.Env = append(cmd.Env, "GIT_TRACE2_EVENT="+trace.Name())
+		}
+	}
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, lastLine(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// negotiatedVersion finds the protocol version git negotiated in a file of
+// its trace2 events, or "" if it didn't talk to a server.
+func negotiatedVersion(trace string) string {
+	content, err := os.ReadFile(trace)
+
+	if err != nil {
+		return ""
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		var event struct {
+			Event string `json:"event"`
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		}
+
+		if json.Unmarshal([]byte(line), &event) == nil && event.Event == "data" && event.Key == "negotiated-version" {
+			return event.Value
+		}
+	}
+
+	return ""
+}
+
+// configFor translates a remote's transfer, proxy, TLS and auth settings
+// into git config for one command.
+func (b systemGitBackend) configFor(remote string, push bool) ([][2]string, error) {
+	settings := b.s.transferConfig(remote, push)
+
+	if sshCommand := b.s.sshCommand(remote, push); sshCommand != "" {
+		settings = append(settings, [2]string{"core.sshCommand", sshCommand})
+	}
+
+	rt := b.s.remoteTransports[remote]
+
+	if rt.proxy.URL != "" {
+		proxyURL, err := url.Parse(rt.proxy.URL)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if rt.proxy.Username != "" {
+			proxyURL.User = url.UserPassword(rt.proxy.Username, rt.proxy.Password)
+		}
+
+		settings = append(settings, [2]string{"http.proxy", proxyURL.String()})
+	}
+
+	if tlsSettings := b.s.config.Remotes[remote].TLS; tlsSettings != nil {
+		if tlsSettings.CABundle != "" {
+			settings = append(settings, [2]string{"http.sslCAInfo", tlsSettings.CABundle})
+		}
+
+		if tlsSettings.ClientCert != "" {
+			settings = append(settings, [2]string{"http.sslCert", tlsSettings.ClientCert}, [2]string{"http.sslKey", tlsSettings.ClientKey})
+		}
+
+		if tlsSettings.InsecureSkipVerify {
+			settings = append(settings, [2]string{"http.sslVerify", "false"})
+		}
+	}
+
+	auth, err := b.s.remoteAuth(remote, push)
+
+	if err != nil || auth == nil {
+		return settings, err
+	}
+
+	header, err := authorizationHeader(auth, b.s.effectiveURL(remote, push))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append(settings, [2]string{"http.extraHeader", "Authorization: " + header}), nil
+}
+
+// authorizationHeader renders an HTTP auth method as the Authorization
+// header it would send to remoteURL.
+func authorizationHeader(auth transport.AuthMethod, remoteURL string) (string, error) {
+	httpAuth, ok := auth.(interface{ SetAuth(*http.Request) })
+
+	if !ok {
+		return "", fmt.Errorf("%s auth isn't supported by the git backend", auth.Name())
+	}
+
+	req, err := http.NewRequest(http.MethodGet, remoteURL, nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	httpAuth.SetAuth(req)
+	header := req.Header.Get("Authorization")
+
+	if header == "" {
+		return "", fmt.Errorf("%s auth produced no credentials", auth.Name())
+	}
+
+	return header, nil
+}
+
+func lastLine(text string) string {
+	lines := strings.FieldsFunc(text, func(r rune) bool { return r == '\r' || r == '\n' })
+
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(lines[i]); line != "" {
+			return line
+		}
+	}
+
+	return "no output"
+}
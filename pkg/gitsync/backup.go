@@ -0,0 +1,44 @@
+package gitsync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// gsBackupPrefix is where old tips are kept on the target before a
+// destructive update, under the time of the update and the branch.
+const gsBackupPrefix string = "refs/gitsync/backup/"
+
+// gsBackupTimeFormat goes down to the microsecond, so backups of a ref
+// made moments apart, like that of a force push and of rolling it back,
+// don't clash.
+const gsBackupTimeFormat string = "20060102T150405.000000Z"
+
+// backupRef pushes oldSHA, what ref on target pointed at before a force
+// push, to refs/gitsync/backup/<timestamp>/<branch> on the target, so the
+// update can be undone. The old tip is fetched from the target first if the
+// repository doesn't have it. It returns the backup ref.
+func (s *Syncer) backupRef(ctx context.Context, repo *git.Repository, target string, ref plumbing.ReferenceName, oldSHA string) (plumbing.ReferenceName, error) {
+	backup := plumbing.ReferenceName(gsBackupPrefix + time.Now().UTC().Format(gsBackupTimeFormat) + "/" + ref.Short())
+
+	if _, err := repo.CommitObject(plumbing.NewHash(oldSHA)); err != nil {
+		if err := s.backendFor(target, opPull).fetch(ctx, repo, s.repoDir, target, []config.RefSpec{config.RefSpec("+" + ref.String() + ":" + backup.String())}, nil); err != nil {
+			return backup, fmt.Errorf("could not fetch %s from %s to back it up: %w", ref.Short(), target, err)
+		}
+	}
+
+	if err := s.pushTo(ctx, repo, target, config.RefSpec(oldSHA+":"+backup.String()), nil); err != nil {
+		return backup, fmt.Errorf("could not back up %s on %s: %w", ref.Short(), target, err)
+	}
+
+	s.pushedRemoteRef(target, backup, oldSHA)
+
+	s.infoPrintf("backed up %s of %s on %s as %s\n", ShortSHA(oldSHA), ref.Short(), target, backup)
+
+	return backup, nil
+}
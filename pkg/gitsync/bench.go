@@ -0,0 +1,380 @@
+package gitsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Phases of a sync Bench measures.
+const (
+	BenchPlan  string = "plan"
+	BenchFetch string = "fetch"
+	BenchPush  string = "push"
+)
+
+// gsBenchPrefix is where Bench pushes its synthetic branches on the
+// targets. They are deleted again once measured.
+const gsBenchPrefix string = "refs/gitsync/bench/"
+
+// gsDefaultBenchRounds is how many times Bench measures each phase unless
+// BenchOptions says otherwise.
+const gsDefaultBenchRounds = 3
+
+// BenchOptions says how Bench measures.
+type BenchOptions struct {
+	// Rounds is how many times each phase is measured, defaulting to 3.
+	Rounds int
+	// SyntheticBranches is how many branches are pushed to each target a
+	// round, defaulting to one for each branch synced to it. Each is a new
+	// commit on top of a synced branch, pushed under refs/gitsync/bench/ so
+	// the branches themselves are never touched.
+	SyntheticBranches int
+}
+
+// BenchResult is how long a phase took against one remote in each round.
+// Remote is empty for the whole fetch phase, whose sources are fetched
+// concurrently.
+type BenchResult struct {
+	Phase     string
+	Remote    string
+	Refs      int
+	Durations []time.Duration
+	Err       error
+}
+
+// Min is the quickest round.
+func (b *BenchResult) Min() time.Duration {
+	if len(b.Durations) == 0 {
+		return 0
+	}
+
+	return slices.Min(b.Durations)
+}
+
+// Max is the slowest round.
+func (b *BenchResult) Max() time.Duration {
+	if len(b.Durations) == 0 {
+		return 0
+	}
+
+	return slices.Max(b.Durations)
+}
+
+// Mean is the average round.
+func (b *BenchResult) Mean() time.Duration {
+	var total time.Duration
+
+	for _, duration := range b.Durations {
+		total += duration
+	}
+
+	return total / time.Duration(max(len(b.Durations), 1))
+}
+
+// BenchReport is what Bench measured.
+type BenchReport struct {
+	Rounds         int
+	FetchesPerHost int
+	Results        []*BenchResult
+}
+
+type reportBench struct {
+	Phase  string  `json:"phase"`
+	Remote string  `json:"remote,omitempty"`
+	Refs   int     `json:"refs"`
+	Rounds []int64 `json:"rounds_ms"`
+	MinMs  int64   `json:"min_ms"`
+	MeanMs int64   `json:"mean_ms"`
+	MaxMs  int64   `json:"max_ms"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// WriteJSON writes the report as JSON to w.
+func (r *BenchReport) WriteJSON(w io.Writer) error {
+	results := []reportBench{}
+
+	for _, result := range r.Results {
+		var rounds []int64
+
+		for _, duration := range result.Durations {
+			rounds = append(rounds, duration.Milliseconds())
+		}
+
+		results = append(results, reportBench{
+			Phase:  result.Phase,
+			Remote: result.Remote,
+			Refs:   result.Refs,
+			Rounds: rounds,
+			MinMs:  result.Min().Milliseconds(),
+			MeanMs: result.Mean().Milliseconds(),
+			MaxMs:  result.Max().Milliseconds(),
+			Error:  errorString(result.Err),
+		})
+	}
+
+	report, err := json.MarshalIndent(map[string]interface{}{
+		"version":          Version,
+		"rounds":           r.Rounds,
+		"fetches_per_host": r.FetchesPerHost,
+		"results":          results,
+	}, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(report, '\n'))
+
+	return err
+}
+
+// Bench measures the phases of a sync against the configured remotes, to
+// tune settings such as the fetches per host: listing every source's and
+// target's refs, which sync plans are made from, fetching every source, and
+// pushing synthetic branches to every target. The first round's fetches
+// bring in what is new on the sources; later rounds measure how long it
+// takes to find there is nothing new. Branches are fetched as a run would,
+// but nothing configured is pushed. An error is returned when the
+// repository can't be read or ctx is cancelled; a remote that fails only
+// fails its results.
+func (s *Syncer) Bench(ctx context.Context, options BenchOptions) (*BenchReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.collectRepoInfo(); err != nil {
+		return nil, err
+	}
+
+	defer s.closeSSHConnections()
+
+	if options.Rounds <= 0 {
+		options.Rounds = gsDefaultBenchRounds
+	}
+
+	// Benchmarks aren't runs, so failures are only logged, not handed to
+	// metrics, hooks, notifications or error tracking.
+	subscribers := s.subscribers
+	s.subscribers = []func(Event){s.logEvent}
+	defer func() { s.subscribers = subscribers }()
+
+	report := &BenchReport{Rounds: options.Rounds, FetchesPerHost: s.fetchesPerHost}
+	results := map[string]*BenchResult{}
+
+	result := func(phase, remote string) *BenchResult {
+		if results[phase+"\x00"+remote] == nil {
+			results[phase+"\x00"+remote] = &BenchResult{Phase: phase, Remote: remote}
+			report.Results = append(report.Results, results[phase+"\x00"+remote])
+		}
+
+		return results[phase+"\x00"+remote]
+	}
+
+	for round := 1; round <= options.Rounds; round++ {
+		s.run = &RunResult{ID: randomHex(8), Repository: s.repoDir, ConfigChecksum: s.configChecksum, Started: time.Now()}
+		s.infoPrintf("bench round %d of %d\n", round, options.Rounds)
+
+		s.benchPlan(ctx, result)
+		s.benchFetch(ctx, result)
+		s.benchPush(ctx, options.SyntheticBranches, result)
+
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// benchPlan lists every source's and target's refs in turn, keeping them
+// for the fetches as the preflight check would.
+func (s *Syncer) benchPlan(ctx context.Context, result func(phase, remote string) *BenchResult) {
+	s.remoteRefs = map[preflightCheck]map[plumbing.ReferenceName]plumbing.Hash{}
+	s.unchanged = nil
+	sources := map[string]bool{}
+
+	for _, entry := range s.config.Sync {
+		sources[entry.Source] = true
+	}
+
+	for _, entry := range s.config.Sync {
+		for _, check := range []preflightCheck{{entry.Source, false}, {entry.Target, true}} {
+			if _, listed := s.remoteRefs[check]; listed || !s.remoteExists(check.remote) || ctx.Err() != nil {
+				continue
+			}
+
+			// A remote that is a source and a target is listed for each.
+			name := check.remote
+
+			if check.push && sources[check.remote] {
+				name += " (push)"
+			}
+
+			plan := result(BenchPlan, name)
+
+			if plan.Err != nil {
+				continue
+			}
+
+			started := time.Now()
+			refs, err := s.listRemoteRefs(ctx, check.remote, check.push)
+
+			if err != nil {
+				plan.Err = err
+				continue
+			}
+
+			plan.Durations = append(plan.Durations, time.Since(started))
+			plan.Refs = len(refs)
+			s.remoteRefs[check] = map[plumbing.ReferenceName]plumbing.Hash{}
+
+			for _, ref := range refs {
+				s.remoteRefs[check][ref.Name()] = ref.Hash()
+			}
+		}
+	}
+}
+
+// benchFetch fetches every source as a run would.
+func (s *Syncer) benchFetch(ctx context.Context, result func(phase, remote string) *BenchResult) {
+	started := time.Now()
+	s.fetchSources(ctx, nil)
+	all := result(BenchFetch, "")
+	all.Refs = 0
+
+	for _, fetch := range s.run.Fetches {
+		source := result(BenchFetch, fetch.Remote)
+		source.Refs = len(fetch.Branches)
+
+		if fetch.Err != nil {
+			source.Err = fetch.Err
+			all.Err = errors.New("not every source could be fetched")
+			continue
+		}
+
+		source.Durations = append(source.Durations, fetch.Duration)
+		all.Refs += len(fetch.Branches)
+	}
+
+	all.Durations = append(all.Durations, time.Since(started))
+}
+
+// benchPush pushes synthetic branches to every target under
+// refs/gitsync/bench/, one push per branch as a run makes them, then
+// deletes them again.
+func (s *Syncer) benchPush(ctx context.Context, branches int, result func(phase, remote string) *BenchResult) {
+	repo, err := s.openRepo()
+	targets := map[string][]plumbing.ReferenceName{}
+	var order []string
+
+	for _, entry := range s.config.Sync {
+		if _, seen := targets[entry.Target]; !seen {
+			order = append(order, entry.Target)
+			targets[entry.Target] = []plumbing.ReferenceName{}
+		}
+
+		for _, branch := range entry.Branches {
+			if s.branchExists(branch) {
+				targets[entry.Target] = append(targets[entry.Target], plumbing.NewBranchReferenceName(branch))
+			}
+		}
+	}
+
+	for _, target := range order {
+		push := result(BenchPush, target)
+
+		switch {
+		case ctx.Err() != nil || !s.remoteExists(target):
+			continue
+		case err != nil:
+			push.Err = err
+			continue
+		case len(targets[target]) == 0:
+			push.Err = errors.New("no branch synced to it exists to build synthetic branches on")
+			continue
+		}
+
+		if err := s.pushURLAllowed(s.effectiveURL(target, true)); err != nil {
+			push.Err = err
+			continue
+		}
+
+		count := branches
+
+		if count <= 0 {
+			count = len(targets[target])
+		}
+
+		push.Refs = count
+		started := time.Now()
+		var pushed []plumbing.ReferenceName
+
+		for i := 0; i < count && push.Err == nil; i++ {
+			base := targets[target][i%len(targets[target])]
+			ref := plumbing.ReferenceName(fmt.Sprintf("%s%s/%d", gsBenchPrefix, s.run.ID, i))
+			commit, err := syntheticCommit(repo, base)
+
+			if err == nil {
+				err = s.pushTo(ctx, repo, target, config.RefSpec(commit.String()+":"+ref.String()), nil)
+			}
+
+			if err != nil {
+				push.Err = fmt.Errorf("could not push %s: %w", ref, err)
+				continue
+			}
+
+			pushed = append(pushed, ref)
+		}
+
+		if push.Err == nil {
+			push.Durations = append(push.Durations, time.Since(started))
+		}
+
+		for _, ref := range pushed {
+			if err := s.pushTo(context.WithoutCancel(ctx), repo, target, config.RefSpec(":"+ref.String()), nil); err != nil {
+				s.warnPrintf("could not delete %s from %s: %s\n", ref, target, err)
+			}
+		}
+	}
+}
+
+// syntheticCommit writes a new commit on top of branch, with the same
+// tree, for Bench to push.
+func syntheticCommit(repo *git.Repository, branch plumbing.ReferenceName) (plumbing.Hash, error) {
+	tip, err := repo.Reference(branch, true)
+
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	parent, err := repo.CommitObject(tip.Hash())
+
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	signature := object.Signature{Name: "gitsync", Email: "gitsync@localhost", When: time.Now()}
+	commit := &object.Commit{
+		Author:       signature,
+		Committer:    signature,
+		Message:      "gitsync bench " + randomHex(8) + "\n",
+		TreeHash:     parent.TreeHash,
+		ParentHashes: []plumbing.Hash{parent.Hash},
+	}
+	encoded := repo.Storer.NewEncodedObject()
+
+	if err := commit.Encode(encoded); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return repo.Storer.SetEncodedObject(encoded)
+}
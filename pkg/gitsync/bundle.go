@@ -0,0 +1,594 @@
+package gitsync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// gsBundlesFile is where the tips last bundled for each sync entry are
+// kept, in the repository's git directory, so the next bundle only carries
+// what is new since.
+const gsBundlesFile string = "gitsync/bundles.json"
+
+const gsBundleHeader string = "# v2 git bundle"
+const gsBundleSuffix string = ".bundle"
+
+// gsBundleTimeFormat starts bundle file names, so they sort in the order
+// they were created.
+const gsBundleTimeFormat string = "20060102T150405Z"
+
+// BundleResult is a bundle CreateBundles wrote for a sync entry.
+type BundleResult struct {
+	Source   string
+	Target   string
+	Path     string
+	Branches []string
+	// Prerequisites are the commits the bundle needs the applying side to
+	// have already, those of the last bundle for the entry. A bundle with
+	// none carries every branch's whole history.
+	Prerequisites []string
+	Objects       int
+}
+
+// bundleState is what CreateBundles remembers between runs.
+type bundleState struct {
+	Entries []bundleEntry `json:"entries"`
+}
+
+type bundleEntry struct {
+	Source  string            `json:"source_remote"`
+	Target  string            `json:"target_remote"`
+	Tips    map[string]string `json:"tips"`
+	Created time.Time         `json:"created"`
+}
+
+// bundleKey is what a sync entry's bundles are kept under.
+func bundleKey(source, target string) string {
+	return source + "\x00" + target
+}
+
+// bundleName is the end of the file names of bundles for source to target.
+func bundleName(source, target string) string {
+	return "--" + url.PathEscape(source) + "--" + url.PathEscape(target) + gsBundleSuffix
+}
+
+// CreateBundles writes a git bundle into dir for every sync entry whose
+// source has moved since its last bundle, with the commits the entry's
+// branches gained since then, so they can be carried across an air gap and
+// handed to ApplyBundles. Only sources are contacted: they are fetched as a
+// run would, and the fetched tips are remembered once bundled. Like Plan,
+// an error is returned when a source can't be listed or fetched.
+func (s *Syncer) CreateBundles(ctx context.Context, dir string) ([]*BundleResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.collectRepoInfo(); err != nil {
+		return nil, err
+	}
+
+	defer s.closeSSHConnections()
+
+	// Bundling isn't a run, so failures are only logged.
+	subscribers := s.subscribers
+	s.subscribers = []func(Event){s.logEvent}
+	defer func() { s.subscribers = subscribers }()
+
+	if err := s.fetchForExport(ctx); err != nil {
+		return nil, err
+	}
+
+	repo, err := s.openRepo()
+
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := s.loadBundleState()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries with the same source and target share their bundles.
+	var keys []string
+	branches := map[string][]string{}
+
+	for _, sync := range s.config.Sync {
+		key := bundleKey(sync.Source, sync.Target)
+
+		if _, exists := branches[key]; !exists {
+			keys = append(keys, key)
+		}
+
+		branches[key] = append(branches[key], sync.Branches...)
+	}
+
+	created := time.Now().UTC()
+	var results []*BundleResult
+
+	for _, key := range keys {
+		source, target, _ := strings.Cut(key, "\x00")
+		tips := map[string]string{}
+
+		for _, branch := range branches[key] {
+			fetched, err := repo.Reference(trackingRef(source, branch), true)
+
+			if err != nil || !s.fetched[source].has(branch) {
+				s.warnPrintf("%s isn't on %s, leaving it out of the bundle for %s\n", branch, source, target)
+				continue
+			}
+
+			tips[branch] = fetched.Hash().String()
+		}
+
+		last := state[key]
+
+		if len(tips) == 0 || (last != nil && sameTips(last.Tips, tips)) {
+			s.infoPrintf("nothing new to bundle from %s to %s\n", source, target)
+			continue
+		}
+
+		path := filepath.Join(dir, created.Format(gsBundleTimeFormat)+bundleName(source, target))
+		result := &BundleResult{Source: source, Target: target, Path: path}
+
+		if last != nil {
+			for _, sha := range last.Tips {
+				// A commit the source has since dropped, and gc has
+				// pruned, can't be left out, so everything is sent.
+				if _, err := repo.CommitObject(plumbing.NewHash(sha)); err == nil && !slices.Contains(result.Prerequisites, sha) {
+					result.Prerequisites = append(result.Prerequisites, sha)
+				}
+			}
+
+			sort.Strings(result.Prerequisites)
+		}
+
+		if err := writeBundle(repo, path, tips, result); err != nil {
+			return results, fmt.Errorf("could not bundle %s to %s: %w", source, target, err)
+		}
+
+		state[key] = &bundleEntry{Source: source, Target: target, Tips: tips, Created: created}
+
+		if err := s.saveBundleState(state); err != nil {
+			return results, fmt.Errorf("wrote %s but could not remember what it carries: %w", path, err)
+		}
+
+		s.infoPrintf("bundled %d branches from %s to %s into %s, %d objects\n", len(result.Branches), source, target, path, result.Objects)
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// fetchForExport fetches every source as a run would, for their branches
+// to be written out for the other side of an air gap, without contacting
+// any target. Like Plan, it fails if a source can't be listed or fetched.
+func (s *Syncer) fetchForExport(ctx context.Context) error {
+	s.run = &RunResult{ID: randomHex(8), Repository: s.repoDir, ConfigChecksum: s.configChecksum, Started: time.Now()}
+	s.unchanged = nil
+
+	var checks []preflightCheck
+	seen := map[preflightCheck]bool{}
+
+	for _, entry := range s.config.Sync {
+		check := preflightCheck{entry.Source, false}
+
+		switch {
+		case seen[check]:
+			continue
+		case !s.remoteExists(check.remote):
+			return fmt.Errorf("%s remote doesn't exist", check.remote)
+		}
+
+		seen[check] = true
+		checks = append(checks, check)
+	}
+
+	heads, failed := s.listHeads(ctx, checks)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.remoteRefs = map[preflightCheck]map[plumbing.ReferenceName]plumbing.Hash{}
+
+	for _, check := range checks {
+		if err := failed[check]; err != nil {
+			return fmt.Errorf("%s remote can't be reached for %s: %w", check.remote, check.operation(), err)
+		}
+
+		s.remoteRefs[check] = map[plumbing.ReferenceName]plumbing.Hash{}
+
+		for name, sha := range heads[check] {
+			s.remoteRefs[check][name] = plumbing.NewHash(sha)
+		}
+	}
+
+	s.fetchSources(ctx, nil)
+
+	for _, fetch := range s.run.Fetches {
+		if fetch.Err != nil {
+			return fmt.Errorf("could not fetch %s: %w", fetch.Remote, fetch.Err)
+		}
+	}
+
+	return nil
+}
+
+// writeBundle writes a v2 git bundle of tips to path, leaving out what
+// result's prerequisites already have, and fills in the rest of result.
+// The bundle can also be read by git itself, e.g. with git fetch.
+func writeBundle(repo *git.Repository, path string, tips map[string]string, result *BundleResult) error {
+	var wants, prerequisites []plumbing.Hash
+
+	for branch, sha := range tips {
+		result.Branches = append(result.Branches, branch)
+		wants = append(wants, plumbing.NewHash(sha))
+	}
+
+	sort.Strings(result.Branches)
+
+	for _, sha := range result.Prerequisites {
+		prerequisites = append(prerequisites, plumbing.NewHash(sha))
+	}
+
+	objects, err := revlist.Objects(repo.Storer, wants, prerequisites)
+
+	if err != nil {
+		return err
+	}
+
+	result.Objects = len(objects)
+	f, err := os.Create(path + ".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(path + ".tmp")
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, gsBundleHeader)
+
+	for _, sha := range result.Prerequisites {
+		subject := ""
+
+		if commit, err := repo.CommitObject(plumbing.NewHash(sha)); err == nil {
+			subject, _, _ = strings.Cut(commit.Message, "\n")
+		}
+
+		fmt.Fprintf(w, "-%s %s\n", sha, subject)
+	}
+
+	for _, branch := range result.Branches {
+		fmt.Fprintf(w, "%s %s\n", tips[branch], plumbing.NewBranchReferenceName(branch))
+	}
+
+	fmt.Fprintln(w)
+
+	_, err = packfile.NewEncoder(w, repo.Storer, false).Encode(objects, 10)
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// ApplyBundles syncs what bundles written by CreateBundles carry, as Run
+// would have synced it from their sources, pushing to the targets. Only the
+// sync entries there are bundles for are synced, and their sources aren't
+// contacted. Bundles are applied oldest first, and one whose prerequisites
+// the repository doesn't have fails its source until the bundle before it
+// is applied. An error, with no result, is returned for a file that isn't
+// named like a bundle of any sync entry.
+func (s *Syncer) ApplyBundles(ctx context.Context, paths []string) (*RunResult, error) {
+	bundles := map[string][]string{}
+
+	for _, path := range paths {
+		base := filepath.Base(path)
+		matched := false
+
+		for _, sync := range s.config.Sync {
+			key := bundleKey(sync.Source, sync.Target)
+			name := bundleName(sync.Source, sync.Target)
+
+			if strings.HasSuffix(base, name) && len(base) > len(name) && !slices.Contains(bundles[key], path) {
+				bundles[key] = append(bundles[key], path)
+				matched = true
+			}
+		}
+
+		if !matched {
+			return nil, fmt.Errorf("%s isn't a bundle of any sync entry", path)
+		}
+	}
+
+	return s.syncOnce(ctx, nil, bundles, nil)
+}
+
+// unbundle reads the run's bundles into the repository in place of
+// fetching their sources, pointing each source's tracking refs at the
+// branches the bundles carry. A source's bundles, from all its sync
+// entries, are read oldest first, so its newest tips win.
+func (s *Syncer) unbundle(runSpan *span) {
+	var sources []string
+	paths := map[string][]string{}
+
+	for _, sync := range s.config.Sync {
+		for _, path := range s.bundles[bundleKey(sync.Source, sync.Target)] {
+			if _, exists := paths[sync.Source]; !exists {
+				sources = append(sources, sync.Source)
+			}
+
+			if !slices.Contains(paths[sync.Source], path) {
+				paths[sync.Source] = append(paths[sync.Source], path)
+			}
+		}
+	}
+
+	s.fetched = map[string]*FetchResult{}
+	repo, err := s.openRepo()
+
+	for _, source := range sources {
+		check := preflightCheck{source, false}
+		result := &FetchResult{Remote: source, Err: err}
+		s.fetched[source] = result
+		s.run.Fetches = append(s.run.Fetches, result)
+		s.remoteRefs[check] = map[plumbing.ReferenceName]plumbing.Hash{}
+
+		sort.Slice(paths[source], func(i, j int) bool {
+			return filepath.Base(paths[source][i]) < filepath.Base(paths[source][j])
+		})
+
+		started := time.Now()
+		unbundleSpan := s.tracer.start(runSpan, "unbundle", "remote", source, "bundles", fmt.Sprint(len(paths[source])))
+
+		for _, path := range paths[source] {
+			if result.Err != nil {
+				break
+			}
+
+			var heads map[string]plumbing.Hash
+			var size int64
+
+			if heads, size, result.Err = readBundle(repo, path); result.Err != nil {
+				result.Err = fmt.Errorf("could not apply %s: %w", path, result.Err)
+				break
+			}
+
+			result.BytesReceived += size
+
+			for branch, hash := range heads {
+				if result.Err = repo.Storer.SetReference(plumbing.NewHashReference(trackingRef(source, branch), hash)); result.Err != nil {
+					break
+				}
+
+				s.remoteRefs[check][plumbing.NewBranchReferenceName(branch)] = hash
+
+				if !result.has(branch) {
+					result.Branches = append(result.Branches, branch)
+				}
+			}
+
+			s.debugPrintf("applied %s, %d branches from %s\n", path, len(heads), source)
+		}
+
+		result.Duration = time.Since(started)
+		unbundleSpan.finish(result.Err)
+
+		if result.Err != nil {
+			s.publish(Event{Type: EventError, Err: result.Err, span: unbundleSpan})
+		}
+	}
+}
+
+// readBundle adds the objects of the v2 git bundle at path to repo,
+// returning the branches it carries and its size. Other refs in it are
+// ignored. Only objects repo doesn't have are added, and loose, rather than
+// adding the bundle's pack: bundles of entries sharing a source overlap,
+// and go-git can delta two objects in overlapping packs on each other and
+// never finish packing them for a push.
+func readBundle(repo *git.Repository, path string) (map[string]plumbing.Hash, int64, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r := bufio.NewReader(f)
+	heads := map[string]plumbing.Hash{}
+
+	for first := true; ; first = false {
+		line, err := r.ReadString('\n')
+
+		if err != nil {
+			return nil, 0, fmt.Errorf("isn't a git bundle: %w", err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case first && line != gsBundleHeader:
+			return nil, 0, errors.New("isn't a v2 git bundle")
+		case first:
+			continue
+		case line == "":
+			parser, err := packfile.NewParserWithStorage(packfile.NewScanner(r), missingObjects{repo.Storer})
+
+			if err == nil {
+				_, err = parser.Parse()
+			}
+
+			if err != nil {
+				return nil, 0, err
+			}
+
+			return heads, info.Size(), nil
+		case strings.HasPrefix(line, "-"):
+			sha, _, _ := strings.Cut(line[1:], " ")
+
+			if err := repo.Storer.HasEncodedObject(plumbing.NewHash(sha)); err != nil {
+				return nil, 0, fmt.Errorf("needs %s, from an earlier bundle, which hasn't been applied", ShortSHA(sha))
+			}
+		default:
+			sha, ref, _ := strings.Cut(line, " ")
+
+			if name := plumbing.ReferenceName(ref); name.IsBranch() {
+				heads[name.Short()] = plumbing.NewHash(sha)
+			}
+		}
+	}
+}
+
+// missingObjects is an object storer that only stores objects it doesn't
+// already have.
+type missingObjects struct {
+	storer.EncodedObjectStorer
+}
+
+func (m missingObjects) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	if m.HasEncodedObject(obj.Hash()) == nil {
+		return obj.Hash(), nil
+	}
+
+	return m.EncodedObjectStorer.SetEncodedObject(obj)
+}
+
+// offline reports whether the run applies bundles or patch series rather
+// than fetching the sources.
+func (s *Syncer) offline() bool {
+	return s.bundles != nil || s.patches != nil
+}
+
+// carriedBranches are the branches of sync a run applying bundles or patch
+// series has commits for: all of them if there are bundles for the entry,
+// or those with patch series. Any other run syncs all of them.
+func (s *Syncer) carriedBranches(sync SyncEntry) []string {
+	switch {
+	case !s.offline():
+		return sync.Branches
+	case s.bundles != nil && len(s.bundles[bundleKey(sync.Source, sync.Target)]) > 0:
+		return sync.Branches
+	}
+
+	var branches []string
+
+	for _, branch := range sync.Branches {
+		if len(s.patches[patchKey(sync.Source, branch)]) > 0 {
+			branches = append(branches, branch)
+		}
+	}
+
+	return branches
+}
+
+func (s *Syncer) loadBundleState() (map[string]*bundleEntry, error) {
+	dotGit, err := s.dotGit()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var state bundleState
+	data, err := util.ReadFile(dotGit, gsBundlesFile)
+
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read what was last bundled: %w", err)
+	}
+
+	entries := map[string]*bundleEntry{}
+
+	for i := range state.Entries {
+		entries[bundleKey(state.Entries[i].Source, state.Entries[i].Target)] = &state.Entries[i]
+	}
+
+	return entries, nil
+}
+
+// saveBundleState writes entries, keeping those of sync entries no longer
+// configured, in case they come back.
+func (s *Syncer) saveBundleState(entries map[string]*bundleEntry) error {
+	dotGit, err := s.dotGit()
+
+	if err != nil {
+		return err
+	}
+
+	state := bundleState{Entries: []bundleEntry{}}
+
+	for _, entry := range entries {
+		state.Entries = append(state.Entries, *entry)
+	}
+
+	sort.Slice(state.Entries, func(i, j int) bool {
+		return bundleKey(state.Entries[i].Source, state.Entries[i].Target) < bundleKey(state.Entries[j].Source, state.Entries[j].Target)
+	})
+
+	data, err := json.MarshalIndent(state, "", "  ")
+
+	if err == nil {
+		err = util.WriteFile(dotGit, gsBundlesFile+".tmp", append(data, '\n'), 0o644)
+	}
+
+	if err == nil {
+		err = dotGit.Rename(gsBundlesFile+".tmp", gsBundlesFile)
+	}
+
+	return err
+}
+
+func sameTips(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for branch, sha := range a {
+		if b[branch] != sha {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,159 @@
+package gitsync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// States of a branch reported by Check.
+const (
+	DriftInSync  string = "in sync"
+	DriftStale   string = "stale"
+	DriftMissing string = "missing"
+	DriftError   string = "error"
+)
+
+// Drift is how a branch on the target compares to the source.
+type Drift struct {
+	Source    string
+	Target    string
+	Branch    string
+	State     string
+	SourceSHA string
+	TargetSHA string
+	Err       error
+}
+
+// listHeads lists every remote of checks at once, keyed by ref name, so a
+// check of many remotes takes about as long as the slowest of them.
+func (s *Syncer) listHeads(ctx context.Context, checks []preflightCheck) (map[preflightCheck]map[plumbing.ReferenceName]string, map[preflightCheck]error) {
+	heads := make([]map[plumbing.ReferenceName]string, len(checks))
+	errs := make([]error, len(checks))
+
+	var wg sync.WaitGroup
+
+	for i, check := range checks {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			refs, err := s.listRemoteRefs(ctx, check.remote, check.push)
+
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			heads[i] = map[plumbing.ReferenceName]string{}
+
+			for _, ref := range refs {
+				if ref.Type() == plumbing.HashReference {
+					heads[i][ref.Name()] = ref.Hash().String()
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	listed := map[preflightCheck]map[plumbing.ReferenceName]string{}
+	failed := map[preflightCheck]error{}
+
+	for i, check := range checks {
+		if errs[i] != nil {
+			failed[check] = errs[i]
+		} else {
+			listed[check] = heads[i]
+		}
+	}
+
+	return listed, failed
+}
+
+// Check compares every configured branch on the source and target remotes
+// without changing anything, returning the drift of each branch. A remote
+// that can't be listed only puts its branches in the DriftError state; an
+// error is returned when the repository itself can't be read or ctx is
+// cancelled.
+func (s *Syncer) Check(ctx context.Context) ([]*Drift, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.collectRepoInfo(); err != nil {
+		return nil, err
+	}
+
+	defer s.closeSSHConnections()
+
+	var checks []preflightCheck
+	seen := map[preflightCheck]bool{}
+
+	for _, entry := range s.config.Sync {
+		for _, check := range []preflightCheck{{entry.Source, false}, {entry.Target, true}} {
+			if !seen[check] && s.remoteExists(check.remote) {
+				seen[check] = true
+				checks = append(checks, check)
+			}
+		}
+	}
+
+	heads, failed := s.listHeads(ctx, checks)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var drifts []*Drift
+
+	for _, sync := range s.config.Sync {
+		source, target := preflightCheck{sync.Source, false}, preflightCheck{sync.Target, true}
+		sourceHeads, targetHeads := heads[source], heads[target]
+		var err error
+
+		switch {
+		case !s.remoteExists(sync.Source):
+			err = fmt.Errorf("%s source remote doesn't exist", sync.Source)
+		case !s.remoteExists(sync.Target):
+			err = fmt.Errorf("%s target remote doesn't exist", sync.Target)
+		case failed[source] != nil:
+			err = failed[source]
+		case failed[target] != nil:
+			err = failed[target]
+		}
+
+		for _, branch := range sync.Branches {
+			branchRef := plumbing.NewBranchReferenceName(branch)
+			drift := &Drift{
+				Source:    sync.Source,
+				Target:    sync.Target,
+				Branch:    branch,
+				State:     DriftInSync,
+				SourceSHA: sourceHeads[branchRef],
+				TargetSHA: targetHeads[branchRef],
+			}
+
+			switch {
+			case err != nil:
+				drift.State = DriftError
+				drift.Err = err
+			case drift.SourceSHA == "":
+				drift.State = DriftError
+				drift.Err = fmt.Errorf("%s doesn't exist on %s", branch, sync.Source)
+			case drift.TargetSHA == "":
+				drift.State = DriftMissing
+			case drift.SourceSHA != drift.TargetSHA:
+				drift.State = DriftStale
+			}
+
+			drifts = append(drifts, drift)
+		}
+	}
+
+	s.putDriftMetrics(drifts)
+
+	return drifts, nil
+}
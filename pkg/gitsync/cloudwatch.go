@@ -0,0 +1,194 @@
+package gitsync
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const gsDefaultCloudWatchNamespace string = "gitsync"
+
+// gsCloudWatchBatch is the most metrics PutMetricData takes at once.
+const gsCloudWatchBatch = 1000
+
+// CloudWatch publishes each run's metrics, and each check's drift, as
+// CloudWatch custom metrics, for hosts on AWS that nothing scrapes.
+type CloudWatch struct {
+	// Namespace defaults to gitsync.
+	Namespace string `json:"namespace"`
+	// Region defaults to $AWS_REGION or $AWS_DEFAULT_REGION.
+	Region string `json:"region"`
+	// Endpoint overrides the region's monitoring endpoint, e.g. for a VPC
+	// endpoint.
+	Endpoint string `json:"endpoint"`
+	// Dimensions are added to every metric, e.g. to tell hosts apart.
+	Dimensions map[string]string `json:"dimensions"`
+}
+
+// cloudWatchDatum is one value of a metric.
+type cloudWatchDatum struct {
+	name       string
+	value      float64
+	unit       string
+	dimensions map[string]string
+}
+
+func (s *Syncer) checkCloudWatch() bool {
+	if s.config.MetricsPush == nil || s.config.MetricsPush.CloudWatch == nil {
+		return true
+	}
+
+	settings := s.config.MetricsPush.CloudWatch
+
+	switch {
+	case awsRegion(settings.Region) == "" && settings.Endpoint == "":
+		errorPrintf("metrics_push cloudwatch needs a region, or $AWS_REGION\n")
+		return false
+	case len(settings.Dimensions) > 28:
+		errorPrintf("metrics_push cloudwatch can have at most 28 dimensions of its own\n")
+		return false
+	}
+
+	return true
+}
+
+// putRunMetrics publishes the run's metrics to CloudWatch: whether each
+// sync entry succeeded or failed, how long it took and how many of its
+// branches were left behind their source, with the entry's source and
+// target as dimensions, and how long the run took and whether it failed.
+func (s *Syncer) putRunMetrics() {
+	if s.config.MetricsPush == nil || s.config.MetricsPush.CloudWatch == nil {
+		return
+	}
+
+	run := s.run
+	data := []cloudWatchDatum{
+		{name: "RunDuration", value: run.Finished.Sub(run.Started).Seconds(), unit: "Seconds"},
+		{name: "RunFailed", value: boolValue(run.Failed()), unit: "Count"},
+	}
+
+	for _, result := range run.Syncs {
+		dimensions := map[string]string{"Source": result.Source, "Target": result.Target}
+		behind := 0
+
+		for _, branch := range result.Branches {
+			if branch.Status == StatusFailed || branch.Status == StatusSkipped {
+				behind++
+			}
+		}
+
+		data = append(data,
+			cloudWatchDatum{name: "SyncSucceeded", value: boolValue(result.Status == StatusSynced), unit: "Count", dimensions: dimensions},
+			cloudWatchDatum{name: "SyncFailed", value: boolValue(result.Status != StatusSynced), unit: "Count", dimensions: dimensions},
+			cloudWatchDatum{name: "SyncDuration", value: result.Duration.Seconds(), unit: "Seconds", dimensions: dimensions},
+			cloudWatchDatum{name: "BranchesBehind", value: float64(behind), unit: "Count", dimensions: dimensions},
+		)
+	}
+
+	s.putCloudWatch(data)
+}
+
+// putDriftMetrics publishes how many branches of each sync entry a check
+// found stale, missing from the target or impossible to check.
+func (s *Syncer) putDriftMetrics(drifts []*Drift) {
+	if s.config.MetricsPush == nil || s.config.MetricsPush.CloudWatch == nil {
+		return
+	}
+
+	drifted := map[[2]string]int{}
+	var entries [][2]string
+
+	for _, drift := range drifts {
+		entry := [2]string{drift.Source, drift.Target}
+
+		if _, seen := drifted[entry]; !seen {
+			entries = append(entries, entry)
+			drifted[entry] = 0
+		}
+
+		if drift.State != DriftInSync {
+			drifted[entry]++
+		}
+	}
+
+	var data []cloudWatchDatum
+
+	for _, entry := range entries {
+		data = append(data, cloudWatchDatum{name: "BranchesDrifted", value: float64(drifted[entry]), unit: "Count", dimensions: map[string]string{"Source": entry[0], "Target": entry[1]}})
+	}
+
+	s.putCloudWatch(data)
+}
+
+// putCloudWatch sends data to CloudWatch with PutMetricData, with the
+// config's own dimensions added to each. Failures are only warned about.
+func (s *Syncer) putCloudWatch(data []cloudWatchDatum) {
+	settings := s.config.MetricsPush.CloudWatch
+	namespace := settings.Namespace
+
+	if namespace == "" {
+		namespace = gsDefaultCloudWatchNamespace
+	}
+
+	region := awsRegion(settings.Region)
+	endpoint := settings.Endpoint
+
+	if endpoint == "" {
+		endpoint = "https://monitoring." + region + ".amazonaws.com/"
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	for start := 0; start < len(data); start += gsCloudWatchBatch {
+		params := url.Values{"Namespace": {namespace}}
+
+		for i, datum := range data[start:min(start+gsCloudWatchBatch, len(data))] {
+			member := fmt.Sprintf("MetricData.member.%d.", i+1)
+			params.Set(member+"MetricName", datum.name)
+			params.Set(member+"Value", strconv.FormatFloat(datum.value, 'f', -1, 64))
+			params.Set(member+"Unit", datum.unit)
+			params.Set(member+"Timestamp", now)
+
+			dimensions := map[string]string{}
+
+			for name, value := range settings.Dimensions {
+				dimensions[name] = value
+			}
+
+			for name, value := range datum.dimensions {
+				dimensions[name] = value
+			}
+
+			names := make([]string, 0, len(dimensions))
+
+			for name := range dimensions {
+				names = append(names, name)
+			}
+
+			sort.Strings(names)
+
+			for j, name := range names {
+				params.Set(fmt.Sprintf("%sDimensions.member.%d.Name", member, j+1), name)
+				params.Set(fmt.Sprintf("%sDimensions.member.%d.Value", member, j+1), dimensions[name])
+			}
+		}
+
+		if _, err := awsQueryRequest(context.Background(), endpoint, region, "monitoring", "PutMetricData", "2010-08-01", params); err != nil {
+			s.warnPrintf("could not put metrics to CloudWatch: %s\n", err)
+			return
+		}
+	}
+
+	s.debugPrintf("put %d metrics to CloudWatch namespace %s\n", len(data), namespace)
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,26 @@
+package gitsync
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// gsCommandWaitDelay is how long a command that was killed gets to close
+// its output before it is closed for it, for when something it started
+// outlives it and holds on to it.
+const gsCommandWaitDelay = 2 * time.Second
+
+// commandContext is exec.CommandContext for commands that have to stop when
+// ctx is done. Killing a hook's shell, or git, doesn't kill what they
+// started, like the hook's commands or git's ssh and remote helpers, and
+// waiting for the output of whatever is left lasts until that exits, so
+// the command gets a process group of its own, which is killed as a whole
+// where processes have them, and a WaitDelay.
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = gsCommandWaitDelay
+	killProcessGroup(cmd)
+
+	return cmd
+}
@@ -0,0 +1,16 @@
+//go:build windows || plan9
+
+package gitsync
+
+import "os/exec"
+
+// killProcessGroup leaves cmd as it is: without process groups only the
+// command itself is killed, and the WaitDelay stops the wait for what it
+// started.
+func killProcessGroup(cmd *exec.Cmd) {}
+
+// processAlive can't tell whether a process is running, so takes it that
+// it is, leaving a lock it holds to go stale by age.
+func processAlive(pid int) bool {
+	return true
+}
@@ -0,0 +1,156 @@
+package gitsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const gsDefaultGitHubAPI string = "https://api.github.com"
+const gsDefaultGitLabAPI string = "https://gitlab.com/api/v4"
+
+// CommitStatus marks synced commits on the remote's forge.
+type CommitStatus struct {
+	Type    string `json:"type"`
+	APIURL  string `json:"api_url"`
+	Project string `json:"project"`
+	Token   string `json:"token"`
+	Context string `json:"context"`
+}
+
+func checkCommitStatus(name string, settings *CommitStatus) bool {
+	if settings.Type != "github" && settings.Type != "gitlab" {
+		errorPrintf("%s remote has an unknown commit_status type: %s\n", name, settings.Type)
+		return false
+	}
+
+	if settings.Project == "" {
+		errorPrintf("%s remote commit_status has no project\n", name)
+		return false
+	}
+
+	if settings.Token == "" {
+		errorPrintf("%s remote commit_status has no token\n", name)
+		return false
+	}
+
+	return true
+}
+
+// setCommitStatus marks sha as mirrored on the target's forge, so that people
+// browsing the target can see a commit has propagated. Failures are only
+// warned about, since the sync itself has already succeeded.
+func (s *Syncer) setCommitStatus(target, branch, sha string) {
+	settings, exists := s.config.Remotes[target]
+
+	if !exists || settings.CommitStatus == nil || sha == "" {
+		return
+	}
+
+	status := settings.CommitStatus
+	token, err := resolveSecret(status.Token)
+
+	if err != nil {
+		s.warnPrintf("%s commit_status token: %s\n", target, err)
+		return
+	}
+
+	statusContext := status.Context
+
+	if statusContext == "" {
+		statusContext = "mirrored-to: " + target
+	}
+
+	description := fmt.Sprintf("%s mirrored to %s by gitsync", branch, target)
+
+	var req *http.Request
+
+	switch status.Type {
+	case "github":
+		req, err = gitHubStatusRequest(status, token, sha, statusContext, description)
+	case "gitlab":
+		req, err = gitLabStatusRequest(status, token, sha, statusContext, description)
+	}
+
+	if err != nil {
+		s.warnPrintf("could not set commit status on %s: %s\n", target, err)
+		return
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+
+	if err != nil {
+		s.warnPrintf("could not set commit status on %s: %s\n", target, err)
+		return
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		s.warnPrintf("could not set commit status on %s: %s\n", target, resp.Status)
+		return
+	}
+
+	s.debugPrintf("set %s commit status %q on %s\n", target, statusContext, ShortSHA(sha))
+}
+
+func gitHubStatusRequest(status *CommitStatus, token, sha, statusContext, description string) (*http.Request, error) {
+	apiURL := status.APIURL
+
+	if apiURL == "" {
+		apiURL = gsDefaultGitHubAPI
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"state":       "success",
+		"context":     statusContext,
+		"description": description,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("%s/repos/%s/statuses/%s", strings.TrimSuffix(apiURL, "/"), status.Project, sha)
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return req, nil
+}
+
+func gitLabStatusRequest(status *CommitStatus, token, sha, statusContext, description string) (*http.Request, error) {
+	apiURL := status.APIURL
+
+	if apiURL == "" {
+		apiURL = gsDefaultGitLabAPI
+	}
+
+	form := url.Values{}
+	form.Set("state", "success")
+	form.Set("name", statusContext)
+	form.Set("description", description)
+
+	endpoint := fmt.Sprintf("%s/projects/%s/statuses/%s", strings.TrimSuffix(apiURL, "/"), url.PathEscape(status.Project), sha)
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("PRIVATE-TOKEN", token)
+
+	return req, nil
+}
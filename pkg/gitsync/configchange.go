@@ -0,0 +1,44 @@
+package gitsync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// Checksum identifies the config's contents, so runs can say which version
+// they used and reloads can tell whether anything changed.
+func (c Config) Checksum() string {
+	tuples, _ := json.Marshal(c)
+	sum := sha256.Sum256(tuples)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// ConfigChecksum is the checksum of the config the Syncer was made with.
+func (s *Syncer) ConfigChecksum() string {
+	return s.configChecksum
+}
+
+// ConfigChanged tells the Syncer its config has changed at the source, and
+// can be called from any goroutine, e.g. by a watcher while a run is in
+// flight. The run carries on with the config it started with, so no run
+// mixes two versions, and publishes EventConfigChanged; replacing the
+// Syncer with one for the new config is up to the caller.
+func (s *Syncer) ConfigChanged() {
+	s.configChanged.Store(true)
+}
+
+// noticeConfigChange publishes EventConfigChanged the first time the run
+// finds out its config has changed.
+func (s *Syncer) noticeConfigChange() {
+	if s.configChanged.CompareAndSwap(true, false) {
+		s.run.ConfigChanged = true
+		s.publish(Event{Type: EventConfigChanged})
+	}
+}
+
+// shortChecksum abbreviates a config checksum for logs.
+func shortChecksum(checksum string) string {
+	return checksum[:min(len(checksum), 12)]
+}
@@ -0,0 +1,622 @@
+package gitsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+)
+
+// How often a config file is checked for changes.
+const gsConfigPollInterval = 5 * time.Second
+
+// How long Consul and Kubernetes hold a watch open before it is renewed.
+const gsConfigWatchWait = 5 * time.Minute
+
+const gsDefaultConfigMapKey string = ".gitsync.conf"
+const gsKubernetesServiceAccount string = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// ConfigProvider is where a Config is loaded from. Daemon mode watches it
+// and picks up changes without a restart.
+type ConfigProvider interface {
+	// Name says where the config comes from, for logs.
+	Name() string
+	// Load reads the current config.
+	Load(ctx context.Context) (Config, error)
+	// Watch blocks until the config has changed since it was last loaded
+	// or watched, or until ctx is cancelled.
+	Watch(ctx context.Context) error
+}
+
+// NewConfigProvider picks a provider for location, which is a file path or
+// one of:
+//
+//	consul://host:8500/path/to/key (or consul+https://)
+//	etcd://[user:password@]host:2379/path/to/key (or etcd+https://)
+//	configmap://namespace/name[/key]
+func NewConfigProvider(location string) (ConfigProvider, error) {
+	if !strings.Contains(location, "://") {
+		return &FileConfigProvider{FS: osfs.Default, Path: location}, nil
+	}
+
+	u, err := url.Parse(location)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key := strings.TrimPrefix(u.Path, "/")
+
+	switch u.Scheme {
+	case "consul", "consul+https":
+		if u.Host == "" || key == "" {
+			return nil, fmt.Errorf("%s needs a host and a key", location)
+		}
+
+		return &consulConfigProvider{address: httpBase(u), key: key, token: os.Getenv("CONSUL_HTTP_TOKEN")}, nil
+	case "etcd", "etcd+https":
+		if u.Host == "" || key == "" {
+			return nil, fmt.Errorf("%s needs a host and a key", location)
+		}
+
+		provider := &etcdConfigProvider{address: httpBase(u), key: key}
+
+		if u.User != nil {
+			provider.username = u.User.Username()
+			provider.password, _ = u.User.Password()
+		}
+
+		return provider, nil
+	case "configmap":
+		name, key, _ := strings.Cut(key, "/")
+
+		if u.Host == "" || name == "" {
+			return nil, fmt.Errorf("%s needs a namespace and a name", location)
+		}
+
+		if key == "" {
+			key = gsDefaultConfigMapKey
+		}
+
+		return &configMapConfigProvider{namespace: u.Host, name: name, key: key}, nil
+	}
+
+	return nil, fmt.Errorf("unknown config provider %s", u.Scheme)
+}
+
+// httpBase is the HTTP endpoint of a consul:// or etcd:// location.
+func httpBase(u *url.URL) string {
+	if strings.HasSuffix(u.Scheme, "+https") {
+		return "https://" + u.Host
+	}
+
+	return "http://" + u.Host
+}
+
+// parseConfig decodes a config, marking decoding errors as
+// ErrInvalidConfigJSON.
+func parseConfig(tuples []byte) (Config, error) {
+	var config Config
+
+	if err := json.Unmarshal(tuples, &config); err != nil {
+		return config, fmt.Errorf("%w: %w", ErrInvalidConfigJSON, err)
+	}
+
+	return config, nil
+}
+
+// FileConfigProvider reads the config from a file, noticing changes by its
+// size and modification time.
+type FileConfigProvider struct {
+	FS   billy.Basic
+	Path string
+	// TrustedKeys, if set, are the keys the file's detached signature, in
+	// Path.sig or Path.asc, must be made by. A bad signature fails Load.
+	TrustedKeys openpgp.EntityList
+	// RequireSignature also fails Load for a file that isn't signed.
+	RequireSignature bool
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+func (p *FileConfigProvider) Name() string {
+	return p.Path
+}
+
+func (p *FileConfigProvider) Load(ctx context.Context) (Config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if info, err := p.FS.Stat(p.Path); err == nil {
+		p.modTime, p.size = info.ModTime(), info.Size()
+	}
+
+	if p.TrustedKeys == nil {
+		return ReadConfig(p.FS, p.Path)
+	}
+
+	file, err := p.FS.Open(p.Path)
+
+	if err != nil {
+		return Config{}, err
+	}
+
+	defer file.Close()
+
+	tuples, err := io.ReadAll(file)
+
+	if err != nil {
+		return Config{}, err
+	}
+
+	if err := verifyConfigSignature(p.FS, p.Path, tuples, p.TrustedKeys, p.RequireSignature); err != nil {
+		return Config{}, err
+	}
+
+	return parseConfig(tuples)
+}
+
+func (p *FileConfigProvider) Watch(ctx context.Context) error {
+	for {
+		select {
+		case <-time.After(gsConfigPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		info, err := p.FS.Stat(p.Path)
+
+		if err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		changed := !info.ModTime().Equal(p.modTime) || info.Size() != p.size
+		p.modTime, p.size = info.ModTime(), info.Size()
+		p.mu.Unlock()
+
+		if changed {
+			return nil
+		}
+	}
+}
+
+// consulConfigProvider reads the config from a Consul KV key, watching it
+// with blocking queries. $CONSUL_HTTP_TOKEN is sent if set.
+type consulConfigProvider struct {
+	address string
+	key     string
+	token   string
+
+	mu    sync.Mutex
+	index string
+}
+
+func (p *consulConfigProvider) Name() string {
+	return p.address + "/v1/kv/" + p.key
+}
+
+// get reads the key, blocking until it changes from index if index is set.
+func (p *consulConfigProvider) get(ctx context.Context, index string) ([]byte, string, error) {
+	query := url.Values{"raw": {"true"}}
+
+	if index != "" {
+		query.Set("index", index)
+		query.Set("wait", gsConfigWatchWait.String())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.address+"/v1/kv/"+p.key+"?"+query.Encode(), nil)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if p.token != "" {
+		req.Header.Set("X-Consul-Token", p.token)
+	}
+
+	client := &http.Client{Timeout: gsConfigWatchWait + time.Minute}
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("consul returned %s for %s", resp.Status, p.key)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+
+	return body, resp.Header.Get("X-Consul-Index"), err
+}
+
+func (p *consulConfigProvider) Load(ctx context.Context) (Config, error) {
+	body, index, err := p.get(ctx, "")
+
+	if err != nil {
+		return Config{}, err
+	}
+
+	p.mu.Lock()
+	p.index = index
+	p.mu.Unlock()
+
+	return parseConfig(body)
+}
+
+func (p *consulConfigProvider) Watch(ctx context.Context) error {
+	for {
+		p.mu.Lock()
+		index := p.index
+		p.mu.Unlock()
+
+		_, newIndex, err := p.get(ctx, index)
+
+		if err != nil {
+			return err
+		}
+
+		if newIndex != index {
+			p.mu.Lock()
+			p.index = newIndex
+			p.mu.Unlock()
+
+			return nil
+		}
+	}
+}
+
+// etcdConfigProvider reads the config from an etcd v3 key through etcd's
+// JSON gateway, authenticating first if a username is set.
+type etcdConfigProvider struct {
+	address  string
+	key      string
+	username string
+	password string
+
+	mu       sync.Mutex
+	revision int64
+}
+
+type etcdRangeResponse struct {
+	Kvs []struct {
+		Value       string `json:"value"`
+		ModRevision string `json:"mod_revision"`
+	} `json:"kvs"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Events []struct {
+			Kv struct {
+				ModRevision string `json:"mod_revision"`
+			} `json:"kv"`
+		} `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *etcdConfigProvider) Name() string {
+	return p.address + "/" + p.key
+}
+
+// post sends a request to the gateway, with no timeout when watching.
+func (p *etcdConfigProvider) post(ctx context.Context, path string, request interface{}, timeout time.Duration) (*http.Response, error) {
+	body, err := json.Marshal(request)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.address+path, bytes.NewReader(body))
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if p.username != "" && path != "/v3/auth/authenticate" {
+		token, err := p.authenticate(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Authorization", token)
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd returned %s for %s", resp.Status, path)
+	}
+
+	return resp, nil
+}
+
+func (p *etcdConfigProvider) authenticate(ctx context.Context) (string, error) {
+	resp, err := p.post(ctx, "/v3/auth/authenticate", map[string]string{"name": p.username, "password": p.password}, 10*time.Second)
+
+	if err != nil {
+		return "", fmt.Errorf("could not authenticate to etcd: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	var auth struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return "", fmt.Errorf("could not authenticate to etcd: %w", err)
+	}
+
+	return auth.Token, nil
+}
+
+func (p *etcdConfigProvider) Load(ctx context.Context) (Config, error) {
+	resp, err := p.post(ctx, "/v3/kv/range", map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(p.key))}, 10*time.Second)
+
+	if err != nil {
+		return Config{}, err
+	}
+
+	defer resp.Body.Close()
+
+	var kv etcdRangeResponse
+
+	if err := json.NewDecoder(resp.Body).Decode(&kv); err != nil {
+		return Config{}, err
+	}
+
+	if len(kv.Kvs) == 0 {
+		return Config{}, fmt.Errorf("etcd has no key %s", p.key)
+	}
+
+	tuples, err := base64.StdEncoding.DecodeString(kv.Kvs[0].Value)
+
+	if err != nil {
+		return Config{}, err
+	}
+
+	revision, _ := strconv.ParseInt(kv.Kvs[0].ModRevision, 10, 64)
+
+	p.mu.Lock()
+	p.revision = revision
+	p.mu.Unlock()
+
+	return parseConfig(tuples)
+}
+
+func (p *etcdConfigProvider) Watch(ctx context.Context) error {
+	p.mu.Lock()
+	revision := p.revision
+	p.mu.Unlock()
+
+	resp, err := p.post(ctx, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            base64.StdEncoding.EncodeToString([]byte(p.key)),
+			"start_revision": strconv.FormatInt(revision+1, 10),
+		},
+	}, 0)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+
+	for {
+		var watch etcdWatchResponse
+
+		if err := decoder.Decode(&watch); err != nil {
+			return fmt.Errorf("etcd watch ended: %w", err)
+		}
+
+		if watch.Error != nil {
+			return fmt.Errorf("etcd watch failed: %s", watch.Error.Message)
+		}
+
+		if events := watch.Result.Events; len(events) > 0 {
+			latest, _ := strconv.ParseInt(events[len(events)-1].Kv.ModRevision, 10, 64)
+
+			p.mu.Lock()
+			p.revision = latest
+			p.mu.Unlock()
+
+			return nil
+		}
+	}
+}
+
+// configMapConfigProvider reads the config from a key of a Kubernetes
+// ConfigMap, using the pod's service account.
+type configMapConfigProvider struct {
+	namespace string
+	name      string
+	key       string
+
+	mu              sync.Mutex
+	resourceVersion string
+}
+
+type configMap struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data map[string]string `json:"data"`
+}
+
+func (p *configMapConfigProvider) Name() string {
+	return fmt.Sprintf("configmap %s/%s key %s", p.namespace, p.name, p.key)
+}
+
+// get sends an in-cluster request to the Kubernetes API.
+func (p *configMapConfigProvider) get(ctx context.Context, path string, query url.Values, timeout time.Duration) (*http.Response, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+
+	if host == "" || port == "" {
+		return nil, errors.New("configmap configs can only be read inside a Kubernetes pod")
+	}
+
+	token, err := os.ReadFile(gsKubernetesServiceAccount + "/token")
+
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := os.ReadFile(gsKubernetesServiceAccount + "/ca.crt")
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+host+":"+port+path+"?"+query.Encode(), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("kubernetes returned %s for %s", resp.Status, path)
+	}
+
+	return resp, nil
+}
+
+func (p *configMapConfigProvider) Load(ctx context.Context) (Config, error) {
+	resp, err := p.get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", p.namespace, p.name), url.Values{}, 10*time.Second)
+
+	if err != nil {
+		return Config{}, err
+	}
+
+	defer resp.Body.Close()
+
+	var cm configMap
+
+	if err := json.NewDecoder(resp.Body).Decode(&cm); err != nil {
+		return Config{}, err
+	}
+
+	tuples, exists := cm.Data[p.key]
+
+	if !exists {
+		return Config{}, fmt.Errorf("%s has no such key", p.Name())
+	}
+
+	p.mu.Lock()
+	p.resourceVersion = cm.Metadata.ResourceVersion
+	p.mu.Unlock()
+
+	return parseConfig([]byte(tuples))
+}
+
+func (p *configMapConfigProvider) Watch(ctx context.Context) error {
+	for {
+		p.mu.Lock()
+		resourceVersion := p.resourceVersion
+		p.mu.Unlock()
+
+		resp, err := p.get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/configmaps", p.namespace), url.Values{
+			"watch":           {"true"},
+			"fieldSelector":   {"metadata.name=" + p.name},
+			"resourceVersion": {resourceVersion},
+			"timeoutSeconds":  {strconv.Itoa(int(gsConfigWatchWait.Seconds()))},
+		}, gsConfigWatchWait+time.Minute)
+
+		if err != nil {
+			return err
+		}
+
+		changed, err := p.readWatch(resp.Body, resourceVersion)
+		resp.Body.Close()
+
+		if err != nil || changed {
+			return err
+		}
+	}
+}
+
+// readWatch reads watch events until the ConfigMap changes from
+// resourceVersion or the server ends the watch.
+func (p *configMapConfigProvider) readWatch(stream io.Reader, resourceVersion string) (bool, error) {
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var event struct {
+			Type   string    `json:"type"`
+			Object configMap `json:"object"`
+		}
+
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return false, err
+		}
+
+		if event.Type == "ERROR" {
+			// Usually 410 Gone: resourceVersion is too old to watch from,
+			// so reload to be sure nothing was missed.
+			return true, nil
+		}
+
+		if event.Object.Metadata.ResourceVersion != resourceVersion {
+			p.mu.Lock()
+			p.resourceVersion = event.Object.Metadata.ResourceVersion
+			p.mu.Unlock()
+
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
@@ -0,0 +1,29 @@
+package gitsync
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errNotConfirmed = errors.New("destructive change not confirmed")
+
+// confirmDestructive asks before gitsync does something that can lose
+// commits on a target, like a force push or deleting a ref. It is allowed
+// outright with Options.AssumeYes, otherwise Options.Confirm is asked and,
+// without one, the config has to allow destructive changes.
+func (s *Syncer) confirmDestructive(action string) error {
+	switch {
+	case s.assumeYes:
+		return nil
+	case s.confirm != nil:
+		if s.confirm(action) {
+			return nil
+		}
+
+		return fmt.Errorf("%w: declined to %s", errNotConfirmed, action)
+	case s.config.AllowDestructive:
+		return nil
+	}
+
+	return fmt.Errorf("%w: refusing to %s without allow_destructive in the config", errNotConfirmed, action)
+}
@@ -0,0 +1,69 @@
+package gitsync
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// gsSSHControlPersist is how long an SSH connection the git backend opened
+// stays open once nothing uses it, so the next git command of the run to
+// the same host reuses it.
+const gsSSHControlPersist string = "60s"
+
+// sshCommand is the core.sshCommand that has git share one SSH connection
+// per host, user and port between its commands, through OpenSSH's
+// ControlMaster, rather than connecting and authenticating for every fetch,
+// push and ref listing. It is empty for remotes that aren't reached over
+// SSH, and when $GIT_SSH_COMMAND or $GIT_SSH choose how git runs SSH.
+func (s *Syncer) sshCommand(remote string, push bool) string {
+	endpoint, err := transport.NewEndpoint(s.effectiveURL(remote, push))
+
+	if err != nil || endpoint.Protocol != "ssh" || os.Getenv("GIT_SSH_COMMAND") != "" || os.Getenv("GIT_SSH") != "" {
+		return ""
+	}
+
+	s.sshControlMu.Lock()
+	defer s.sshControlMu.Unlock()
+
+	if s.sshControlDir == "" {
+		dir, err := os.MkdirTemp("", "gitsync-ssh-")
+
+		if err != nil {
+			s.warnPrintf("could not create a directory for SSH connections, so they won't be shared: %s\n", err)
+			return ""
+		}
+
+		s.sshControlDir = dir
+	}
+
+	// %C is a hash of the host, user and port, which keeps the socket's
+	// path within the length Unix sockets allow.
+	return "ssh -o ControlMaster=auto -o ControlPersist=" + gsSSHControlPersist + " -o ControlPath='" + filepath.Join(s.sshControlDir, "%C") + "'"
+}
+
+// closeSSHConnections closes the SSH connections the run's git commands
+// shared, rather than leaving them open until they time out.
+func (s *Syncer) closeSSHConnections() {
+	s.sshControlMu.Lock()
+	defer s.sshControlMu.Unlock()
+
+	if s.sshControlDir == "" {
+		return
+	}
+
+	sockets, _ := filepath.Glob(filepath.Join(s.sshControlDir, "*"))
+
+	for _, socket := range sockets {
+		// ssh wants a host, but only goes by the socket to close it.
+		if output, err := exec.Command("ssh", "-o", "ControlPath="+socket, "-O", "exit", "gitsync").CombinedOutput(); err != nil {
+			s.debugPrintf("could not close SSH connection %s: %s\n", filepath.Base(socket), strings.TrimSpace(string(output)))
+		}
+	}
+
+	os.RemoveAll(s.sshControlDir)
+	s.sshControlDir = ""
+}
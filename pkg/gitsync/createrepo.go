@@ -0,0 +1,605 @@
+package gitsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// CreateRepo creates the remote's repository on its forge when it doesn't
+// exist, so new mirrors need no setting up by hand.
+type CreateRepo struct {
+	Type   string `json:"type"`
+	APIURL string `json:"api_url"`
+	// Project defaults to the path of the remote's push URL.
+	Project string `json:"project"`
+	Token   string `json:"token"`
+	// Username sends Token to Bitbucket as an app password rather than an
+	// access token.
+	Username string `json:"username"`
+	// Visibility is private (the default), public or internal.
+	Visibility  string `json:"visibility"`
+	Description string `json:"description"`
+	// DefaultBranch is the new project's default branch, on GitLab, Gitea
+	// and Forgejo.
+	DefaultBranch string `json:"default_branch"`
+	// MarkMirror points a new Gitea or Forgejo repository's website at the
+	// source it mirrors, and describes it as a mirror unless Description
+	// says otherwise.
+	MarkMirror bool `json:"mark_mirror"`
+	// Region, Tags and KMSKeyID are for CodeCommit, whose region defaults
+	// to the one in the remote's URL.
+	Region   string            `json:"region"`
+	Tags     map[string]string `json:"tags"`
+	KMSKeyID string            `json:"kms_key_id"`
+}
+
+const gsDefaultBitbucketAPI string = "https://api.bitbucket.org/2.0"
+
+var gsCreateTypes = map[string]bool{
+	"github":           true,
+	"gitlab":           true,
+	"gitea":            true,
+	"bitbucket":        true,
+	"bitbucket_server": true,
+	"codecommit":       true,
+	"local":            true,
+}
+
+var gsCreateVisibilities = map[string]bool{
+	"":         true,
+	"private":  true,
+	"public":   true,
+	"internal": true,
+}
+
+func checkCreateRepo(name string, settings *CreateRepo) bool {
+	if !gsCreateTypes[settings.Type] {
+		errorPrintf("%s remote has an unknown create type: %s\n", name, settings.Type)
+		return false
+	}
+
+	if settings.Type == "codecommit" {
+		return checkCodeCommitRepo(name, settings)
+	}
+
+	if settings.Type == "local" {
+		if settings.APIURL != "" || settings.Project != "" || settings.Token != "" || settings.Username != "" || settings.Visibility != "" || settings.Description != "" || settings.DefaultBranch != "" || settings.MarkMirror || settings.Region != "" || len(settings.Tags) > 0 || settings.KMSKeyID != "" {
+			errorPrintf("%s remote create for a local repository takes no other settings\n", name)
+			return false
+		}
+
+		return true
+	}
+
+	if (settings.Type == "gitea" || settings.Type == "bitbucket_server") && settings.APIURL == "" {
+		errorPrintf("%s remote create needs the api_url of the %s server\n", name, settings.Type)
+		return false
+	}
+
+	if (settings.Type == "gitea" || strings.HasPrefix(settings.Type, "bitbucket")) && settings.Visibility == "internal" {
+		errorPrintf("%s remote create can't make %s repositories internal\n", name, settings.Type)
+		return false
+	}
+
+	if settings.MarkMirror && settings.Type != "gitea" {
+		errorPrintf("%s remote create can only mark_mirror on Gitea or Forgejo\n", name)
+		return false
+	}
+
+	if owner, repo, found := strings.Cut(settings.Project, "/"); settings.Project != "" && (!found || owner == "" || repo == "") {
+		errorPrintf("%s remote create needs a project of the form owner/repo or group/project\n", name)
+		return false
+	}
+
+	if settings.Token == "" {
+		errorPrintf("%s remote create has no token\n", name)
+		return false
+	}
+
+	if !gsCreateVisibilities[settings.Visibility] {
+		errorPrintf("%s remote create has an unknown visibility: %s\n", name, settings.Visibility)
+		return false
+	}
+
+	if settings.Region != "" || len(settings.Tags) > 0 || settings.KMSKeyID != "" {
+		errorPrintf("%s remote create's region, tags and kms_key_id are only for CodeCommit\n", name)
+		return false
+	}
+
+	return true
+}
+
+// checkCodeCommitRepo checks CodeCommit create settings, which name the
+// repository alone and take AWS credentials rather than a token.
+func checkCodeCommitRepo(name string, settings *CreateRepo) bool {
+	switch {
+	case strings.Contains(settings.Project, "/"):
+		errorPrintf("%s remote create's project is a CodeCommit repository name, without an owner\n", name)
+		return false
+	case settings.Token != "" || settings.Username != "":
+		errorPrintf("%s remote create for CodeCommit uses AWS credentials, not a token\n", name)
+		return false
+	case settings.Visibility != "" || settings.DefaultBranch != "" || settings.MarkMirror:
+		errorPrintf("%s remote create for CodeCommit doesn't take a visibility, default_branch or mark_mirror\n", name)
+		return false
+	}
+
+	return true
+}
+
+// ensureRepo creates the target's repository if it has create settings and
+// the forge says the repository doesn't exist yet.
+func (s *Syncer) ensureRepo(ctx context.Context, target string) error {
+	settings := s.config.Remotes[target].Create
+
+	if settings == nil {
+		return nil
+	}
+
+	if settings.Type == "local" {
+		return s.ensureLocalRepo(target)
+	}
+
+	token, err := resolveSecret(settings.Token)
+
+	if err != nil {
+		return fmt.Errorf("%s create token: %w", target, err)
+	}
+
+	resolved := *settings
+	settings = &resolved
+
+	if settings.Project == "" {
+		if settings.Project, err = projectFromURL(settings.Type, s.effectiveURL(target, true)); err != nil {
+			return fmt.Errorf("%s create: %w", target, err)
+		}
+	}
+
+	var created bool
+
+	switch settings.Type {
+	case "github":
+		created, err = ensureGitHubRepo(ctx, settings, token)
+	case "gitlab":
+		created, err = ensureGitLabProject(ctx, settings, token)
+	case "gitea":
+		created, err = ensureGiteaRepo(ctx, settings, token, s.mirroredURL(target))
+	case "bitbucket", "bitbucket_server":
+		created, err = ensureBitbucketRepo(ctx, settings, token)
+	case "codecommit":
+		created, err = ensureCodeCommitRepo(ctx, settings, s.effectiveURL(target, true))
+	}
+
+	if created {
+		s.infoPrintf("created %s repository %s for %s\n", settings.Type, settings.Project, target)
+	}
+
+	// A repository that was created can be pushed to, even if setting it
+	// up afterwards failed.
+	if err != nil && created {
+		s.warnPrintf("created %s but could not finish setting it up: %s\n", settings.Project, err)
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not create %s on %s: %w", settings.Project, settings.Type, err)
+	}
+
+	return nil
+}
+
+// ensureGitHubRepo creates the project on GitHub, under the organization
+// that owns it or, if the token's user owns it, under the user. It returns
+// whether it had to.
+func ensureGitHubRepo(ctx context.Context, settings *CreateRepo, token string) (bool, error) {
+	apiURL := settings.APIURL
+
+	if apiURL == "" {
+		apiURL = gsDefaultGitHubAPI
+	}
+
+	apiURL = strings.TrimSuffix(apiURL, "/")
+	headers := map[string]string{"Accept": "application/vnd.github+json", "Authorization": "Bearer " + token}
+	status, err := forgeRequest(ctx, http.MethodGet, apiURL+"/repos/"+settings.Project, headers, nil, nil)
+
+	switch {
+	case err != nil:
+		return false, err
+	case status == http.StatusOK:
+		return false, nil
+	case status != http.StatusNotFound:
+		return false, fmt.Errorf("looking the repository up: %s", http.StatusText(status))
+	}
+
+	var user struct {
+		Login string `json:"login"`
+	}
+
+	if status, err := forgeRequest(ctx, http.MethodGet, apiURL+"/user", headers, nil, &user); err != nil || status != http.StatusOK {
+		if err == nil {
+			err = fmt.Errorf("looking the token's user up: %s", http.StatusText(status))
+		}
+
+		return false, err
+	}
+
+	owner, name, _ := strings.Cut(settings.Project, "/")
+	visibility := settings.Visibility
+
+	if visibility == "" {
+		visibility = "private"
+	}
+
+	endpoint := apiURL + "/orgs/" + owner + "/repos"
+	body := map[string]interface{}{
+		"name":        name,
+		"description": settings.Description,
+		"private":     visibility != "public",
+		"visibility":  visibility,
+	}
+
+	// Users' repositories are either private or public.
+	if strings.EqualFold(user.Login, owner) {
+		endpoint = apiURL + "/user/repos"
+		delete(body, "visibility")
+	}
+
+	if status, err = forgeRequest(ctx, http.MethodPost, endpoint, headers, body, nil); err == nil && status != http.StatusCreated {
+		err = fmt.Errorf("creating the repository: %s", http.StatusText(status))
+	}
+
+	return err == nil, err
+}
+
+// ensureGitLabProject creates the project on GitLab, in the group or user
+// namespace its path is in. It returns whether it had to.
+func ensureGitLabProject(ctx context.Context, settings *CreateRepo, token string) (bool, error) {
+	apiURL := settings.APIURL
+
+	if apiURL == "" {
+		apiURL = gsDefaultGitLabAPI
+	}
+
+	apiURL = strings.TrimSuffix(apiURL, "/")
+	headers := map[string]string{"PRIVATE-TOKEN": token}
+	status, err := forgeRequest(ctx, http.MethodGet, apiURL+"/projects/"+url.PathEscape(settings.Project), headers, nil, nil)
+
+	switch {
+	case err != nil:
+		return false, err
+	case status == http.StatusOK:
+		return false, nil
+	case status != http.StatusNotFound:
+		return false, fmt.Errorf("looking the project up: %s", http.StatusText(status))
+	}
+
+	cut := strings.LastIndex(settings.Project, "/")
+	namespace, name := settings.Project[:cut], settings.Project[cut+1:]
+
+	var found struct {
+		ID int `json:"id"`
+	}
+
+	if status, err := forgeRequest(ctx, http.MethodGet, apiURL+"/namespaces/"+url.PathEscape(namespace), headers, nil, &found); err != nil || status != http.StatusOK {
+		if err == nil {
+			err = fmt.Errorf("looking namespace %s up: %s", namespace, http.StatusText(status))
+		}
+
+		return false, err
+	}
+
+	visibility := settings.Visibility
+
+	if visibility == "" {
+		visibility = "private"
+	}
+
+	body := map[string]interface{}{
+		"name":         name,
+		"path":         name,
+		"namespace_id": found.ID,
+		"visibility":   visibility,
+		"description":  settings.Description,
+	}
+
+	if settings.DefaultBranch != "" {
+		body["default_branch"] = settings.DefaultBranch
+	}
+
+	if status, err = forgeRequest(ctx, http.MethodPost, apiURL+"/projects", headers, body, nil); err == nil && status != http.StatusCreated {
+		err = fmt.Errorf("creating the project: %s", http.StatusText(status))
+	}
+
+	return err == nil, err
+}
+
+// ensureGiteaRepo creates the repository on Gitea or Forgejo, under the
+// organization that owns it or, if the token's user owns it, under the
+// user. With mark_mirror, the repository's website is source. It returns
+// whether it had to.
+func ensureGiteaRepo(ctx context.Context, settings *CreateRepo, token, source string) (bool, error) {
+	apiURL := strings.TrimSuffix(settings.APIURL, "/")
+	headers := map[string]string{"Authorization": "token " + token}
+	status, err := forgeRequest(ctx, http.MethodGet, apiURL+"/repos/"+settings.Project, headers, nil, nil)
+
+	switch {
+	case err != nil:
+		return false, err
+	case status == http.StatusOK:
+		return false, nil
+	case status != http.StatusNotFound:
+		return false, fmt.Errorf("looking the repository up: %s", http.StatusText(status))
+	}
+
+	var user struct {
+		Login string `json:"login"`
+	}
+
+	if status, err := forgeRequest(ctx, http.MethodGet, apiURL+"/user", headers, nil, &user); err != nil || status != http.StatusOK {
+		if err == nil {
+			err = fmt.Errorf("looking the token's user up: %s", http.StatusText(status))
+		}
+
+		return false, err
+	}
+
+	owner, name, _ := strings.Cut(settings.Project, "/")
+	endpoint := apiURL + "/orgs/" + owner + "/repos"
+
+	if strings.EqualFold(user.Login, owner) {
+		endpoint = apiURL + "/user/repos"
+	}
+
+	body := map[string]interface{}{
+		"name":        name,
+		"description": settings.Description,
+		"private":     settings.Visibility != "public",
+	}
+
+	if settings.DefaultBranch != "" {
+		body["default_branch"] = settings.DefaultBranch
+	}
+
+	if settings.MarkMirror && settings.Description == "" && source != "" {
+		body["description"] = "Mirror of " + source
+	}
+
+	if status, err = forgeRequest(ctx, http.MethodPost, endpoint, headers, body, nil); err == nil && status != http.StatusCreated {
+		err = fmt.Errorf("creating the repository: %s", http.StatusText(status))
+	}
+
+	if err != nil || !settings.MarkMirror || source == "" {
+		return err == nil, err
+	}
+
+	// The website can only be set once the repository exists.
+	if status, err = forgeRequest(ctx, http.MethodPatch, apiURL+"/repos/"+settings.Project, headers, map[string]string{"website": source}, nil); err == nil && status != http.StatusOK {
+		err = fmt.Errorf("marking the repository as a mirror: %s", http.StatusText(status))
+	}
+
+	return true, err
+}
+
+// ensureBitbucketRepo creates the repository in a Bitbucket Cloud workspace
+// or a Bitbucket Data Center project. The token is sent as an app password
+// with a username, and otherwise as an access token or, on Data Center, a
+// personal access token. It returns whether it had to.
+func ensureBitbucketRepo(ctx context.Context, settings *CreateRepo, token string) (bool, error) {
+	headers := map[string]string{"Authorization": "Bearer " + token}
+
+	if settings.Username != "" {
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(settings.Username+":"+token))
+	}
+
+	owner, name, _ := strings.Cut(settings.Project, "/")
+	endpoint := strings.TrimSuffix(settings.APIURL, "/") + "/projects/" + url.PathEscape(owner) + "/repos"
+	body := map[string]interface{}{"name": name, "scmId": "git", "public": settings.Visibility == "public"}
+
+	if settings.DefaultBranch != "" {
+		body["defaultBranch"] = settings.DefaultBranch
+	}
+
+	if settings.Type == "bitbucket" {
+		apiURL := settings.APIURL
+
+		if apiURL == "" {
+			apiURL = gsDefaultBitbucketAPI
+		}
+
+		endpoint = strings.TrimSuffix(apiURL, "/") + "/repositories/" + url.PathEscape(owner)
+		body = map[string]interface{}{"scm": "git", "is_private": settings.Visibility != "public"}
+	}
+
+	if settings.Description != "" {
+		body["description"] = settings.Description
+	}
+
+	status, err := forgeRequest(ctx, http.MethodGet, endpoint+"/"+url.PathEscape(name), headers, nil, nil)
+
+	switch {
+	case err != nil:
+		return false, err
+	case status == http.StatusOK:
+		return false, nil
+	case status != http.StatusNotFound:
+		return false, fmt.Errorf("looking the repository up: %s", http.StatusText(status))
+	}
+
+	// Cloud names the repository in the URL, Data Center in the body.
+	if settings.Type == "bitbucket" {
+		endpoint += "/" + url.PathEscape(name)
+	}
+
+	if status, err = forgeRequest(ctx, http.MethodPost, endpoint, headers, body, nil); err == nil && status != http.StatusOK && status != http.StatusCreated {
+		err = fmt.Errorf("creating the repository: %s", http.StatusText(status))
+	}
+
+	return err == nil, err
+}
+
+// ensureCodeCommitRepo creates the repository in CodeCommit, tagged and
+// encrypted with the KMS key as configured, signing the requests with the
+// AWS credentials found as the AWS CLI finds them. It returns whether it
+// had to.
+func ensureCodeCommitRepo(ctx context.Context, settings *CreateRepo, remoteURL string) (bool, error) {
+	region := settings.Region
+
+	// CodeCommit's Git URLs are on git-codecommit.<region>.amazonaws.com.
+	if endpoint, err := transport.NewEndpoint(remoteURL); region == "" && err == nil {
+		if parts := strings.Split(endpoint.Host, "."); len(parts) > 2 && parts[0] == "git-codecommit" {
+			region = parts[1]
+		}
+	}
+
+	if region == "" {
+		return false, errors.New("no region in the remote's URL, set create's region")
+	}
+
+	apiURL := settings.APIURL
+
+	if apiURL == "" {
+		apiURL = "https://codecommit." + region + ".amazonaws.com/"
+	}
+
+	status, errType, err := awsJSONRequest(ctx, apiURL, region, "codecommit", "CodeCommit_20150413.GetRepository", map[string]string{"repositoryName": settings.Project})
+
+	switch {
+	case status == http.StatusOK:
+		return false, nil
+	case errType != "RepositoryDoesNotExistException" && err != nil:
+		return false, err
+	case errType != "RepositoryDoesNotExistException":
+		return false, fmt.Errorf("looking the repository up: %s", http.StatusText(status))
+	}
+
+	body := map[string]interface{}{"repositoryName": settings.Project}
+
+	if settings.Description != "" {
+		body["repositoryDescription"] = settings.Description
+	}
+
+	if len(settings.Tags) > 0 {
+		body["tags"] = settings.Tags
+	}
+
+	if settings.KMSKeyID != "" {
+		body["kmsKeyId"] = settings.KMSKeyID
+	}
+
+	if status, _, err = awsJSONRequest(ctx, apiURL, region, "codecommit", "CodeCommit_20150413.CreateRepository", body); err == nil && status != http.StatusOK {
+		err = fmt.Errorf("creating the repository: %s", http.StatusText(status))
+	}
+
+	return err == nil, err
+}
+
+// projectFromURL is the repository a remote URL points at on a forge: the
+// whole path for GitLab, whose groups nest, the last part for CodeCommit,
+// whose repositories have no owner, and otherwise its last two parts,
+// owner/repo, which leaves out what comes before them, like the /scm/
+// Bitbucket Data Center serves HTTPS clones under.
+func projectFromURL(forge, remoteURL string) (string, error) {
+	endpoint, err := transport.NewEndpoint(remoteURL)
+
+	if err != nil {
+		return "", err
+	}
+
+	project := strings.TrimSuffix(strings.Trim(endpoint.Path, "/"), ".git")
+
+	if parts := strings.Split(project, "/"); forge != "gitlab" && len(parts) > 2 {
+		project = strings.Join(parts[len(parts)-2:], "/")
+	}
+
+	if forge == "codecommit" {
+		return project[strings.LastIndex(project, "/")+1:], nil
+	}
+
+	if !strings.Contains(project, "/") {
+		return "", fmt.Errorf("no project in %s, set create's project", remoteURL)
+	}
+
+	return project, nil
+}
+
+// mirroredURL is the URL of the source the first sync entry pushing to
+// target mirrors, without any credentials in it.
+func (s *Syncer) mirroredURL(target string) string {
+	for _, entry := range s.config.Sync {
+		if entry.Target != target {
+			continue
+		}
+
+		source := s.effectiveURL(entry.Source, false)
+
+		if parsed, err := url.Parse(source); err == nil && parsed.User != nil {
+			parsed.User = nil
+			source = parsed.String()
+		}
+
+		return source
+	}
+
+	return ""
+}
+
+// forgeRequest calls a forge's JSON API, sending body as JSON if there is
+// one and decoding a successful response into result if it is given. It
+// returns the response's status.
+func forgeRequest(ctx context.Context, method, endpoint string, headers map[string]string, body, result interface{}) (int, error) {
+	var reader io.Reader
+
+	if body != nil {
+		encoded, err := json.Marshal(body)
+
+		if err != nil {
+			return 0, err
+		}
+
+		reader = bytes.NewReader(encoded)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if result != nil && resp.StatusCode/100 == 2 {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return resp.StatusCode, fmt.Errorf("could not decode %s: %w", endpoint, err)
+		}
+	}
+
+	return resp.StatusCode, nil
+}
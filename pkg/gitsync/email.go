@@ -0,0 +1,156 @@
+package gitsync
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const gsDefaultSMTPPort int = 587
+
+// SMTP is the mail server email notifications are sent through.
+type SMTP struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Subject  string   `json:"subject"`
+	// TLS connects with implicit TLS (usually port 465), otherwise STARTTLS
+	// is used whenever the server offers it unless Plaintext is set.
+	TLS       bool `json:"tls"`
+	Plaintext bool `json:"plaintext"`
+}
+
+// emailNotifier mails run summaries.
+type emailNotifier struct{}
+
+func (n emailNotifier) Check(notification Notification) error {
+	settings := notification.SMTP
+
+	if settings == nil || settings.Host == "" || settings.From == "" || len(settings.To) == 0 {
+		return errors.New("needs smtp host, from and to")
+	}
+
+	if settings.TLS && settings.Plaintext {
+		return errors.New("smtp can't be both tls and plaintext")
+	}
+
+	return nil
+}
+
+func (n emailNotifier) Events() []string {
+	return []string{eventRunFinished}
+}
+
+func (n emailNotifier) Send(message *NotificationMessage) error {
+	return sendEmail(message.Notification.SMTP, message.Subject, message.Text)
+}
+
+// sendEmail delivers a notification over SMTP, refusing to send credentials
+// over an unencrypted connection.
+func sendEmail(settings *SMTP, subject, message string) error {
+	port := settings.Port
+
+	if port == 0 {
+		port = gsDefaultSMTPPort
+	}
+
+	addr := net.JoinHostPort(settings.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: settings.Host}
+
+	var conn net.Conn
+	var err error
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	if settings.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, settings.Host)
+
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	defer client.Close()
+
+	encrypted := settings.TLS
+
+	if !settings.TLS && !settings.Plaintext {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+
+			encrypted = true
+		}
+	}
+
+	if settings.Username != "" {
+		if !encrypted {
+			return errors.New("refusing to authenticate over an unencrypted smtp connection")
+		}
+
+		password, err := resolveSecret(settings.Password)
+
+		if err != nil {
+			return err
+		}
+
+		if err := client.Auth(smtp.PlainAuth("", settings.Username, password, settings.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(settings.From); err != nil {
+		return err
+	}
+
+	for _, to := range settings.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+
+	if err != nil {
+		return err
+	}
+
+	headers := []string{
+		"From: " + settings.From,
+		"To: " + strings.Join(settings.To, ", "),
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+
+	body := strings.ReplaceAll(message, "\n", "\r\n")
+
+	if _, err := fmt.Fprintf(w, "%s\r\n\r\n%s", strings.Join(headers, "\r\n"), body); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
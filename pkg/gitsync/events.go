@@ -0,0 +1,169 @@
+package gitsync
+
+import (
+	"time"
+)
+
+// EventType is a point in a run's lifecycle.
+type EventType string
+
+// Events published on a Syncer's event bus, in the order they happen.
+const (
+	EventRunStarted     EventType = "run_started"
+	EventSyncStarted    EventType = "sync_started"
+	EventSyncSkipped    EventType = "sync_skipped"
+	EventBranchPulled   EventType = "branch_pulled"
+	EventBranchPushed   EventType = "branch_pushed"
+	EventBranchFinished EventType = "branch_finished"
+	EventSyncFinished   EventType = "sync_finished"
+	EventRunFinished    EventType = "run_finished"
+	// EventError is published whenever something fails, as well as the
+	// lifecycle event that records the failure.
+	EventError EventType = "error"
+	// EventConfigChanged is published during a run whose config changed at
+	// its source, which the run goes on using; see Syncer.ConfigChanged.
+	EventConfigChanged EventType = "config_changed"
+)
+
+// Event is something that happened during a run. Logging, metrics,
+// notifications, on_failure hooks and error tracking all subscribe to a
+// Syncer's events, and library users can too with Subscribe.
+type Event struct {
+	Type EventType
+	Time time.Time
+	Run  *RunResult
+	// Entry and Sync are the sync entry being processed, for sync and branch
+	// events.
+	Entry *SyncEntry
+	Sync  *SyncResult
+	// Branch is set for branch events, and for errors syncing a branch.
+	Branch *BranchResult
+	// Err is the error of an EventError or EventBranchPulled.
+	Err error
+
+	span *span
+}
+
+// Subscribe calls handler with every event of every later run, after the
+// Syncer's own subscribers. Handlers are called synchronously, in the order
+// they subscribed, and must not call back into the Syncer.
+func (s *Syncer) Subscribe(handler func(Event)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.subscribers = append(s.subscribers, handler)
+}
+
+// publish fills in the run and the sync entry being processed and hands the
+// event to every subscriber.
+func (s *Syncer) publish(event Event) {
+	event.Time = time.Now()
+	event.Run = s.run
+
+	if event.Sync == nil {
+		event.Entry = s.currentEntry
+		event.Sync = s.currentSync
+	}
+
+	for _, handler := range s.subscribers {
+		handler(event)
+	}
+}
+
+// subscribeBuiltins subscribes the Syncer's own observers, in the order their
+// side effects should happen.
+func (s *Syncer) subscribeBuiltins() {
+	s.subscribers = []func(Event){
+		s.logEvent,
+		s.recordEventMetrics,
+		s.runEventHooks,
+		s.reportEvent,
+		s.notifyEvent,
+		s.streamEvent,
+	}
+}
+
+func (s *Syncer) logEvent(event Event) {
+	switch event.Type {
+	case EventSyncStarted:
+		s.infoPrintf("syncing %d branches between %s and %s\n", len(event.Entry.Branches), event.Sync.Source, event.Sync.Target)
+	case EventSyncSkipped:
+		s.warnPrintf("Attempting sync from %s to %s would fail, skipping...\n", event.Sync.Source, event.Sync.Target)
+	case EventBranchPulled:
+		if event.Err == nil {
+			s.debugPrintf("pulled %s from %s: %s -> %s\n", event.Branch.Branch, event.Sync.Source, ShortSHA(event.Branch.OldSHA), ShortSHA(event.Branch.NewSHA))
+		}
+	case EventBranchPushed:
+		s.debugPrintf("pushed %s to %s: %s\n", event.Branch.Branch, event.Sync.Target, ShortSHA(event.Branch.NewSHA))
+	case EventConfigChanged:
+		s.warnPrintf("config changed during the run, finishing it with the config it started with (%s)\n", shortChecksum(event.Run.ConfigChecksum))
+	case EventError:
+		if event.Branch != nil {
+			s.errorPrintf("syncing %s from %s to %s: %s\n", event.Branch.Branch, event.Sync.Source, event.Sync.Target, event.Err)
+		} else {
+			s.errorPrintf("%s\n", event.Err)
+		}
+	}
+}
+
+func (s *Syncer) recordEventMetrics(event Event) {
+	switch event.Type {
+	case EventRunStarted:
+		metricLastRun.replace(1, event.Run.ID)
+	case EventSyncStarted:
+		s.metricAdd(metricSyncsAttempted, 1, event.Sync.Source, event.Sync.Target)
+	case EventBranchFinished:
+		source, target, branch := event.Sync.Source, event.Sync.Target, event.Branch
+
+		s.metricObserve(metricBranchDuration, branch.Duration.Seconds(), source, target, branch.Branch)
+		s.metricObserve(metricPhaseDuration, branch.PullDuration.Seconds(), source, target, branch.Branch, "pull")
+		s.metricObserve(metricPhaseDuration, branch.PushDuration.Seconds(), source, target, branch.Branch, "push")
+		s.metricAdd(metricBranchBytes, float64(branch.BytesReceived), source, target, branch.Branch, "received")
+		s.metricAdd(metricBranchBytes, float64(branch.BytesSent), source, target, branch.Branch, "sent")
+	case EventSyncFinished:
+		if event.Sync.Status == StatusSynced {
+			s.metricAdd(metricSyncsSucceeded, 1, event.Sync.Source, event.Sync.Target)
+			s.metricSet(metricLastSuccess, float64(time.Now().Unix()), event.Sync.Source, event.Sync.Target)
+		} else {
+			s.metricAdd(metricSyncsFailed, 1, event.Sync.Source, event.Sync.Target)
+		}
+	case EventRunFinished:
+		s.pushMetrics()
+	}
+}
+
+// runEventHooks runs on_failure hooks. Other hooks can fail what they are
+// run for, so they are run by the engine itself rather than from events.
+func (s *Syncer) runEventHooks(event Event) {
+	switch {
+	case event.Type == EventSyncFinished && event.Sync.Status != StatusSynced:
+		s.runFailureHooks(event.Entry.Hooks.OnFailure, event.span, event.Sync)
+	case event.Type == EventRunFinished && event.Run.Failed():
+		s.runFailureHooks(s.config.Hooks.OnFailure, event.span, nil)
+	}
+}
+
+func (s *Syncer) reportEvent(event Event) {
+	if event.Type == EventRunFinished {
+		s.reportSyncFailures()
+		s.recordHistory()
+		s.pingHealthcheck()
+	}
+}
+
+func (s *Syncer) notifyEvent(event Event) {
+	switch {
+	case event.Type == EventRunStarted:
+		s.notify(eventRunStarted, nil)
+	case event.Type == EventSyncFinished:
+		s.notify(eventSyncFinished, event.Sync)
+
+		if event.Sync.Status != StatusSynced {
+			s.notify(eventSyncFailed, event.Sync)
+		}
+	case event.Type == EventRunFinished:
+		s.notify(eventRunFinished, nil)
+	case event.Type == EventConfigChanged:
+		s.notify(eventConfigChanged, nil)
+	}
+}
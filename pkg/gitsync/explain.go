@@ -0,0 +1,245 @@
+package gitsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Causes of a branch not syncing, as Explain tells them.
+const (
+	CauseNotConfigured  string = "not configured"
+	CauseMissingRemote  string = "missing remote"
+	CauseMissingBranch  string = "missing branch"
+	CausePushURLRefused string = "push url refused"
+	CauseSameRemote     string = "same remote"
+	CauseProtected      string = "protected branch"
+	CauseAuth           string = "auth error"
+	CauseDiverged       string = "diverged"
+	CauseNotConfirmed   string = "not confirmed"
+	CauseLargeChange    string = "large change"
+	CauseAtomicGroup    string = "atomic group failed"
+	CauseFailFast       string = "fail fast"
+	CauseUnknown        string = "unknown"
+)
+
+// gsCauses tell the causes apart by what their errors say, which is all the
+// history keeps of them, in the order they are tried: a protected branch
+// refusing a push can read like an authorization failure, for one. Besides
+// gitsync's own errors they know what git, go-git and the larger forges say.
+var gsCauses = []struct {
+	cause    string
+	messages []string
+	hint     string
+}{
+	{CauseNotConfigured, []string{"no sync entry syncs"}, "no sync entry syncs the branch from the source to the target: add it to one, e.g. with gitsync config add-sync"},
+	{CauseMissingRemote, []string{"remote doesn't exist"}, "add the remote to the repository, or give it a url in the config's remotes and sync in a -workdir"},
+	{CauseMissingBranch, []string{"branch doesn't exist", errMissingOnSource.Error()}, "fetch the branch into the repository, check the source still has it, or take it out of the sync entry"},
+	{CausePushURLRefused, []string{errPushURLRefused.Error()}, "the target's URL matches a -deny-push-url pattern, or none of the -allow-push-url ones"},
+	{CauseSameRemote, []string{errSameRemote.Error()}, "the source and target point at the same repository: fix one of their URLs, or set allow_same_remote on the sync entry"},
+	{CauseProtected, []string{"protected branch", "gh006", "pre-receive hook declined", "not allowed to push", "not allowed to force push", "cannot force-push"}, "the target protects the branch from this push: let gitsync's account push, or force push, to it, or sync it via_pr"},
+	{CauseAuth, []string{transport.ErrAuthenticationRequired.Error(), transport.ErrAuthorizationFailed.Error(), "permission denied", "could not read username", "invalid credentials", "returned error: 401", "returned error: 403"}, "the remote refused gitsync's credentials: check the remote's auth, and that it can still read the source and push to the target"},
+	{CauseDiverged, []string{errHistoryRewritten.Error(), git.ErrNonFastForwardUpdate.Error(), "non-fast-forward", "fetch first"}, "the source or the target was rewritten, so one no longer descends from the other: see on_rewrite"},
+	{CauseNotConfirmed, []string{errNotConfirmed.Error()}, "a force push or deletion needs confirming: run gitsync on a terminal, pass -yes or set allow_destructive"},
+	{CauseLargeChange, []string{errLargeChange.Error()}, "the change is bigger than max_change allows: review it, then sync it with -confirm-large-change"},
+	{CauseAtomicGroup, []string{errAtomicGroupFailed.Error()}, "another branch of the atomic sync entry failed, so this one wasn't synced: explain that one"},
+	{CauseFailFast, []string{errFailFast.Error()}, "an earlier branch failed and -fail-fast stopped the run before this one"},
+}
+
+// Explanation is why a branch was or wasn't synced: what the last run in the
+// history recorded for it, and what is wrong with it now, going by the
+// config and the repository, that would stop the next run syncing it.
+type Explanation struct {
+	Source string
+	Target string
+	Branch string
+	// Configured is whether a sync entry syncs the branch from the source
+	// to the target.
+	Configured bool
+	// LastRun is nil when the history has no run that synced the branch,
+	// or there's no history.
+	LastRun *LastRun
+	// Problems are what is wrong now.
+	Problems []string
+	// Cause is what stops the branch syncing, the first of the problems
+	// or else what the last run failed with, and "" if nothing does. Hint
+	// is what to do about it.
+	Cause string
+	Hint  string
+}
+
+// ExplainReport is the explanation for every sync entry of a branch.
+type ExplainReport struct {
+	History      bool
+	Explanations []*Explanation
+}
+
+type reportExplanation struct {
+	Source     string         `json:"source_remote"`
+	Target     string         `json:"target_remote"`
+	Branch     string         `json:"branch"`
+	Configured bool           `json:"configured"`
+	LastRun    *reportLastRun `json:"last_run"`
+	Problems   []string       `json:"problems"`
+	Cause      string         `json:"cause,omitempty"`
+	Hint       string         `json:"hint,omitempty"`
+}
+
+// WriteJSON writes the report as JSON to w.
+func (r *ExplainReport) WriteJSON(w io.Writer) error {
+	explanations := []reportExplanation{}
+
+	for _, e := range r.Explanations {
+		explanation := reportExplanation{
+			Source:     e.Source,
+			Target:     e.Target,
+			Branch:     e.Branch,
+			Configured: e.Configured,
+			Problems:   append([]string{}, e.Problems...),
+			Cause:      e.Cause,
+			Hint:       e.Hint,
+		}
+
+		if run := e.LastRun; run != nil {
+			explanation.LastRun = &reportLastRun{RunID: run.RunID, Finished: run.Finished, Status: run.Status, SHA: run.SHA, Error: run.Error}
+		}
+
+		explanations = append(explanations, explanation)
+	}
+
+	report, err := json.MarshalIndent(map[string]interface{}{
+		"version":      Version,
+		"history":      r.History,
+		"explanations": explanations,
+	}, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(report, '\n'))
+
+	return err
+}
+
+// Explain explains why branch was or wasn't synced from source to target,
+// or for every sync entry with the branch when they are empty. It checks
+// what a run checks before syncing anything, without reaching the
+// remotes, and looks up the last run of the branch in the history.
+func (s *Syncer) Explain(source, target, branch string) (*ExplainReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.collectRepoInfo(); err != nil {
+		return nil, err
+	}
+
+	report := &ExplainReport{History: s.history != nil}
+	var entries []SyncEntry
+
+	for _, entry := range s.config.Sync {
+		if (source == "" || entry.Source == source) && (target == "" || entry.Target == target) && slices.Contains(entry.Branches, branch) {
+			entries = append(entries, entry)
+		}
+	}
+
+	if len(entries) == 0 {
+		entries = append(entries, SyncEntry{Source: source, Target: target})
+	}
+
+	for _, entry := range entries {
+		explanation := &Explanation{Source: entry.Source, Target: entry.Target, Branch: branch, Configured: entry.Branches != nil}
+		explanation.Problems = s.problems(entry, branch)
+
+		lastRun, err := s.lastRun(entry.Source, entry.Target, branch)
+
+		if err != nil {
+			return nil, fmt.Errorf("could not read the history: %w", err)
+		}
+
+		explanation.LastRun = lastRun
+
+		switch {
+		case len(explanation.Problems) > 0:
+			explanation.Cause, explanation.Hint = causeOf(explanation.Problems[0])
+		case lastRun != nil && (lastRun.Status == StatusFailed || lastRun.Status == StatusSkipped):
+			explanation.Cause, explanation.Hint = causeOf(lastRun.Error)
+		}
+
+		report.Explanations = append(report.Explanations, explanation)
+	}
+
+	return report, nil
+}
+
+// problems are what would stop a run syncing branch for entry, as far as
+// can be told without reaching the remotes.
+func (s *Syncer) problems(entry SyncEntry, branch string) []string {
+	var problems []string
+
+	if entry.Branches == nil {
+		problems = append(problems, fmt.Sprintf("no sync entry syncs %s%s%s", branch, optional(" from ", entry.Source), optional(" to ", entry.Target)))
+	}
+
+	if entry.Source != "" && !s.remoteExists(entry.Source) {
+		problems = append(problems, fmt.Sprintf("%s source remote doesn't exist", entry.Source))
+	}
+
+	if entry.Target != "" && !s.remoteExists(entry.Target) {
+		problems = append(problems, fmt.Sprintf("%s target remote doesn't exist", entry.Target))
+	}
+
+	if !s.branchExists(branch) {
+		problems = append(problems, fmt.Sprintf("%s branch doesn't exist", branch))
+	}
+
+	// Any of the entry's other branches missing skips it too.
+	for _, other := range entry.Branches {
+		if other != branch && !s.branchExists(other) {
+			problems = append(problems, fmt.Sprintf("%s branch doesn't exist, so the sync entry is skipped", other))
+		}
+	}
+
+	if entry.Branches != nil && s.remoteExists(entry.Source) && s.remoteExists(entry.Target) {
+		if err := s.sameRemoteURL(entry); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if entry.Target != "" && s.remoteExists(entry.Target) {
+		if err := s.pushURLAllowed(s.effectiveURL(entry.Target, true)); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	return problems
+}
+
+// causeOf tells which cause an error, as recorded, is, and what to do about
+// it.
+func causeOf(message string) (string, string) {
+	lower := strings.ToLower(message)
+
+	for _, cause := range gsCauses {
+		for _, known := range cause.messages {
+			if strings.Contains(lower, known) {
+				return cause.cause, cause.hint
+			}
+		}
+	}
+
+	return CauseUnknown, ""
+}
+
+func optional(prefix, value string) string {
+	if value == "" {
+		return ""
+	}
+
+	return prefix + value
+}
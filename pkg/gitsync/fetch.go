@@ -0,0 +1,301 @@
+package gitsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+var errMissingOnSource = errors.New("branch doesn't exist on the source")
+
+// FetchResult is the single fetch of a run from one source remote, which
+// brings in every branch synced from it.
+type FetchResult struct {
+	Remote        string
+	Branches      []string
+	Duration      time.Duration
+	BytesReceived int64
+	Err           error
+}
+
+// trackingRef is where a source's branch is fetched to.
+func trackingRef(source, branch string) plumbing.ReferenceName {
+	return plumbing.NewRemoteReferenceName(source, branch)
+}
+
+// gsDefaultFetchesPerHost is how many sources on one host are fetched at
+// once unless Options says otherwise.
+const gsDefaultFetchesPerHost = 2
+
+// fetchSources fetches every branch the run syncs from each source remote,
+// once per remote, into refs/remotes/<source>/<branch>, so branches are
+// then brought up to date from what was fetched instead of each pulling on
+// its own. Only branches the preflight check saw on the source are fetched;
+// sources that failed it aren't fetched at all, and nor are branches
+// skip_unchanged skips for every target. With shared objects, the
+// fetch goes into them instead and the tracking refs are pointed at it.
+// Sources are fetched concurrently, up to fetchesPerHost at a time from
+// any one host.
+func (s *Syncer) fetchSources(ctx context.Context, runSpan *span) {
+	var sources []string
+	branches := map[string][]string{}
+	seen := map[string]bool{}
+
+	for _, entry := range s.config.Sync {
+		heads, reachable := s.remoteRefs[preflightCheck{entry.Source, false}]
+
+		if !reachable {
+			continue
+		}
+
+		if _, exists := branches[entry.Source]; !exists {
+			sources = append(sources, entry.Source)
+			branches[entry.Source] = nil
+		}
+
+		for _, branch := range entry.Branches {
+			key := entry.Source + "\x00" + branch
+			_, unchanged := s.unchanged[syncedKey(entry.Source, entry.Target, branch)]
+
+			if _, onSource := heads[plumbing.NewBranchReferenceName(branch)]; onSource && !unchanged && !seen[key] {
+				seen[key] = true
+				branches[entry.Source] = append(branches[entry.Source], branch)
+			}
+		}
+	}
+
+	s.fetched = map[string]*FetchResult{}
+
+	// Opening the repository up front fails every fetch if it can't be
+	// opened, and creates the shared objects before the fetches race to.
+	_, err := s.openRepo()
+	shared := s.config.SharedObjects != ""
+	hosts := map[string]chan struct{}{}
+	spans := map[string]*span{}
+
+	var wg sync.WaitGroup
+
+	for _, source := range sources {
+		result := &FetchResult{Remote: source, Branches: branches[source], Err: err}
+		s.fetched[source] = result
+		s.run.Fetches = append(s.run.Fetches, result)
+
+		if err != nil || len(result.Branches) == 0 || ctx.Err() != nil {
+			continue
+		}
+
+		host := urlHost(s.effectiveURL(source, false))
+
+		if hosts[host] == nil {
+			hosts[host] = make(chan struct{}, s.fetchesPerHost)
+		}
+
+		s.infoPrintf("fetching %d branches from %s\n", len(result.Branches), source)
+		fetchSpan := s.tracer.start(runSpan, "fetch", "remote", source, "branches", fmt.Sprint(len(result.Branches)))
+		spans[source] = fetchSpan
+		slots := hosts[host]
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			result.Err = s.fetchSource(ctx, result, shared)
+			fetchSpan.finish(result.Err)
+		}()
+	}
+
+	wg.Wait()
+
+	for _, result := range s.run.Fetches {
+		fetchSpan, fetched := spans[result.Remote]
+
+		switch {
+		case !fetched:
+		case result.Err == nil:
+			s.debugPrintf("fetched %s in %s, %s received\n", result.Remote, result.Duration.Round(time.Millisecond), HumanBytes(result.BytesReceived))
+		case ctx.Err() == nil:
+			s.publish(Event{Type: EventError, Err: result.Err, span: fetchSpan})
+		}
+	}
+}
+
+// fetchSource fetches result's branches from its remote. It opens the
+// repository, or the shared objects, afresh, as go-git repositories aren't
+// safe to share between the fetches running at once.
+func (s *Syncer) fetchSource(ctx context.Context, result *FetchResult, shared bool) error {
+	source := result.Remote
+	repo, err := s.openRepo()
+	into, dir := repo, s.repoDir
+
+	if err == nil && shared {
+		into, err = s.openSharedObjects()
+		dir = s.config.SharedObjects
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var refSpecs []config.RefSpec
+	firstMirror := true
+
+	for _, branch := range result.Branches {
+		destination := trackingRef(source, branch)
+
+		if shared {
+			destination = s.sharedRef(source, branch)
+		}
+
+		if _, err := into.Reference(destination, false); err == nil {
+			firstMirror = false
+		}
+
+		refSpecs = append(refSpecs, config.RefSpec("+"+plumbing.NewBranchReferenceName(branch).String()+":"+destination.String()))
+	}
+
+	shallow, err := into.Storer.Shallow()
+
+	if err != nil {
+		return err
+	}
+
+	counter := &byteCounter{}
+	progress := s.newProgress("fetch", source, fmt.Sprintf("%d branches", len(result.Branches)))
+
+	if progress != nil {
+		progress.counter = counter
+	}
+
+	started := time.Now()
+	backend := s.backendFor(source, opPull)
+
+	// A first mirror, or one an interrupted fetch left shallow, is fetched
+	// in steps if the source says so; deepen_by needs the git backend.
+	if gitBackend, git := backend.(systemGitBackend); git && s.deepenBy(source) > 0 && (firstMirror || len(shallow) > 0) {
+		err = gitBackend.fetchInSteps(countBytes(ctx, counter), into, dir, source, refSpecs, progress, s.deepenBy(source))
+	} else {
+		err = backend.fetch(countBytes(ctx, counter), into, dir, source, refSpecs, progress)
+	}
+
+	result.Duration = time.Since(started)
+	result.BytesReceived = counter.received.Load()
+	progress.finish()
+
+	if err != nil {
+		return fmt.Errorf("could not fetch from %s: %w", source, err)
+	}
+
+	if shared {
+		return s.linkShared(repo, into, source, result.Branches)
+	}
+
+	return nil
+}
+
+// fastForward brings branchRef up to date with what was fetched for it
+// from source. It returns git.ErrNonFastForwardUpdate if the fetched tip
+// doesn't descend from the branch, and leaves a branch that is already
+// ahead of the source alone, like git merge --ff-only.
+func (s *Syncer) fastForward(repo *git.Repository, worktree *git.Worktree, source string, branchRef plumbing.ReferenceName) error {
+	fetch := s.fetched[source]
+
+	switch {
+	case fetch == nil:
+		return fmt.Errorf("%s wasn't fetched", source)
+	case fetch.Err != nil:
+		return fetch.Err
+	}
+
+	fetched, err := repo.Reference(trackingRef(source, branchRef.Short()), true)
+
+	if err != nil || !fetch.has(branchRef.Short()) {
+		return fmt.Errorf("%w: %s on %s", errMissingOnSource, branchRef.Short(), source)
+	}
+
+	local, err := repo.Reference(branchRef, true)
+
+	if err != nil {
+		return err
+	}
+
+	if local.Hash() == fetched.Hash() {
+		return nil
+	}
+
+	localCommit, err := repo.CommitObject(local.Hash())
+
+	if err != nil {
+		return err
+	}
+
+	fetchedCommit, err := repo.CommitObject(fetched.Hash())
+
+	if err != nil {
+		return err
+	}
+
+	if ahead, err := fetchedCommit.IsAncestor(localCommit); err != nil || ahead {
+		return err
+	}
+
+	if descends, err := localCommit.IsAncestor(fetchedCommit); err != nil || !descends {
+		if err != nil {
+			return err
+		}
+
+		return git.ErrNonFastForwardUpdate
+	}
+
+	return moveBranch(repo, worktree, branchRef, fetched.Hash())
+}
+
+// moveBranch points branchRef at hash. The checkout, if there is one, is
+// reset to match if the branch is the one checked out, so it never looks
+// modified.
+func moveBranch(repo *git.Repository, worktree *git.Worktree, branchRef plumbing.ReferenceName, hash plumbing.Hash) error {
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(branchRef, hash)); err != nil {
+		return fmt.Errorf("could not move %s to %s: %w", branchRef.Short(), ShortSHA(hash.String()), err)
+	}
+
+	if head, err := repo.Storer.Reference(plumbing.HEAD); worktree != nil && err == nil && head.Type() == plumbing.SymbolicReference && head.Target() == branchRef {
+		if err := worktree.Reset(&git.ResetOptions{Commit: hash, Mode: git.HardReset}); err != nil {
+			return fmt.Errorf("could not update the checkout of %s: %w", branchRef.Short(), err)
+		}
+	}
+
+	return nil
+}
+
+// urlHost is the host a remote URL connects to, for limiting the fetches
+// per host. Local paths all count as one host.
+func urlHost(remoteURL string) string {
+	endpoint, err := transport.NewEndpoint(remoteURL)
+
+	if err != nil {
+		return remoteURL
+	}
+
+	return strings.ToLower(endpoint.Host)
+}
+
+func (f *FetchResult) has(branch string) bool {
+	for _, fetched := range f.Branches {
+		if fetched == branch {
+			return true
+		}
+	}
+
+	return false
+}
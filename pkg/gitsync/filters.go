@@ -0,0 +1,259 @@
+package gitsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// gsFilterMaxSteps stops a filter that loops forever from hanging the run.
+const gsFilterMaxSteps uint64 = 10000000
+
+// gsMaxFilterCommits bounds how many commits a filter is shown.
+const gsMaxFilterCommits int = 1000
+
+// ScriptFilter is a Starlark script defining filter(change), which is called
+// for every branch after it is pulled and before it is pushed, and can veto
+// the push or change what is pushed where.
+type ScriptFilter struct {
+	Script string `json:"script"`
+}
+
+// scriptFilter is a loaded filter script, frozen so it can be called from
+// any run.
+type scriptFilter struct {
+	path string
+	fn   starlark.Callable
+}
+
+// filterDecision is what the filters made of a branch.
+type filterDecision struct {
+	allow        bool
+	reason       string
+	filter       string
+	sha          string
+	targetBranch string
+}
+
+func loadScriptFilters(where string, filters []ScriptFilter) ([]*scriptFilter, bool) {
+	var loaded []*scriptFilter
+
+	for i, filter := range filters {
+		if filter.Script == "" {
+			errorPrintf("%s filter %d has no script\n", where, i)
+			return nil, false
+		}
+
+		thread := &starlark.Thread{Name: filter.Script}
+		thread.SetMaxExecutionSteps(gsFilterMaxSteps)
+
+		globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, filter.Script, nil, starlark.StringDict{"struct": starlark.NewBuiltin("struct", starlarkstruct.Make)})
+
+		if err != nil {
+			errorPrintf("%s filter %s: %s\n", where, filter.Script, err)
+			return nil, false
+		}
+
+		globals.Freeze()
+
+		fn, ok := globals["filter"].(starlark.Callable)
+
+		if !ok {
+			errorPrintf("%s filter %s doesn't define filter(change)\n", where, filter.Script)
+			return nil, false
+		}
+
+		loaded = append(loaded, &scriptFilter{path: filter.Script, fn: fn})
+	}
+
+	return loaded, true
+}
+
+// filterCommits lists the commits a push would add, newest first. With no
+// oldSHA, when the target doesn't have the branch yet, that is the branch's
+// most recent history.
+func filterCommits(repo *git.Repository, oldSHA, newSHA string) *starlark.List {
+	var commits []starlark.Value
+
+	if newSHA == "" || oldSHA == newSHA {
+		return starlark.NewList(commits)
+	}
+
+	log, err := repo.Log(&git.LogOptions{From: plumbing.NewHash(newSHA)})
+
+	if err != nil {
+		return starlark.NewList(commits)
+	}
+
+	log.ForEach(func(c *object.Commit) error {
+		if c.Hash.String() == oldSHA || len(commits) >= gsMaxFilterCommits {
+			return storer.ErrStop
+		}
+
+		commits = append(commits, starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"sha":     starlark.String(c.Hash.String()),
+			"author":  starlark.String(c.Author.Name),
+			"email":   starlark.String(c.Author.Email),
+			"message": starlark.String(c.Message),
+			"time":    starlark.MakeInt64(c.Author.When.Unix()),
+			"parents": starlark.MakeInt(c.NumParents()),
+		}))
+
+		return nil
+	})
+
+	return starlark.NewList(commits)
+}
+
+// runFilters calls every filter in turn with the branch's change, which runs
+// from targetSHA, what the target has now, to the pulled commit. The first
+// veto wins; changes to what is pushed accumulate, later filters seeing
+// earlier filters' changes.
+func (s *Syncer) runFilters(ctx context.Context, filters []*scriptFilter, repo *git.Repository, source, target, targetSHA string, result *BranchResult) (filterDecision, error) {
+	decision := filterDecision{allow: true}
+	commits := filterCommits(repo, targetSHA, result.NewSHA)
+	commits.Freeze()
+
+	for _, filter := range filters {
+		targetBranch := result.Branch
+
+		if decision.targetBranch != "" {
+			targetBranch = decision.targetBranch
+		}
+
+		newSHA := result.NewSHA
+
+		if decision.sha != "" {
+			newSHA = decision.sha
+		}
+
+		change := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"run_id":        starlark.String(s.run.ID),
+			"repository":    starlark.String(s.repoDir),
+			"source":        starlark.String(source),
+			"target":        starlark.String(target),
+			"branch":        starlark.String(result.Branch),
+			"target_branch": starlark.String(targetBranch),
+			"old_sha":       starlark.String(targetSHA),
+			"new_sha":       starlark.String(newSHA),
+			"commits":       commits,
+		})
+
+		thread := &starlark.Thread{
+			Name:  filter.path,
+			Print: func(_ *starlark.Thread, msg string) { s.infoPrintf("%s: %s\n", filter.path, msg) },
+		}
+		thread.SetMaxExecutionSteps(gsFilterMaxSteps)
+
+		stop := context.AfterFunc(ctx, func() { thread.Cancel(ctx.Err().Error()) })
+		value, err := starlark.Call(thread, filter.fn, starlark.Tuple{change}, nil)
+		stop()
+
+		if err != nil {
+			var evalErr *starlark.EvalError
+
+			if errors.As(err, &evalErr) {
+				return decision, fmt.Errorf("filter %s: %s", filter.path, evalErr.Backtrace())
+			}
+
+			return decision, fmt.Errorf("filter %s: %w", filter.path, err)
+		}
+
+		if err := decision.apply(filter.path, value); err != nil {
+			return decision, err
+		}
+
+		if !decision.allow {
+			return decision, nil
+		}
+	}
+
+	return decision, nil
+}
+
+// apply folds a filter's return value into the decision: None or True
+// allows the push, False or a string vetoes it, and a dict can veto with
+// "allow" and "reason" or redirect it with "sha" and "target_branch".
+func (d *filterDecision) apply(path string, value starlark.Value) error {
+	switch v := value.(type) {
+	case starlark.NoneType:
+		return nil
+	case starlark.Bool:
+		if !v {
+			d.allow = false
+			d.filter = path
+		}
+
+		return nil
+	case starlark.String:
+		d.allow = false
+		d.filter = path
+		d.reason = string(v)
+
+		return nil
+	case *starlark.Dict:
+		for _, item := range v.Items() {
+			key, ok := starlark.AsString(item[0])
+
+			if !ok {
+				return fmt.Errorf("filter %s returned a dict with a non-string key %s", path, item[0])
+			}
+
+			switch key {
+			case "allow":
+				allow, ok := item[1].(starlark.Bool)
+
+				if !ok {
+					return fmt.Errorf("filter %s returned a non-bool allow", path)
+				}
+
+				if !allow {
+					d.allow = false
+					d.filter = path
+				}
+			case "reason", "sha", "target_branch":
+				text, ok := starlark.AsString(item[1])
+
+				if !ok {
+					return fmt.Errorf("filter %s returned a non-string %s", path, key)
+				}
+
+				switch key {
+				case "reason":
+					d.reason = text
+				case "sha":
+					if !plumbing.IsHash(text) {
+						return fmt.Errorf("filter %s returned an invalid sha %s", path, text)
+					}
+
+					d.sha = text
+				case "target_branch":
+					d.targetBranch = text
+				}
+			default:
+				return fmt.Errorf("filter %s returned an unknown key %s", path, key)
+			}
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("filter %s returned a %s, not None, a bool, a string or a dict", path, value.Type())
+}
+
+// vetoError explains why a branch wasn't pushed.
+func (d filterDecision) vetoError() error {
+	if d.reason == "" {
+		return fmt.Errorf("vetoed by filter %s", d.filter)
+	}
+
+	return fmt.Errorf("vetoed by filter %s: %s", d.filter, d.reason)
+}
@@ -0,0 +1,75 @@
+package gitsync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const gsGCPScope string = "https://www.googleapis.com/auth/cloud-platform"
+
+// gcpAuth authenticates to Google Cloud Source Repositories with an OAuth2
+// access token, refreshed from the underlying credentials as it expires.
+type gcpAuth struct {
+	tokens oauth2.TokenSource
+}
+
+// newGCPAuth uses the service account key in credentials_file when given,
+// otherwise Application Default Credentials (GOOGLE_APPLICATION_CREDENTIALS,
+// gcloud's user credentials or the metadata server).
+func newGCPAuth(settings *Auth) (transport.AuthMethod, error) {
+	ctx := context.Background()
+
+	var creds *google.Credentials
+	var err error
+
+	if settings.CredentialsFile != "" {
+		var key []byte
+
+		key, err = os.ReadFile(settings.CredentialsFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		creds, err = google.CredentialsFromJSON(ctx, key, gsGCPScope)
+	} else {
+		creds, err = google.FindDefaultCredentials(ctx, gsGCPScope)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not find google credentials: %w", err)
+	}
+
+	tokens := oauth2.ReuseTokenSource(nil, creds.TokenSource)
+
+	if _, err := tokens.Token(); err != nil {
+		return nil, fmt.Errorf("could not obtain google access token: %w", err)
+	}
+
+	return &gcpAuth{tokens: tokens}, nil
+}
+
+func (a *gcpAuth) Name() string {
+	return "http-gcp-oauth2"
+}
+
+func (a *gcpAuth) String() string {
+	return a.Name()
+}
+
+func (a *gcpAuth) SetAuth(r *http.Request) {
+	token, err := a.tokens.Token()
+
+	if err != nil {
+		warnPrintf("could not refresh google access token: %s\n", err)
+		return
+	}
+
+	r.Header.Set("Authorization", "Bearer "+token.AccessToken)
+}
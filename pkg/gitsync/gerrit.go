@@ -0,0 +1,109 @@
+package gitsync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Gerrit has a sync entry push each branch to Gerrit's refs/for/<branch>
+// rather than to the branch, so every new commit becomes a change for
+// review, for Gerrit targets that only take changes through review.
+type Gerrit struct {
+	Topic     string   `json:"topic"`
+	Reviewers []string `json:"reviewers"`
+	CC        []string `json:"cc"`
+}
+
+func checkGerrit(i int, sync SyncEntry) bool {
+	switch {
+	case sync.ViaPR != nil:
+		errorPrintf("sync entry %d can't have both gerrit and via_pr\n", i)
+		return false
+	case sync.Atomic:
+		errorPrintf("sync entry %d can't be atomic with gerrit, as changes pushed for review can't be rolled back\n", i)
+		return false
+	}
+
+	for _, option := range append(append([]string{sync.Gerrit.Topic}, sync.Gerrit.Reviewers...), sync.Gerrit.CC...) {
+		if strings.ContainsAny(option, ", \t\n%") {
+			errorPrintf("sync entry %d gerrit topic, reviewers and cc can't contain commas, spaces or %%: %q\n", i, option)
+			return false
+		}
+	}
+
+	return true
+}
+
+// reviewRef is where a gerrit sync entry pushes branch to for review, with
+// the topic, reviewers and cc as Gerrit's push options.
+func reviewRef(settings *Gerrit, branch plumbing.ReferenceName) string {
+	var options []string
+
+	if settings.Topic != "" {
+		options = append(options, "topic="+settings.Topic)
+	}
+
+	for _, reviewer := range settings.Reviewers {
+		options = append(options, "r="+reviewer)
+	}
+
+	for _, cc := range settings.CC {
+		options = append(options, "cc="+cc)
+	}
+
+	ref := "refs/for/" + branch.Short()
+
+	if len(options) > 0 {
+		ref += "%" + strings.Join(options, ",")
+	}
+
+	return ref
+}
+
+// pushForReview pushes pushSrc to Gerrit for review as changes to base on
+// target, unless base already has it, when the branch is up to date. Gerrit
+// refuses a push whose commits all already have changes, open or merged, so
+// that is up to date too.
+func (s *Syncer) pushForReview(ctx context.Context, repo *git.Repository, target, pushSrc string, base plumbing.ReferenceName, result *BranchResult, branchSpan *span) error {
+	baseSHA, err := s.remoteRefSHA(ctx, target, base)
+
+	if err != nil {
+		return fmt.Errorf("could not read %s on %s: %w", base.Short(), target, err)
+	}
+
+	if baseSHA == result.NewSHA {
+		s.infoPrintf("%s is already up to date on %s\n", base.Short(), target)
+		result.Status = StatusUpToDate
+		return nil
+	}
+
+	s.infoPrintf("pushing changes on %s to %s for review\n", base.Short(), target)
+
+	pushProgress := s.newProgress("push", target, base.Short())
+	pushSpan := s.tracer.start(branchSpan, "push", "remote", target)
+	started := time.Now()
+	err = s.pushTo(ctx, repo, target, config.RefSpec(pushSrc+":"+reviewRef(s.currentEntry.Gerrit, base)), pushProgress)
+	result.PushDuration = time.Since(started)
+	pushSpan.finish(err)
+	pushProgress.finish()
+
+	if err != nil && strings.Contains(err.Error(), "no new changes") {
+		s.infoPrintf("%s has no new changes for review on %s\n", base.Short(), target)
+		result.Status = StatusUpToDate
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	result.pushedRef, result.targetOldSHA = plumbing.ReferenceName("refs/for/"+base.Short()), baseSHA
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package gitsync
+
+import (
+	"net/http"
+	"time"
+)
+
+// pingHealthcheck tells a dead man's switch monitor (healthchecks.io,
+// Cronitor and the like) that the run succeeded. Failed runs don't ping, so
+// the monitor alerts on them the same way it does on runs that never happen.
+func (s *Syncer) pingHealthcheck() {
+	if s.config.HealthcheckURL == "" {
+		return
+	}
+
+	if s.run.Failed() {
+		s.infoPrintf("not pinging the healthcheck as the run failed\n")
+		return
+	}
+
+	pingURL, err := resolveSecret(s.config.HealthcheckURL)
+
+	if err != nil {
+		s.warnPrintf("healthcheck url: %s\n", err)
+		return
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(pingURL)
+
+	if err != nil {
+		s.warnPrintf("could not ping the healthcheck: %s\n", err)
+		return
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		s.warnPrintf("could not ping the healthcheck: %s\n", resp.Status)
+		return
+	}
+
+	s.debugPrintf("pinged the healthcheck\n")
+}
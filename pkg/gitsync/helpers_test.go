@@ -0,0 +1,135 @@
+package gitsync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// testRepos sets up a checkout with a source and a target remote, both bare
+// repositories on disk, each with the branches given pointing at one
+// commit, which the checkout has too.
+func testRepos(t *testing.T, branches ...string) (string, *git.Repository, *git.Repository, plumbing.Hash) {
+	t.Helper()
+
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remotes := map[string]*git.Repository{}
+
+	for _, name := range []string{"source", "target"} {
+		remoteDir := t.TempDir()
+		remote, err := git.PlainInit(remoteDir, true)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := repo.CreateRemote(&config.RemoteConfig{Name: name, URLs: []string{remoteDir}}); err != nil {
+			t.Fatal(err)
+		}
+
+		remotes[name] = remote
+	}
+
+	commit := testCommit(t, repo, "initial")
+
+	for _, branch := range branches {
+		setTestBranch(t, repo, branch, commit)
+	}
+
+	if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(branches[0]))); err != nil {
+		t.Fatal(err)
+	}
+
+	for name := range remotes {
+		var refSpecs []config.RefSpec
+
+		for _, branch := range branches {
+			refSpecs = append(refSpecs, config.RefSpec("refs/heads/"+branch+":refs/heads/"+branch))
+		}
+
+		if err := repo.Push(&git.PushOptions{RemoteName: name, RefSpecs: refSpecs}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir, remotes["source"], remotes["target"], commit
+}
+
+// testCommit stores a commit with an empty tree and the parents given in
+// repo.
+func testCommit(t *testing.T, repo *git.Repository, message string, parents ...plumbing.Hash) plumbing.Hash {
+	t.Helper()
+
+	tree := repo.Storer.NewEncodedObject()
+
+	if err := (&object.Tree{}).Encode(tree); err != nil {
+		t.Fatal(err)
+	}
+
+	treeHash, err := repo.Storer.SetEncodedObject(tree)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature := object.Signature{Name: "gitsync", Email: "gitsync@example.com", When: time.Now()}
+	commit := repo.Storer.NewEncodedObject()
+
+	if err := (&object.Commit{Author: signature, Committer: signature, Message: message, TreeHash: treeHash, ParentHashes: parents}).Encode(commit); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := repo.Storer.SetEncodedObject(commit)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hash
+}
+
+func setTestBranch(t *testing.T, repo *git.Repository, branch string, hash plumbing.Hash) {
+	t.Helper()
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName(branch), hash)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBranchSHA(t *testing.T, repo *git.Repository, branch string) plumbing.Hash {
+	t.Helper()
+
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ref.Hash()
+}
+
+func testBranchResult(t *testing.T, result *RunResult, branch string) *BranchResult {
+	t.Helper()
+
+	for _, sync := range result.Syncs {
+		for _, b := range sync.Branches {
+			if b.Branch == branch {
+				return b
+			}
+		}
+	}
+
+	t.Fatalf("no result for %s", branch)
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package gitsync
+
+import (
+	"database/sql"
+
+	_ "modernc.org/sqlite"
+)
+
+const gsHistorySchema string = `
+CREATE TABLE IF NOT EXISTS runs (
+	run_id      TEXT PRIMARY KEY,
+	host        TEXT NOT NULL,
+	repository  TEXT NOT NULL,
+	version     TEXT NOT NULL,
+	started     TEXT NOT NULL,
+	finished    TEXT NOT NULL,
+	duration_ms INTEGER NOT NULL,
+	status      TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS branches (
+	run_id         TEXT NOT NULL REFERENCES runs (run_id),
+	sync_id        TEXT NOT NULL,
+	source_remote  TEXT NOT NULL,
+	target_remote  TEXT NOT NULL,
+	branch         TEXT NOT NULL,
+	status         TEXT NOT NULL,
+	old_sha        TEXT NOT NULL,
+	new_sha        TEXT NOT NULL,
+	commits        INTEGER NOT NULL,
+	duration_ms    INTEGER NOT NULL,
+	bytes_received INTEGER NOT NULL,
+	bytes_sent     INTEGER NOT NULL,
+	error          TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS branches_sync ON branches (source_remote, target_remote, branch);
+CREATE INDEX IF NOT EXISTS runs_started ON runs (started);
+`
+
+// Timestamps are stored as fixed-width UTC text, which sorts correctly and
+// which SQLite's date and time functions understand.
+const gsHistoryTimeFormat string = "2006-01-02T15:04:05.000Z"
+
+// openHistory opens, creating if needed, the SQLite database every run's
+// per-branch results are recorded in.
+func openHistory(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait rather than fail if another gitsync is writing its run.
+	if _, err := db.Exec("PRAGMA busy_timeout = 10000"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, err := db.Exec(gsHistorySchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// recordHistory stores the run and the result of every branch in it in one
+// transaction, so a crash never leaves half a run behind.
+func (s *Syncer) recordHistory() {
+	if s.history == nil {
+		return
+	}
+
+	report := buildReport(s.run)
+	tx, err := s.history.Begin()
+
+	if err != nil {
+		s.errorPrintf("could not record run history: %s\n", err)
+		return
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO runs (run_id, host, repository, version, started, finished, duration_ms, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		report.RunID, report.Host, report.Repository, report.Version,
+		report.Started.UTC().Format(gsHistoryTimeFormat), report.Finished.UTC().Format(gsHistoryTimeFormat), report.DurationMs, report.Status)
+
+	if err != nil {
+		s.errorPrintf("could not record run history: %s\n", err)
+		return
+	}
+
+	for _, sync := range report.Syncs {
+		for _, branch := range sync.Branches {
+			_, err = tx.Exec(`INSERT INTO branches (run_id, sync_id, source_remote, target_remote, branch, status,
+				old_sha, new_sha, commits, duration_ms, bytes_received, bytes_sent, error)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				report.RunID, sync.ID, sync.Source, sync.Target, branch.Branch, branch.Status,
+				branch.OldSHA, branch.NewSHA, branch.Commits, branch.DurationMs,
+				branch.BytesReceived, branch.BytesSent, branch.Error)
+
+			if err != nil {
+				s.errorPrintf("could not record run history: %s\n", err)
+				return
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.errorPrintf("could not record run history: %s\n", err)
+		return
+	}
+
+	s.debugPrintf("recorded run %s in the history\n", report.RunID)
+}
@@ -0,0 +1,203 @@
+package gitsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Points in a run at which hooks are run.
+const (
+	hookPreRun     string = "pre_run"
+	hookPreBranch  string = "pre_branch"
+	hookPostBranch string = "post_branch"
+	hookPostRun    string = "post_run"
+	hookOnFailure  string = "on_failure"
+)
+
+// What a failing hook does.
+const (
+	hookOnErrorWarn string = "warn"
+	hookOnErrorFail string = "fail"
+)
+
+const gsDefaultHookTimeout = 5 * time.Minute
+
+// gsMaxHookOutput bounds how much of a failing hook's output is kept in its
+// error.
+const gsMaxHookOutput int = 1024
+
+// Hook is a shell command run at some point of a run, with the run's details
+// in GITSYNC_* environment variables.
+type Hook struct {
+	Command string `json:"command"`
+	// OnError is warn (the default) to log a failing hook and carry on, or
+	// fail to fail whatever the hook was run for.
+	OnError string `json:"on_error"`
+	Timeout string `json:"timeout"`
+}
+
+// Hooks are run globally, or for a single sync entry when set on it. In a
+// sync entry, pre_run and post_run run before and after that entry and
+// on_failure when it fails; globally they run around the whole run and
+// on_failure when anything in it fails.
+type Hooks struct {
+	PreRun     []Hook `json:"pre_run"`
+	PreBranch  []Hook `json:"pre_branch"`
+	PostBranch []Hook `json:"post_branch"`
+	PostRun    []Hook `json:"post_run"`
+	OnFailure  []Hook `json:"on_failure"`
+}
+
+func (h Hooks) points() map[string][]Hook {
+	return map[string][]Hook{
+		hookPreRun:     h.PreRun,
+		hookPreBranch:  h.PreBranch,
+		hookPostBranch: h.PostBranch,
+		hookPostRun:    h.PostRun,
+		hookOnFailure:  h.OnFailure,
+	}
+}
+
+func checkHooks(where string, hooks Hooks) bool {
+	for point, list := range hooks.points() {
+		for i, hook := range list {
+			if strings.TrimSpace(hook.Command) == "" {
+				errorPrintf("%s %s hook %d has no command\n", where, point, i)
+				return false
+			}
+
+			if hook.OnError != "" && hook.OnError != hookOnErrorWarn && hook.OnError != hookOnErrorFail {
+				errorPrintf("%s %s hook %d has an unknown on_error: %s\n", where, point, i, hook.OnError)
+				return false
+			}
+
+			if hook.Timeout != "" {
+				if _, err := time.ParseDuration(hook.Timeout); err != nil {
+					errorPrintf("%s %s hook %d timeout: %s\n", where, point, i, err)
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// hookEnv describes what a hook is being run for. sync and branch are nil
+// for hooks that aren't about one.
+func (s *Syncer) hookEnv(point string, sync *SyncResult, branch *BranchResult) []string {
+	env := append(os.Environ(),
+		"GITSYNC_HOOK="+point,
+		"GITSYNC_RUN_ID="+s.run.ID,
+		"GITSYNC_REPOSITORY="+s.repoDir,
+	)
+
+	switch {
+	case branch != nil:
+		env = append(env,
+			"GITSYNC_BRANCH="+branch.Branch,
+			"GITSYNC_OLD_SHA="+branch.OldSHA,
+			"GITSYNC_NEW_SHA="+branch.NewSHA,
+			fmt.Sprintf("GITSYNC_COMMITS=%d", branch.Commits),
+			"GITSYNC_STATUS="+branch.Status,
+			"GITSYNC_ERROR="+errorString(branch.Err),
+		)
+	case sync != nil && point != hookPreRun:
+		env = append(env, "GITSYNC_STATUS="+sync.Status, "GITSYNC_ERROR="+errorString(sync.Err))
+	case sync == nil && point != hookPreRun:
+		status := StatusSynced
+
+		if s.run.Failed() {
+			status = StatusFailed
+		}
+
+		env = append(env, "GITSYNC_STATUS="+status, "GITSYNC_ERROR="+errorString(s.run.Err))
+	}
+
+	if sync != nil {
+		env = append(env,
+			"GITSYNC_SYNC_ID="+sync.ID,
+			"GITSYNC_SOURCE_REMOTE="+sync.Source,
+			"GITSYNC_TARGET_REMOTE="+sync.Target,
+		)
+	}
+
+	return env
+}
+
+// runHooks runs hooks in order, killing any still running when ctx is
+// cancelled. A hook that fails with on_error set to fail
+// stops the rest and its error is returned; other failures are only logged.
+func (s *Syncer) runHooks(ctx context.Context, point string, hooks []Hook, parent *span, sync *SyncResult, branch *BranchResult) error {
+	for _, hook := range hooks {
+		hookSpan := s.tracer.start(parent, "hook", "point", point, "command", hook.Command)
+		err := s.runHook(ctx, point, hook, s.hookEnv(point, sync, branch))
+		hookSpan.finish(err)
+
+		if err == nil {
+			continue
+		}
+
+		if hook.OnError == hookOnErrorFail {
+			return err
+		}
+
+		s.warnPrintf("%s\n", err)
+	}
+
+	return nil
+}
+
+func (s *Syncer) runHook(ctx context.Context, point string, hook Hook, env []string) error {
+	timeout := gsDefaultHookTimeout
+
+	if hook.Timeout != "" {
+		timeout, _ = time.ParseDuration(hook.Timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+
+	cmd := commandContext(ctx, "sh", "-c", hook.Command)
+	cmd.Dir = s.repoDir
+	cmd.Env = env
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	s.debugPrintf("running %s hook: %s\n", point, hook.Command)
+	err := cmd.Run()
+
+	if text := strings.TrimSpace(output.String()); text != "" {
+		s.debugPrintf("%s hook output:\n%s\n", point, text)
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s hook %q timed out after %s", point, hook.Command, timeout)
+	}
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s hook %q: %w", point, hook.Command, ctx.Err())
+	}
+
+	if err != nil {
+		text := strings.TrimSpace(output.String())
+
+		if len(text) > gsMaxHookOutput {
+			text = text[len(text)-gsMaxHookOutput:]
+		}
+
+		if text != "" {
+			return fmt.Errorf("%s hook %q failed: %w: %s", point, hook.Command, err, text)
+		}
+
+		return fmt.Errorf("%s hook %q failed: %w", point, hook.Command, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package gitsync
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookTimeoutStopsWhatTheHookRuns(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+	}{
+		{"command", "sleep 20"},
+		{"after another command", "true; sleep 20"},
+		{"in the background", "sleep 20 & wait"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Syncer{repoDir: t.TempDir()}
+			started := time.Now()
+			err := s.runHook(context.Background(), hookPreRun, Hook{Command: test.command, Timeout: "500ms"}, nil)
+
+			if err == nil || !strings.Contains(err.Error(), "timed out") {
+				t.Errorf("got %v, want a timeout", err)
+			}
+
+			if elapsed := time.Since(started); elapsed > 5*time.Second {
+				t.Errorf("took %s to time out", elapsed)
+			}
+		})
+	}
+}
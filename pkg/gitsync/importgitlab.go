@@ -0,0 +1,140 @@
+package gitsync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gsGitLabPageSize is how many items each page of a GitLab listing asks for,
+// the most GitLab returns.
+const gsGitLabPageSize = 100
+
+// GitLabMirror is a GitLab project that mirrors another repository with
+// GitLab's pull mirroring.
+type GitLabMirror struct {
+	// Project is the project's full path.
+	Project string
+	// SourceURL is where the project pulls from. GitLab never reveals the
+	// credentials it pulls with, so they are left out, and HadCredentials
+	// set if there were any.
+	SourceURL      string
+	HadCredentials bool
+	// TargetURL is the project's HTTPS clone URL.
+	TargetURL string
+	// Branches are the project's branches, or only its protected ones if
+	// that is all GitLab mirrors.
+	Branches      []string
+	OnlyProtected bool
+	// OverwriteDiverged is set when GitLab overwrites branches that have
+	// diverged from the source, rather than leaving them be.
+	OverwriteDiverged bool
+	// Wildcards are protected branch patterns that can't be listed as
+	// branches.
+	Wildcards []string
+}
+
+// GitLabMirrors lists the projects of a GitLab group, and of its subgroups,
+// that are pull mirrors, with what they mirror, so equivalent configs can be
+// written for gitsync. token is an API token that can read the projects'
+// settings, which GitLab only shows maintainers; apiURL defaults to
+// GitLab.com's.
+func GitLabMirrors(ctx context.Context, apiURL, token, group string) ([]GitLabMirror, error) {
+	if apiURL == "" {
+		apiURL = gsDefaultGitLabAPI
+	}
+
+	token, err := resolveSecret(token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	apiURL = strings.TrimSuffix(apiURL, "/")
+	headers := map[string]string{"PRIVATE-TOKEN": token}
+
+	type project struct {
+		ID                               int    `json:"id"`
+		PathWithNamespace                string `json:"path_with_namespace"`
+		HTTPURLToRepo                    string `json:"http_url_to_repo"`
+		Mirror                           bool   `json:"mirror"`
+		ImportURL                        string `json:"import_url"`
+		OnlyMirrorProtectedBranches      bool   `json:"only_mirror_protected_branches"`
+		MirrorOverwritesDivergedBranches bool   `json:"mirror_overwrites_diverged_branches"`
+	}
+
+	var mirrors []GitLabMirror
+
+	for page := 1; ; page++ {
+		var projects []project
+		endpoint := fmt.Sprintf("%s/groups/%s/projects?include_subgroups=true&archived=false&per_page=%d&page=%d", apiURL, url.PathEscape(group), gsGitLabPageSize, page)
+
+		if status, err := forgeRequest(ctx, http.MethodGet, endpoint, headers, nil, &projects); err != nil || status != http.StatusOK {
+			return nil, forgeError(err, status, "listing the projects of "+group)
+		}
+
+		for _, found := range projects {
+			if !found.Mirror || found.ImportURL == "" {
+				continue
+			}
+
+			mirror := GitLabMirror{
+				Project:           found.PathWithNamespace,
+				SourceURL:         found.ImportURL,
+				TargetURL:         found.HTTPURLToRepo,
+				OnlyProtected:     found.OnlyMirrorProtectedBranches,
+				OverwriteDiverged: found.MirrorOverwritesDivergedBranches,
+			}
+
+			if source, err := url.Parse(found.ImportURL); err == nil && source.User != nil {
+				source.User = nil
+				mirror.SourceURL, mirror.HadCredentials = source.String(), true
+			}
+
+			if err := gitLabMirrorBranches(ctx, apiURL, headers, found.ID, &mirror); err != nil {
+				return nil, fmt.Errorf("%s: %w", found.PathWithNamespace, err)
+			}
+
+			mirrors = append(mirrors, mirror)
+		}
+
+		if len(projects) < gsGitLabPageSize {
+			return mirrors, nil
+		}
+	}
+}
+
+// gitLabMirrorBranches lists the branches GitLab mirrors into the project.
+func gitLabMirrorBranches(ctx context.Context, apiURL string, headers map[string]string, id int, mirror *GitLabMirror) error {
+	listing := "repository/branches"
+
+	if mirror.OnlyProtected {
+		listing = "protected_branches"
+	}
+
+	for page := 1; ; page++ {
+		var branches []struct {
+			Name string `json:"name"`
+		}
+
+		endpoint := fmt.Sprintf("%s/projects/%d/%s?per_page=%d&page=%d", apiURL, id, listing, gsGitLabPageSize, page)
+
+		if status, err := forgeRequest(ctx, http.MethodGet, endpoint, headers, nil, &branches); err != nil || status != http.StatusOK {
+			return forgeError(err, status, "listing its branches")
+		}
+
+		for _, branch := range branches {
+			if strings.Contains(branch.Name, "*") {
+				mirror.Wildcards = append(mirror.Wildcards, branch.Name)
+			} else {
+				mirror.Branches = append(mirror.Branches, branch.Name)
+			}
+		}
+
+		if len(branches) < gsGitLabPageSize {
+			return nil
+		}
+	}
+}
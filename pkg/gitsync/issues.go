@@ -0,0 +1,354 @@
+package gitsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// gsIssuesFile is where the runs each failure_issue sync entry has failed in
+// a row, and the issue filed for it, are kept, in the repository's git
+// directory.
+const gsIssuesFile string = "gitsync/issues.json"
+
+// gsDefaultIssueAfter is how many runs in a row a sync entry has to fail
+// before an issue is filed, unless its failure_issue says otherwise.
+const gsDefaultIssueAfter = 3
+
+// FailureIssue files an issue on the target's forge once a sync entry has
+// failed a number of runs in a row, keeps it up to date while the entry
+// keeps failing and closes it once the entry syncs again, so the target's
+// owners can see their mirror is broken.
+type FailureIssue struct {
+	Type   string `json:"type"`
+	APIURL string `json:"api_url"`
+	// Project defaults to the path of the target's push URL.
+	Project string `json:"project"`
+	Token   string `json:"token"`
+	// After is how many runs in a row have to fail, defaulting to 3.
+	After  int      `json:"after"`
+	Labels []string `json:"labels"`
+}
+
+// issueState is what failure_issue remembers between runs about each sync
+// entry that has failed since it last synced.
+type issueState struct {
+	Entries []issueEntry `json:"entries"`
+}
+
+type issueEntry struct {
+	Source   string `json:"source_remote"`
+	Target   string `json:"target_remote"`
+	Failures int    `json:"failures"`
+	// Issue is the issue's number, or iid on GitLab, and URL where to see
+	// it, once filed.
+	Issue int    `json:"issue,omitempty"`
+	URL   string `json:"url,omitempty"`
+}
+
+func checkFailureIssue(i int, settings *FailureIssue) bool {
+	switch {
+	case settings.Type != "github" && settings.Type != "gitlab":
+		errorPrintf("sync entry %d has an unknown failure_issue type: %s\n", i, settings.Type)
+		return false
+	case settings.Token == "":
+		errorPrintf("sync entry %d failure_issue has no token\n", i)
+		return false
+	case settings.After < 0:
+		errorPrintf("sync entry %d failure_issue's after can't be negative\n", i)
+		return false
+	}
+
+	return true
+}
+
+// fileFailureIssues counts the runs in a row each failure_issue sync entry
+// of the run has failed, filing or updating its issue once there have been
+// enough and closing it when the entry syncs. Failing to reach the forge is
+// only warned about, and tried again next run.
+func (s *Syncer) fileFailureIssues(ctx context.Context) {
+	tracked := false
+
+	for _, sync := range s.config.Sync {
+		tracked = tracked || sync.FailureIssue != nil
+	}
+
+	if !tracked {
+		return
+	}
+
+	dotGit, err := s.dotGit()
+
+	if err != nil {
+		s.warnPrintf("could not count the failures of sync entries: %s\n", err)
+		return
+	}
+
+	var state issueState
+	data, err := util.ReadFile(dotGit, gsIssuesFile)
+
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.warnPrintf("could not read the failures of sync entries, counting afresh: %s\n", err)
+	}
+
+	entries := map[string]*issueEntry{}
+
+	for i := range state.Entries {
+		entries[state.Entries[i].Source+"\x00"+state.Entries[i].Target] = &state.Entries[i]
+	}
+
+	next := issueState{Entries: []issueEntry{}}
+
+	for _, sync := range s.config.Sync {
+		key := sync.Source + "\x00" + sync.Target
+		entry := entries[key]
+
+		if entry == nil {
+			entry = &issueEntry{Source: sync.Source, Target: sync.Target}
+		}
+
+		// The same source and target are only counted once a run.
+		delete(entries, key)
+
+		if result := s.syncResult(sync); sync.FailureIssue != nil && result != nil {
+			s.updateFailureIssue(ctx, sync, result, entry)
+		}
+
+		if sync.FailureIssue != nil && (entry.Failures > 0 || entry.Issue != 0) {
+			next.Entries = append(next.Entries, *entry)
+		}
+	}
+
+	data, err = json.MarshalIndent(next, "", "  ")
+
+	if err == nil {
+		err = util.WriteFile(dotGit, gsIssuesFile+".tmp", append(data, '\n'), 0o644)
+	}
+
+	if err == nil {
+		err = dotGit.Rename(gsIssuesFile+".tmp", gsIssuesFile)
+	}
+
+	if err != nil {
+		s.warnPrintf("could not save the failures of sync entries: %s\n", err)
+	}
+}
+
+// syncResult is the run's result for sync, or nil if the run didn't get to
+// it.
+func (s *Syncer) syncResult(sync SyncEntry) *SyncResult {
+	var found *SyncResult
+
+	for _, result := range s.run.Syncs {
+		if result.Source == sync.Source && result.Target == sync.Target {
+			found = result
+		}
+	}
+
+	return found
+}
+
+// updateFailureIssue counts result against entry and files, updates or
+// closes its issue to match.
+func (s *Syncer) updateFailureIssue(ctx context.Context, sync SyncEntry, result *SyncResult, entry *issueEntry) {
+	settings := *sync.FailureIssue
+	after := settings.After
+
+	if after == 0 {
+		after = gsDefaultIssueAfter
+	}
+
+	if result.Status == StatusSynced {
+		entry.Failures = 0
+	} else {
+		entry.Failures++
+	}
+
+	if entry.Failures < after && (entry.Failures > 0 || entry.Issue == 0) {
+		return
+	}
+
+	token, err := resolveSecret(settings.Token)
+
+	if err == nil && settings.Project == "" {
+		settings.Project, err = projectFromURL(settings.Type, s.effectiveURL(sync.Target, true))
+	}
+
+	if err != nil {
+		s.warnPrintf("%s failure_issue: %s\n", sync.Target, err)
+		return
+	}
+
+	api := newIssueAPI(&settings, token)
+
+	switch {
+	case entry.Failures == 0:
+		err = api.close(ctx, entry.Issue, fmt.Sprintf("gitsync synced %s to %s again in run %s, closing.", sync.Source, sync.Target, s.run.ID))
+
+		if err == nil {
+			s.infoPrintf("closed issue %s now that %s syncs to %s again\n", entry.URL, sync.Source, sync.Target)
+			entry.Issue, entry.URL = 0, ""
+		}
+	case entry.Issue == 0:
+		entry.Issue, entry.URL, err = api.open(ctx, fmt.Sprintf("Mirroring %s to %s is failing", sync.Source, sync.Target), s.failureReport(sync, result, entry.Failures))
+
+		if err == nil {
+			s.infoPrintf("filed issue %s as %s has failed to sync to %s %d runs in a row\n", entry.URL, sync.Source, sync.Target, entry.Failures)
+		}
+	default:
+		err = api.update(ctx, entry.Issue, s.failureReport(sync, result, entry.Failures))
+	}
+
+	if err != nil {
+		s.warnPrintf("could not update the failure issue for %s on %s: %s\n", sync.Target, settings.Type, err)
+	}
+}
+
+// failureReport is the markdown body of a failure issue: why the entry
+// failed in the last run and where each of its branches is on the source
+// and target.
+func (s *Syncer) failureReport(sync SyncEntry, result *SyncResult, failures int) string {
+	host, _ := os.Hostname()
+	sourceHeads := s.remoteRefs[preflightCheck{sync.Source, false}]
+	targetHeads := s.remoteRefs[preflightCheck{sync.Target, true}]
+
+	var report strings.Builder
+
+	fmt.Fprintf(&report, "gitsync on %s has failed to sync `%s` to `%s` %d runs in a row, most recently run `%s` at %s.\n\n",
+		host, sync.Source, sync.Target, failures, s.run.ID, s.run.Started.UTC().Format("2006-01-02 15:04:05 MST"))
+
+	if result.Err != nil {
+		fmt.Fprintf(&report, "**%s**\n\n", result.Err)
+	}
+
+	report.WriteString("| Branch | Result | Source | Target | Error |\n| --- | --- | --- | --- | --- |\n")
+
+	for _, branch := range result.Branches {
+		branchRef := plumbing.NewBranchReferenceName(branch.Branch)
+		sourceSHA, targetSHA := "", ""
+
+		if hash, exists := sourceHeads[branchRef]; exists {
+			sourceSHA = ShortSHA(hash.String())
+		}
+
+		if hash, exists := targetHeads[branchRef]; exists {
+			targetSHA = ShortSHA(hash.String())
+		}
+
+		fmt.Fprintf(&report, "| `%s` | %s | %s | %s | %s |\n", branch.Branch, branch.Status, sourceSHA, targetSHA,
+			strings.NewReplacer("|", "\\|", "\n", " ").Replace(errorString(branch.Err)))
+	}
+
+	report.WriteString("\nThis issue is updated while the mirror keeps failing and closed once it syncs again.\n")
+
+	return report.String()
+}
+
+// issueAPI files and closes issues on GitHub or GitLab.
+type issueAPI struct {
+	forge    string
+	endpoint string
+	headers  map[string]string
+	labels   []string
+}
+
+func newIssueAPI(settings *FailureIssue, token string) *issueAPI {
+	apiURL := settings.APIURL
+
+	if settings.Type == "gitlab" {
+		if apiURL == "" {
+			apiURL = gsDefaultGitLabAPI
+		}
+
+		return &issueAPI{
+			forge:    "gitlab",
+			endpoint: strings.TrimSuffix(apiURL, "/") + "/projects/" + url.PathEscape(settings.Project) + "/issues",
+			headers:  map[string]string{"PRIVATE-TOKEN": token},
+			labels:   settings.Labels,
+		}
+	}
+
+	if apiURL == "" {
+		apiURL = gsDefaultGitHubAPI
+	}
+
+	return &issueAPI{
+		forge:    "github",
+		endpoint: strings.TrimSuffix(apiURL, "/") + "/repos/" + settings.Project + "/issues",
+		headers:  map[string]string{"Accept": "application/vnd.github+json", "Authorization": "Bearer " + token},
+		labels:   settings.Labels,
+	}
+}
+
+// open files an issue, returning its number and URL.
+func (a *issueAPI) open(ctx context.Context, title, body string) (int, string, error) {
+	var request map[string]interface{}
+	var created struct {
+		Number int    `json:"number"`
+		IID    int    `json:"iid"`
+		URL    string `json:"html_url"`
+		WebURL string `json:"web_url"`
+	}
+
+	if a.forge == "gitlab" {
+		request = map[string]interface{}{"title": title, "description": body, "labels": strings.Join(a.labels, ",")}
+	} else {
+		request = map[string]interface{}{"title": title, "body": body, "labels": append([]string{}, a.labels...)}
+	}
+
+	if status, err := forgeRequest(ctx, http.MethodPost, a.endpoint, a.headers, request, &created); err != nil || status != http.StatusCreated {
+		return 0, "", forgeError(err, status, "filing the issue")
+	}
+
+	if a.forge == "gitlab" {
+		return created.IID, created.WebURL, nil
+	}
+
+	return created.Number, created.URL, nil
+}
+
+// update replaces the issue's body.
+func (a *issueAPI) update(ctx context.Context, issue int, body string) error {
+	method, request := http.MethodPatch, map[string]string{"body": body}
+
+	if a.forge == "gitlab" {
+		method, request = http.MethodPut, map[string]string{"description": body}
+	}
+
+	if status, err := forgeRequest(ctx, method, fmt.Sprintf("%s/%d", a.endpoint, issue), a.headers, request, nil); err != nil || status != http.StatusOK {
+		return forgeError(err, status, "updating the issue")
+	}
+
+	return nil
+}
+
+// close comments on the issue and closes it.
+func (a *issueAPI) close(ctx context.Context, issue int, comment string) error {
+	comments, method, request := "comments", http.MethodPatch, map[string]string{"state": "closed"}
+
+	if a.forge == "gitlab" {
+		comments, method, request = "notes", http.MethodPut, map[string]string{"state_event": "close"}
+	}
+
+	if status, err := forgeRequest(ctx, http.MethodPost, fmt.Sprintf("%s/%d/%s", a.endpoint, issue, comments), a.headers, map[string]string{"body": comment}, nil); err != nil || status != http.StatusCreated {
+		return forgeError(err, status, "commenting on the issue")
+	}
+
+	if status, err := forgeRequest(ctx, method, fmt.Sprintf("%s/%d", a.endpoint, issue), a.headers, request, nil); err != nil || status != http.StatusOK {
+		return forgeError(err, status, "closing the issue")
+	}
+
+	return nil
+}
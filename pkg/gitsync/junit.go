@@ -0,0 +1,103 @@
+package gitsync
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	ID       string           `xml:"id,attr"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     float64          `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	ID        string          `xml:"id,attr"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      float64         `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// WriteJUnit writes the run as a JUnit XML report, with one test suite per
+// sync entry and one test case per branch, so CI servers can render mirror
+// failures natively.
+func (r *RunResult) WriteJUnit(w io.Writer) error {
+	report := buildReport(r)
+	suites := junitTestSuites{ID: report.RunID, Name: "gitsync", Time: float64(report.DurationMs) / 1000}
+
+	for _, sync := range report.Syncs {
+		suite := junitTestSuite{
+			ID:        sync.ID,
+			Name:      fmt.Sprintf("%s -> %s", sync.Source, sync.Target),
+			Time:      float64(sync.DurationMs) / 1000,
+			Timestamp: report.Started.Format("2006-01-02T15:04:05"),
+		}
+
+		for _, branch := range sync.Branches {
+			testCase := junitTestCase{
+				Name:      branch.Branch,
+				ClassName: fmt.Sprintf("gitsync.%s.%s", sync.Source, sync.Target),
+				Time:      float64(branch.DurationMs) / 1000,
+			}
+
+			switch branch.Status {
+			case StatusFailed:
+				testCase.Failure = &junitFailure{Message: branch.Error, Type: StatusFailed, Text: branch.Error}
+				suite.Failures++
+			case StatusSkipped:
+				testCase.Skipped = &junitSkipped{Message: sync.Error}
+				suite.Skipped++
+			default:
+				testCase.SystemOut = fmt.Sprintf("%s -> %s (%d commits)", ShortSHA(branch.OldSHA), ShortSHA(branch.NewSHA), branch.Commits)
+			}
+
+			suite.Cases = append(suite.Cases, testCase)
+			suite.Tests++
+		}
+
+		suites.Suites = append(suites.Suites, suite)
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Skipped += suite.Skipped
+	}
+
+	output, err := xml.MarshalIndent(suites, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	output = append([]byte(xml.Header), append(output, '\n')...)
+	_, err = w.Write(output)
+
+	return err
+}
@@ -0,0 +1,225 @@
+package gitsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// gsKafkaPendingFile is where ref updates Kafka couldn't take are kept until
+// the next run, in the repository's git directory.
+const gsKafkaPendingFile string = "gitsync/kafka-pending.json"
+
+// gsKafkaMaxPending is how many ref updates are kept for the next run when
+// they can't be sent, the oldest being dropped beyond that.
+const gsKafkaMaxPending = 10000
+
+// Kafka sends an event to a Kafka topic for every ref gitsync updates, keyed
+// by repository and branch, so a data platform can follow changes as they
+// propagate between sites.
+type Kafka struct {
+	// Brokers are host:port addresses to bootstrap from.
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+	// Site names where this gitsync runs in its events, defaulting to the
+	// host name.
+	Site string `json:"site"`
+	// Repository is the repository part of event keys, defaulting to the
+	// path of each sync entry's source URL, so every site mirroring a
+	// repository uses the same keys.
+	Repository string `json:"repository"`
+	TLS        bool   `json:"tls"`
+	// SASL is the mechanism to authenticate with: plain, scram-sha-256 or
+	// scram-sha-512. Password may be a secret reference.
+	SASL     string `json:"sasl"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// refUpdateEvent is the value of a Kafka record.
+type refUpdateEvent struct {
+	Event      string    `json:"event"`
+	RunID      string    `json:"run_id"`
+	SyncID     string    `json:"sync_id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Site       string    `json:"site"`
+	Repository string    `json:"repository"`
+	Source     string    `json:"source_remote"`
+	Target     string    `json:"target_remote"`
+	Branch     string    `json:"branch"`
+	Ref        string    `json:"ref"`
+	OldSHA     string    `json:"old_sha"`
+	NewSHA     string    `json:"new_sha"`
+	Commits    int       `json:"commits"`
+}
+
+// kafkaRecord is a ref update waiting to be sent.
+type kafkaRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+	Time  time.Time       `json:"time"`
+}
+
+func (s *Syncer) checkKafka() bool {
+	settings := s.config.Kafka
+
+	if settings == nil {
+		return true
+	}
+
+	switch {
+	case len(settings.Brokers) == 0 || settings.Topic == "":
+		errorPrintf("kafka needs brokers and a topic\n")
+		return false
+	case settings.SASL != "" && settings.SASL != gsKafkaSASLPlain && settings.SASL != gsKafkaSASLSCRAM256 && settings.SASL != gsKafkaSASLSCRAM512:
+		errorPrintf("kafka has an unknown sasl mechanism: %s\n", settings.SASL)
+		return false
+	case settings.SASL != "" && (settings.Username == "" || settings.Password == ""):
+		errorPrintf("kafka sasl needs a username and password\n")
+		return false
+	}
+
+	for _, broker := range settings.Brokers {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			errorPrintf("kafka broker %s isn't host:port: %s\n", broker, err)
+			return false
+		}
+	}
+
+	return true
+}
+
+// streamEvent queues a Kafka record for every ref pushed and sends them
+// once the run is over.
+func (s *Syncer) streamEvent(event Event) {
+	settings := s.config.Kafka
+
+	if settings == nil {
+		return
+	}
+
+	switch event.Type {
+	case EventBranchPushed:
+		s.queueRefUpdate(settings, event)
+	case EventRunFinished:
+		s.sendRefUpdates(settings)
+	}
+}
+
+func (s *Syncer) queueRefUpdate(settings *Kafka, event Event) {
+	site := settings.Site
+
+	if site == "" {
+		site, _ = os.Hostname()
+	}
+
+	repository := settings.Repository
+
+	if repository == "" {
+		var err error
+
+		// gitlab keeps the whole path, subgroups and all.
+		if repository, err = projectFromURL("gitlab", s.effectiveURL(event.Sync.Source, false)); err != nil {
+			repository = filepath.Base(s.repoDir)
+		}
+	}
+
+	update := refUpdateEvent{
+		Event:      "ref_updated",
+		RunID:      event.Run.ID,
+		SyncID:     event.Sync.ID,
+		Timestamp:  event.Time,
+		Site:       site,
+		Repository: repository,
+		Source:     event.Sync.Source,
+		Target:     event.Sync.Target,
+		Branch:     event.Branch.Branch,
+		Ref:        event.Branch.pushedRef.String(),
+		OldSHA:     event.Branch.targetOldSHA,
+		NewSHA:     event.Branch.NewSHA,
+		Commits:    event.Branch.Commits,
+	}
+
+	value, err := json.Marshal(update)
+
+	if err != nil {
+		s.warnPrintf("could not queue the kafka event for %s: %s\n", update.Ref, err)
+		return
+	}
+
+	s.kafkaRecords = append(s.kafkaRecords, kafkaRecord{Key: repository + "/" + update.Branch, Value: value, Time: event.Time})
+}
+
+// sendRefUpdates sends the run's ref updates, after those earlier runs
+// couldn't send, keeping them all for the next run if Kafka can't be
+// reached.
+func (s *Syncer) sendRefUpdates(settings *Kafka) {
+	records := s.kafkaRecords
+	s.kafkaRecords = nil
+
+	dotGit, err := s.dotGit()
+
+	if err != nil {
+		s.warnPrintf("could not send ref updates to kafka: %s\n", err)
+		return
+	}
+
+	var pending []kafkaRecord
+	data, err := util.ReadFile(dotGit, gsKafkaPendingFile)
+
+	if err == nil {
+		err = json.Unmarshal(data, &pending)
+	}
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.warnPrintf("could not read the ref updates kafka hasn't taken yet, dropping them: %s\n", err)
+	}
+
+	records = append(pending, records...)
+
+	if len(records) == 0 {
+		return
+	}
+
+	if dropped := len(records) - gsKafkaMaxPending; dropped > 0 {
+		s.warnPrintf("dropping the %d oldest ref updates kafka hasn't taken\n", dropped)
+		records = records[dropped:]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gsKafkaTimeout)
+	defer cancel()
+
+	if err := produceKafka(ctx, settings, records); err != nil {
+		s.warnPrintf("could not send %d ref updates to kafka, trying again next run: %s\n", len(records), err)
+
+		data, err := json.Marshal(records)
+
+		if err == nil {
+			err = util.WriteFile(dotGit, gsKafkaPendingFile+".tmp", append(data, '\n'), 0o644)
+		}
+
+		if err == nil {
+			err = dotGit.Rename(gsKafkaPendingFile+".tmp", gsKafkaPendingFile)
+		}
+
+		if err != nil {
+			s.warnPrintf("could not keep the ref updates for the next run: %s\n", err)
+		}
+
+		return
+	}
+
+	s.debugPrintf("sent %d ref updates to kafka topic %s\n", len(records), settings.Topic)
+
+	if len(pending) > 0 {
+		if err := dotGit.Remove(gsKafkaPendingFile); err != nil {
+			s.warnPrintf("could not forget the ref updates kafka has taken, they may be sent again: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,623 @@
+package gitsync
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gsKafkaTimeout bounds sending a run's ref updates, connecting included.
+const gsKafkaTimeout = 30 * time.Second
+
+// SASL mechanisms kafka's sasl can be set to.
+const (
+	gsKafkaSASLPlain    string = "plain"
+	gsKafkaSASLSCRAM256 string = "scram-sha-256"
+	gsKafkaSASLSCRAM512 string = "scram-sha-512"
+)
+
+// Kafka API keys and the versions of them gitsync speaks, which brokers
+// since Kafka 1.0 all support.
+const (
+	kafkaProduce          int16 = 0
+	kafkaMetadata         int16 = 3
+	kafkaSASLHandshake    int16 = 17
+	kafkaSASLAuthenticate int16 = 36
+)
+
+var errKafkaShort = errors.New("short response from kafka")
+
+var gsKafkaErrors = map[int16]string{
+	3:  "unknown topic or partition",
+	5:  "leader not available",
+	6:  "not leader for partition",
+	7:  "request timed out",
+	10: "message too large",
+	19: "not enough replicas",
+	20: "not enough replicas after append",
+	29: "not authorized for the topic",
+	33: "unsupported sasl mechanism",
+	58: "sasl authentication failed",
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaError describes a Kafka error code.
+func kafkaError(code int16) error {
+	if message, found := gsKafkaErrors[code]; found {
+		return fmt.Errorf("kafka: %s", message)
+	}
+
+	return fmt.Errorf("kafka error %d", code)
+}
+
+// produceKafka sends records to settings' topic, each to the partition its
+// key hashes to as Kafka's own clients would pick, waiting for every
+// in-sync replica to have them.
+func produceKafka(ctx context.Context, settings *Kafka, records []kafkaRecord) error {
+	password, err := resolveSecret(settings.Password)
+
+	if err != nil {
+		return err
+	}
+
+	conns := map[string]*kafkaConn{}
+
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	var brokers map[int32]string
+	var leaders []int32
+
+	for _, broker := range settings.Brokers {
+		var conn *kafkaConn
+
+		if conn, err = dialKafka(ctx, settings, password, broker); err == nil {
+			conns[broker] = conn
+			brokers, leaders, err = conn.metadata(settings.Topic)
+		}
+
+		if err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	batches := map[int32]map[int32][]kafkaRecord{}
+
+	for _, record := range records {
+		partition := (murmur2([]byte(record.Key)) & 0x7fffffff) % int32(len(leaders))
+		leader := leaders[partition]
+
+		if batches[leader] == nil {
+			batches[leader] = map[int32][]kafkaRecord{}
+		}
+
+		batches[leader][partition] = append(batches[leader][partition], record)
+	}
+
+	for leader, partitions := range batches {
+		addr, found := brokers[leader]
+
+		if !found {
+			return kafkaError(5)
+		}
+
+		conn := conns[addr]
+
+		if conn == nil {
+			if conn, err = dialKafka(ctx, settings, password, addr); err != nil {
+				return err
+			}
+
+			conns[addr] = conn
+		}
+
+		if err := conn.produce(settings.Topic, partitions); err != nil {
+			return fmt.Errorf("%s: %w", addr, err)
+		}
+	}
+
+	return nil
+}
+
+// kafkaConn is a connection to a Kafka broker.
+type kafkaConn struct {
+	net.Conn
+	correlation int32
+}
+
+func dialKafka(ctx context.Context, settings *Kafka, password, addr string) (*kafkaConn, error) {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if settings.TLS {
+		host, _, _ := net.SplitHostPort(addr)
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+
+	if deadline, found := ctx.Deadline(); found {
+		conn.SetDeadline(deadline)
+	}
+
+	c := &kafkaConn{Conn: conn}
+
+	if settings.SASL != "" {
+		if err := c.authenticate(settings.SASL, settings.Username, password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: %w", addr, err)
+		}
+	}
+
+	return c, nil
+}
+
+// request sends a request and reads its response, after the response
+// header.
+func (c *kafkaConn) request(api, version int16, body []byte) (*kafkaReader, error) {
+	c.correlation++
+
+	var request kafkaWriter
+	request.int32(0)
+	request.int16(api)
+	request.int16(version)
+	request.int32(c.correlation)
+	request.string("gitsync")
+	request.buf = append(request.buf, body...)
+	binary.BigEndian.PutUint32(request.buf, uint32(len(request.buf)-4))
+
+	if _, err := c.Write(request.buf); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+
+	if _, err := io.ReadFull(c, size[:]); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, binary.BigEndian.Uint32(size[:]))
+
+	if _, err := io.ReadFull(c, response); err != nil {
+		return nil, err
+	}
+
+	reader := &kafkaReader{data: response}
+
+	if correlation := reader.int32(); reader.err == nil && correlation != c.correlation {
+		return nil, fmt.Errorf("kafka answered request %d instead of %d", correlation, c.correlation)
+	}
+
+	return reader, reader.err
+}
+
+// metadata finds the brokers' addresses, by node ID, and the leader of each
+// of topic's partitions.
+func (c *kafkaConn) metadata(topic string) (map[int32]string, []int32, error) {
+	var request kafkaWriter
+	request.int32(1)
+	request.string(topic)
+
+	response, err := c.request(kafkaMetadata, 1, request.buf)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	brokers := map[int32]string{}
+
+	for n := response.int32(); n > 0 && response.err == nil; n-- {
+		node, host, port := response.int32(), response.string(), response.int32()
+		response.string()
+		brokers[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	response.int32()
+
+	var leaders []int32
+
+	for n := response.int32(); n > 0 && response.err == nil; n-- {
+		code, name := response.int16(), response.string()
+		response.int8()
+
+		if name == topic && code != 0 {
+			return nil, nil, kafkaError(code)
+		}
+
+		for p := response.int32(); p > 0 && response.err == nil; p-- {
+			response.int16()
+			partition, leader := response.int32(), response.int32()
+			response.skip(4 * int(response.int32()))
+			response.skip(4 * int(response.int32()))
+
+			if name != topic {
+				continue
+			}
+
+			for int(partition) >= len(leaders) {
+				leaders = append(leaders, -1)
+			}
+
+			leaders[partition] = leader
+		}
+	}
+
+	if response.err != nil {
+		return nil, nil, response.err
+	}
+
+	if len(leaders) == 0 {
+		return nil, nil, kafkaError(3)
+	}
+
+	return brokers, leaders, nil
+}
+
+// produce appends records to partitions of topic this broker leads, as one
+// uncompressed batch each.
+func (c *kafkaConn) produce(topic string, partitions map[int32][]kafkaRecord) error {
+	var request kafkaWriter
+	request.int16(-1)
+	request.int16(-1)
+	request.int32(int32(gsKafkaTimeout / time.Millisecond))
+	request.int32(1)
+	request.string(topic)
+	request.int32(int32(len(partitions)))
+
+	for partition, records := range partitions {
+		request.int32(partition)
+		request.bytes(recordBatch(records))
+	}
+
+	response, err := c.request(kafkaProduce, 3, request.buf)
+
+	if err != nil {
+		return err
+	}
+
+	for n := response.int32(); n > 0 && response.err == nil; n-- {
+		response.string()
+
+		for p := response.int32(); p > 0 && response.err == nil; p-- {
+			response.int32()
+
+			if code := response.int16(); code != 0 && response.err == nil {
+				return kafkaError(code)
+			}
+
+			response.int64()
+			response.int64()
+		}
+	}
+
+	return response.err
+}
+
+// authenticate authenticates with SASL, PLAIN or SCRAM.
+func (c *kafkaConn) authenticate(mechanism, username, password string) error {
+	var request kafkaWriter
+	request.string(strings.ToUpper(mechanism))
+
+	response, err := c.request(kafkaSASLHandshake, 1, request.buf)
+
+	if err != nil {
+		return err
+	}
+
+	if code := response.int16(); code != 0 {
+		return kafkaError(code)
+	}
+
+	if mechanism == gsKafkaSASLPlain {
+		_, err := c.saslAuthenticate([]byte("\x00" + username + "\x00" + password))
+		return err
+	}
+
+	hashFunc := sha256.New
+
+	if mechanism == gsKafkaSASLSCRAM512 {
+		hashFunc = sha512.New
+	}
+
+	return c.scram(hashFunc, username, password)
+}
+
+func (c *kafkaConn) saslAuthenticate(message []byte) ([]byte, error) {
+	var request kafkaWriter
+	request.bytes(message)
+
+	response, err := c.request(kafkaSASLAuthenticate, 0, request.buf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	code, reason, reply := response.int16(), response.string(), response.bytes()
+
+	if response.err != nil {
+		return nil, response.err
+	}
+
+	if code != 0 {
+		if reason != "" {
+			return nil, fmt.Errorf("%w: %s", kafkaError(code), reason)
+		}
+
+		return nil, kafkaError(code)
+	}
+
+	return reply, nil
+}
+
+// scram authenticates with SCRAM (RFC 5802), checking the broker knows the
+// password too.
+func (c *kafkaConn) scram(hashFunc func() hash.Hash, username, password string) error {
+	mac := func(key []byte, message string) []byte {
+		h := hmac.New(hashFunc, key)
+		h.Write([]byte(message))
+		return h.Sum(nil)
+	}
+
+	nonce := randomHex(16)
+	clientFirst := "n=" + strings.NewReplacer("=", "=3D", ",", "=2C").Replace(username) + ",r=" + nonce
+	reply, err := c.saslAuthenticate([]byte("n,," + clientFirst))
+
+	if err != nil {
+		return err
+	}
+
+	serverFirst := string(reply)
+	fields := scramFields(serverFirst)
+	salt, err := base64.StdEncoding.DecodeString(fields["s"])
+	iterations, convErr := strconv.Atoi(fields["i"])
+
+	if err != nil || convErr != nil || !strings.HasPrefix(fields["r"], nonce) {
+		return errors.New("kafka sent a bad scram challenge")
+	}
+
+	salted, err := pbkdf2.Key(hashFunc, password, salt, iterations, hashFunc().Size())
+
+	if err != nil {
+		return err
+	}
+
+	clientKey := mac(salted, "Client Key")
+	storedKey := hashFunc()
+	storedKey.Write(clientKey)
+
+	clientFinal := "c=biws,r=" + fields["r"]
+	authMessage := clientFirst + "," + serverFirst + "," + clientFinal
+	proof := mac(storedKey.Sum(nil), authMessage)
+
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	reply, err = c.saslAuthenticate([]byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+
+	if err != nil {
+		return err
+	}
+
+	serverFinal := scramFields(string(reply))
+
+	if serverFinal["e"] != "" {
+		return fmt.Errorf("kafka: %s", serverFinal["e"])
+	}
+
+	signature := mac(mac(salted, "Server Key"), authMessage)
+
+	if !hmac.Equal([]byte(serverFinal["v"]), []byte(base64.StdEncoding.EncodeToString(signature))) {
+		return errors.New("kafka's scram signature doesn't match, it may not be the broker it claims to be")
+	}
+
+	return nil
+}
+
+func scramFields(message string) map[string]string {
+	fields := map[string]string{}
+
+	for _, field := range strings.Split(message, ",") {
+		if name, value, found := strings.Cut(field, "="); found {
+			fields[name] = value
+		}
+	}
+
+	return fields
+}
+
+// recordBatch encodes records as a v2 record batch.
+func recordBatch(records []kafkaRecord) []byte {
+	first, last := records[0].Time.UnixMilli(), records[0].Time.UnixMilli()
+
+	for _, record := range records {
+		first, last = min(first, record.Time.UnixMilli()), max(last, record.Time.UnixMilli())
+	}
+
+	var batch kafkaWriter
+	batch.int16(0)
+	batch.int32(int32(len(records) - 1))
+	batch.int64(first)
+	batch.int64(last)
+	batch.int64(-1)
+	batch.int16(-1)
+	batch.int32(-1)
+	batch.int32(int32(len(records)))
+
+	for i, record := range records {
+		var body []byte
+		body = append(body, 0)
+		body = binary.AppendVarint(body, record.Time.UnixMilli()-first)
+		body = binary.AppendVarint(body, int64(i))
+		body = binary.AppendVarint(body, int64(len(record.Key)))
+		body = append(body, record.Key...)
+		body = binary.AppendVarint(body, int64(len(record.Value)))
+		body = append(body, record.Value...)
+		body = binary.AppendVarint(body, 0)
+
+		batch.buf = binary.AppendVarint(batch.buf, int64(len(body)))
+		batch.buf = append(batch.buf, body...)
+	}
+
+	var header kafkaWriter
+	header.int64(0)
+	header.int32(int32(4 + 1 + 4 + len(batch.buf)))
+	header.int32(-1)
+	header.int8(2)
+	header.int32(int32(crc32.Checksum(batch.buf, crc32c)))
+
+	return append(header.buf, batch.buf...)
+}
+
+// murmur2 is the hash Kafka's clients partition keys by.
+func murmur2(data []byte) int32 {
+	const m = 0x5bd1e995
+
+	length := len(data)
+	h := uint32(0x9747b28c) ^ uint32(length)
+
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length&^3:]
+
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+
+	return int32(h)
+}
+
+// kafkaWriter encodes Kafka's big-endian protocol types.
+type kafkaWriter struct {
+	buf []byte
+}
+
+func (w *kafkaWriter) int8(v int8)   { w.buf = append(w.buf, byte(v)) }
+func (w *kafkaWriter) int16(v int16) { w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(v)) }
+func (w *kafkaWriter) int32(v int32) { w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(v)) }
+func (w *kafkaWriter) int64(v int64) { w.buf = binary.BigEndian.AppendUint64(w.buf, uint64(v)) }
+
+func (w *kafkaWriter) string(v string) {
+	w.int16(int16(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *kafkaWriter) bytes(v []byte) {
+	w.int32(int32(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+// kafkaReader decodes Kafka's big-endian protocol types, remembering the
+// first response too short for them.
+type kafkaReader struct {
+	data []byte
+	err  error
+}
+
+func (r *kafkaReader) skip(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if n < 0 || n > len(r.data) {
+		r.err = errKafkaShort
+		return nil
+	}
+
+	taken := r.data[:n]
+	r.data = r.data[n:]
+
+	return taken
+}
+
+func (r *kafkaReader) int8() int8 {
+	if b := r.skip(1); b != nil {
+		return int8(b[0])
+	}
+
+	return 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.skip(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.skip(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.skip(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+
+	return 0
+}
+
+// string reads a string, a null one reading as empty.
+func (r *kafkaReader) string() string {
+	if n := r.int16(); n > 0 {
+		return string(r.skip(int(n)))
+	}
+
+	return ""
+}
+
+func (r *kafkaReader) bytes() []byte {
+	if n := r.int32(); n > 0 {
+		return r.skip(int(n))
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package gitsync
+
+import (
+	"fmt"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// MaxChange is how much a single run may change the targets before it needs
+// confirming, to catch syncing an accidental reset or rewrite upstream.
+// Zero means no limit.
+type MaxChange struct {
+	// Commits limits how many commits a push may move a target branch
+	// forward, or back when it is force pushed.
+	Commits int `json:"commits"`
+	// Refs limits how many refs a run may rewrite with force pushes.
+	Refs int `json:"refs"`
+}
+
+func checkMaxChange(limits *MaxChange) bool {
+	if limits != nil && (limits.Commits < 0 || limits.Refs < 0) {
+		errorPrintf("max_change limits can't be negative\n")
+		return false
+	}
+
+	return true
+}
+
+// checkLargeChange refuses to move ref on target from oldSHA to newSHA if
+// that would go over the configured limits, unless large changes were
+// confirmed. New branches on the target are never limited.
+func (s *Syncer) checkLargeChange(repo *git.Repository, target string, ref plumbing.ReferenceName, oldSHA, newSHA string, force bool) error {
+	limits := s.config.MaxChange
+
+	if limits == nil || s.confirmLargeChange || oldSHA == "" {
+		return nil
+	}
+
+	if force && limits.Refs > 0 && s.rewrittenRefs >= limits.Refs {
+		return fmt.Errorf("%w: %s on %s would be rewritten after %d refs already were this run, the limit is %d", errLargeChange, ref.Short(), target, s.rewrittenRefs, limits.Refs)
+	}
+
+	if limits.Commits == 0 {
+		return nil
+	}
+
+	ahead, behind := divergence(repo, oldSHA, newSHA)
+
+	if behind > limits.Commits {
+		return fmt.Errorf("%w: %s on %s would move back %d commits, the limit is %d", errLargeChange, ref.Short(), target, behind, limits.Commits)
+	}
+
+	if ahead > limits.Commits {
+		return fmt.Errorf("%w: %s on %s would move forward %d commits, the limit is %d", errLargeChange, ref.Short(), target, ahead, limits.Commits)
+	}
+
+	return nil
+}
+
+// divergence counts the commits newSHA has that oldSHA doesn't, and the
+// commits oldSHA would lose, from their merge base. When the repository
+// doesn't have oldSHA only the commits added can be counted.
+func divergence(repo *git.Repository, oldSHA, newSHA string) (int, int) {
+	oldCommit, err := repo.CommitObject(plumbing.NewHash(oldSHA))
+
+	if err != nil {
+		return countCommits(repo, oldSHA, newSHA), 0
+	}
+
+	newCommit, err := repo.CommitObject(plumbing.NewHash(newSHA))
+
+	if err != nil {
+		return 0, 0
+	}
+
+	bases, err := oldCommit.MergeBase(newCommit)
+
+	if err != nil || len(bases) == 0 {
+		return countCommits(repo, "", newSHA), countCommits(repo, "", oldSHA)
+	}
+
+	base := bases[0].Hash.String()
+
+	return countCommits(repo, base, newSHA), countCommits(repo, base, oldSHA)
+}
@@ -0,0 +1,247 @@
+package gitsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// gsLockFile is the lock gitsync takes in a local repository while it
+// pushes to it.
+const gsLockFile string = "gitsync.lock"
+
+// A held lock is touched every gsLockRefresh. One untouched for gsLockStale
+// was left behind by a gitsync that died, on another host if its process
+// can't be checked. A lock that isn't stale is waited for for up to
+// gsLockWait, looking again every gsLockPoll.
+const (
+	gsLockRefresh = time.Minute
+	gsLockStale   = 10 * time.Minute
+	gsLockWait    = 5 * time.Minute
+	gsLockPoll    = 250 * time.Millisecond
+)
+
+var errLocked = errors.New("locked by another gitsync")
+
+// localPath is where a remote URL points on the local filesystem, for plain
+// paths and file:// URLs, or "" for a remote reached over the network.
+func localPath(remoteURL string) string {
+	if path, found := strings.CutPrefix(remoteURL, "file://"); found {
+		return path
+	}
+
+	if endpoint, err := transport.NewEndpoint(remoteURL); remoteURL == "" || err != nil || endpoint.Protocol != "file" {
+		return ""
+	}
+
+	return remoteURL
+}
+
+// absoluteURL makes a relative path to a local remote absolute, relative to
+// dir, where git, running in the repository, takes it to be relative to.
+// go-git would take it to be relative to the current directory instead.
+func absoluteURL(remoteURL, dir string) string {
+	if path := localPath(remoteURL); path != "" && path == remoteURL && !filepath.IsAbs(path) && dir != "" {
+		return filepath.Join(dir, path)
+	}
+
+	return remoteURL
+}
+
+// ensureLocalRepo creates a local target's repository, bare, if its
+// directory doesn't exist yet. The directory it goes in must, so that a
+// share that isn't mounted isn't mistaken for an empty one.
+func (s *Syncer) ensureLocalRepo(target string) error {
+	path := localPath(s.effectiveURL(target, true))
+
+	switch _, err := os.Stat(path); {
+	case path == "":
+		return fmt.Errorf("%s create is local, but the remote isn't a path or file:// URL", target)
+	case err == nil:
+		return nil
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	if _, err := os.Stat(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("could not create %s: %w", path, err)
+	}
+
+	// Another gitsync creating it at the same time is as good.
+	if _, err := git.PlainInit(path, true); err != nil && !errors.Is(err, git.ErrRepositoryAlreadyExists) {
+		return fmt.Errorf("could not create %s: %w", path, err)
+	}
+
+	s.infoPrintf("created bare repository %s for %s\n", path, target)
+
+	return nil
+}
+
+// cloneLocalWorkdir starts a new workdir clone as a bare clone of a source
+// on the local filesystem, whose objects git hardlinks rather than copies
+// when they are on the same filesystem, so the first run neither copies
+// the history nor takes up space for it twice. It returns false when the
+// source isn't local or git isn't installed, and the clone starts empty.
+func (s *Syncer) cloneLocalWorkdir(dir, source string) bool {
+	path := localPath(source)
+	binary, err := exec.LookPath("git")
+
+	if path == "" || err != nil {
+		return false
+	}
+
+	s.infoPrintf("cloning %s into workdir clone %s\n", path, dir)
+
+	output, err := exec.CommandContext(context.Background(), binary, "clone", "--bare", "--local", "--quiet", path, dir).CombinedOutput()
+
+	if err != nil {
+		s.warnPrintf("could not clone %s, fetching it instead: %s\n", path, lastLine(string(output)))
+		os.RemoveAll(dir)
+		return false
+	}
+
+	return true
+}
+
+// pushTo pushes refSpec to target with its push backend, holding the
+// target's lock while it does if the target is a local repository, which
+// other gitsyncs, on this host or others sharing it over NFS, push to too.
+func (s *Syncer) pushTo(ctx context.Context, repo *git.Repository, target string, refSpec config.RefSpec, progress *progressWriter) error {
+	if path := localPath(s.effectiveURL(target, true)); path != "" {
+		unlock, err := s.lock(ctx, filepath.Join(path, gsLockFile))
+
+		if err != nil {
+			return err
+		}
+
+		defer unlock()
+	}
+
+	return s.backendFor(target, opPush).push(ctx, repo, target, refSpec, progress)
+}
+
+// lock takes the advisory lock at path, a file created exclusively, which
+// unlike flock works over NFS, holding this process's ID and host. A stale
+// lock is taken over, any other waited for. The lock is touched while it is
+// held, and releasing it removes it.
+func (s *Syncer) lock(ctx context.Context, path string) (func(), error) {
+	host, _ := os.Hostname()
+	deadline := time.Now().Add(gsLockWait)
+
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+
+		if err == nil {
+			_, err = fmt.Fprintf(file, "%d %s\n", os.Getpid(), host)
+
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+
+		if err == nil {
+			return holdLock(path), nil
+		}
+
+		if !errors.Is(err, os.ErrExist) {
+			os.Remove(path)
+			return nil, fmt.Errorf("could not lock %s: %w", path, err)
+		}
+
+		holder, stale := staleLock(path, host)
+
+		if stale && takeOverLock(path, holder) {
+			s.warnPrintf("took over the lock %s left behind by %s\n", path, holder)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s is %w, %s", filepath.Dir(path), errLocked, holder)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(gsLockPoll):
+		}
+	}
+}
+
+// holdLock touches the lock at path until the function it returns releases
+// it.
+func holdLock(path string) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(gsLockRefresh)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				os.Chtimes(path, now, now)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		os.Remove(path)
+	}
+}
+
+// staleLock says who holds the lock at path, and whether they are gone: a
+// process on this host that isn't running any more, or anyone who hasn't
+// touched it in gsLockStale.
+func staleLock(path, host string) (string, bool) {
+	content, err := os.ReadFile(path)
+	info, statErr := os.Stat(path)
+
+	if err != nil || statErr != nil {
+		return "", false
+	}
+
+	holder := strings.TrimSpace(string(content))
+	pid, lockHost, _ := strings.Cut(holder, " ")
+	id, err := strconv.Atoi(pid)
+
+	if lockHost == host && err == nil && !processAlive(id) {
+		return holder, true
+	}
+
+	return holder, time.Since(info.ModTime()) > gsLockStale
+}
+
+// takeOverLock removes the stale lock at path held by holder. It is moved
+// aside first, so that of several gitsyncs taking it over at once only one
+// removes it, and put back if it turns out someone took it in the meantime.
+func takeOverLock(path, holder string) bool {
+	aside := fmt.Sprintf("%s.%d", path, os.Getpid())
+
+	if err := os.Rename(path, aside); err != nil {
+		return false
+	}
+
+	if content, err := os.ReadFile(aside); err == nil && strings.TrimSpace(string(content)) != holder {
+		os.Link(aside, path)
+		os.Remove(aside)
+
+		return false
+	}
+
+	os.Remove(aside)
+
+	return true
+}
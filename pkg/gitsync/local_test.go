@@ -0,0 +1,130 @@
+package gitsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+)
+
+func TestLock(t *testing.T) {
+	host, _ := os.Hostname()
+
+	tests := []struct {
+		name   string
+		holder string
+		age    time.Duration
+		taken  bool
+	}{
+		{"free", "", 0, true},
+		{"held here", fmt.Sprintf("%d %s", os.Getpid(), host), 0, false},
+		{"held elsewhere", "1 elsewhere", 0, false},
+		{"left behind here", fmt.Sprintf("%d %s", 1<<30, host), 0, true},
+		{"left behind elsewhere", "1 elsewhere", gsLockStale + time.Minute, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), gsLockFile)
+
+			if test.holder != "" {
+				if err := os.WriteFile(path, []byte(test.holder+"\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+
+				touched := time.Now().Add(-test.age)
+
+				if err := os.Chtimes(path, touched, touched); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 4*gsLockPoll)
+			defer cancel()
+
+			s := &Syncer{}
+			unlock, err := s.lock(ctx, path)
+
+			if (err == nil) != test.taken {
+				t.Fatalf("got %v, want taken %t", err, test.taken)
+			}
+
+			content, _ := os.ReadFile(path)
+
+			if !test.taken {
+				if strings.TrimSpace(string(content)) != test.holder {
+					t.Errorf("lock is held by %q, want %q", content, test.holder)
+				}
+
+				return
+			}
+
+			if want := fmt.Sprintf("%d %s\n", os.Getpid(), host); string(content) != want {
+				t.Errorf("lock is held by %q, want %q", content, want)
+			}
+
+			unlock()
+
+			if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("lock is still there once released: %v", err)
+			}
+		})
+	}
+}
+
+func TestPushToLockedLocalTarget(t *testing.T) {
+	dir, _, target, initial := testRepos(t, "main")
+	local, err := git.PlainOpen(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{Sync: []SyncEntry{{Source: "source", Target: "target", Branches: []string{"main"}}}}
+	syncer, err := New(config, Options{RepoDir: dir, Progress: ProgressNone})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syncer.collectRepoInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	lockPath := filepath.Join(localPath(syncer.effectiveURL("target", true)), gsLockFile)
+	unlock, err := syncer.lock(context.Background(), lockPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 4*gsLockPoll)
+	defer cancel()
+
+	refSpec := gitconfig.RefSpec(initial.String() + ":refs/heads/pushed")
+
+	if err := syncer.pushTo(ctx, local, "target", refSpec, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("pushing to the locked target got %v, want it to wait", err)
+	}
+
+	unlock()
+
+	if err := syncer.pushTo(context.Background(), local, "target", refSpec, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testBranchSHA(t, target, "pushed"); got != initial {
+		t.Errorf("pushed is %s, want %s", ShortSHA(got.String()), ShortSHA(initial.String()))
+	}
+
+	if _, err := os.Stat(lockPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the target is still locked after the push: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package gitsync
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// LogLevel is how much gitsync logs, each level including the ones before it.
+type LogLevel int
+
+const (
+	LevelError LogLevel = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+	LevelTrace
+)
+
+var gsLogLevels = map[string]LogLevel{
+	"error": LevelError,
+	"warn":  LevelWarn,
+	"info":  LevelInfo,
+	"debug": LevelDebug,
+	"trace": LevelTrace,
+}
+
+var gsLogPrefixes = map[LogLevel]string{
+	LevelError: "ERROR ",
+	LevelWarn:  "WARN ",
+	LevelInfo:  "INFO ",
+	LevelDebug: "DEBUG ",
+	LevelTrace: "TRACE ",
+}
+
+var currentLogLevel = LevelInfo
+
+// SetLogLevel picks the log level from the -log-level flag, falling back to
+// -quiet (errors only) or the verbosity given by -v (info) and -vv or -debug
+// (debug). Without any of them, interactive runs get info and everything else
+// (cron, pipes) only warnings and errors, so a quiet run means nothing went
+// wrong.
+func SetLogLevel(name string, quiet bool, verbosity int) error {
+	if quiet && verbosity > 0 {
+		return errors.New("-quiet can't be combined with -v, -vv or -debug")
+	}
+
+	if name == "" {
+		switch {
+		case quiet:
+			name = "error"
+		case verbosity >= 2:
+			name = "debug"
+		case verbosity == 1:
+			name = "info"
+		case StdoutIsTerminal():
+			name = "info"
+		default:
+			name = "warn"
+		}
+	}
+
+	level, exists := gsLogLevels[strings.ToLower(name)]
+
+	if !exists {
+		return fmt.Errorf("unknown log level %s", name)
+	}
+
+	currentLogLevel = level
+
+	return nil
+}
+
+// StdoutIsTerminal reports whether stdout is an interactive terminal.
+func StdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// LogPrefix is the text every log line at level starts with.
+func LogPrefix(level LogLevel) string {
+	return gsLogPrefixes[level]
+}
+
+// LogEnabled reports whether messages at level are logged.
+func LogEnabled(level LogLevel) bool {
+	return level <= currentLogLevel
+}
+
+// Logf logs a message at level through the standard logger.
+func Logf(level LogLevel, format string, args ...interface{}) {
+	if LogEnabled(level) {
+		log.Printf(gsLogPrefixes[level]+format, args...)
+	}
+}
+
+func errorPrintf(format string, args ...interface{}) {
+	Logf(LevelError, format, args...)
+}
+
+func warnPrintf(format string, args ...interface{}) {
+	Logf(LevelWarn, format, args...)
+}
+
+func infoPrintf(format string, args ...interface{}) {
+	Logf(LevelInfo, format, args...)
+}
+
+func debugPrintf(format string, args ...interface{}) {
+	Logf(LevelDebug, format, args...)
+}
+
+// correlation tags a log line with the run and sync entry it belongs to.
+func (s *Syncer) correlation() string {
+	switch {
+	case s.run == nil || s.run.ID == "":
+		return ""
+	case s.currentSync == nil:
+		return "run=" + s.run.ID + " "
+	}
+
+	return "run=" + s.run.ID + " sync=" + s.currentSync.ID + " "
+}
+
+// logf logs a message at level, tagged with the run and sync entry the
+// Syncer is processing.
+func (s *Syncer) logf(level LogLevel, format string, args ...interface{}) {
+	if LogEnabled(level) {
+		log.Printf(gsLogPrefixes[level]+s.correlation()+format, args...)
+	}
+}
+
+func (s *Syncer) errorPrintf(format string, args ...interface{}) {
+	s.logf(LevelError, format, args...)
+}
+
+func (s *Syncer) warnPrintf(format string, args ...interface{}) {
+	s.logf(LevelWarn, format, args...)
+}
+
+func (s *Syncer) infoPrintf(format string, args ...interface{}) {
+	s.logf(LevelInfo, format, args...)
+}
+
+func (s *Syncer) debugPrintf(format string, args ...interface{}) {
+	s.logf(LevelDebug, format, args...)
+}
+
+func (s *Syncer) tracePrintf(format string, args ...interface{}) {
+	s.logf(LevelTrace, format, args...)
+}
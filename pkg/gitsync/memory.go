@@ -0,0 +1,95 @@
+package gitsync
+
+import (
+	"errors"
+	"os/exec"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// Memory bounds how much memory syncing takes, for repositories with
+// millions of objects in containers with memory limits.
+type Memory struct {
+	// ObjectCacheMB is the size of the cache of decoded objects each open
+	// repository keeps; go-git's default is 96.
+	ObjectCacheMB int `json:"object_cache_mb"`
+	// LargeObjectKB reads objects bigger than this from their pack as they
+	// are needed, instead of whole into memory.
+	LargeObjectKB int `json:"large_object_kb"`
+	// GitBackend makes git the backend of remotes that don't choose one.
+	// git streams packs to and from disk, where go-git indexes the packs it
+	// fetches and builds the packs it pushes in memory.
+	GitBackend bool `json:"git_backend"`
+}
+
+func (s *Syncer) checkMemory() bool {
+	memory := s.config.Memory
+
+	switch {
+	case memory == nil:
+		return true
+	case memory.ObjectCacheMB < 0 || memory.LargeObjectKB < 0:
+		errorPrintf("memory limits can't be negative\n")
+		return false
+	case !memory.GitBackend:
+		return true
+	case s.fs != nil:
+		errorPrintf("memory's git_backend needs the repository on disk\n")
+		return false
+	}
+
+	if s.gitBinary == "" {
+		binary, err := exec.LookPath("git")
+
+		if err != nil {
+			errorPrintf("memory's git_backend needs git, but it can't be found: %s\n", err)
+			return false
+		}
+
+		s.gitBinary = binary
+	}
+
+	return true
+}
+
+// openStorage is the storage for the repository in dotGit, bounded by the
+// memory settings.
+func (s *Syncer) openStorage(dotGit billy.Filesystem) *filesystem.Storage {
+	objects := cache.NewObjectLRUDefault()
+	var options filesystem.Options
+
+	if memory := s.config.Memory; memory != nil {
+		if memory.ObjectCacheMB > 0 {
+			objects = cache.NewObjectLRU(cache.FileSize(memory.ObjectCacheMB) * cache.MiByte)
+		}
+
+		options.LargeObjectThreshold = int64(memory.LargeObjectKB) * 1024
+	}
+
+	return filesystem.NewStorageWithOptions(dotGit, objects, options)
+}
+
+// boundMemory reopens a repository go-git opened with its defaults with the
+// memory settings instead.
+func (s *Syncer) boundMemory(repo *git.Repository) (*git.Repository, error) {
+	if s.config.Memory == nil {
+		return repo, nil
+	}
+
+	local, ok := repo.Storer.(*filesystem.Storage)
+
+	if !ok {
+		return nil, errors.New("repository isn't on disk")
+	}
+
+	var checkout billy.Filesystem
+
+	if worktree, err := repo.Worktree(); err == nil {
+		checkout = worktree.Filesystem
+	}
+
+	return git.Open(s.openStorage(local.Filesystem()), checkout)
+}
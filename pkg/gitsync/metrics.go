@@ -0,0 +1,298 @@
+package gitsync
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+const (
+	metricCounter   string = "counter"
+	metricGauge     string = "gauge"
+	metricHistogram string = "histogram"
+)
+
+var gsDurationBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// metricFamily is a minimal Prometheus metric with a fixed set of label
+// names. It is just enough to render the text exposition format without
+// pulling in the full client library.
+type metricFamily struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+	series     map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels  []string
+	value   float64
+	counts  []uint64
+	sum     float64
+	samples uint64
+}
+
+var metricsMutex sync.Mutex
+var metricFamilies []*metricFamily
+
+var (
+	metricSyncsAttempted   = newMetric("gitsync_syncs_attempted_total", "Sync entries attempted.", metricCounter, nil, "source", "target")
+	metricSyncsSucceeded   = newMetric("gitsync_syncs_succeeded_total", "Sync entries where every branch synced.", metricCounter, nil, "source", "target")
+	metricSyncsFailed      = newMetric("gitsync_syncs_failed_total", "Sync entries that were skipped or had a branch fail.", metricCounter, nil, "source", "target")
+	metricBranchDuration   = newMetric("gitsync_branch_duration_seconds", "Time taken to sync a single branch.", metricHistogram, gsDurationBuckets, "source", "target", "branch")
+	metricPhaseDuration    = newMetric("gitsync_phase_duration_seconds", "Time taken by each phase (pull, push) of syncing a branch.", metricHistogram, gsDurationBuckets, "source", "target", "branch", "phase")
+	metricBranchBytes      = newMetric("gitsync_branch_bytes_total", "Bytes sent and received over HTTP(S) transports while syncing a branch.", metricCounter, nil, "source", "target", "branch", "direction")
+	metricBytesTransferred = newMetric("gitsync_bytes_transferred_total", "Bytes sent and received over HTTP(S) transports.", metricCounter, nil, "direction")
+	metricLastRun          = newMetric("gitsync_last_run_info", "The run_id of the most recent run, for correlating with logs and reports.", metricGauge, nil, "run_id")
+	metricLastSuccess      = newMetric("gitsync_last_success_timestamp_seconds", "Unix time of the last fully successful sync of an entry.", metricGauge, nil, "source", "target")
+)
+
+func newMetric(name, help, kind string, buckets []float64, labelNames ...string) *metricFamily {
+	family := &metricFamily{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     map[string]*metricSeries{},
+	}
+
+	metricFamilies = append(metricFamilies, family)
+
+	return family
+}
+
+func (f *metricFamily) seriesFor(labels []string) *metricSeries {
+	key := strings.Join(labels, "\xff")
+	series, exists := f.series[key]
+
+	if !exists {
+		series = &metricSeries{labels: labels, counts: make([]uint64, len(f.buckets))}
+		f.series[key] = series
+	}
+
+	return series
+}
+
+func (f *metricFamily) add(v float64, labels ...string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	f.seriesFor(labels).value += v
+}
+
+func (f *metricFamily) set(v float64, labels ...string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	f.seriesFor(labels).value = v
+}
+
+func (f *metricFamily) observe(v float64, labels ...string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	series := f.seriesFor(labels)
+
+	for i, bound := range f.buckets {
+		if v <= bound {
+			series.counts[i]++
+		}
+	}
+
+	series.sum += v
+	series.samples++
+}
+
+// replace sets v as the only series of the metric, for info metrics whose
+// labels change every run. It isn't sent to StatsD, where the labels would
+// become part of the metric name.
+func (f *metricFamily) replace(v float64, labels ...string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	f.series = map[string]*metricSeries{}
+	f.seriesFor(labels).value = v
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	var pairs []string
+
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// writeMetrics renders every metric in the Prometheus text exposition format.
+func writeMetrics(w io.Writer) {
+	received, sent := transferredBytes()
+	metricBytesTransferred.set(float64(received), "received")
+	metricBytesTransferred.set(float64(sent), "sent")
+
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	for _, family := range metricFamilies {
+		fmt.Fprintf(w, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", family.name, family.kind)
+
+		keys := make([]string, 0, len(family.series))
+
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			series := family.series[key]
+
+			if family.kind != metricHistogram {
+				fmt.Fprintf(w, "%s%s %g\n", family.name, formatLabels(family.labelNames, series.labels), series.value)
+				continue
+			}
+
+			for i, bound := range family.buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", family.name, formatLabels(family.labelNames, series.labels, "le", fmt.Sprint(bound)), series.counts[i])
+			}
+
+			fmt.Fprintf(w, "%s_bucket%s %d\n", family.name, formatLabels(family.labelNames, series.labels, "le", "+Inf"), series.samples)
+			fmt.Fprintf(w, "%s_sum%s %g\n", family.name, formatLabels(family.labelNames, series.labels), series.sum)
+			fmt.Fprintf(w, "%s_count%s %d\n", family.name, formatLabels(family.labelNames, series.labels), series.samples)
+		}
+	}
+}
+
+// ServeMetrics serves /metrics on addr until the server fails.
+func ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+
+	infoPrintf("serving metrics on %s/metrics\n", addr)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		errorPrintf("metrics server stopped: %s\n", err)
+	}
+}
+
+// gsIdleConnsPerHost is how many idle HTTP connections are kept open to
+// each host, enough for the fetches and pushes running at once.
+const gsIdleConnsPerHost = 8
+
+// gsCachedTransports is how many differently configured HTTP transports,
+// one per set of proxy and TLS settings, are kept with their connections.
+const gsCachedTransports = 64
+
+var bytesReceived atomic.Int64
+var bytesSent atomic.Int64
+
+func init() {
+	// Count bytes at the connection level so the totals include HTTP(S)
+	// remotes that go-git reconfigures per remote (proxies, client certs),
+	// which it does by cloning this transport.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &countingConn{Conn: conn}, nil
+	}
+
+	// Connections are kept alive between the fetches, pushes and ref
+	// listings of a run, which reach the same few hosts over and over. The
+	// transports go-git clones for remotes with their own proxy or TLS
+	// settings are cached too, so their connections are reused as well.
+	transport.MaxIdleConnsPerHost = gsIdleConnsPerHost
+	httpClient := githttp.NewClientWithOptions(&http.Client{Transport: transport}, &githttp.ClientOptions{CacheMaxEntries: gsCachedTransports})
+	client.InstallProtocol("http", httpClient)
+	client.InstallProtocol("https", httpClient)
+}
+
+func transferredBytes() (int64, int64) {
+	return bytesReceived.Load(), bytesSent.Load()
+}
+
+// byteCounter counts the bytes of one transfer, so transfers running at the
+// same time are counted apart. Connections are counted towards the transfer
+// whose request is using them; HTTP/2 connections carrying several
+// transfers at once count towards whichever used them last.
+type byteCounter struct {
+	received atomic.Int64
+	sent     atomic.Int64
+}
+
+// countBytes has the HTTP(S) requests made with ctx counted by counter.
+func countBytes(ctx context.Context, counter *byteCounter) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn := info.Conn
+
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				conn = tlsConn.NetConn()
+			}
+
+			if counting, ok := conn.(*countingConn); ok {
+				counting.counter.Store(counter)
+			}
+		},
+	})
+}
+
+type countingConn struct {
+	net.Conn
+	counter atomic.Pointer[byteCounter]
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	bytesReceived.Add(int64(n))
+
+	if counter := c.counter.Load(); counter != nil {
+		counter.received.Add(int64(n))
+	}
+
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	bytesSent.Add(int64(n))
+
+	if counter := c.counter.Load(); counter != nil {
+		counter.sent.Add(int64(n))
+	}
+
+	return n, err
+}
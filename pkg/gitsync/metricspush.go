@@ -0,0 +1,196 @@
+package gitsync
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const gsDefaultPushgatewayJob string = "gitsync"
+const gsDefaultStatsdPrefix string = "gitsync"
+
+// statsd packets are kept under the common 1432 byte MTU-safe payload size.
+const gsStatsdMaxPacket int = 1432
+
+// MetricsPush sends each run's metrics to a Pushgateway, StatsD or
+// CloudWatch.
+type MetricsPush struct {
+	PushgatewayURL string      `json:"pushgateway_url"`
+	Job            string      `json:"job"`
+	Instance       string      `json:"instance"`
+	StatsdAddr     string      `json:"statsd_addr"`
+	StatsdPrefix   string      `json:"statsd_prefix"`
+	CloudWatch     *CloudWatch `json:"cloudwatch"`
+}
+
+var statsdUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// Metric families are shared by every Syncer in the process, as they are
+// served from one /metrics endpoint. Each Syncer only buffers the StatsD lines
+// for its own updates, which are sent when its run ends.
+
+func (s *Syncer) metricAdd(f *metricFamily, v float64, labels ...string) {
+	f.add(v, labels...)
+	s.recordStatsd(f, v, labels)
+}
+
+func (s *Syncer) metricSet(f *metricFamily, v float64, labels ...string) {
+	f.set(v, labels...)
+	s.recordStatsd(f, v, labels)
+}
+
+func (s *Syncer) metricObserve(f *metricFamily, v float64, labels ...string) {
+	f.observe(v, labels...)
+	s.recordStatsd(f, v, labels)
+}
+
+// recordStatsd converts a metric update into a StatsD line. Counters become
+// counts, histograms become timers in milliseconds and gauges stay gauges.
+func (s *Syncer) recordStatsd(f *metricFamily, v float64, labels []string) {
+	settings := s.config.MetricsPush
+
+	if settings == nil || settings.StatsdAddr == "" {
+		return
+	}
+
+	prefix := settings.StatsdPrefix
+
+	if prefix == "" {
+		prefix = gsDefaultStatsdPrefix
+	}
+
+	name := strings.TrimSuffix(strings.TrimPrefix(f.name, "gitsync_"), "_total")
+	parts := []string{prefix, name}
+
+	for _, label := range labels {
+		parts = append(parts, statsdUnsafe.ReplaceAllString(label, "_"))
+	}
+
+	switch f.kind {
+	case metricCounter:
+		s.statsdLines = append(s.statsdLines, fmt.Sprintf("%s:%g|c", strings.Join(parts, "."), v))
+	case metricGauge:
+		s.statsdLines = append(s.statsdLines, fmt.Sprintf("%s:%g|g", strings.Join(parts, "."), v))
+	case metricHistogram:
+		s.statsdLines = append(s.statsdLines, fmt.Sprintf("%s:%d|ms", strings.TrimSuffix(strings.Join(parts, "."), "_seconds"), int64(v*1000)))
+	}
+}
+
+// pushMetrics sends the run's metrics to the configured Pushgateway, StatsD
+// and CloudWatch sinks, for one-shot runs that nothing would ever scrape.
+func (s *Syncer) pushMetrics() {
+	settings := s.config.MetricsPush
+
+	if settings == nil {
+		return
+	}
+
+	if settings.PushgatewayURL != "" {
+		if err := pushToPushgateway(settings); err != nil {
+			s.warnPrintf("could not push metrics to %s: %s\n", settings.PushgatewayURL, err)
+		}
+	}
+
+	if settings.StatsdAddr != "" {
+		received, sent := transferredBytes()
+		s.recordStatsd(metricBytesTransferred, float64(received), []string{"received"})
+		s.recordStatsd(metricBytesTransferred, float64(sent), []string{"sent"})
+
+		lines := s.statsdLines
+		s.statsdLines = nil
+
+		if err := flushStatsd(settings.StatsdAddr, lines); err != nil {
+			s.warnPrintf("could not send metrics to statsd %s: %s\n", settings.StatsdAddr, err)
+		}
+	}
+
+	s.putRunMetrics()
+}
+
+func pushToPushgateway(settings *MetricsPush) error {
+	job := settings.Job
+
+	if job == "" {
+		job = gsDefaultPushgatewayJob
+	}
+
+	instance := settings.Instance
+
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+
+	pushURL := fmt.Sprintf("%s/metrics/job/%s/instance/%s", strings.TrimSuffix(settings.PushgatewayURL, "/"), url.PathEscape(job), url.PathEscape(instance))
+
+	var body bytes.Buffer
+	writeMetrics(&body)
+
+	req, err := http.NewRequest(http.MethodPut, pushURL, &body)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pushgateway returned %s", resp.Status)
+	}
+
+	debugPrintf("pushed metrics to %s\n", pushURL)
+
+	return nil
+}
+
+func flushStatsd(addr string, lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	conn, err := net.Dial("udp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	var packet bytes.Buffer
+
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > gsStatsdMaxPacket {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+
+			packet.Reset()
+		}
+
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+
+		packet.WriteString(line)
+	}
+
+	_, err = conn.Write(packet.Bytes())
+
+	debugPrintf("sent %d statsd metrics to %s\n", len(lines), addr)
+
+	return err
+}
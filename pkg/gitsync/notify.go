@@ -0,0 +1,376 @@
+package gitsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Notification sends run results to a chat webhook, email, generic webhook,
+// pager or any other registered Notifier.
+type Notification struct {
+	Type          string       `json:"type"`
+	URL           string       `json:"url"`
+	OnlyOnFailure bool         `json:"only_on_failure"`
+	Syncs         []SyncFilter `json:"syncs"`
+	Template      string       `json:"template"`
+	SMTP          *SMTP        `json:"smtp"`
+	Events        []string     `json:"events"`
+	Secret        string       `json:"secret"`
+	RoutingKey    string       `json:"routing_key"`
+	// TopicARN is the SNS topic sns notifications publish to.
+	TopicARN string `json:"topic_arn"`
+}
+
+// SyncFilter selects sync entries by remote; an empty field matches
+// any remote.
+type SyncFilter struct {
+	Source string `json:"source_remote"`
+	Target string `json:"target_remote"`
+}
+
+const gsDefaultNotificationTemplate string = `gitsync {{.Status}} on {{.Host}} ({{.Repository}})
+{{range .Syncs}}{{.Source}} -> {{.Target}}: {{.Status}}
+{{range .Branches}}  {{.Branch}}: {{.Status}}{{if .NewSHA}} {{short .OldSHA}} -> {{short .NewSHA}} ({{.Commits}} commits){{end}}{{if .Error}} {{.Error}}{{end}}
+{{end}}{{end}}`
+
+const gsDefaultNotificationSubject string = "gitsync {{.Status}} on {{.Host}}"
+
+// Events notifications can be sent.
+const (
+	eventRunStarted    string = string(EventRunStarted)
+	eventRunFinished   string = string(EventRunFinished)
+	eventSyncFailed    string = "sync_failed"
+	eventSyncFinished  string = string(EventSyncFinished)
+	eventConfigChanged string = string(EventConfigChanged)
+)
+
+var gsNotificationEvents = map[string]bool{
+	eventRunStarted:    true,
+	eventRunFinished:   true,
+	eventSyncFailed:    true,
+	eventSyncFinished:  true,
+	eventConfigChanged: true,
+}
+
+// Notifier delivers notifications of one type. The built-in types are
+// registered at startup, and library users can add their own with
+// RegisterNotifier.
+type Notifier interface {
+	// Check validates a notification's settings when the config is loaded.
+	Check(notification Notification) error
+	// Events are the events sent to the notifier when a notification
+	// doesn't list its own.
+	Events() []string
+	// Send delivers one event.
+	Send(message *NotificationMessage) error
+}
+
+// NotificationMessage is one event for one notification. Subject, Text and
+// Status only cover the sync entries the notification is interested in.
+type NotificationMessage struct {
+	Notification Notification
+	Event        string
+	Run          *RunResult
+	// Sync is the sync entry that failed, for sync_failed events, or that
+	// finished, for sync_finished events.
+	Sync *SyncResult
+	// Status is synced or failed.
+	Status string
+	// Subject and Text are the notification's templates rendered with the
+	// run report.
+	Subject string
+	Text    string
+
+	report reportRun
+}
+
+var gsNotifiersMu sync.RWMutex
+var gsNotifiers = map[string]Notifier{}
+
+// RegisterNotifier makes notifier handle notifications of notificationType,
+// replacing any notifier already registered for it.
+func RegisterNotifier(notificationType string, notifier Notifier) {
+	gsNotifiersMu.Lock()
+	defer gsNotifiersMu.Unlock()
+
+	gsNotifiers[notificationType] = notifier
+}
+
+func notifierFor(notificationType string) (Notifier, bool) {
+	gsNotifiersMu.RLock()
+	defer gsNotifiersMu.RUnlock()
+
+	notifier, exists := gsNotifiers[notificationType]
+
+	return notifier, exists
+}
+
+func init() {
+	for _, chat := range []string{"slack", "teams", "discord"} {
+		RegisterNotifier(chat, chatNotifier{chatType: chat})
+	}
+
+	RegisterNotifier("email", emailNotifier{})
+	RegisterNotifier("webhook", webhookNotifier{})
+	RegisterNotifier("pagerduty", pagerDutyNotifier{})
+	RegisterNotifier("sns", snsNotifier{})
+	RegisterNotifier("sqs", sqsNotifier{})
+}
+
+func (s *Syncer) checkNotifications() bool {
+	s.notificationTemplates = map[int]*template.Template{}
+	s.notificationSubjects = map[int]*template.Template{}
+
+	for i, notification := range s.config.Notifications {
+		notifier, exists := notifierFor(notification.Type)
+
+		if !exists {
+			errorPrintf("notification %d has an unknown type: %s\n", i, notification.Type)
+			return false
+		}
+
+		if err := notifier.Check(notification); err != nil {
+			errorPrintf("notification %d %s\n", i, err)
+			return false
+		}
+
+		for _, event := range notification.Events {
+			if !gsNotificationEvents[event] {
+				errorPrintf("notification %d has an unknown event: %s\n", i, event)
+				return false
+			}
+		}
+
+		subject := gsDefaultNotificationSubject
+
+		if notification.SMTP != nil && notification.SMTP.Subject != "" {
+			subject = notification.SMTP.Subject
+		}
+
+		tmpl, err := template.New(fmt.Sprintf("subject%d", i)).Parse(subject)
+
+		if err != nil {
+			errorPrintf("notification %d subject: %s\n", i, err)
+			return false
+		}
+
+		s.notificationSubjects[i] = tmpl
+
+		text := notification.Template
+
+		if text == "" {
+			text = gsDefaultNotificationTemplate
+		}
+
+		tmpl, err = template.New(fmt.Sprintf("notification%d", i)).Funcs(template.FuncMap{"short": ShortSHA}).Parse(text)
+
+		if err != nil {
+			errorPrintf("notification %d template: %s\n", i, err)
+			return false
+		}
+
+		s.notificationTemplates[i] = tmpl
+	}
+
+	return true
+}
+
+func (f SyncFilter) matches(source, target string) bool {
+	return (f.Source == "" || f.Source == source) && (f.Target == "" || f.Target == target)
+}
+
+func notificationMatchesSync(notification Notification, source, target string) bool {
+	if len(notification.Syncs) == 0 {
+		return true
+	}
+
+	for _, filter := range notification.Syncs {
+		if filter.matches(source, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notificationReport narrows the run report down to the syncs a notification
+// cares about, returning false when there is nothing to send.
+func notificationReport(notification Notification, report reportRun) (reportRun, bool) {
+	var syncs []reportSync
+
+	for _, sync := range report.Syncs {
+		if !notificationMatchesSync(notification, sync.Source, sync.Target) || (notification.OnlyOnFailure && sync.Status == StatusSynced) {
+			continue
+		}
+
+		syncs = append(syncs, sync)
+	}
+
+	if len(syncs) == 0 {
+		return report, false
+	}
+
+	report.Syncs = syncs
+	report.Status = StatusSynced
+
+	for _, sync := range syncs {
+		if sync.Status != StatusSynced {
+			report.Status = StatusFailed
+		}
+	}
+
+	return report, true
+}
+
+func (n Notification) wantsEvent(event string, notifier Notifier) bool {
+	events := n.Events
+
+	if len(events) == 0 {
+		events = notifier.Events()
+	}
+
+	for _, wanted := range events {
+		if wanted == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notify sends an event to every notification that wants it and whose
+// routing rules match. sync is only set for per-sync events.
+func (s *Syncer) notify(event string, sync *SyncResult) {
+	if len(s.config.Notifications) == 0 {
+		return
+	}
+
+	report := buildReport(s.run)
+
+	for i, notification := range s.config.Notifications {
+		notifier, _ := notifierFor(notification.Type)
+
+		if !notification.wantsEvent(event, notifier) {
+			continue
+		}
+
+		message := &NotificationMessage{Notification: notification, Event: event, Run: s.run, Sync: sync}
+		message.report = report
+
+		switch event {
+		case eventSyncFailed, eventSyncFinished:
+			if !notificationMatchesSync(notification, sync.Source, sync.Target) {
+				continue
+			}
+
+			message.report.Syncs = nil
+
+			for j := range report.Syncs {
+				if s.run.Syncs[j] == sync {
+					message.report.Syncs = []reportSync{report.Syncs[j]}
+				}
+			}
+
+			message.report.Status = StatusFailed
+
+			if sync.Status == StatusSynced {
+				message.report.Status = StatusSynced
+			}
+		case eventRunFinished:
+			filtered, send := notificationReport(notification, report)
+
+			if !send {
+				continue
+			}
+
+			message.report = filtered
+		case eventRunStarted:
+			message.report.Syncs = nil
+		}
+
+		message.Status = message.report.Status
+
+		var subject, text strings.Builder
+
+		if err := s.notificationSubjects[i].Execute(&subject, message.report); err != nil {
+			s.warnPrintf("notification %d subject: %s\n", i, err)
+			continue
+		}
+
+		if err := s.notificationTemplates[i].Execute(&text, message.report); err != nil {
+			s.warnPrintf("notification %d template: %s\n", i, err)
+			continue
+		}
+
+		message.Subject = subject.String()
+		message.Text = text.String()
+
+		if err := notifier.Send(message); err != nil {
+			s.warnPrintf("notification %d: could not send %s %s: %s\n", i, event, notification.Type, err)
+			continue
+		}
+
+		s.debugPrintf("sent %s %s notification\n", event, notification.Type)
+	}
+}
+
+// chatNotifier posts run summaries to Slack, Teams or Discord incoming
+// webhooks.
+type chatNotifier struct {
+	chatType string
+}
+
+func (n chatNotifier) Check(notification Notification) error {
+	if notification.URL == "" {
+		return errors.New("has no url")
+	}
+
+	return nil
+}
+
+func (n chatNotifier) Events() []string {
+	return []string{eventRunFinished}
+}
+
+func (n chatNotifier) Send(message *NotificationMessage) error {
+	webhook, err := resolveSecret(message.Notification.URL)
+
+	if err != nil {
+		return err
+	}
+
+	// Slack incoming webhooks and Teams connectors both take a "text" field.
+	payload := map[string]string{"text": message.Text}
+
+	if n.chatType == "discord" {
+		payload = map[string]string{"content": message.Text}
+	}
+
+	body, err := json.Marshal(payload)
+
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package gitsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const gsPagerDutyEventsAPI string = "https://events.pagerduty.com/v2/enqueue"
+
+// PagerDuty caps summaries at this many characters.
+const gsPagerDutyMaxSummary int = 1024
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	CustomDetails map[string]string `json:"custom_details"`
+}
+
+// pagerDutyNotifier raises a PagerDuty incident when a run fails and
+// resolves it once a run succeeds again. One incident is kept per host and
+// repository.
+type pagerDutyNotifier struct{}
+
+func (n pagerDutyNotifier) Check(notification Notification) error {
+	if notification.RoutingKey == "" {
+		return errors.New("has no routing_key")
+	}
+
+	return nil
+}
+
+func (n pagerDutyNotifier) Events() []string {
+	return []string{eventRunFinished}
+}
+
+func (n pagerDutyNotifier) Send(message *NotificationMessage) error {
+	routingKey, err := resolveSecret(message.Notification.RoutingKey)
+
+	if err != nil {
+		return err
+	}
+
+	event := pagerDutyEvent{
+		RoutingKey:  routingKey,
+		EventAction: "resolve",
+		DedupKey:    fmt.Sprintf("gitsync/%s/%s", message.report.Host, message.report.Repository),
+	}
+
+	if message.Status == StatusFailed {
+		summary := message.Subject
+
+		if len(summary) > gsPagerDutyMaxSummary {
+			summary = summary[:gsPagerDutyMaxSummary]
+		}
+
+		event.EventAction = "trigger"
+		event.Payload = &pagerDutyPayload{
+			Summary:       summary,
+			Source:        message.report.Host,
+			Severity:      "error",
+			CustomDetails: map[string]string{"run_id": message.Run.ID, "details": message.Text},
+		}
+	}
+
+	body, err := json.Marshal(event)
+
+	if err != nil {
+		return err
+	}
+
+	api := message.Notification.URL
+
+	if api == "" {
+		api = gsPagerDutyEventsAPI
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(api, "application/json", bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pagerduty returned %s", resp.Status)
+	}
+
+	return nil
+}
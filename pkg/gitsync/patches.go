@@ -0,0 +1,597 @@
+package gitsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// gsPatchesSentFile is where the source commit each branch's patches were
+// last created up to is kept, and gsPatchesAppliedFile where the source
+// commit each branch's patches were last applied up to and the commit that
+// became, both in the repository's git directory.
+const (
+	gsPatchesSentFile    string = "gitsync/patches-sent.json"
+	gsPatchesAppliedFile string = "gitsync/patches-applied.json"
+)
+
+const gsPatchSuffix string = ".mbox"
+
+// gsMaxAppliedPatches is how many of the source commits each branch's
+// applied patches came from are remembered, for series applied again to be
+// recognised and skipped.
+const gsMaxAppliedPatches = 10000
+
+// Patches are committed by gitsync, on their authors' dates, so applying the
+// same series on top of the same commit always gives the same commits.
+const (
+	gsPatchCommitterName  string = "gitsync"
+	gsPatchCommitterEmail string = "gitsync@localhost"
+)
+
+// gsPatchFromLine starts every patch of a git format-patch mbox, with the
+// source commit it was made from.
+var gsPatchFromLine = regexp.MustCompile(`(?m)^From ([0-9a-f]{40}) Mon Sep 17 00:00:00 2001$`)
+
+var gsPatchBaseLine = regexp.MustCompile(`(?m)^base-commit: ([0-9a-f]{40})$`)
+
+// PatchSeries is a series of patches CreatePatches wrote for a branch of a
+// source.
+type PatchSeries struct {
+	Source string
+	Branch string
+	Path   string
+	// Base is the source commit the series applies on top of, and Tip
+	// the one its last patch was made from.
+	Base    string
+	Tip     string
+	Commits int
+}
+
+type patchesState struct {
+	Branches []patchedBranch `json:"branches"`
+}
+
+type patchedBranch struct {
+	Source string `json:"source_remote"`
+	Branch string `json:"branch"`
+	// SourceSHA is the source commit patches were last created or applied
+	// up to, and SHA the commit applying them made of it.
+	SourceSHA string    `json:"source_sha"`
+	SHA       string    `json:"sha,omitempty"`
+	Applied   []string  `json:"applied,omitempty"`
+	Updated   time.Time `json:"updated"`
+}
+
+// patchSeries is a series read back for applying.
+type patchSeries struct {
+	path    string
+	base    string
+	shas    []string
+	patches [][]byte
+}
+
+// patchKey is what a branch of a source's patches are kept under.
+func patchKey(source, branch string) string {
+	return source + "\x00" + branch
+}
+
+// patchName is the end of the file names of patch series for branch of
+// source.
+func patchName(source, branch string) string {
+	return "--" + url.PathEscape(source) + "--" + url.PathEscape(branch) + gsPatchSuffix
+}
+
+// CreatePatches writes an mbox of patches, as git format-patch makes them,
+// into dir for every branch of every source with new commits since its
+// last series, so they can be sent by email or file transfer where nothing
+// else may cross between networks, and handed to ApplyPatches. A branch's
+// first call only records where its patches start from, which the other
+// side needs to have, e.g. from a bundle. Branches whose new commits
+// include merges, or whose source rewrote them, can't be sent as patches
+// and are skipped with a warning. Only sources are contacted, and git has
+// to be installed. Like Plan, an error is returned when a source can't be
+// listed or fetched.
+func (s *Syncer) CreatePatches(ctx context.Context, dir string) ([]*PatchSeries, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.collectRepoInfo(); err != nil {
+		return nil, err
+	}
+
+	defer s.closeSSHConnections()
+
+	// Creating patches isn't a run, so failures are only logged.
+	subscribers := s.subscribers
+	s.subscribers = []func(Event){s.logEvent}
+	defer func() { s.subscribers = subscribers }()
+
+	if err := s.lookPathGit("patches"); err != nil {
+		return nil, err
+	}
+
+	if err := s.fetchForExport(ctx); err != nil {
+		return nil, err
+	}
+
+	repo, err := s.openRepo()
+
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := s.loadPatchesState(gsPatchesSentFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	created := time.Now().UTC()
+	seen := map[string]bool{}
+	var results []*PatchSeries
+
+	for _, sync := range s.config.Sync {
+		for _, branch := range sync.Branches {
+			key := patchKey(sync.Source, branch)
+
+			if seen[key] {
+				continue
+			}
+
+			seen[key] = true
+			fetched, err := repo.Reference(trackingRef(sync.Source, branch), true)
+
+			if err != nil || !s.fetched[sync.Source].has(branch) {
+				s.warnPrintf("%s isn't on %s, so has no patches\n", branch, sync.Source)
+				continue
+			}
+
+			tip := fetched.Hash().String()
+			last := state[key]
+
+			switch {
+			case last == nil:
+				s.infoPrintf("patches for %s on %s start from %s, which the other side needs to apply them on\n", branch, sync.Source, ShortSHA(tip))
+			case last.SourceSHA == tip:
+				s.infoPrintf("no new patches for %s on %s\n", branch, sync.Source)
+				continue
+			case !descendsFrom(repo, tip, last.SourceSHA):
+				s.warnPrintf("%s on %s was rewritten since its last patches, which new ones can't follow on from, skipping it\n", branch, sync.Source)
+				continue
+			default:
+				series, err := s.writePatchSeries(ctx, dir, created, sync.Source, branch, last.SourceSHA, tip)
+
+				if err != nil {
+					return results, fmt.Errorf("could not create patches for %s on %s: %w", branch, sync.Source, err)
+				}
+
+				if series == nil {
+					continue
+				}
+
+				s.infoPrintf("wrote %d patches for %s on %s into %s\n", series.Commits, branch, sync.Source, series.Path)
+				results = append(results, series)
+			}
+
+			state[key] = &patchedBranch{Source: sync.Source, Branch: branch, SourceSHA: tip, Updated: created}
+
+			if err := s.savePatchesState(gsPatchesSentFile, state); err != nil {
+				return results, fmt.Errorf("could not remember the patches created for %s on %s: %w", branch, sync.Source, err)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// writePatchSeries writes the commits after base up to tip as a series of
+// patches, or returns nil, having warned, if they include merges.
+func (s *Syncer) writePatchSeries(ctx context.Context, dir string, created time.Time, source, branch, base, tip string) (*PatchSeries, error) {
+	merges, err := s.runGit(ctx, s.repoDir, nil, nil, "rev-list", "--merges", base+".."+tip)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bytes.TrimSpace(merges)) > 0 {
+		s.warnPrintf("%s on %s has new merge commits, which can't be sent as patches, skipping it\n", branch, source)
+		return nil, nil
+	}
+
+	mbox, err := s.runGit(ctx, s.repoDir, nil, nil, "format-patch", "--stdout", "--binary", "--base="+base, base+".."+tip)
+
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, created.Format(gsBundleTimeFormat)+patchName(source, branch))
+
+	if err := os.WriteFile(path+".tmp", mbox, 0o644); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return nil, err
+	}
+
+	return &PatchSeries{Source: source, Branch: branch, Path: path, Base: base, Tip: tip, Commits: len(gsPatchFromLine.FindAll(mbox, -1))}, nil
+}
+
+// ApplyPatches applies the patch series written by CreatePatches at paths,
+// and syncs the branches they are for as Run would have synced them from
+// their sources, pushing to the targets. Only branches there are series
+// for are synced, and their sources aren't contacted. A branch's series
+// are applied in the order they were created, on top of the commit its
+// last patch became, or, for its first series, on the source commit its
+// patches start from. Patches already applied are skipped, so series can
+// be applied again, and a series that doesn't follow on from what was last
+// applied fails its branch. git has to be installed. An error, with no
+// result, is returned for a file that isn't named like a series of any
+// branch synced.
+func (s *Syncer) ApplyPatches(ctx context.Context, paths []string) (*RunResult, error) {
+	if err := s.lookPathGit("patches"); err != nil {
+		return nil, err
+	}
+
+	patches := map[string][]string{}
+
+	for _, path := range paths {
+		base := filepath.Base(path)
+		matched := false
+
+		for _, sync := range s.config.Sync {
+			for _, branch := range sync.Branches {
+				key := patchKey(sync.Source, branch)
+				name := patchName(sync.Source, branch)
+
+				if strings.HasSuffix(base, name) && len(base) > len(name) && !slices.Contains(patches[key], path) {
+					patches[key] = append(patches[key], path)
+				}
+
+				matched = matched || strings.HasSuffix(base, name) && len(base) > len(name)
+			}
+		}
+
+		if !matched {
+			return nil, fmt.Errorf("%s isn't a patch series of any branch synced", path)
+		}
+	}
+
+	return s.syncOnce(ctx, nil, nil, patches)
+}
+
+// applyPatchSeries applies the run's patch series in place of fetching
+// their sources, pointing each source's tracking refs at the commits the
+// series' branches end up at.
+func (s *Syncer) applyPatchSeries(ctx context.Context, runSpan *span) {
+	var sources []string
+	branches := map[string][]string{}
+
+	for _, sync := range s.config.Sync {
+		for _, branch := range sync.Branches {
+			key := patchKey(sync.Source, branch)
+
+			if len(s.patches[key]) == 0 || slices.Contains(branches[sync.Source], branch) {
+				continue
+			}
+
+			if _, exists := branches[sync.Source]; !exists {
+				sources = append(sources, sync.Source)
+			}
+
+			branches[sync.Source] = append(branches[sync.Source], branch)
+		}
+	}
+
+	s.fetched = map[string]*FetchResult{}
+	state, err := s.loadPatchesState(gsPatchesAppliedFile)
+
+	for _, source := range sources {
+		check := preflightCheck{source, false}
+		result := &FetchResult{Remote: source, Err: err}
+		s.fetched[source] = result
+		s.run.Fetches = append(s.run.Fetches, result)
+		s.remoteRefs[check] = map[plumbing.ReferenceName]plumbing.Hash{}
+
+		started := time.Now()
+		patchSpan := s.tracer.start(runSpan, "patch", "remote", source, "branches", fmt.Sprint(len(branches[source])))
+
+		for _, branch := range branches[source] {
+			if result.Err != nil {
+				break
+			}
+
+			key := patchKey(source, branch)
+			paths := s.patches[key]
+
+			sort.Slice(paths, func(i, j int) bool {
+				return filepath.Base(paths[i]) < filepath.Base(paths[j])
+			})
+
+			for _, path := range paths {
+				if result.Err = s.applySeries(ctx, state, source, branch, path); result.Err != nil {
+					result.Err = fmt.Errorf("could not apply %s: %w", path, result.Err)
+					break
+				}
+
+				if info, err := os.Stat(path); err == nil {
+					result.BytesReceived += info.Size()
+				}
+			}
+
+			if result.Err == nil {
+				result.Err = s.savePatchesState(gsPatchesAppliedFile, state)
+			}
+
+			if result.Err != nil {
+				break
+			}
+
+			sha := plumbing.NewHash(state[key].SHA)
+
+			if result.Err = s.setTrackingRef(source, branch, sha); result.Err != nil {
+				break
+			}
+
+			s.remoteRefs[check][plumbing.NewBranchReferenceName(branch)] = sha
+			result.Branches = append(result.Branches, branch)
+		}
+
+		result.Duration = time.Since(started)
+		patchSpan.finish(result.Err)
+
+		if result.Err != nil {
+			s.publish(Event{Type: EventError, Err: result.Err, span: patchSpan})
+		}
+	}
+}
+
+// applySeries applies the patches of the series at path that haven't been
+// applied to branch of source yet, updating state to match.
+func (s *Syncer) applySeries(ctx context.Context, state map[string]*patchedBranch, source, branch, path string) error {
+	series, err := readPatchSeries(path)
+
+	if err != nil {
+		return err
+	}
+
+	key := patchKey(source, branch)
+	applied := state[key]
+	start := series.base
+	pending := series.patches
+	pendingSHAs := series.shas
+
+	switch {
+	case applied == nil:
+	case slices.Contains(applied.Applied, series.shas[len(series.shas)-1]):
+		s.debugPrintf("%s was already applied to %s\n", path, branch)
+		return nil
+	case applied.SourceSHA == series.base:
+		start = applied.SHA
+	case slices.Contains(series.shas, applied.SourceSHA):
+		i := slices.Index(series.shas, applied.SourceSHA) + 1
+		start, pending, pendingSHAs = applied.SHA, series.patches[i:], series.shas[i:]
+	default:
+		return fmt.Errorf("it doesn't follow on from %s, the last patch applied to %s, so the series before it has to be applied first", ShortSHA(applied.SourceSHA), branch)
+	}
+
+	repo, err := s.openRepo()
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := repo.CommitObject(plumbing.NewHash(start)); err != nil {
+		return fmt.Errorf("it applies on top of %s, which this repository doesn't have, so %s has to be brought here first, e.g. with a bundle", ShortSHA(start), branch)
+	}
+
+	worktree, err := os.MkdirTemp("", "gitsync-am-")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(worktree)
+
+	if _, err := s.runGit(ctx, s.repoDir, nil, nil, "worktree", "add", "--detach", "--force", worktree, start); err != nil {
+		return err
+	}
+
+	defer s.runGit(context.WithoutCancel(ctx), s.repoDir, nil, nil, "worktree", "remove", "--force", worktree)
+
+	env := []string{
+		"GIT_COMMITTER_NAME=" + gsPatchCommitterName,
+		"GIT_COMMITTER_EMAIL=" + gsPatchCommitterEmail,
+	}
+
+	if _, err := s.runGit(ctx, worktree, bytes.NewReader(bytes.Join(pending, nil)), env, "am", "--committer-date-is-author-date", "--keep-cr"); err != nil {
+		s.runGit(context.WithoutCancel(ctx), worktree, nil, nil, "am", "--abort")
+		return err
+	}
+
+	head, err := s.runGit(ctx, worktree, nil, nil, "rev-parse", "HEAD")
+
+	if err != nil {
+		return err
+	}
+
+	next := &patchedBranch{Source: source, Branch: branch, SourceSHA: series.shas[len(series.shas)-1], SHA: strings.TrimSpace(string(head)), Updated: time.Now().UTC()}
+
+	if applied != nil {
+		next.Applied = applied.Applied
+	}
+
+	next.Applied = append(next.Applied, pendingSHAs...)
+
+	if dropped := len(next.Applied) - gsMaxAppliedPatches; dropped > 0 {
+		next.Applied = next.Applied[dropped:]
+	}
+
+	state[key] = next
+	s.debugPrintf("applied %d patches of %s to %s, now at %s\n", len(pending), path, branch, ShortSHA(next.SHA))
+
+	return nil
+}
+
+// readPatchSeries splits the mbox at path into its patches.
+func readPatchSeries(path string) (*patchSeries, error) {
+	mbox, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	series := &patchSeries{path: path}
+	starts := gsPatchFromLine.FindAllSubmatchIndex(mbox, -1)
+
+	if len(starts) == 0 {
+		return nil, errors.New("it has no patches")
+	}
+
+	for i, start := range starts {
+		end := len(mbox)
+
+		if i+1 < len(starts) {
+			end = starts[i+1][0]
+		}
+
+		series.shas = append(series.shas, string(mbox[start[2]:start[3]]))
+		series.patches = append(series.patches, mbox[start[0]:end])
+	}
+
+	base := gsPatchBaseLine.FindSubmatch(series.patches[0])
+
+	if base == nil {
+		return nil, errors.New("it doesn't say which commit it applies on top of")
+	}
+
+	series.base = string(base[1])
+
+	return series, nil
+}
+
+// setTrackingRef points the tracking ref of branch of source at sha.
+func (s *Syncer) setTrackingRef(source, branch string, sha plumbing.Hash) error {
+	repo, err := s.openRepo()
+
+	if err != nil {
+		return err
+	}
+
+	return repo.Storer.SetReference(plumbing.NewHashReference(trackingRef(source, branch), sha))
+}
+
+// lookPathGit finds git for what, which needs it.
+func (s *Syncer) lookPathGit(what string) error {
+	if s.gitBinary != "" {
+		return nil
+	}
+
+	binary, err := exec.LookPath("git")
+
+	if err != nil {
+		return fmt.Errorf("%s need git, but it can't be found: %w", what, err)
+	}
+
+	s.gitBinary = binary
+
+	return nil
+}
+
+// runGit runs git in dir with stdin and extra environment, returning what
+// it printed.
+func (s *Syncer) runGit(ctx context.Context, dir string, stdin io.Reader, env []string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := commandContext(ctx, s.gitBinary, append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), env...)
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	s.debugPrintf("running git %s\n", strings.Join(args, " "))
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, lastLine(stderr.String()+stdout.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func (s *Syncer) loadPatchesState(file string) (map[string]*patchedBranch, error) {
+	dotGit, err := s.dotGit()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var state patchesState
+	data, err := util.ReadFile(dotGit, file)
+
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read which patches were handled: %w", err)
+	}
+
+	branches := map[string]*patchedBranch{}
+
+	for i := range state.Branches {
+		branches[patchKey(state.Branches[i].Source, state.Branches[i].Branch)] = &state.Branches[i]
+	}
+
+	return branches, nil
+}
+
+func (s *Syncer) savePatchesState(file string, branches map[string]*patchedBranch) error {
+	dotGit, err := s.dotGit()
+
+	if err != nil {
+		return err
+	}
+
+	state := patchesState{Branches: []patchedBranch{}}
+
+	for _, branch := range branches {
+		state.Branches = append(state.Branches, *branch)
+	}
+
+	sort.Slice(state.Branches, func(i, j int) bool {
+		return patchKey(state.Branches[i].Source, state.Branches[i].Branch) < patchKey(state.Branches[j].Source, state.Branches[j].Branch)
+	})
+
+	data, err := json.MarshalIndent(state, "", "  ")
+
+	if err == nil {
+		err = util.WriteFile(dotGit, file+".tmp", append(data, '\n'), 0o644)
+	}
+
+	if err == nil {
+		err = dotGit.Rename(file+".tmp", file)
+	}
+
+	return err
+}
@@ -0,0 +1,313 @@
+package gitsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Actions of a PlannedChange.
+const (
+	// PlanCreate is a branch the target doesn't have yet.
+	PlanCreate string = "create"
+	// PlanFastForward is a branch whose tip on the target is an ancestor
+	// of what is pushed.
+	PlanFastForward string = "fast-forward"
+	// PlanForce is a branch whose tip on the target would be replaced by
+	// commits that don't descend from it.
+	PlanForce string = "force"
+	// PlanNone is a branch the target already has.
+	PlanNone string = "none"
+)
+
+var errPlanMoved = errors.New("moved since the plan was made")
+var errOffPlan = errors.New("not what the plan says")
+
+// PlannedChange is what a sync would do to one branch on its target.
+type PlannedChange struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Branch string `json:"branch"`
+	Action string `json:"action"`
+	// SourceSHA is the branch's tip on the source, and OldSHA its tip on
+	// the target, empty if the target doesn't have it. NewSHA is what is
+	// pushed: the source's tip, or the local branch if it is ahead.
+	SourceSHA string `json:"source_sha"`
+	OldSHA    string `json:"old_sha"`
+	NewSHA    string `json:"new_sha"`
+	Commits   int    `json:"commits"`
+}
+
+// Plan is every ref change a sync would make, for someone to review before
+// Apply makes exactly those changes.
+type Plan struct {
+	Version        string           `json:"version"`
+	Repository     string           `json:"repository"`
+	ConfigChecksum string           `json:"config_checksum"`
+	Created        time.Time        `json:"created"`
+	Changes        []*PlannedChange `json:"changes"`
+}
+
+// ReadPlan reads a plan written by Plan.WriteJSON.
+func ReadPlan(r io.Reader) (*Plan, error) {
+	var plan Plan
+
+	if err := json.NewDecoder(r).Decode(&plan); err != nil {
+		return nil, fmt.Errorf("could not read plan: %w", err)
+	}
+
+	return &plan, nil
+}
+
+// WriteJSON writes the plan as JSON to w.
+func (p *Plan) WriteJSON(w io.Writer) error {
+	plan, err := json.MarshalIndent(p, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(plan, '\n'))
+
+	return err
+}
+
+// Plan works out the change a sync would make to every configured branch on
+// its target, without changing any branch or remote. Sources are fetched, so
+// how the target's tip relates to what would be pushed is known. An error is
+// returned when a remote can't be listed or fetched, or a branch doesn't
+// exist, as a plan has to cover every branch to be applied.
+func (s *Syncer) Plan(ctx context.Context) (*Plan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.collectRepoInfo(); err != nil {
+		return nil, err
+	}
+
+	defer s.closeSSHConnections()
+
+	// Plans aren't runs, so failures are only logged, not handed to
+	// metrics, hooks, notifications or error tracking.
+	subscribers := s.subscribers
+	s.subscribers = []func(Event){s.logEvent}
+	defer func() { s.subscribers = subscribers }()
+
+	s.run = &RunResult{ID: randomHex(8), Repository: s.repoDir, ConfigChecksum: s.configChecksum, Started: time.Now()}
+	s.unchanged = nil
+
+	var checks []preflightCheck
+	seen := map[preflightCheck]bool{}
+
+	for _, entry := range s.config.Sync {
+		for _, check := range []preflightCheck{{entry.Source, false}, {entry.Target, true}} {
+			switch {
+			case seen[check]:
+				continue
+			case !s.remoteExists(check.remote):
+				return nil, fmt.Errorf("%s remote doesn't exist", check.remote)
+			case check.push:
+				if err := s.pushURLAllowed(s.effectiveURL(check.remote, true)); err != nil {
+					return nil, fmt.Errorf("%s remote can't be pushed to: %w", check.remote, err)
+				}
+			}
+
+			seen[check] = true
+			checks = append(checks, check)
+		}
+	}
+
+	heads, failed := s.listHeads(ctx, checks)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.remoteRefs = map[preflightCheck]map[plumbing.ReferenceName]plumbing.Hash{}
+
+	for _, check := range checks {
+		if err := failed[check]; err != nil {
+			return nil, fmt.Errorf("%s remote can't be reached for %s: %w", check.remote, check.operation(), err)
+		}
+
+		s.remoteRefs[check] = map[plumbing.ReferenceName]plumbing.Hash{}
+
+		for name, sha := range heads[check] {
+			s.remoteRefs[check][name] = plumbing.NewHash(sha)
+		}
+	}
+
+	s.fetchSources(ctx, nil)
+
+	for _, fetch := range s.run.Fetches {
+		if fetch.Err != nil {
+			return nil, fmt.Errorf("could not fetch %s: %w", fetch.Remote, fetch.Err)
+		}
+	}
+
+	repo, err := s.openRepo()
+
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Version: Version, Repository: s.repoDir, ConfigChecksum: s.configChecksum, Created: time.Now().UTC(), Changes: []*PlannedChange{}}
+
+	for _, sync := range s.config.Sync {
+		for _, branch := range sync.Branches {
+			branchRef := plumbing.NewBranchReferenceName(branch)
+			fetched, err := repo.Reference(trackingRef(sync.Source, branch), true)
+
+			switch {
+			case err != nil || !s.fetched[sync.Source].has(branch):
+				return nil, fmt.Errorf("%w: %s on %s", errMissingOnSource, branch, sync.Source)
+			case !s.branchExists(branch) && s.workdir == "":
+				return nil, fmt.Errorf("%s branch doesn't exist", branch)
+			}
+
+			change := &PlannedChange{
+				Source:    sync.Source,
+				Target:    sync.Target,
+				Branch:    branch,
+				SourceSHA: fetched.Hash().String(),
+				NewSHA:    fetched.Hash().String(),
+				OldSHA:    heads[preflightCheck{sync.Target, true}][branchRef],
+			}
+
+			// A branch already ahead of its source is left alone, and
+			// pushed as it is.
+			if local := branchSHA(repo, branchRef); local != "" && local != change.NewSHA && descendsFrom(repo, local, change.NewSHA) {
+				change.NewSHA = local
+			}
+
+			switch {
+			case change.OldSHA == "":
+				change.Action = PlanCreate
+			case change.OldSHA == change.NewSHA:
+				change.Action = PlanNone
+			case descendsFrom(repo, change.NewSHA, change.OldSHA):
+				change.Action = PlanFastForward
+			default:
+				change.Action = PlanForce
+			}
+
+			change.Commits = countCommits(repo, change.OldSHA, change.NewSHA)
+			plan.Changes = append(plan.Changes, change)
+		}
+	}
+
+	return plan, nil
+}
+
+// descendsFrom reports whether sha's history includes ancestor, false if
+// either isn't a commit in the repository.
+func descendsFrom(repo *git.Repository, sha, ancestor string) bool {
+	commit, err := repo.CommitObject(plumbing.NewHash(sha))
+
+	if err != nil {
+		return false
+	}
+
+	ancestorCommit, err := repo.CommitObject(plumbing.NewHash(ancestor))
+
+	if err != nil {
+		return false
+	}
+
+	descends, err := ancestorCommit.IsAncestor(commit)
+
+	return err == nil && descends
+}
+
+// Apply syncs the branches plan changes, and only those, as Run would. It
+// fails a branch rather than sync it if its source or target has moved
+// since the plan was made, or if filters would push something other than
+// what was planned. An error, with no result, is returned for a plan made
+// with another config.
+func (s *Syncer) Apply(ctx context.Context, plan *Plan) (*RunResult, error) {
+	if plan.ConfigChecksum != s.configChecksum {
+		return nil, fmt.Errorf("the plan was made with config %s, not the current %s", plan.ConfigChecksum, s.configChecksum)
+	}
+
+	changes := map[string]*PlannedChange{}
+
+	for _, change := range plan.Changes {
+		if change.Action != PlanNone {
+			changes[syncedKey(change.Source, change.Target, change.Branch)] = change
+		}
+	}
+
+	return s.syncOnce(ctx, changes, nil, nil)
+}
+
+// plannedBranches are the branches of sync a run applying a plan changes,
+// or all of them for any other run.
+func (s *Syncer) plannedBranches(sync SyncEntry) []string {
+	if s.plan == nil {
+		return sync.Branches
+	}
+
+	var branches []string
+
+	for _, branch := range sync.Branches {
+		if _, planned := s.plan[syncedKey(sync.Source, sync.Target, branch)]; planned {
+			branches = append(branches, branch)
+		}
+	}
+
+	return branches
+}
+
+// planMoved returns why a branch can't be synced as planned because its
+// source or target no longer has the tip the plan was made with, or nil if
+// the run isn't applying a plan.
+func (s *Syncer) planMoved(ctx context.Context, repo *git.Repository, source, target string, branchRef plumbing.ReferenceName) error {
+	change := s.plan[syncedKey(source, target, branchRef.Short())]
+
+	if change == nil {
+		return nil
+	}
+
+	if sourceSHA := branchSHA(repo, trackingRef(source, branchRef.Short())); s.fetched[source].has(branchRef.Short()) && sourceSHA != change.SourceSHA {
+		return fmt.Errorf("%s %w: it is at %s on %s, not %s", branchRef.Short(), errPlanMoved, ShortSHA(sourceSHA), source, ShortSHA(change.SourceSHA))
+	}
+
+	targetSHA, err := s.remoteRefSHA(ctx, target, branchRef)
+
+	switch {
+	case err != nil:
+		return fmt.Errorf("could not read %s on %s to check it against the plan: %w", branchRef.Short(), target, err)
+	case targetSHA != change.OldSHA:
+		return fmt.Errorf("%s %w: it is at %s on %s, not %s", branchRef.Short(), errPlanMoved, describeSHA(targetSHA), target, describeSHA(change.OldSHA))
+	}
+
+	return nil
+}
+
+// offPlan returns why pushing sha to pushDst isn't what the plan says to do
+// with branch, or nil if it is or the run isn't applying a plan.
+func (s *Syncer) offPlan(source, target, branch string, pushDst plumbing.ReferenceName, sha string) error {
+	change := s.plan[syncedKey(source, target, branch)]
+
+	if change == nil || (pushDst.Short() == branch && sha == change.NewSHA) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: it would push %s to %s on %s instead of %s to %s", errOffPlan, ShortSHA(sha), pushDst.Short(), target, ShortSHA(change.NewSHA), branch)
+}
+
+// describeSHA abbreviates a branch's tip, which is empty when there is no
+// branch.
+func describeSHA(sha string) string {
+	if sha == "" {
+		return "nothing"
+	}
+
+	return ShortSHA(sha)
+}
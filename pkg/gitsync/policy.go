@@ -0,0 +1,336 @@
+package gitsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+const gsDefaultPolicyPath string = "gitsync/sync"
+
+// Policy is an OPA Rego policy asked about every branch before it is
+// pushed. It is evaluated by an OPA server at URL, or from the Rego File
+// with the opa binary, and its decision at Path can deny the push or
+// annotate the branch's result.
+type Policy struct {
+	URL   string `json:"url"`
+	File  string `json:"file"`
+	Path  string `json:"path"`
+	Token string `json:"token"`
+	// FailOpen pushes branches the policy couldn't be evaluated for,
+	// rather than failing them.
+	FailOpen bool `json:"fail_open"`
+}
+
+// policyInput is what the policy is given as input.
+type policyInput struct {
+	RunID        string         `json:"run_id"`
+	Host         string         `json:"host"`
+	Repository   string         `json:"repository"`
+	Source       policyRemote   `json:"source"`
+	Target       policyRemote   `json:"target"`
+	Branch       string         `json:"branch"`
+	TargetBranch string         `json:"target_branch"`
+	OldSHA       string         `json:"old_sha"`
+	NewSHA       string         `json:"new_sha"`
+	Commits      []policyCommit `json:"commits"`
+}
+
+type policyRemote struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type policyCommit struct {
+	SHA     string `json:"sha"`
+	Author  string `json:"author"`
+	Email   string `json:"email"`
+	Message string `json:"message"`
+	Time    int64  `json:"time"`
+	Parents int    `json:"parents"`
+}
+
+// policyDecision is the policy's answer: true or false, or an object with
+// allow, deny reasons and annotations.
+type policyDecision struct {
+	Allow       *bool             `json:"allow"`
+	Deny        []string          `json:"deny"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+func (s *Syncer) checkPolicy() bool {
+	policy := s.config.Policy
+
+	if policy == nil {
+		return true
+	}
+
+	if (policy.URL == "") == (policy.File == "") {
+		errorPrintf("policy needs exactly one of url or file\n")
+		return false
+	}
+
+	if policy.URL != "" {
+		if u, err := url.Parse(policy.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errorPrintf("policy has an invalid url: %s\n", policy.URL)
+			return false
+		}
+
+		return true
+	}
+
+	if _, err := os.Stat(policy.File); err != nil {
+		errorPrintf("policy file: %s\n", err)
+		return false
+	}
+
+	binary, err := exec.LookPath("opa")
+
+	if err != nil {
+		errorPrintf("policy file %s needs the opa binary: %s\n", policy.File, err)
+		return false
+	}
+
+	s.opaBinary = binary
+
+	return true
+}
+
+// applyPolicy asks the policy about pushing the branch's NewSHA to
+// targetBranch on target, which has targetSHA now. A denial skips the
+// branch, like a filter veto, and annotations are kept in its result. The
+// error returned is for a policy that couldn't be evaluated, which fails the
+// branch unless the policy fails open.
+func (s *Syncer) applyPolicy(ctx context.Context, repo *git.Repository, source, target, targetSHA, targetBranch string, result *BranchResult) error {
+	host, _ := os.Hostname()
+
+	decision, err := s.evaluatePolicy(ctx, policyInput{
+		RunID:        s.run.ID,
+		Host:         host,
+		Repository:   s.repoDir,
+		Source:       policyRemote{Name: source, URL: redactURL(s.effectiveURL(source, false))},
+		Target:       policyRemote{Name: target, URL: redactURL(s.effectiveURL(target, true))},
+		Branch:       result.Branch,
+		TargetBranch: targetBranch,
+		OldSHA:       targetSHA,
+		NewSHA:       result.NewSHA,
+		Commits:      policyCommits(repo, targetSHA, result.NewSHA),
+	})
+
+	if err != nil {
+		err = fmt.Errorf("policy: %w", err)
+
+		if s.config.Policy.FailOpen && ctx.Err() == nil {
+			s.warnPrintf("%s, pushing %s anyway\n", err, result.Branch)
+			return nil
+		}
+
+		return err
+	}
+
+	result.Annotations = decision.Annotations
+
+	if denial := decision.denial(); denial != nil {
+		result.Status = StatusSkipped
+		result.Err = denial
+		s.infoPrintf("not pushing %s to %s: %s\n", result.Branch, target, denial)
+	}
+
+	return nil
+}
+
+// denial explains why the policy denied the push, or is nil if it didn't.
+func (d policyDecision) denial() error {
+	if len(d.Deny) > 0 {
+		sort.Strings(d.Deny)
+		return fmt.Errorf("denied by policy: %s", strings.Join(d.Deny, "; "))
+	}
+
+	if d.Allow != nil && !*d.Allow {
+		return errors.New("denied by policy")
+	}
+
+	return nil
+}
+
+// evaluatePolicy returns the policy's decision for input. A decision the
+// policy leaves undefined is an error, so a policy that doesn't load or has
+// the wrong package doesn't let everything through.
+func (s *Syncer) evaluatePolicy(ctx context.Context, input policyInput) (policyDecision, error) {
+	var decision policyDecision
+
+	policy := s.config.Policy
+	path := strings.Trim(policy.Path, "/")
+
+	if path == "" {
+		path = gsDefaultPolicyPath
+	}
+
+	inputJSON, err := json.Marshal(input)
+
+	if err != nil {
+		return decision, err
+	}
+
+	var value interface{}
+
+	if policy.File != "" {
+		var stdout, stderr bytes.Buffer
+
+		query := "data." + strings.ReplaceAll(path, "/", ".")
+		cmd := commandContext(ctx, s.opaBinary, "eval", "--format", "json", "--stdin-input", "--data", policy.File, query)
+		cmd.Stdin = bytes.NewReader(inputJSON)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() != nil {
+				return decision, ctx.Err()
+			}
+
+			return decision, fmt.Errorf("opa eval: %w: %s", err, lastLine(stderr.String()))
+		}
+
+		var output struct {
+			Result []struct {
+				Expressions []struct {
+					Value interface{} `json:"value"`
+				} `json:"expressions"`
+			} `json:"result"`
+		}
+
+		if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+			return decision, fmt.Errorf("opa eval: %w", err)
+		}
+
+		if len(output.Result) == 0 || len(output.Result[0].Expressions) == 0 {
+			return decision, fmt.Errorf("%s is undefined", query)
+		}
+
+		value = output.Result[0].Expressions[0].Value
+	} else {
+		body, err := json.Marshal(map[string]json.RawMessage{"input": inputJSON})
+
+		if err != nil {
+			return decision, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(policy.URL, "/")+"/v1/data/"+path, bytes.NewReader(body))
+
+		if err != nil {
+			return decision, err
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+
+		if policy.Token != "" {
+			token, err := resolveSecret(policy.Token)
+
+			if err != nil {
+				return decision, err
+			}
+
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Do(req)
+
+		if err != nil {
+			return decision, err
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return decision, fmt.Errorf("opa returned %s", resp.Status)
+		}
+
+		var output struct {
+			Result *interface{} `json:"result"`
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&output); err != nil {
+			return decision, err
+		}
+
+		if output.Result == nil {
+			return decision, fmt.Errorf("%s is undefined", path)
+		}
+
+		value = *output.Result
+	}
+
+	switch v := value.(type) {
+	case bool:
+		decision.Allow = &v
+	case map[string]interface{}:
+		raw, _ := json.Marshal(v)
+
+		if err := json.Unmarshal(raw, &decision); err != nil {
+			return decision, fmt.Errorf("invalid decision: %w", err)
+		}
+	default:
+		return decision, fmt.Errorf("decision is a %T, not a bool or an object", value)
+	}
+
+	return decision, nil
+}
+
+// policyCommits lists the commits a push would add, newest first, like the
+// filters are shown.
+func policyCommits(repo *git.Repository, oldSHA, newSHA string) []policyCommit {
+	commits := []policyCommit{}
+
+	if newSHA == "" || oldSHA == newSHA {
+		return commits
+	}
+
+	log, err := repo.Log(&git.LogOptions{From: plumbing.NewHash(newSHA)})
+
+	if err != nil {
+		return commits
+	}
+
+	log.ForEach(func(c *object.Commit) error {
+		if c.Hash.String() == oldSHA || len(commits) >= gsMaxFilterCommits {
+			return storer.ErrStop
+		}
+
+		commits = append(commits, policyCommit{
+			SHA:     c.Hash.String(),
+			Author:  c.Author.Name,
+			Email:   c.Author.Email,
+			Message: c.Message,
+			Time:    c.Author.When.Unix(),
+			Parents: c.NumParents(),
+		})
+
+		return nil
+	})
+
+	return commits
+}
+
+// redactURL hides the password of a URL that has one.
+func redactURL(raw string) string {
+	if u, err := url.Parse(raw); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+
+	return raw
+}
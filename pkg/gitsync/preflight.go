@@ -0,0 +1,131 @@
+package gitsync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// preflightCheck is a remote and the direction a sync entry uses it in:
+// sources are fetched from and targets pushed to, which can go to different
+// URLs with different credentials.
+type preflightCheck struct {
+	remote string
+	push   bool
+}
+
+// preflight asks every source and target remote for its refs, like git
+// ls-remote, before any branch is synced, so a remote that is down or
+// rejects our credentials is reported up front rather than partway through
+// the run. The refs are kept for the rest of the run. Targets whose push
+// URL isn't allowed aren't contacted at all, and targets with create
+// settings have their repository created first if it doesn't exist.
+// Sync entries using a remote that failed are then skipped.
+func (s *Syncer) preflight(ctx context.Context, runSpan *span) {
+	var checks []preflightCheck
+	seen := map[preflightCheck]bool{}
+
+	for _, entry := range s.config.Sync {
+		entryChecks := []preflightCheck{{entry.Source, false}, {entry.Target, true}}
+
+		// A run applying bundles or patches reads them instead of the
+		// sources, which are likely out of reach, and only pushes to the
+		// entries they carry commits for.
+		switch {
+		case !s.offline():
+		case len(s.carriedBranches(entry)) > 0:
+			entryChecks = entryChecks[1:]
+		default:
+			entryChecks = nil
+		}
+
+		for _, check := range entryChecks {
+			if !seen[check] && s.remoteExists(check.remote) {
+				seen[check] = true
+				checks = append(checks, check)
+			}
+		}
+	}
+
+	preflightSpan := s.tracer.start(runSpan, "preflight", "remotes", fmt.Sprint(len(checks)))
+	errs := make([]error, len(checks))
+	refs := make([][]*plumbing.Reference, len(checks))
+	refused := make([]bool, len(checks))
+
+	var wg sync.WaitGroup
+
+	for i, check := range checks {
+		if check.push {
+			if errs[i] = s.pushURLAllowed(s.effectiveURL(check.remote, true)); errs[i] != nil {
+				refused[i] = true
+				continue
+			}
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if check.push {
+				if errs[i] = s.ensureRepo(ctx, check.remote); errs[i] != nil {
+					return
+				}
+			}
+
+			refs[i], errs[i] = s.listRemoteRefs(ctx, check.remote, check.push)
+		}()
+	}
+
+	wg.Wait()
+
+	s.unreachable = map[preflightCheck]error{}
+	s.remoteRefs = map[preflightCheck]map[plumbing.ReferenceName]plumbing.Hash{}
+
+	for i, check := range checks {
+		if errs[i] == nil {
+			s.debugPrintf("%s remote is reachable for %s\n", check.remote, check.operation())
+			s.remoteRefs[check] = map[plumbing.ReferenceName]plumbing.Hash{}
+
+			for _, ref := range refs[i] {
+				s.remoteRefs[check][ref.Name()] = ref.Hash()
+			}
+
+			continue
+		}
+
+		err := fmt.Errorf("%s remote can't be reached for %s: %w", check.remote, check.operation(), errs[i])
+
+		if refused[i] {
+			err = fmt.Errorf("%s remote can't be pushed to: %w", check.remote, errs[i])
+		}
+
+		s.unreachable[check] = err
+
+		if ctx.Err() == nil {
+			s.publish(Event{Type: EventError, Err: err, span: preflightSpan})
+		}
+	}
+
+	preflightSpan.finish(nil)
+}
+
+// unreachableRemote returns why the entry's source or target failed the
+// preflight check, or nil if both passed.
+func (s *Syncer) unreachableRemote(entry SyncEntry) error {
+	if err := s.unreachable[preflightCheck{entry.Source, false}]; err != nil {
+		return err
+	}
+
+	return s.unreachable[preflightCheck{entry.Target, true}]
+}
+
+func (c preflightCheck) operation() string {
+	if c.push {
+		return opPush
+	}
+
+	return opPull
+}
@@ -0,0 +1,156 @@
+package gitsync
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Ways of showing fetch and push progress.
+const (
+	ProgressAuto string = "auto"
+	ProgressBar  string = "bar"
+	ProgressLog  string = "log"
+	ProgressNone string = "none"
+)
+
+var gsProgressModes = map[string]bool{
+	ProgressAuto: true,
+	ProgressBar:  true,
+	ProgressLog:  true,
+	ProgressNone: true,
+}
+
+const gsDefaultProgressInterval = 10 * time.Second
+
+// resolveProgressMode checks a progress mode and decides what ProgressAuto
+// means for this process.
+func resolveProgressMode(mode string) (string, error) {
+	if !gsProgressModes[mode] {
+		return "", fmt.Errorf("unknown progress mode %s", mode)
+	}
+
+	if mode == ProgressAuto {
+		if !LogEnabled(LevelInfo) {
+			mode = ProgressNone
+		} else if StdoutIsTerminal() {
+			mode = ProgressBar
+		} else {
+			mode = ProgressLog
+		}
+	}
+
+	return mode, nil
+}
+
+// progressWriter receives go-git's sideband progress (the "Counting
+// objects", "Receiving objects" lines a git server sends) and either redraws
+// it in place on a terminal or logs it periodically.
+type progressWriter struct {
+	syncer    *Syncer
+	operation string
+	remote    string
+	branch    string
+	started   time.Time
+	lastLog   time.Time
+	latest    string
+	received  int64
+	sent      int64
+	// counter counts the transfer's own bytes, when it has one, rather than
+	// everything transferred since it started.
+	counter *byteCounter
+}
+
+// newProgress returns a progress writer for one transfer, or nil when
+// progress reporting is off or the remote is asked not to send any.
+func (s *Syncer) newProgress(operation, remote, branch string) *progressWriter {
+	if s.progressMode == ProgressNone || !s.sendsProgress(remote) {
+		return nil
+	}
+
+	received, sent := transferredBytes()
+	now := time.Now()
+
+	return &progressWriter{
+		syncer:    s,
+		operation: operation,
+		remote:    remote,
+		branch:    branch,
+		started:   now,
+		lastLog:   now,
+		received:  received,
+		sent:      sent,
+	}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	// Servers terminate in-place updates with \r and finished lines with \n.
+	for _, message := range strings.FieldsFunc(string(b), func(r rune) bool { return r == '\r' || r == '\n' }) {
+		if message = strings.TrimSpace(message); message != "" {
+			p.latest = message
+		}
+	}
+
+	switch p.syncer.progressMode {
+	case ProgressBar:
+		fmt.Fprintf(os.Stderr, "\r\033[K%s %s %s: %s", p.operation, p.branch, p.remote, p.latest)
+	case ProgressLog:
+		if time.Since(p.lastLog) >= p.syncer.progressInterval {
+			p.log()
+		}
+	}
+
+	return len(b), nil
+}
+
+func (p *progressWriter) transferred() (int64, int64) {
+	if p.counter != nil {
+		return p.counter.received.Load(), p.counter.sent.Load()
+	}
+
+	received, sent := transferredBytes()
+
+	return received - p.received, sent - p.sent
+}
+
+func (p *progressWriter) log() {
+	received, sent := p.transferred()
+
+	p.syncer.infoPrintf("%s %s %s: %s (%s received, %s sent, %s elapsed)\n", p.operation, p.branch, p.remote, p.latest,
+		HumanBytes(received), HumanBytes(sent), time.Since(p.started).Round(time.Second))
+
+	p.lastLog = time.Now()
+}
+
+// finish ends the progress display for a transfer.
+func (p *progressWriter) finish() {
+	if p == nil || p.latest == "" {
+		return
+	}
+
+	switch p.syncer.progressMode {
+	case ProgressBar:
+		fmt.Fprintln(os.Stderr)
+	case ProgressLog:
+		p.log()
+	}
+}
+
+// HumanBytes formats a byte count with a binary unit.
+func HumanBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,422 @@
+package gitsync
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// gsDefaultStagingPrefix is what the staging branches of a via_pr sync entry
+// are named with unless its branch_prefix says otherwise.
+const gsDefaultStagingPrefix string = "gitsync/"
+
+// PullRequest has a sync entry push each branch to a staging branch on the
+// target and open a pull request, or GitLab merge request, from it to the
+// branch, for targets whose branch protection forbids pushing directly.
+type PullRequest struct {
+	Type   string `json:"type"`
+	APIURL string `json:"api_url"`
+	// Project defaults to the path of the target's push URL.
+	Project string `json:"project"`
+	Token   string `json:"token"`
+	// Username sends Token to Bitbucket as an app password rather than an
+	// access token.
+	Username string `json:"username"`
+	// BranchPrefix is prepended to a branch's name to name its staging
+	// branch, defaulting to gitsync/.
+	BranchPrefix string `json:"branch_prefix"`
+}
+
+var gsPullRequestTypes = map[string]bool{
+	"github":           true,
+	"gitlab":           true,
+	"gitea":            true,
+	"bitbucket":        true,
+	"bitbucket_server": true,
+}
+
+func checkPullRequest(i int, settings *PullRequest) bool {
+	switch {
+	case !gsPullRequestTypes[settings.Type]:
+		errorPrintf("sync entry %d has an unknown via_pr type: %s\n", i, settings.Type)
+		return false
+	case (settings.Type == "gitea" || settings.Type == "bitbucket_server") && settings.APIURL == "":
+		errorPrintf("sync entry %d via_pr needs the api_url of the %s server\n", i, settings.Type)
+		return false
+	case settings.Token == "":
+		errorPrintf("sync entry %d via_pr has no token\n", i)
+		return false
+	}
+
+	if owner, repo, found := strings.Cut(settings.Project, "/"); settings.Project != "" && (!found || owner == "" || repo == "") {
+		errorPrintf("sync entry %d via_pr needs a project of the form owner/repo or group/project\n", i)
+		return false
+	}
+
+	return true
+}
+
+// stagingRef is the staging branch a via_pr sync entry pushes branch to.
+func stagingRef(settings *PullRequest, branch plumbing.ReferenceName) plumbing.ReferenceName {
+	prefix := settings.BranchPrefix
+
+	if prefix == "" {
+		prefix = gsDefaultStagingPrefix
+	}
+
+	return plumbing.NewBranchReferenceName(prefix + branch.Short())
+}
+
+// pushStaging pushes pushSrc to base's staging branch on target, unless base
+// already has it, when the branch is up to date, or the staging branch does,
+// when there's nothing new to push. The staging branch is gitsync's own, so
+// it is force pushed without asking.
+func (s *Syncer) pushStaging(ctx context.Context, repo *git.Repository, target, pushSrc string, base plumbing.ReferenceName, result *BranchResult, branchSpan *span) error {
+	baseSHA, err := s.remoteRefSHA(ctx, target, base)
+
+	if err != nil {
+		return fmt.Errorf("could not read %s on %s: %w", base.Short(), target, err)
+	}
+
+	if baseSHA == result.NewSHA {
+		s.infoPrintf("%s is already up to date on %s\n", base.Short(), target)
+		result.Status = StatusUpToDate
+		return nil
+	}
+
+	staging := stagingRef(s.currentEntry.ViaPR, base)
+	stagingSHA, err := s.remoteRefSHA(ctx, target, staging)
+
+	if err != nil {
+		return fmt.Errorf("could not read %s on %s: %w", staging.Short(), target, err)
+	}
+
+	if stagingSHA == result.NewSHA {
+		s.debugPrintf("%s is already up to date on %s\n", staging.Short(), target)
+		return nil
+	}
+
+	s.infoPrintf("pushing changes on %s to %s on %s\n", base.Short(), staging.Short(), target)
+
+	pushProgress := s.newProgress("push", target, base.Short())
+	pushSpan := s.tracer.start(branchSpan, "push", "remote", target)
+	started := time.Now()
+	err = s.pushTo(ctx, repo, target, config.RefSpec("+"+pushSrc+":"+staging.String()), pushProgress)
+	result.PushDuration = time.Since(started)
+	pushSpan.finish(err)
+	pushProgress.finish()
+
+	if err != nil {
+		s.forgetRemoteRefs(target)
+		return err
+	}
+
+	s.pushedRemoteRef(target, staging, result.NewSHA)
+	result.pushedRef, result.targetOldSHA = staging, stagingSHA
+
+	return nil
+}
+
+// openPullRequest opens a pull request from base's staging branch to base on
+// target, unless one is open already, which pushing to the staging branch
+// has brought up to date. Its URL is kept in the branch's result.
+func (s *Syncer) openPullRequest(ctx context.Context, source, target string, base plumbing.ReferenceName, result *BranchResult) error {
+	settings := *s.currentEntry.ViaPR
+	token, err := resolveSecret(settings.Token)
+
+	if err != nil {
+		return fmt.Errorf("%s via_pr token: %w", target, err)
+	}
+
+	if settings.Project == "" {
+		if settings.Project, err = projectFromURL(settings.Type, s.effectiveURL(target, true)); err != nil {
+			return fmt.Errorf("%s via_pr: %w", target, err)
+		}
+	}
+
+	head := stagingRef(&settings, base).Short()
+	title := fmt.Sprintf("Sync %s from %s", base.Short(), source)
+	body := fmt.Sprintf("Brings %s up to date with %s on %s, at %s.\n\nOpened by gitsync, which pushes to %s as %s moves.", base.Short(), result.Branch, source, ShortSHA(result.NewSHA), head, result.Branch)
+
+	var link string
+	var opened bool
+
+	switch settings.Type {
+	case "github":
+		link, opened, err = gitHubPullRequest(ctx, &settings, token, head, base.Short(), title, body)
+	case "gitlab":
+		link, opened, err = gitLabMergeRequest(ctx, &settings, token, head, base.Short(), title, body)
+	case "gitea":
+		link, opened, err = giteaPullRequest(ctx, &settings, token, head, base.Short(), title, body)
+	case "bitbucket", "bitbucket_server":
+		link, opened, err = bitbucketPullRequest(ctx, &settings, token, head, base.Short(), title, body)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not open a pull request for %s on %s: %w", base.Short(), target, err)
+	}
+
+	if opened {
+		s.infoPrintf("opened pull request %s for %s on %s\n", link, base.Short(), target)
+	} else {
+		s.debugPrintf("pull request %s for %s on %s is already open\n", link, base.Short(), target)
+	}
+
+	result.PullRequest = link
+
+	return nil
+}
+
+// gitHubPullRequest finds the open pull request from head to base, or opens
+// one. It returns the pull request's URL and whether it had to open it.
+func gitHubPullRequest(ctx context.Context, settings *PullRequest, token, head, base, title, body string) (string, bool, error) {
+	apiURL := settings.APIURL
+
+	if apiURL == "" {
+		apiURL = gsDefaultGitHubAPI
+	}
+
+	endpoint := strings.TrimSuffix(apiURL, "/") + "/repos/" + settings.Project + "/pulls"
+	headers := map[string]string{"Accept": "application/vnd.github+json", "Authorization": "Bearer " + token}
+	owner, _, _ := strings.Cut(settings.Project, "/")
+	query := url.Values{"state": {"open"}, "head": {owner + ":" + head}, "base": {base}}
+
+	var open []struct {
+		URL string `json:"html_url"`
+	}
+
+	if status, err := forgeRequest(ctx, http.MethodGet, endpoint+"?"+query.Encode(), headers, nil, &open); err != nil || status != http.StatusOK {
+		return "", false, forgeError(err, status, "looking for an open pull request")
+	}
+
+	if len(open) > 0 {
+		return open[0].URL, false, nil
+	}
+
+	var created struct {
+		URL string `json:"html_url"`
+	}
+
+	request := map[string]string{"title": title, "head": head, "base": base, "body": body}
+
+	if status, err := forgeRequest(ctx, http.MethodPost, endpoint, headers, request, &created); err != nil || status != http.StatusCreated {
+		return "", false, forgeError(err, status, "opening the pull request")
+	}
+
+	return created.URL, true, nil
+}
+
+// gitLabMergeRequest finds the open merge request from head to base, or
+// opens one. It returns the merge request's URL and whether it had to open
+// it.
+func gitLabMergeRequest(ctx context.Context, settings *PullRequest, token, head, base, title, body string) (string, bool, error) {
+	apiURL := settings.APIURL
+
+	if apiURL == "" {
+		apiURL = gsDefaultGitLabAPI
+	}
+
+	endpoint := strings.TrimSuffix(apiURL, "/") + "/projects/" + url.PathEscape(settings.Project) + "/merge_requests"
+	headers := map[string]string{"PRIVATE-TOKEN": token}
+	query := url.Values{"state": {"opened"}, "source_branch": {head}, "target_branch": {base}}
+
+	var open []struct {
+		URL string `json:"web_url"`
+	}
+
+	if status, err := forgeRequest(ctx, http.MethodGet, endpoint+"?"+query.Encode(), headers, nil, &open); err != nil || status != http.StatusOK {
+		return "", false, forgeError(err, status, "looking for an open merge request")
+	}
+
+	if len(open) > 0 {
+		return open[0].URL, false, nil
+	}
+
+	var created struct {
+		URL string `json:"web_url"`
+	}
+
+	request := map[string]string{"title": title, "source_branch": head, "target_branch": base, "description": body}
+
+	if status, err := forgeRequest(ctx, http.MethodPost, endpoint, headers, request, &created); err != nil || status != http.StatusCreated {
+		return "", false, forgeError(err, status, "opening the merge request")
+	}
+
+	return created.URL, true, nil
+}
+
+// giteaPullRequest finds the open pull request from head to base on Gitea
+// or Forgejo, or opens one. It returns the pull request's URL and whether it
+// had to open it.
+func giteaPullRequest(ctx context.Context, settings *PullRequest, token, head, base, title, body string) (string, bool, error) {
+	endpoint := strings.TrimSuffix(settings.APIURL, "/") + "/repos/" + settings.Project + "/pulls"
+	headers := map[string]string{"Authorization": "token " + token}
+
+	type pullRequest struct {
+		URL  string `json:"html_url"`
+		Head struct {
+			Ref string `json:"ref"`
+		} `json:"head"`
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+	}
+
+	// Gitea can't filter open pull requests by branch.
+	for page := 1; ; page++ {
+		var open []pullRequest
+
+		if status, err := forgeRequest(ctx, http.MethodGet, fmt.Sprintf("%s?state=open&limit=50&page=%d", endpoint, page), headers, nil, &open); err != nil || status != http.StatusOK {
+			return "", false, forgeError(err, status, "looking for an open pull request")
+		}
+
+		for _, pull := range open {
+			if pull.Head.Ref == head && pull.Base.Ref == base {
+				return pull.URL, false, nil
+			}
+		}
+
+		if len(open) < 50 {
+			break
+		}
+	}
+
+	var created pullRequest
+
+	request := map[string]string{"title": title, "head": head, "base": base, "body": body}
+
+	if status, err := forgeRequest(ctx, http.MethodPost, endpoint, headers, request, &created); err != nil || status != http.StatusCreated {
+		return "", false, forgeError(err, status, "opening the pull request")
+	}
+
+	return created.URL, true, nil
+}
+
+// bitbucketPullRequest finds the open pull request from head to base on
+// Bitbucket Cloud or Data Center, or opens one. The token is sent as
+// ensureBitbucketRepo sends it. It returns the pull request's URL and
+// whether it had to open it.
+func bitbucketPullRequest(ctx context.Context, settings *PullRequest, token, head, base, title, body string) (string, bool, error) {
+	headers := map[string]string{"Authorization": "Bearer " + token}
+
+	if settings.Username != "" {
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(settings.Username+":"+token))
+	}
+
+	owner, name, _ := strings.Cut(settings.Project, "/")
+
+	if settings.Type == "bitbucket_server" {
+		endpoint := strings.TrimSuffix(settings.APIURL, "/") + "/projects/" + url.PathEscape(owner) + "/repos/" + url.PathEscape(name) + "/pull-requests"
+		query := url.Values{"state": {"OPEN"}, "direction": {"INCOMING"}, "at": {"refs/heads/" + base}, "limit": {"100"}}
+
+		type pullRequest struct {
+			FromRef struct {
+				ID string `json:"id"`
+			} `json:"fromRef"`
+			Links struct {
+				Self []struct {
+					Href string `json:"href"`
+				} `json:"self"`
+			} `json:"links"`
+		}
+
+		link := func(pull pullRequest) string {
+			if len(pull.Links.Self) == 0 {
+				return ""
+			}
+
+			return pull.Links.Self[0].Href
+		}
+
+		var open struct {
+			Values []pullRequest `json:"values"`
+		}
+
+		if status, err := forgeRequest(ctx, http.MethodGet, endpoint+"?"+query.Encode(), headers, nil, &open); err != nil || status != http.StatusOK {
+			return "", false, forgeError(err, status, "looking for an open pull request")
+		}
+
+		for _, pull := range open.Values {
+			if pull.FromRef.ID == "refs/heads/"+head {
+				return link(pull), false, nil
+			}
+		}
+
+		var created pullRequest
+
+		request := map[string]interface{}{
+			"title":       title,
+			"description": body,
+			"fromRef":     map[string]string{"id": "refs/heads/" + head},
+			"toRef":       map[string]string{"id": "refs/heads/" + base},
+		}
+
+		if status, err := forgeRequest(ctx, http.MethodPost, endpoint, headers, request, &created); err != nil || status != http.StatusCreated {
+			return "", false, forgeError(err, status, "opening the pull request")
+		}
+
+		return link(created), true, nil
+	}
+
+	apiURL := settings.APIURL
+
+	if apiURL == "" {
+		apiURL = gsDefaultBitbucketAPI
+	}
+
+	endpoint := strings.TrimSuffix(apiURL, "/") + "/repositories/" + url.PathEscape(owner) + "/" + url.PathEscape(name) + "/pullrequests"
+	query := url.Values{"q": {fmt.Sprintf("source.branch.name=%q AND destination.branch.name=%q AND state=\"OPEN\"", head, base)}}
+
+	type pullRequest struct {
+		Links struct {
+			HTML struct {
+				Href string `json:"href"`
+			} `json:"html"`
+		} `json:"links"`
+	}
+
+	var open struct {
+		Values []pullRequest `json:"values"`
+	}
+
+	if status, err := forgeRequest(ctx, http.MethodGet, endpoint+"?"+query.Encode(), headers, nil, &open); err != nil || status != http.StatusOK {
+		return "", false, forgeError(err, status, "looking for an open pull request")
+	}
+
+	if len(open.Values) > 0 {
+		return open.Values[0].Links.HTML.Href, false, nil
+	}
+
+	var created pullRequest
+
+	request := map[string]interface{}{
+		"title":       title,
+		"description": body,
+		"source":      map[string]interface{}{"branch": map[string]string{"name": head}},
+		"destination": map[string]interface{}{"branch": map[string]string{"name": base}},
+	}
+
+	if status, err := forgeRequest(ctx, http.MethodPost, endpoint, headers, request, &created); err != nil || status != http.StatusCreated {
+		return "", false, forgeError(err, status, "opening the pull request")
+	}
+
+	return created.Links.HTML.Href, true, nil
+}
+
+// forgeError is the error of a forge request that failed, or returned
+// status when something else was expected.
+func forgeError(err error, status int, doing string) error {
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("%s: %s", doing, http.StatusText(status))
+}
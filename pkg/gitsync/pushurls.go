@@ -0,0 +1,75 @@
+package gitsync
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+var errPushURLRefused = errors.New("push url not allowed")
+
+// checkURLPatterns makes sure every allow and deny pattern is a valid glob.
+func checkURLPatterns(patterns ...[]string) error {
+	for _, list := range patterns {
+		for _, pattern := range list {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid push url pattern %s: %w", pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// pushURLAllowed returns why pushing to remoteURL is refused by the deny
+// and allow patterns gitsync was started with, or nil if it isn't. Deny
+// patterns win over allow patterns, and when there are allow patterns the
+// URL must match one of them.
+func (s *Syncer) pushURLAllowed(remoteURL string) error {
+	key := urlKey(remoteURL)
+
+	if pattern := matchURL(s.denyPushURLs, key); pattern != "" {
+		return fmt.Errorf("%w: %s matches %s", errPushURLRefused, redactURL(remoteURL), pattern)
+	}
+
+	if len(s.allowPushURLs) > 0 && matchURL(s.allowPushURLs, key) == "" {
+		return fmt.Errorf("%w: %s matches none of %s", errPushURLRefused, redactURL(remoteURL), strings.Join(s.allowPushURLs, ", "))
+	}
+
+	return nil
+}
+
+// urlKey reduces a remote URL to host/path, so https, ssh and scp-like URLs
+// for the same repository are matched alike. Local repositories are just
+// their path.
+func urlKey(remoteURL string) string {
+	key := remoteURL
+
+	if endpoint, err := transport.NewEndpoint(remoteURL); err == nil {
+		key = endpoint.Path
+
+		if endpoint.Host != "" {
+			key = strings.ToLower(endpoint.Host) + "/" + strings.TrimPrefix(endpoint.Path, "/")
+		}
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(key, "/"), ".git")
+}
+
+// matchURL returns the first pattern that matches key, or any of its leading
+// path elements, so a host or an organisation matches every repository under
+// it.
+func matchURL(patterns []string, key string) string {
+	for _, pattern := range patterns {
+		for prefix := key; prefix != ""; prefix = prefix[:max(strings.LastIndex(prefix, "/"), 0)] {
+			if matched, _ := path.Match(pattern, prefix); matched {
+				return pattern
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,456 @@
+package gitsync
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/youmark/pkcs8"
+	"golang.org/x/net/proxy"
+)
+
+// Remote holds settings that apply to a single remote.
+type Remote struct {
+	// URL is where the remote is, for the clone gitsync keeps in a
+	// workdir. Remotes of a checkout keep the URL they have there.
+	URL          string        `json:"url"`
+	Proxy        *Proxy        `json:"proxy"`
+	TLS          *TLS          `json:"tls"`
+	Auth         *Auth         `json:"auth"`
+	CommitStatus *CommitStatus `json:"commit_status"`
+	Create       *CreateRepo   `json:"create"`
+	Transfer     *Transfer     `json:"transfer"`
+	// Backend runs the remote's operations with go-git (the default) or
+	// the git binary; PullBackend and PushBackend override it per operation.
+	Backend     string `json:"backend"`
+	PullBackend string `json:"pull_backend"`
+	PushBackend string `json:"push_backend"`
+	// S3 reaches the bucket of a remote whose URL is s3://bucket/prefix.
+	S3 *S3Store `json:"s3"`
+	// WebhookSecret authenticates the webhooks the remote's forge sends
+	// when it is pushed to, which trigger a sync.
+	WebhookSecret string `json:"webhook_secret"`
+}
+
+// Proxy routes a remote through its own proxy.
+type Proxy struct {
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// TLS configures client certificates and trust for an HTTPS remote.
+type TLS struct {
+	ClientCert          string `json:"client_cert"`
+	ClientKey           string `json:"client_key"`
+	ClientKeyPassphrase string `json:"client_key_passphrase"`
+	CABundle            string `json:"ca_bundle"`
+	InsecureSkipVerify  bool   `json:"insecure_skip_verify"`
+}
+
+// remoteTransport is the resolved form of a Remote, ready to be
+// handed to go-git for every operation against that remote.
+type remoteTransport struct {
+	proxy      transport.ProxyOptions
+	clientCert []byte
+	clientKey  []byte
+	caBundle   []byte
+	insecure   bool
+}
+
+const gsWarningInsecureTLS string = "TLS certificate verification is DISABLED for remote %s, connections can be intercepted\n"
+
+var gsProxySchemes = map[string]bool{
+	"http":    true,
+	"https":   true,
+	"socks5":  true,
+	"socks5h": true,
+}
+
+func init() {
+	// go-git dials SSH remotes through golang.org/x/net/proxy, which only
+	// knows about SOCKS, so teach it to tunnel through HTTP CONNECT proxies too.
+	proxy.RegisterDialerType("http", newConnectDialer)
+	proxy.RegisterDialerType("https", newConnectDialer)
+}
+
+func (s *Syncer) loadRemotes() bool {
+	s.remoteTransports = map[string]remoteTransport{}
+
+	for name, remote := range s.config.Remotes {
+		var rt remoteTransport
+
+		if remote.Proxy != nil {
+			proxyURL, err := url.Parse(remote.Proxy.URL)
+
+			if err != nil || !gsProxySchemes[proxyURL.Scheme] || proxyURL.Host == "" {
+				errorPrintf("%s remote has an invalid proxy url: %s\n", name, remote.Proxy.URL)
+				return false
+			}
+
+			password, err := resolveSecret(remote.Proxy.Password)
+
+			if err != nil {
+				errorPrintf("%s remote proxy password: %s\n", name, err)
+				return false
+			}
+
+			rt.proxy = transport.ProxyOptions{
+				URL:      remote.Proxy.URL,
+				Username: remote.Proxy.Username,
+				Password: password,
+			}
+		}
+
+		if remote.TLS != nil && (remote.TLS.ClientCert != "" || remote.TLS.ClientKey != "") {
+			cert, key, err := loadClientCertificate(remote.TLS)
+
+			if err != nil {
+				errorPrintf("%s remote client certificate: %s\n", name, err)
+				return false
+			}
+
+			rt.clientCert = cert
+			rt.clientKey = key
+		}
+
+		if remote.TLS != nil && remote.TLS.CABundle != "" {
+			bundle, err := os.ReadFile(remote.TLS.CABundle)
+
+			if err != nil {
+				errorPrintf("%s remote ca bundle: %s\n", name, err)
+				return false
+			}
+
+			if !x509.NewCertPool().AppendCertsFromPEM(bundle) {
+				errorPrintf("%s remote ca bundle %s contains no certificates\n", name, remote.TLS.CABundle)
+				return false
+			}
+
+			rt.caBundle = bundle
+		}
+
+		if remote.TLS != nil && remote.TLS.InsecureSkipVerify {
+			warnPrintf(gsWarningInsecureTLS, name)
+			rt.insecure = true
+		}
+
+		if remote.Auth != nil && !checkAuth(name, remote.Auth) {
+			return false
+		}
+
+		if remote.CommitStatus != nil && !checkCommitStatus(name, remote.CommitStatus) {
+			return false
+		}
+
+		if remote.Create != nil && !checkCreateRepo(name, remote.Create) {
+			return false
+		}
+
+		if remote.S3 != nil && !checkS3Store(name, remote.S3) {
+			return false
+		}
+
+		if !s.checkBackends(name, remote) || !s.checkTransfer(name, remote.Transfer) {
+			return false
+		}
+
+		s.remoteTransports[name] = rt
+	}
+
+	return true
+}
+
+// loadClientCertificate reads a PEM client certificate and key, decrypting
+// the key with the configured passphrase if it is encrypted. The key is
+// returned unencrypted as go-git expects.
+func loadClientCertificate(settings *TLS) ([]byte, []byte, error) {
+	if settings.ClientCert == "" || settings.ClientKey == "" {
+		return nil, nil, errors.New("client_cert and client_key must both be set")
+	}
+
+	cert, err := os.ReadFile(settings.ClientCert)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := os.ReadFile(settings.ClientKey)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	passphrase, err := resolveSecret(settings.ClientKeyPassphrase)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ := pem.Decode(key)
+
+	if block == nil {
+		return nil, nil, fmt.Errorf("%s does not contain a PEM key", settings.ClientKey)
+	}
+
+	var decrypted interface{}
+
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		decrypted, err = pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(passphrase))
+	case x509.IsEncryptedPEMBlock(block):
+		var der []byte
+		der, err = x509.DecryptPEMBlock(block, []byte(passphrase))
+		if err == nil {
+			key = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+		}
+	}
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not decrypt %s: %w", settings.ClientKey, err)
+	}
+
+	if decrypted != nil {
+		der, err := x509.MarshalPKCS8PrivateKey(decrypted)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+
+	if _, err := tls.X509KeyPair(cert, key); err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+func (s *Syncer) fetchOptions(remote string, refSpecs []config.RefSpec) (*git.FetchOptions, error) {
+	rt := s.remoteTransports[remote]
+	auth, err := s.remoteAuth(remote, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &git.FetchOptions{
+		RemoteName:      remote,
+		RemoteURL:       s.remoteURL(remote, false),
+		Auth:            auth,
+		RefSpecs:        refSpecs,
+		ProxyOptions:    rt.proxy,
+		ClientCert:      rt.clientCert,
+		ClientKey:       rt.clientKey,
+		CABundle:        rt.caBundle,
+		InsecureSkipTLS: rt.insecure,
+	}, nil
+}
+
+func (s *Syncer) pushOptions(remote string, refSpec config.RefSpec) (*git.PushOptions, error) {
+	rt := s.remoteTransports[remote]
+	auth, err := s.remoteAuth(remote, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &git.PushOptions{
+		RemoteName:      remote,
+		RemoteURL:       s.remoteURL(remote, true),
+		Auth:            auth,
+		RefSpecs:        []config.RefSpec{refSpec},
+		ProxyOptions:    rt.proxy,
+		ClientCert:      rt.clientCert,
+		ClientKey:       rt.clientKey,
+		CABundle:        rt.caBundle,
+		InsecureSkipTLS: rt.insecure,
+	}, nil
+}
+
+// listRemoteRefs asks a remote for its refs, like git ls-remote, through
+// the backend of the operation the listing is for.
+func (s *Syncer) listRemoteRefs(ctx context.Context, remote string, push bool) ([]*plumbing.Reference, error) {
+	op := opPull
+
+	if push {
+		op = opPush
+	}
+
+	return s.backendFor(remote, op).listRefs(ctx, remote, push)
+}
+
+// remoteRefSHA returns the SHA a target remote has for ref, or "" if the
+// remote doesn't have it.
+func (s *Syncer) remoteRefSHA(ctx context.Context, remote string, ref plumbing.ReferenceName) (string, error) {
+	refs, err := s.advertisedRefs(ctx, remote, true)
+
+	if err != nil {
+		return "", err
+	}
+
+	if hash, exists := refs[ref]; exists {
+		return hash.String(), nil
+	}
+
+	return "", nil
+}
+
+// advertisedRefs returns a remote's refs. They are listed once per run, by
+// the preflight check or the first branch to need them, and then kept up to
+// date with what the run pushes, rather than listed again for every branch.
+func (s *Syncer) advertisedRefs(ctx context.Context, remote string, push bool) (map[plumbing.ReferenceName]plumbing.Hash, error) {
+	check := preflightCheck{remote, push}
+
+	if refs, cached := s.remoteRefs[check]; cached {
+		return refs, nil
+	}
+
+	listed, err := s.listRemoteRefs(ctx, remote, push)
+
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[plumbing.ReferenceName]plumbing.Hash{}
+
+	for _, ref := range listed {
+		refs[ref.Name()] = ref.Hash()
+	}
+
+	s.remoteRefs[check] = refs
+
+	return refs, nil
+}
+
+// pushedRemoteRef records that ref on a target remote was pushed to sha, or
+// deleted when sha is empty.
+func (s *Syncer) pushedRemoteRef(remote string, ref plumbing.ReferenceName, sha string) {
+	refs, cached := s.remoteRefs[preflightCheck{remote, true}]
+
+	switch {
+	case !cached:
+	case sha == "":
+		delete(refs, ref)
+	default:
+		refs[ref] = plumbing.NewHash(sha)
+	}
+}
+
+// forgetRemoteRefs has a target remote's refs listed again the next time
+// they are needed, when what it has can't be assumed: after a push failed
+// partway, or before a force push, which must not replace commits pushed
+// by someone else since the remote was listed.
+func (s *Syncer) forgetRemoteRefs(remote string) {
+	delete(s.remoteRefs, preflightCheck{remote, true})
+}
+
+// connectDialer tunnels a connection through an HTTP(S) proxy using CONNECT.
+type connectDialer struct {
+	proxyURL *url.URL
+	forward  proxy.Dialer
+}
+
+func newConnectDialer(proxyURL *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	return &connectDialer{proxyURL: proxyURL, forward: forward}, nil
+}
+
+func (d *connectDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyAddr := d.proxyURL.Host
+
+	if d.proxyURL.Port() == "" {
+		if d.proxyURL.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(d.proxyURL.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(d.proxyURL.Hostname(), "80")
+		}
+	}
+
+	var conn net.Conn
+	var err error
+
+	if ctxDialer, ok := d.forward.(proxy.ContextDialer); ok {
+		conn, err = ctxDialer.DialContext(ctx, "tcp", proxyAddr)
+	} else {
+		conn, err = d.forward.Dial("tcp", proxyAddr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if d.proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: d.proxyURL.Hostname()})
+
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if user := d.proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", d.proxyURL.Host, addr, resp.Status)
+	}
+
+	// SSH servers speak first, so their banner may already be sitting in
+	// the reader we used to parse the proxy's response.
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
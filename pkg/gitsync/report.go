@@ -0,0 +1,154 @@
+package gitsync
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+type reportBranch struct {
+	Branch        string            `json:"branch"`
+	Status        string            `json:"status"`
+	OldSHA        string            `json:"old_sha,omitempty"`
+	NewSHA        string            `json:"new_sha,omitempty"`
+	Commits       int               `json:"commits"`
+	DurationMs    int64             `json:"duration_ms"`
+	PullMs        int64             `json:"pull_ms"`
+	PushMs        int64             `json:"push_ms"`
+	BytesReceived int64             `json:"bytes_received"`
+	BytesSent     int64             `json:"bytes_sent"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+	PullRequest   string            `json:"pull_request,omitempty"`
+	Error         string            `json:"error,omitempty"`
+}
+
+type reportSync struct {
+	ID         string         `json:"sync_id"`
+	Source     string         `json:"source_remote"`
+	Target     string         `json:"target_remote"`
+	Status     string         `json:"status"`
+	DurationMs int64          `json:"duration_ms"`
+	Error      string         `json:"error,omitempty"`
+	Branches   []reportBranch `json:"branches"`
+}
+
+type reportFetch struct {
+	Remote        string   `json:"remote"`
+	Branches      []string `json:"branches"`
+	DurationMs    int64    `json:"duration_ms"`
+	BytesReceived int64    `json:"bytes_received"`
+	Error         string   `json:"error,omitempty"`
+}
+
+type reportRun struct {
+	RunID          string        `json:"run_id"`
+	Version        string        `json:"version"`
+	Host           string        `json:"host"`
+	Repository     string        `json:"repository"`
+	ConfigChecksum string        `json:"config_checksum"`
+	ConfigChanged  bool          `json:"config_changed,omitempty"`
+	Started        time.Time     `json:"started"`
+	Finished       time.Time     `json:"finished"`
+	DurationMs     int64         `json:"duration_ms"`
+	Status         string        `json:"status"`
+	Error          string        `json:"error,omitempty"`
+	Fetches        []reportFetch `json:"fetches"`
+	Syncs          []reportSync  `json:"syncs"`
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
+
+// buildReport renders a run, finished or still in progress, in the form
+// used by the JSON report, notifications and the history.
+func buildReport(run *RunResult) reportRun {
+	finished := run.Finished
+	host, _ := os.Hostname()
+
+	if finished.IsZero() {
+		finished = time.Now()
+	}
+
+	report := reportRun{
+		RunID:          run.ID,
+		Version:        Version,
+		Host:           host,
+		Repository:     run.Repository,
+		ConfigChecksum: run.ConfigChecksum,
+		ConfigChanged:  run.ConfigChanged,
+		Started:        run.Started,
+		Finished:       finished,
+		DurationMs:     finished.Sub(run.Started).Milliseconds(),
+		Status:         StatusSynced,
+		Error:          errorString(run.Err),
+		Fetches:        []reportFetch{},
+		Syncs:          []reportSync{},
+	}
+
+	if run.Failed() {
+		report.Status = StatusFailed
+	}
+
+	for _, fetch := range run.Fetches {
+		report.Fetches = append(report.Fetches, reportFetch{
+			Remote:        fetch.Remote,
+			Branches:      fetch.Branches,
+			DurationMs:    fetch.Duration.Milliseconds(),
+			BytesReceived: fetch.BytesReceived,
+			Error:         errorString(fetch.Err),
+		})
+	}
+
+	for _, result := range run.Syncs {
+		sync := reportSync{
+			ID:         result.ID,
+			Source:     result.Source,
+			Target:     result.Target,
+			Status:     result.Status,
+			DurationMs: result.Duration.Milliseconds(),
+			Error:      errorString(result.Err),
+			Branches:   []reportBranch{},
+		}
+
+		for _, branch := range result.Branches {
+			sync.Branches = append(sync.Branches, reportBranch{
+				Branch:        branch.Branch,
+				Status:        branch.Status,
+				OldSHA:        branch.OldSHA,
+				NewSHA:        branch.NewSHA,
+				Commits:       branch.Commits,
+				DurationMs:    branch.Duration.Milliseconds(),
+				PullMs:        branch.PullDuration.Milliseconds(),
+				PushMs:        branch.PushDuration.Milliseconds(),
+				BytesReceived: branch.BytesReceived,
+				BytesSent:     branch.BytesSent,
+				Annotations:   branch.Annotations,
+				PullRequest:   branch.PullRequest,
+				Error:         errorString(branch.Err),
+			})
+		}
+
+		report.Syncs = append(report.Syncs, sync)
+	}
+
+	return report
+}
+
+// WriteJSON writes the run as an indented JSON report.
+func (r *RunResult) WriteJSON(w io.Writer) error {
+	report, err := json.MarshalIndent(buildReport(r), "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(report, '\n'))
+
+	return err
+}
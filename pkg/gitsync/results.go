@@ -0,0 +1,153 @@
+package gitsync
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// Statuses of a sync entry or branch.
+const (
+	StatusSynced  string = "synced"
+	StatusSkipped string = "skipped"
+	StatusFailed  string = "failed"
+	// StatusUpToDate is a branch the target already had, so nothing was
+	// pushed. Its sync entry counts as synced.
+	StatusUpToDate string = "up to date"
+)
+
+var errSyncSkipped = errors.New("sync skipped, it would fail")
+var errBranchesFailed = errors.New("one or more branches failed")
+var errLargeChange = errors.New("change too large to sync without confirmation")
+var errFailFast = errors.New("stopped after the first failure")
+var errAtomicGroupFailed = errors.New("not synced, another branch of the atomic group failed")
+
+// gsMaxCountedCommits bounds the history walk used to count transferred
+// commits, so a rewritten branch doesn't walk the whole repository.
+const gsMaxCountedCommits int = 10000
+
+// BranchResult is the outcome of syncing one branch.
+type BranchResult struct {
+	Branch        string
+	Status        string
+	OldSHA        string
+	NewSHA        string
+	Commits       int
+	Duration      time.Duration
+	PullDuration  time.Duration
+	PushDuration  time.Duration
+	BytesReceived int64
+	BytesSent     int64
+	// Annotations are what the policy had to say about the branch.
+	Annotations map[string]string
+	// PullRequest is the URL of the pull request a via_pr sync entry
+	// opened, or brought up to date, for the branch.
+	PullRequest string
+	Err         error
+
+	// pushedRef is what was pushed to the target, which had targetOldSHA
+	// before, for rolling back atomic groups.
+	pushedRef    plumbing.ReferenceName
+	targetOldSHA string
+}
+
+// SyncResult is the outcome of one sync entry.
+type SyncResult struct {
+	ID       string
+	Source   string
+	Target   string
+	Status   string
+	Branches []*BranchResult
+	Duration time.Duration
+	Err      error
+}
+
+// RunResult is the outcome of a run. Its ID, and the IDs of its sync
+// entries, tag every log line, report, webhook and trace so that output from
+// overlapping runs can be told apart. Err is set when the run stopped early,
+// in which case Syncs only holds the entries processed before it did.
+type RunResult struct {
+	ID         string
+	Repository string
+	// ConfigChecksum is the Config.Checksum of the config the run used,
+	// and ConfigChanged whether it changed at its source during the run.
+	ConfigChecksum string
+	ConfigChanged  bool
+	Started        time.Time
+	Finished       time.Time
+	// Fetches are the run's fetches, one per source remote, made before
+	// any sync entry is processed.
+	Fetches []*FetchResult
+	Syncs   []*SyncResult
+	Err     error
+}
+
+// Failed reports whether the run stopped early or any sync entry of it was
+// skipped or failed.
+func (r *RunResult) Failed() bool {
+	if r.Err != nil {
+		return true
+	}
+
+	for _, result := range r.Syncs {
+		if result.Status != StatusSynced {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ShortSHA abbreviates a SHA to seven characters, or "-" if it is empty.
+func ShortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+
+	if sha == "" {
+		return "-"
+	}
+
+	return sha
+}
+
+func branchSHA(repo *git.Repository, branchRef plumbing.ReferenceName) string {
+	ref, err := repo.Reference(branchRef, true)
+
+	if err != nil {
+		return ""
+	}
+
+	return ref.Hash().String()
+}
+
+// countCommits counts the commits reachable from newSHA but not from oldSHA,
+// stopping at gsMaxCountedCommits.
+func countCommits(repo *git.Repository, oldSHA, newSHA string) int {
+	if oldSHA == newSHA || newSHA == "" {
+		return 0
+	}
+
+	commits, err := repo.Log(&git.LogOptions{From: plumbing.NewHash(newSHA)})
+
+	if err != nil {
+		return 0
+	}
+
+	count := 0
+
+	commits.ForEach(func(c *object.Commit) error {
+		if c.Hash.String() == oldSHA || count >= gsMaxCountedCommits {
+			return storer.ErrStop
+		}
+
+		count++
+		return nil
+	})
+
+	return count
+}
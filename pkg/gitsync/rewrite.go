@@ -0,0 +1,143 @@
+package gitsync
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	format "github.com/go-git/go-git/v5/plumbing/format/config"
+)
+
+// URLRewrite mirrors git's url.<base>.insteadOf and
+// url.<base>.pushInsteadOf settings; the map key is the base.
+type URLRewrite struct {
+	InsteadOf     []string `json:"instead_of"`
+	PushInsteadOf []string `json:"push_instead_of"`
+}
+
+type urlRule struct {
+	base   string
+	prefix string
+	push   bool
+}
+
+type urlRules []urlRule
+
+// loadURLRewrites gathers insteadOf rules from the global git config, the
+// repository's own config and finally the gitsync config, mirroring the
+// precedence git uses. It also records each remote's URL exactly as
+// configured, before any rewriting.
+func (s *Syncer) loadURLRewrites(repo *git.Repository) error {
+	s.urlRules = nil
+
+	if global, err := config.LoadConfig(config.GlobalScope); err == nil {
+		s.urlRules.add(global.Raw)
+	}
+
+	local, err := repo.Config()
+
+	if err != nil {
+		return fmt.Errorf("could not read repository config: %w", err)
+	}
+
+	s.urlRules.add(local.Raw)
+
+	for _, subsection := range local.Raw.Section("remote").Subsections {
+		if remoteURL := subsection.Option("url"); remoteURL != "" {
+			s.repoRemoteURLs[subsection.Name] = remoteURL
+		}
+	}
+
+	for base, rewrite := range s.config.URLRewrites {
+		for _, prefix := range rewrite.InsteadOf {
+			s.urlRules = append(s.urlRules, urlRule{base: base, prefix: prefix})
+		}
+
+		for _, prefix := range rewrite.PushInsteadOf {
+			s.urlRules = append(s.urlRules, urlRule{base: base, prefix: prefix, push: true})
+		}
+	}
+
+	return nil
+}
+
+func (rules *urlRules) add(raw *format.Config) {
+	if raw == nil || !raw.HasSection("url") {
+		return
+	}
+
+	for _, subsection := range raw.Section("url").Subsections {
+		for _, prefix := range subsection.Options.GetAll("insteadOf") {
+			*rules = append(*rules, urlRule{base: subsection.Name, prefix: prefix})
+		}
+
+		for _, prefix := range subsection.Options.GetAll("pushInsteadOf") {
+			*rules = append(*rules, urlRule{base: subsection.Name, prefix: prefix, push: true})
+		}
+	}
+}
+
+// rewrite applies the longest matching insteadOf rule, preferring
+// pushInsteadOf rules when the URL is being pushed to.
+func (rules urlRules) rewrite(remoteURL string, push bool) string {
+	if push {
+		if rewritten, matched := rules.longest(remoteURL, true); matched {
+			return rewritten
+		}
+	}
+
+	rewritten, _ := rules.longest(remoteURL, false)
+
+	return rewritten
+}
+
+func (rules urlRules) longest(remoteURL string, push bool) (string, bool) {
+	var match *urlRule
+
+	for i, rule := range rules {
+		if rule.push != push || !strings.HasPrefix(remoteURL, rule.prefix) {
+			continue
+		}
+
+		if match == nil || len(rule.prefix) >= len(match.prefix) {
+			match = &rules[i]
+		}
+	}
+
+	if match == nil {
+		return remoteURL, false
+	}
+
+	return match.base + strings.TrimPrefix(remoteURL, match.prefix), true
+}
+
+// remoteURL returns the rewritten URL for a remote, or "" when no rule
+// applies and go-git should use the remote's configured URL.
+func (s *Syncer) remoteURL(remote string, push bool) string {
+	configured, exists := s.repoRemoteURLs[remote]
+
+	if !exists {
+		return ""
+	}
+
+	rewritten := s.urlRules.rewrite(configured, push)
+
+	if rewritten == configured {
+		return ""
+	}
+
+	s.debugPrintf("rewrote %s url %s to %s\n", remote, configured, rewritten)
+
+	return rewritten
+}
+
+// effectiveURL is the URL operations on a remote actually use, with a
+// relative path to a local remote made absolute as git would.
+func (s *Syncer) effectiveURL(remote string, push bool) string {
+	if rewritten := s.remoteURL(remote, push); rewritten != "" {
+		return absoluteURL(rewritten, s.repoDir)
+	}
+
+	return absoluteURL(s.repoRemoteURLs[remote], s.repoDir)
+}
@@ -0,0 +1,83 @@
+package gitsync
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// What to do when a source branch's history has been rewritten, so its new
+// tip doesn't descend from the tip gitsync last synced.
+const (
+	RewriteFail       string = "fail"
+	RewriteForce      string = "force"
+	RewriteQuarantine string = "quarantine"
+)
+
+var gsRewritePolicies = map[string]bool{
+	RewriteFail:       true,
+	RewriteForce:      true,
+	RewriteQuarantine: true,
+}
+
+// gsQuarantinePrefix is where quarantined rewrites are pushed on the target.
+const gsQuarantinePrefix string = "rewritten/"
+
+var errHistoryRewritten = errors.New("history rewritten")
+
+func checkRewritePolicy(where, policy string) bool {
+	if policy != "" && !gsRewritePolicies[policy] {
+		errorPrintf("%s has an unknown on_rewrite %s, it must be fail, force or quarantine\n", where, policy)
+		return false
+	}
+
+	return true
+}
+
+// rewritePolicy is the sync entry's on_rewrite, or the global one, or fail.
+func (s *Syncer) rewritePolicy(sync SyncEntry) string {
+	switch {
+	case sync.OnRewrite != "":
+		return sync.OnRewrite
+	case s.config.OnRewrite != "":
+		return s.config.OnRewrite
+	}
+
+	return RewriteFail
+}
+
+// handleRewrite deals with a branch that can't be fast-forwarded because
+// the source rewrote it. The rewritten tip is kept under
+// refs/gitsync/rewritten/<source>/<branch> and, as policy says, the branch
+// fails, the rewritten tip is force pushed to it, or the rewritten tip is
+// pushed to rewritten/<branch> on the target instead. The local branch is
+// left alone either way: a force pushed branch is only moved once the push
+// has gone through, so a push that is refused or fails leaves it where it
+// was for the next run to find the rewrite again. It returns what to push
+// where.
+func (s *Syncer) handleRewrite(repo *git.Repository, source, target string, branchRef plumbing.ReferenceName, policy string) (string, plumbing.ReferenceName, error) {
+	fetched := plumbing.ReferenceName(fmt.Sprintf("refs/gitsync/rewritten/%s/%s", source, branchRef.Short()))
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(fetched, plumbing.NewHash(branchSHA(repo, trackingRef(source, branchRef.Short()))))); err != nil {
+		return branchRef.String(), branchRef, fmt.Errorf("could not keep rewritten %s from %s: %w", branchRef.Short(), source, err)
+	}
+
+	oldSHA, newSHA := branchSHA(repo, branchRef), branchSHA(repo, fetched)
+	rewrite := fmt.Errorf("%w: %s on %s is now %s, which doesn't descend from %s", errHistoryRewritten, branchRef.Short(), source, ShortSHA(newSHA), ShortSHA(oldSHA))
+
+	switch policy {
+	case RewriteForce:
+		s.warnPrintf("%s, force pushing it to %s\n", rewrite, target)
+
+		return newSHA, branchRef, nil
+	case RewriteQuarantine:
+		quarantine := plumbing.NewBranchReferenceName(gsQuarantinePrefix + branchRef.Short())
+		s.warnPrintf("%s, pushing it to %s on %s instead\n", rewrite, quarantine.Short(), target)
+
+		return newSHA, quarantine, nil
+	}
+
+	return branchRef.String(), branchRef, rewrite
+}
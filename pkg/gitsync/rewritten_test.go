@@ -0,0 +1,60 @@
+package gitsync
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestForcedRewriteMovesBranchOnlyOncePushed(t *testing.T) {
+	dir, source, target, initial := testRepos(t, "main")
+	rewritten := testCommit(t, source, "rewritten")
+	setTestBranch(t, source, "main", rewritten)
+
+	config := Config{Sync: []SyncEntry{{Source: "source", Target: "target", Branches: []string{"main"}, OnRewrite: RewriteForce}}}
+	local, err := git.PlainOpen(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		assumeYes bool
+		status    string
+		err       error
+		sha       plumbing.Hash
+	}{
+		{"unconfirmed", false, StatusFailed, errNotConfirmed, initial},
+		{"unconfirmed again", false, StatusFailed, errNotConfirmed, initial},
+		{"confirmed", true, StatusSynced, nil, rewritten},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			syncer, err := New(config, Options{RepoDir: dir, Progress: ProgressNone, AssumeYes: test.assumeYes})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, _ := syncer.Run(context.Background())
+			branch := testBranchResult(t, result, "main")
+
+			if branch.Status != test.status || !errors.Is(branch.Err, test.err) {
+				t.Fatalf("got %s (%v), want %s (%v)", branch.Status, branch.Err, test.status, test.err)
+			}
+
+			if got := testBranchSHA(t, local, "main"); got != test.sha {
+				t.Errorf("local main is %s, want %s", ShortSHA(got.String()), ShortSHA(test.sha.String()))
+			}
+
+			if got := testBranchSHA(t, target, "main"); got != test.sha {
+				t.Errorf("target main is %s, want %s", ShortSHA(got.String()), ShortSHA(test.sha.String()))
+			}
+		})
+	}
+}
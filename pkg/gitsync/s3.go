@@ -0,0 +1,580 @@
+package gitsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/idxfile"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+)
+
+// BackendS3 keeps a bare repository snapshot in S3-compatible object
+// storage, rather than pushing to a git server. Remotes whose URL is
+// s3://bucket/prefix use it without asking.
+const BackendS3 string = "s3"
+
+const (
+	gsS3Scheme string = "s3://"
+	// gsS3MaxPacks is how many packs a snapshot collects, one per push that
+	// sent objects, before the next push repacks them into one.
+	gsS3MaxPacks int = 50
+	// gsS3Timeout bounds each request, generously, since a first snapshot's
+	// pack can be large.
+	gsS3Timeout = 30 * time.Minute
+)
+
+// S3Store says how to reach the bucket of a remote whose URL is
+// s3://bucket/prefix.
+type S3Store struct {
+	// Region is the bucket's region, or else $AWS_REGION, or us-east-1.
+	Region string `json:"region"`
+	// Endpoint is the base URL of an S3-compatible store, like MinIO or R2,
+	// which is addressed path-style. AWS's is the default.
+	Endpoint string `json:"endpoint"`
+}
+
+// checkS3Store validates a remote's object storage settings.
+func checkS3Store(name string, store *S3Store) bool {
+	if store.Endpoint == "" {
+		return true
+	}
+
+	endpoint, err := url.Parse(store.Endpoint)
+
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		errorPrintf("%s remote's s3 endpoint must be an http or https URL: %s\n", name, store.Endpoint)
+		return false
+	}
+
+	return true
+}
+
+// s3Bucket is where a remote's snapshot is kept.
+type s3Bucket struct {
+	base   string // URL of the bucket, ending in /
+	prefix string // of the snapshot's keys, ending in / unless empty
+	region string
+}
+
+// s3BucketFor parses remote's s3://bucket/prefix URL.
+func (s *Syncer) s3BucketFor(remote string) (*s3Bucket, error) {
+	location, found := strings.CutPrefix(s.effectiveURL(remote, true), gsS3Scheme)
+
+	if !found {
+		return nil, fmt.Errorf("%s remote uses the s3 backend, but its URL isn't s3://bucket/prefix", remote)
+	}
+
+	name, prefix, _ := strings.Cut(location, "/")
+
+	if name == "" {
+		return nil, fmt.Errorf("%s remote's URL has no bucket", remote)
+	}
+
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+
+	bucket := &s3Bucket{prefix: prefix, region: "us-east-1"}
+	settings := s.config.Remotes[remote].S3
+
+	if settings == nil {
+		settings = &S3Store{}
+	}
+
+	if region := awsRegion(settings.Region); region != "" {
+		bucket.region = region
+	}
+
+	if settings.Endpoint != "" {
+		bucket.base = strings.TrimSuffix(settings.Endpoint, "/") + "/" + name + "/"
+	} else {
+		bucket.base = "https://" + name + ".s3." + bucket.region + ".amazonaws.com/"
+	}
+
+	return bucket, nil
+}
+
+// errS3NotFound is returned for keys the bucket doesn't have.
+var errS3NotFound = errors.New("not found")
+
+// request sends a signed request for key, returning the response's body.
+func (b *s3Bucket) request(ctx context.Context, method, key string, body []byte) ([]byte, error) {
+	creds, err := loadAWSCredentials()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, gsS3Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, b.base+b.prefix+key, bytes.NewReader(body))
+
+	if err != nil {
+		return nil, err
+	}
+
+	bodyHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(bodyHash[:]))
+	signAWSRequest(req, body, creds, b.region, "s3", time.Now())
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 == 2 {
+		return content, nil
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", key, errS3NotFound)
+	}
+
+	var failure struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+
+	if xml.Unmarshal(content, &failure) == nil && failure.Code != "" {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, key, failure.Code, failure.Message)
+	}
+
+	return nil, fmt.Errorf("%s %s returned %s", method, key, resp.Status)
+}
+
+// get reads key, returning nil, and no error, if the bucket doesn't have
+// it.
+func (b *s3Bucket) get(ctx context.Context, key string) ([]byte, error) {
+	content, err := b.request(ctx, http.MethodGet, key, nil)
+
+	if errors.Is(err, errS3NotFound) {
+		return nil, nil
+	}
+
+	return content, err
+}
+
+func (b *s3Bucket) put(ctx context.Context, key string, content []byte) error {
+	_, err := b.request(ctx, http.MethodPut, key, content)
+	return err
+}
+
+func (b *s3Bucket) delete(ctx context.Context, key string) error {
+	_, err := b.request(ctx, http.MethodDelete, key, nil)
+
+	if errors.Is(err, errS3NotFound) {
+		return nil
+	}
+
+	return err
+}
+
+// s3Snapshot is the state of a bare repository kept in a bucket, laid out
+// as git has one on disk, so that copying the prefix down, or serving it
+// over dumb HTTP, gives a repository git can clone.
+type s3Snapshot struct {
+	head  string
+	refs  map[plumbing.ReferenceName]plumbing.Hash
+	packs []string // names, as pack-<hash>.pack
+}
+
+// readSnapshot reads a snapshot's refs and packs. A prefix with nothing in
+// it yet is an empty snapshot.
+func (b *s3Bucket) readSnapshot(ctx context.Context) (*s3Snapshot, error) {
+	snapshot := &s3Snapshot{refs: make(map[plumbing.ReferenceName]plumbing.Hash)}
+	head, err := b.get(ctx, "HEAD")
+
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot.head = strings.TrimSpace(string(head))
+	packedRefs, err := b.get(ctx, "packed-refs")
+
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(packedRefs))
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "^") {
+			continue
+		}
+
+		sha, name, found := strings.Cut(line, " ")
+
+		if !found || !plumbing.IsHash(sha) {
+			return nil, fmt.Errorf("packed-refs has a line that isn't a ref: %s", line)
+		}
+
+		snapshot.refs[plumbing.ReferenceName(name)] = plumbing.NewHash(sha)
+	}
+
+	packs, err := b.get(ctx, "objects/info/packs")
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(packs), "\n") {
+		if pack, found := strings.CutPrefix(line, "P "); found {
+			snapshot.packs = append(snapshot.packs, pack)
+		}
+	}
+
+	return snapshot, nil
+}
+
+// writeRefs writes a snapshot's refs, which is what makes the objects
+// uploaded before it part of the snapshot. HEAD and config are written
+// along with the first refs.
+func (b *s3Bucket) writeRefs(ctx context.Context, snapshot *s3Snapshot) error {
+	names := make([]string, 0, len(snapshot.refs))
+
+	for name := range snapshot.refs {
+		names = append(names, string(name))
+	}
+
+	sort.Strings(names)
+
+	var packedRefs, infoRefs strings.Builder
+
+	packedRefs.WriteString("# pack-refs with: sorted \n")
+
+	for _, name := range names {
+		sha := snapshot.refs[plumbing.ReferenceName(name)].String()
+		packedRefs.WriteString(sha + " " + name + "\n")
+		infoRefs.WriteString(sha + "\t" + name + "\n")
+	}
+
+	if err := b.put(ctx, "packed-refs", []byte(packedRefs.String())); err != nil {
+		return err
+	}
+
+	if err := b.put(ctx, "info/refs", []byte(infoRefs.String())); err != nil {
+		return err
+	}
+
+	head := snapshotHead(snapshot.refs, names)
+
+	if head == "" || "ref: "+head == snapshot.head {
+		return nil
+	}
+
+	// Buckets have no empty directories, and git won't take a directory
+	// without refs/ for a repository.
+	if snapshot.head == "" {
+		if err := b.put(ctx, "config", []byte("[core]\n\trepositoryformatversion = 0\n\tbare = true\n")); err != nil {
+			return err
+		}
+
+		if err := b.put(ctx, "refs/.keep", nil); err != nil {
+			return err
+		}
+	}
+
+	if err := b.put(ctx, "HEAD", []byte("ref: "+head+"\n")); err != nil {
+		return err
+	}
+
+	snapshot.head = "ref: " + head
+
+	return nil
+}
+
+// snapshotHead is the branch a snapshot's HEAD points at: main or master
+// if there is one, otherwise the first branch.
+func snapshotHead(refs map[plumbing.ReferenceName]plumbing.Hash, names []string) string {
+	for _, name := range []string{"refs/heads/main", "refs/heads/master"} {
+		if _, exists := refs[plumbing.ReferenceName(name)]; exists {
+			return name
+		}
+	}
+
+	for _, name := range names {
+		if strings.HasPrefix(name, "refs/heads/") {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// writePack uploads a pack of objects, and its index, then lists it in
+// objects/info/packs, so git can find it once the refs point into it.
+func (b *s3Bucket) writePack(ctx context.Context, repo *git.Repository, objects []plumbing.Hash, snapshot *s3Snapshot) (string, error) {
+	var pack bytes.Buffer
+
+	checksum, err := packfile.NewEncoder(&pack, repo.Storer, false).Encode(objects, 10)
+
+	if err != nil {
+		return "", err
+	}
+
+	writer := new(idxfile.Writer)
+	parser, err := packfile.NewParser(packfile.NewScanner(bytes.NewReader(pack.Bytes())), writer)
+
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := parser.Parse(); err != nil {
+		return "", err
+	}
+
+	index, err := writer.Index()
+
+	if err != nil {
+		return "", err
+	}
+
+	var idx bytes.Buffer
+
+	if _, err := idxfile.NewEncoder(&idx).Encode(index); err != nil {
+		return "", err
+	}
+
+	name := "pack-" + checksum.String()
+
+	if err := b.put(ctx, "objects/pack/"+name+".pack", pack.Bytes()); err != nil {
+		return "", err
+	}
+
+	if err := b.put(ctx, "objects/pack/"+name+".idx", idx.Bytes()); err != nil {
+		return "", err
+	}
+
+	if !slices.Contains(snapshot.packs, name+".pack") {
+		snapshot.packs = append(snapshot.packs, name+".pack")
+	}
+
+	return name + ".pack", b.writePackList(ctx, snapshot.packs)
+}
+
+func (b *s3Bucket) writePackList(ctx context.Context, packs []string) error {
+	var list strings.Builder
+
+	for _, pack := range packs {
+		list.WriteString("P " + pack + "\n")
+	}
+
+	list.WriteString("\n")
+
+	return b.put(ctx, "objects/info/packs", []byte(list.String()))
+}
+
+// s3Backend pushes to a snapshot in object storage. Each push uploads a
+// pack of the objects the snapshot doesn't have yet, then the refs; it
+// can't be fetched from, so such remotes are only ever targets.
+type s3Backend struct {
+	s *Syncer
+}
+
+func (b s3Backend) fetch(_ context.Context, _ *git.Repository, _, remote string, _ []config.RefSpec, _ *progressWriter) error {
+	return fmt.Errorf("%s remote is a snapshot in object storage, which can only be pushed to", remote)
+}
+
+func (b s3Backend) push(ctx context.Context, repo *git.Repository, remote string, refSpec config.RefSpec, progress *progressWriter) error {
+	if err := b.s.pushURLAllowed(b.s.effectiveURL(remote, true)); err != nil {
+		return err
+	}
+
+	bucket, err := b.s.s3BucketFor(remote)
+
+	if err != nil {
+		return err
+	}
+
+	// Each push rewrites the refs it read, so pushes of a run's branches
+	// mustn't overlap.
+	b.s.s3Mu.Lock()
+	defer b.s.s3Mu.Unlock()
+
+	snapshot, err := bucket.readSnapshot(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	dst := refSpec.Dst("")
+	old, exists := snapshot.refs[dst]
+
+	if refSpec.IsDelete() {
+		if !exists {
+			return nil
+		}
+
+		delete(snapshot.refs, dst)
+
+		return bucket.writeRefs(ctx, snapshot)
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(refSpec.Src()))
+
+	if err != nil {
+		return err
+	}
+
+	if exists && old == *hash {
+		return nil
+	}
+
+	if exists && !refSpec.IsForceUpdate() {
+		oldCommit, err := object.GetCommit(repo.Storer, old)
+
+		if err != nil {
+			return fmt.Errorf("%w: %s", git.ErrNonFastForwardUpdate, dst)
+		}
+
+		newCommit, err := object.GetCommit(repo.Storer, *hash)
+
+		if err != nil {
+			return err
+		}
+
+		if descends, err := oldCommit.IsAncestor(newCommit); err != nil || !descends {
+			return fmt.Errorf("%w: %s", git.ErrNonFastForwardUpdate, dst)
+		}
+	}
+
+	// Everything reachable from the snapshot's refs is in its packs, so
+	// only what isn't needs sending, as far as this repository can tell.
+	var have []plumbing.Hash
+
+	for _, tip := range snapshot.refs {
+		if _, err := repo.Storer.EncodedObject(plumbing.AnyObject, tip); err == nil && !slices.Contains(have, tip) {
+			have = append(have, tip)
+		}
+	}
+
+	objects, err := revlist.Objects(repo.Storer, []plumbing.Hash{*hash}, have)
+
+	if err != nil {
+		return err
+	}
+
+	if len(objects) > 0 {
+		if progress != nil {
+			fmt.Fprintf(progress, "uploading %d objects to %s\n", len(objects), remote)
+		}
+
+		if _, err := bucket.writePack(ctx, repo, objects, snapshot); err != nil {
+			return err
+		}
+	}
+
+	snapshot.refs[dst] = *hash
+
+	if err := bucket.writeRefs(ctx, snapshot); err != nil {
+		return err
+	}
+
+	if len(snapshot.packs) > gsS3MaxPacks {
+		b.repack(ctx, repo, remote, bucket, snapshot)
+	}
+
+	return nil
+}
+
+// repack replaces a snapshot's packs with a single one, once it has
+// collected too many for git to read it quickly. It needs every object the
+// snapshot has, so it's left for a later push when this repository doesn't
+// have them all; and since the snapshot is complete either way, failing is
+// only worth a warning.
+func (b s3Backend) repack(ctx context.Context, repo *git.Repository, remote string, bucket *s3Bucket, snapshot *s3Snapshot) {
+	var tips []plumbing.Hash
+
+	for _, tip := range snapshot.refs {
+		if _, err := repo.Storer.EncodedObject(plumbing.AnyObject, tip); err != nil {
+			return
+		}
+
+		if !slices.Contains(tips, tip) {
+			tips = append(tips, tip)
+		}
+	}
+
+	objects, err := revlist.Objects(repo.Storer, tips, nil)
+
+	if err == nil {
+		old := snapshot.packs
+		snapshot.packs = nil
+
+		var pack string
+
+		if pack, err = bucket.writePack(ctx, repo, objects, snapshot); err == nil {
+			for _, name := range old {
+				if name == pack {
+					continue
+				}
+
+				for _, key := range []string{name, strings.TrimSuffix(name, ".pack") + ".idx"} {
+					if err := bucket.delete(ctx, "objects/pack/"+key); err != nil {
+						b.s.warnPrintf("could not delete %s from %s after repacking: %s\n", key, remote, err)
+					}
+				}
+			}
+
+			b.s.debugPrintf("repacked %d packs on %s into %s\n", len(old), remote, pack)
+			return
+		}
+
+		snapshot.packs = old
+	}
+
+	b.s.warnPrintf("could not repack %s: %s\n", remote, err)
+}
+
+// listRefs reads the snapshot's refs.
+func (b s3Backend) listRefs(ctx context.Context, remote string, _ bool) ([]*plumbing.Reference, error) {
+	bucket, err := b.s.s3BucketFor(remote)
+
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := bucket.readSnapshot(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]*plumbing.Reference, 0, len(snapshot.refs))
+
+	for name, hash := range snapshot.refs {
+		refs = append(refs, plumbing.NewHashReference(name, hash))
+	}
+
+	return refs, nil
+}
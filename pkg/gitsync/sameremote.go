@@ -0,0 +1,49 @@
+package gitsync
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errSameRemote = errors.New("source and target are the same repository")
+
+// checkSameRemote refuses a sync entry that pulls from and pushes to the
+// same remote, unless it allows that.
+func checkSameRemote(i int, sync SyncEntry) bool {
+	if sync.Source != sync.Target {
+		return true
+	}
+
+	if sync.AllowSameRemote {
+		warnPrintf("sync entry %d pulls from and pushes to %s\n", i, sync.Source)
+		return true
+	}
+
+	errorPrintf("sync entry %d has %s as both source_remote and target_remote, set allow_same_remote if that is intended\n", i, sync.Source)
+
+	return false
+}
+
+// sameRemoteURL returns an error if the entry's source and target are
+// different remotes that, after URL rewriting, fetch from and push to the
+// same repository. It only warns if the entry allows that.
+func (s *Syncer) sameRemoteURL(sync SyncEntry) error {
+	if sync.Source == sync.Target {
+		return nil
+	}
+
+	source, target := s.effectiveURL(sync.Source, false), s.effectiveURL(sync.Target, true)
+
+	if source == "" || urlKey(source) != urlKey(target) {
+		return nil
+	}
+
+	err := fmt.Errorf("%w: %s and %s both point at %s", errSameRemote, sync.Source, sync.Target, redactURL(target))
+
+	if sync.AllowSameRemote {
+		s.warnPrintf("%s\n", err)
+		return nil
+	}
+
+	return err
+}
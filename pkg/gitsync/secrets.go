@@ -0,0 +1,45 @@
+package gitsync
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+)
+
+const gsSecretKeyring string = "keyring:"
+const gsSecretFile string = "file:"
+
+// resolveSecret turns a secret reference from the config into its value.
+// "keyring:<service>/<account>" reads from the OS keyring (macOS Keychain,
+// Windows Credential Manager or the Secret Service on Linux), "file:<path>"
+// reads the trimmed contents of a file, and anything else is used verbatim.
+func resolveSecret(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, gsSecretKeyring):
+		service, account, found := strings.Cut(strings.TrimPrefix(ref, gsSecretKeyring), "/")
+
+		if !found || service == "" || account == "" {
+			return "", fmt.Errorf("keyring reference %s is not of the form keyring:<service>/<account>", ref)
+		}
+
+		secret, err := keyring.Get(service, account)
+
+		if err != nil {
+			return "", fmt.Errorf("could not read %s/%s from the keyring: %w", service, account, err)
+		}
+
+		return secret, nil
+	case strings.HasPrefix(ref, gsSecretFile):
+		secret, err := os.ReadFile(strings.TrimPrefix(ref, gsSecretFile))
+
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(string(secret)), nil
+	}
+
+	return ref, nil
+}
@@ -0,0 +1,183 @@
+package gitsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// sentryTarget is a parsed DSN of the form https://<key>@<host>/<project>.
+type sentryTarget struct {
+	storeURL string
+	key      string
+}
+
+// setSentryDSN enables error reporting, taking the DSN from the config or
+// the standard SENTRY_DSN environment variable.
+func (s *Syncer) setSentryDSN(dsn string) bool {
+	if dsn == "" {
+		dsn = os.Getenv("SENTRY_DSN")
+	}
+
+	if dsn == "" {
+		return true
+	}
+
+	dsn, err := resolveSecret(dsn)
+
+	if err != nil {
+		errorPrintf("sentry dsn: %s\n", err)
+		return false
+	}
+
+	parsed, err := url.Parse(dsn)
+
+	if err != nil || parsed.User == nil || parsed.Host == "" {
+		errorPrintf("sentry dsn is not of the form https://<key>@<host>/<project>\n")
+		return false
+	}
+
+	path := strings.Trim(parsed.Path, "/")
+	project := path
+	prefix := ""
+
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		prefix = "/" + path[:i]
+		project = path[i+1:]
+	}
+
+	if project == "" {
+		errorPrintf("sentry dsn has no project\n")
+		return false
+	}
+
+	s.sentry = &sentryTarget{
+		storeURL: fmt.Sprintf("%s://%s%s/api/%s/store/", parsed.Scheme, parsed.Host, prefix, project),
+		key:      parsed.User.Username(),
+	}
+
+	return true
+}
+
+type sentryEvent struct {
+	EventID    string                 `json:"event_id"`
+	Timestamp  string                 `json:"timestamp"`
+	Level      string                 `json:"level"`
+	Logger     string                 `json:"logger"`
+	Platform   string                 `json:"platform"`
+	Release    string                 `json:"release,omitempty"`
+	ServerName string                 `json:"server_name"`
+	Message    string                 `json:"message"`
+	Tags       map[string]string      `json:"tags"`
+	Extra      map[string]interface{} `json:"extra,omitempty"`
+}
+
+// captureSentry sends a single event using Sentry's store endpoint, which
+// GlitchTip and other compatible trackers also accept.
+func (s *Syncer) captureSentry(level, message string, tags map[string]string, extra map[string]interface{}) {
+	if s.sentry == nil {
+		return
+	}
+
+	host, _ := os.Hostname()
+	tags["repository"] = s.repoDir
+	tags["run_id"] = s.run.ID
+
+	event := sentryEvent{
+		EventID:    randomHex(16),
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Level:      level,
+		Logger:     "gitsync",
+		Platform:   "go",
+		Release:    Version,
+		ServerName: host,
+		Message:    message,
+		Tags:       tags,
+		Extra:      extra,
+	}
+
+	body, err := json.Marshal(event)
+
+	if err != nil {
+		s.warnPrintf("could not encode sentry event: %s\n", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.sentry.storeURL, bytes.NewReader(body))
+
+	if err != nil {
+		s.warnPrintf("could not report to sentry: %s\n", err)
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=gitsync/%s, sentry_key=%s", Version, s.sentry.key))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+
+	if err != nil {
+		s.warnPrintf("could not report to sentry: %s\n", err)
+		return
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		s.warnPrintf("could not report to sentry: %s\n", resp.Status)
+		return
+	}
+
+	s.debugPrintf("reported %s to sentry as %s\n", level, event.EventID)
+}
+
+// reportSyncFailures sends an event for a run that stopped early and for
+// every sync entry of the run that was skipped or had a branch fail, with the
+// failing branches as extra context.
+func (s *Syncer) reportSyncFailures() {
+	if s.sentry == nil {
+		return
+	}
+
+	if s.run.Err != nil {
+		s.captureSentry("error", fmt.Sprintf("run stopped: %s", s.run.Err), map[string]string{}, map[string]interface{}{})
+	}
+
+	for _, result := range s.run.Syncs {
+		if result.Status == StatusSynced {
+			continue
+		}
+
+		branches := map[string]interface{}{}
+
+		for _, branch := range result.Branches {
+			if branch.Status != StatusSynced && branch.Status != StatusUpToDate {
+				branches[branch.Branch] = map[string]string{
+					"status":  branch.Status,
+					"old_sha": branch.OldSHA,
+					"new_sha": branch.NewSHA,
+					"error":   errorString(branch.Err),
+				}
+			}
+		}
+
+		s.captureSentry("error", fmt.Sprintf("sync from %s to %s %s: %s", result.Source, result.Target, result.Status, errorString(result.Err)),
+			map[string]string{"sync_id": result.ID, "source_remote": result.Source, "target_remote": result.Target, "status": result.Status},
+			map[string]interface{}{"branches": branches})
+	}
+}
+
+// ReportPanic is deferred by callers to send a panic to the Syncer's Sentry
+// before letting it crash the process as usual.
+func (s *Syncer) ReportPanic() {
+	if r := recover(); r != nil {
+		s.captureSentry("fatal", fmt.Sprintf("panic: %v", r), map[string]string{}, map[string]interface{}{"stack": string(debug.Stack())})
+		panic(r)
+	}
+}
@@ -0,0 +1,199 @@
+package gitsync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// gsSharedPrefix is where the shared objects keep the branches fetched into
+// them, under the source repository they came from, so everything fetched
+// stays reachable there.
+const gsSharedPrefix string = "refs/gitsync/shared/"
+
+func (s *Syncer) checkSharedObjects() bool {
+	switch {
+	case s.config.SharedObjects == "":
+		return true
+	case s.fs != nil:
+		errorPrintf("shared_objects needs the repository on disk\n")
+		return false
+	case !filepath.IsAbs(s.config.SharedObjects):
+		errorPrintf("shared_objects must be an absolute path: %s\n", s.config.SharedObjects)
+		return false
+	}
+
+	return true
+}
+
+// openSharedObjects opens the bare repository whose objects are shared,
+// creating it the first time.
+func (s *Syncer) openSharedObjects() (*git.Repository, error) {
+	dir := s.config.SharedObjects
+	shared, err := git.PlainOpen(dir)
+
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		s.infoPrintf("creating shared objects in %s\n", dir)
+		shared, err = git.PlainInit(dir, true)
+	}
+
+	if err == nil {
+		shared, err = s.boundMemory(shared)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not open shared objects %s: %w", dir, err)
+	}
+
+	return shared, nil
+}
+
+// borrowObjects makes repo read the objects it doesn't have from shared.
+// They are listed in its alternates for git itself, but go-git's support for
+// alternates misses some of the lookups a push makes, so repo's storage is
+// also wrapped to fall back to shared's.
+func borrowObjects(repo, shared *git.Repository, objects string) (*git.Repository, error) {
+	local, ok := repo.Storer.(*filesystem.Storage)
+
+	if !ok {
+		return nil, errors.New("repository isn't on disk")
+	}
+
+	if err := addAlternate(local, objects); err != nil {
+		return nil, fmt.Errorf("could not share objects from %s: %w", objects, err)
+	}
+
+	var checkout billy.Filesystem
+
+	if worktree, err := repo.Worktree(); err == nil {
+		checkout = worktree.Filesystem
+	} else if !errors.Is(err, git.ErrIsBareRepository) {
+		return nil, err
+	}
+
+	return git.Open(borrowingStorage{Storage: local, shared: shared.Storer}, checkout)
+}
+
+// addAlternate lists objects in the repository's objects/info/alternates,
+// unless it already is.
+func addAlternate(local *filesystem.Storage, objects string) error {
+	dotGit := local.Filesystem()
+	file, err := dotGit.OpenFile(dotGit.Join("objects", "info", "alternates"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	existing, err := io.ReadAll(file)
+
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(existing), "\n") {
+		if strings.TrimSpace(line) == objects {
+			return nil
+		}
+	}
+
+	if len(existing) > 0 && !strings.HasSuffix(string(existing), "\n") {
+		objects = "\n" + objects
+	}
+
+	_, err = io.WriteString(file, objects+"\n")
+
+	return err
+}
+
+// borrowingStorage is a repository's storage that looks objects it doesn't
+// have up in the shared objects.
+type borrowingStorage struct {
+	*filesystem.Storage
+	shared storage.Storer
+}
+
+func (b borrowingStorage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	object, err := b.Storage.EncodedObject(t, h)
+
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return b.shared.EncodedObject(t, h)
+	}
+
+	return object, err
+}
+
+func (b borrowingStorage) DeltaObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	object, err := b.Storage.DeltaObject(t, h)
+
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return b.shared.EncodedObject(t, h)
+	}
+
+	return object, err
+}
+
+func (b borrowingStorage) HasEncodedObject(h plumbing.Hash) error {
+	err := b.Storage.HasEncodedObject(h)
+
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return b.shared.HasEncodedObject(h)
+	}
+
+	return err
+}
+
+func (b borrowingStorage) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	size, err := b.Storage.EncodedObjectSize(h)
+
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return b.shared.EncodedObjectSize(h)
+	}
+
+	return size, err
+}
+
+// sharedRef is where branch of source's repository is fetched to in the
+// shared objects. Repositories syncing from the same source share the ref,
+// as they would its objects.
+func (s *Syncer) sharedRef(source, branch string) plumbing.ReferenceName {
+	key := strings.Trim(urlKey(s.effectiveURL(source, false)), "/")
+	ref := plumbing.ReferenceName(gsSharedPrefix + key + "/heads/" + branch)
+
+	if key == "" || ref.Validate() != nil {
+		sum := sha256.Sum256([]byte(key))
+		ref = plumbing.ReferenceName(gsSharedPrefix + hex.EncodeToString(sum[:8]) + "/heads/" + branch)
+	}
+
+	return ref
+}
+
+// linkShared points source's tracking refs in repo at what was fetched into
+// the shared objects, whose objects repo borrows.
+func (s *Syncer) linkShared(repo, shared *git.Repository, source string, branches []string) error {
+	for _, branch := range branches {
+		fetched, err := shared.Reference(s.sharedRef(source, branch), true)
+
+		if err != nil {
+			return fmt.Errorf("could not read %s from the shared objects: %w", branch, err)
+		}
+
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(trackingRef(source, branch), fetched.Hash())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package gitsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/go-git/go-billy/v5"
+)
+
+// A config file's detached signature is looked for next to it, binary as
+// made by gpg --detach-sign or armored as made with --armor.
+var gsSignatureExtensions = []string{".sig", ".asc"}
+
+// ErrUnsignedConfig is returned for a config file without a signature when
+// one is required.
+var ErrUnsignedConfig = errors.New("config is not signed")
+
+// ReadTrustedKeys reads the OpenPGP public keys config signatures are
+// trusted from, armored or binary, e.g. from gpg --export.
+func ReadTrustedKeys(path string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+
+	if err != nil {
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read trusted keys from %s: %w", path, err)
+	}
+
+	return keys, nil
+}
+
+// verifyConfigSignature checks the detached signature next to path was made
+// over config by one of keys. A missing signature is only an error when
+// required.
+func verifyConfigSignature(fs billy.Basic, path string, config []byte, keys openpgp.EntityList, required bool) error {
+	for _, extension := range gsSignatureExtensions {
+		file, err := fs.Open(path + extension)
+
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		signature, err := io.ReadAll(file)
+		file.Close()
+
+		if err != nil {
+			return err
+		}
+
+		check := openpgp.CheckDetachedSignature
+
+		if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN")) {
+			check = openpgp.CheckArmoredDetachedSignature
+		}
+
+		signer, err := check(keys, bytes.NewReader(config), bytes.NewReader(signature), nil)
+
+		if err != nil {
+			return fmt.Errorf("bad signature %s%s: %w", path, extension, err)
+		}
+
+		debugPrintf("config %s is signed by %X\n", path, signer.PrimaryKey.Fingerprint)
+
+		return nil
+	}
+
+	if required {
+		return fmt.Errorf("%w: no %s.sig or %s.asc", ErrUnsignedConfig, path, path)
+	}
+
+	warnPrintf("config %s isn't signed\n", path)
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package gitsync
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+func testKey(t *testing.T, name string) *openpgp.Entity {
+	t.Helper()
+
+	key, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestVerifyConfigSignature(t *testing.T) {
+	trusted, untrusted := testKey(t, "trusted"), testKey(t, "untrusted")
+	config := []byte(`{"sync": []}`)
+
+	sign := func(key *openpgp.Entity, armored bool, data []byte) []byte {
+		var signature bytes.Buffer
+		var err error
+
+		if armored {
+			err = openpgp.ArmoredDetachSign(&signature, key, bytes.NewReader(data), nil)
+		} else {
+			err = openpgp.DetachSign(&signature, key, bytes.NewReader(data), nil)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return signature.Bytes()
+	}
+
+	tests := []struct {
+		name       string
+		signatures map[string][]byte
+		required   bool
+		err        error
+		ok         bool
+	}{
+		{"binary", map[string][]byte{".sig": sign(trusted, false, config)}, true, nil, true},
+		{"armored", map[string][]byte{".asc": sign(trusted, true, config)}, true, nil, true},
+		{"untrusted key", map[string][]byte{".sig": sign(untrusted, false, config)}, false, nil, false},
+		{"other config", map[string][]byte{".asc": sign(trusted, true, []byte(`{"sync": null}`))}, false, nil, false},
+		{"garbage", map[string][]byte{".sig": []byte("not a signature")}, false, nil, false},
+		{"bad .sig before good .asc", map[string][]byte{".sig": sign(untrusted, false, config), ".asc": sign(trusted, true, config)}, false, nil, false},
+		{"unsigned", nil, false, nil, true},
+		{"unsigned but required", nil, true, ErrUnsignedConfig, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs := memfs.New()
+
+			for extension, signature := range test.signatures {
+				if err := util.WriteFile(fs, "gitsync.json"+extension, signature, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := verifyConfigSignature(fs, "gitsync.json", config, openpgp.EntityList{trusted}, test.required)
+
+			if (err == nil) != test.ok || (test.err != nil && !errors.Is(err, test.err)) {
+				t.Errorf("got %v, want ok %t (%v)", err, test.ok, test.err)
+			}
+		})
+	}
+}
+
+func TestReadTrustedKeys(t *testing.T) {
+	key := testKey(t, "trusted")
+
+	var binary, armored bytes.Buffer
+
+	if err := key.Serialize(&binary); err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := key.Serialize(writer); err != nil {
+		t.Fatal(err)
+	}
+
+	writer.Close()
+
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"binary", binary.Bytes(), true},
+		{"armored", armored.Bytes(), true},
+		{"garbage", []byte("not a key"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys")
+
+			if err := os.WriteFile(path, test.data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			keys, err := ReadTrustedKeys(path)
+
+			if (err == nil) != test.ok {
+				t.Fatalf("got %v, want ok %t", err, test.ok)
+			}
+
+			if test.ok && (len(keys) != 1 || keys[0].PrimaryKey.KeyId != key.PrimaryKey.KeyId) {
+				t.Errorf("got %d keys, want the one written", len(keys))
+			}
+		})
+	}
+}
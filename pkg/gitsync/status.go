@@ -0,0 +1,319 @@
+package gitsync
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// BranchStatus is where a configured branch stands: how the target's tip
+// compares to the source's, and what the last run recorded in the history
+// did with it.
+type BranchStatus struct {
+	Source    string
+	Target    string
+	Branch    string
+	SourceSHA string
+	TargetSHA string
+	// Ahead is how many commits the target has that the source doesn't,
+	// and Behind how many the source has that the target doesn't. They are
+	// only Counted when both tips are in the repository.
+	Ahead   int
+	Behind  int
+	Counted bool
+	// LastRun is nil when the history has no run that synced the branch,
+	// or there's no history.
+	LastRun *LastRun
+	Err     error
+}
+
+// LastRun is the last run recorded in the history for a branch.
+type LastRun struct {
+	RunID    string
+	Finished time.Time
+	Status   string
+	SHA      string
+	Error    string
+}
+
+// StatusReport is the status of every configured branch.
+type StatusReport struct {
+	History  bool
+	Branches []*BranchStatus
+}
+
+type reportLastRun struct {
+	RunID    string    `json:"run_id"`
+	Finished time.Time `json:"finished"`
+	Status   string    `json:"status"`
+	SHA      string    `json:"sha,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type reportStatus struct {
+	Source    string         `json:"source_remote"`
+	Target    string         `json:"target_remote"`
+	Branch    string         `json:"branch"`
+	SourceSHA string         `json:"source_sha,omitempty"`
+	TargetSHA string         `json:"target_sha,omitempty"`
+	Ahead     *int           `json:"ahead"`
+	Behind    *int           `json:"behind"`
+	LastRun   *reportLastRun `json:"last_run"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// WriteJSON writes the report as JSON to w.
+func (r *StatusReport) WriteJSON(w io.Writer) error {
+	branches := []reportStatus{}
+
+	for _, status := range r.Branches {
+		branch := reportStatus{
+			Source:    status.Source,
+			Target:    status.Target,
+			Branch:    status.Branch,
+			SourceSHA: status.SourceSHA,
+			TargetSHA: status.TargetSHA,
+			Error:     errorString(status.Err),
+		}
+
+		if status.Counted {
+			branch.Ahead, branch.Behind = &status.Ahead, &status.Behind
+		}
+
+		if run := status.LastRun; run != nil {
+			branch.LastRun = &reportLastRun{RunID: run.RunID, Finished: run.Finished, Status: run.Status, SHA: run.SHA, Error: run.Error}
+		}
+
+		branches = append(branches, branch)
+	}
+
+	report, err := json.MarshalIndent(map[string]interface{}{
+		"version":  Version,
+		"history":  r.History,
+		"branches": branches,
+	}, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(report, '\n'))
+
+	return err
+}
+
+// Status lists every configured branch's source and target tips, fetching
+// the sources so that how far the target is ahead or behind counts their
+// latest commits, and looks up the last run of each branch in the history.
+// Like Check, nothing is pushed and no branch is moved; a remote that can't
+// be listed or fetched only fails its own branches.
+func (s *Syncer) Status(ctx context.Context) (*StatusReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.collectRepoInfo(); err != nil {
+		return nil, err
+	}
+
+	defer s.closeSSHConnections()
+
+	// Status isn't a run, so failures are only logged.
+	subscribers := s.subscribers
+	s.subscribers = []func(Event){s.logEvent}
+	defer func() { s.subscribers = subscribers }()
+
+	s.run = &RunResult{ID: randomHex(8), Repository: s.repoDir, ConfigChecksum: s.configChecksum, Started: time.Now()}
+	s.unchanged = nil
+
+	var checks []preflightCheck
+	seen := map[preflightCheck]bool{}
+
+	for _, entry := range s.config.Sync {
+		for _, check := range []preflightCheck{{entry.Source, false}, {entry.Target, true}} {
+			if !seen[check] && s.remoteExists(check.remote) {
+				seen[check] = true
+				checks = append(checks, check)
+			}
+		}
+	}
+
+	heads, failed := s.listHeads(ctx, checks)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.remoteRefs = map[preflightCheck]map[plumbing.ReferenceName]plumbing.Hash{}
+
+	for check, listed := range heads {
+		if !check.push {
+			s.remoteRefs[check] = map[plumbing.ReferenceName]plumbing.Hash{}
+
+			for name, sha := range listed {
+				s.remoteRefs[check][name] = plumbing.NewHash(sha)
+			}
+		}
+	}
+
+	s.fetchSources(ctx, nil)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	repo, err := s.openRepo()
+
+	if err != nil {
+		return nil, err
+	}
+
+	report := &StatusReport{History: s.history != nil}
+
+	for _, sync := range s.config.Sync {
+		source, target := preflightCheck{sync.Source, false}, preflightCheck{sync.Target, true}
+		var err error
+
+		switch {
+		case !s.remoteExists(sync.Source):
+			err = fmt.Errorf("%s source remote doesn't exist", sync.Source)
+		case !s.remoteExists(sync.Target):
+			err = fmt.Errorf("%s target remote doesn't exist", sync.Target)
+		case failed[source] != nil:
+			err = failed[source]
+		case failed[target] != nil:
+			err = failed[target]
+		case s.fetched[sync.Source] != nil && s.fetched[sync.Source].Err != nil:
+			err = fmt.Errorf("could not fetch %s: %w", sync.Source, s.fetched[sync.Source].Err)
+		}
+
+		for _, branch := range sync.Branches {
+			branchRef := plumbing.NewBranchReferenceName(branch)
+			status := &BranchStatus{
+				Source:    sync.Source,
+				Target:    sync.Target,
+				Branch:    branch,
+				SourceSHA: heads[source][branchRef],
+				TargetSHA: heads[target][branchRef],
+				Err:       err,
+			}
+
+			if status.Err == nil && status.SourceSHA == "" {
+				status.Err = fmt.Errorf("%s doesn't exist on %s", branch, sync.Source)
+			}
+
+			if status.Err == nil && status.TargetSHA != "" {
+				status.Ahead, status.Behind, status.Counted = aheadBehind(repo, status.TargetSHA, status.SourceSHA)
+			}
+
+			lastRun, historyErr := s.lastRun(sync.Source, sync.Target, branch)
+
+			if historyErr != nil {
+				return nil, fmt.Errorf("could not read the history: %w", historyErr)
+			}
+
+			status.LastRun = lastRun
+			report.Branches = append(report.Branches, status)
+		}
+	}
+
+	return report, nil
+}
+
+// aheadBehind counts the commits reachable from target but not source, and
+// from source but not target, stopping at gsMaxCountedCommits. It reports
+// false when either commit isn't in the repository, as a target's tip that
+// was pushed by someone else may not be.
+func aheadBehind(repo *git.Repository, targetSHA, sourceSHA string) (int, int, bool) {
+	targetCommit, err := repo.CommitObject(plumbing.NewHash(targetSHA))
+
+	if err != nil {
+		return 0, 0, false
+	}
+
+	sourceCommit, err := repo.CommitObject(plumbing.NewHash(sourceSHA))
+
+	if err != nil {
+		return 0, 0, false
+	}
+
+	bases, err := targetCommit.MergeBase(sourceCommit)
+
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var ignore []plumbing.Hash
+
+	for _, base := range bases {
+		ignore = append(ignore, base.Hash)
+	}
+
+	ahead, err := countFrom(targetCommit, ignore)
+
+	if err != nil {
+		return 0, 0, false
+	}
+
+	behind, err := countFrom(sourceCommit, ignore)
+
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return ahead, behind, true
+}
+
+// countFrom counts the commits reachable from commit without going through
+// the commits in ignore.
+func countFrom(commit *object.Commit, ignore []plumbing.Hash) (int, error) {
+	count := 0
+	err := object.NewCommitPreorderIter(commit, nil, ignore).ForEach(func(*object.Commit) error {
+		if count++; count >= gsMaxCountedCommits {
+			return storer.ErrStop
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// lastRun looks up the last run in the history that synced a branch of the
+// Syncer's repository, since one history can be shared by the runs of
+// several.
+func (s *Syncer) lastRun(source, target, branch string) (*LastRun, error) {
+	if s.history == nil {
+		return nil, nil
+	}
+
+	var run LastRun
+	var finished string
+
+	err := s.history.QueryRow(`SELECT r.run_id, r.finished, b.status, b.new_sha, b.error
+		FROM branches b JOIN runs r ON r.run_id = b.run_id
+		WHERE r.repository = ? AND b.source_remote = ? AND b.target_remote = ? AND b.branch = ?
+		ORDER BY r.started DESC LIMIT 1`, s.repoDir, source, target, branch).Scan(&run.RunID, &finished, &run.Status, &run.SHA, &run.Error)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if run.Finished, err = time.Parse(gsHistoryTimeFormat, finished); err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
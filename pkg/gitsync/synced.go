@@ -0,0 +1,148 @@
+package gitsync
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// gsSyncedFile is where skip_unchanged keeps the branches last synced, in
+// the repository's git directory.
+const gsSyncedFile string = "gitsync/synced.json"
+
+// syncedState is what skip_unchanged remembers between runs: the source tip
+// each branch was last synced to its target at, and the config it was
+// synced with.
+type syncedState struct {
+	ConfigChecksum string         `json:"config_checksum"`
+	Branches       []syncedBranch `json:"branches"`
+}
+
+type syncedBranch struct {
+	Source string `json:"source_remote"`
+	Target string `json:"target_remote"`
+	Branch string `json:"branch"`
+	SHA    string `json:"sha"`
+}
+
+func syncedKey(source, target, branch string) string {
+	return source + "\x00" + target + "\x00" + branch
+}
+
+// dotGit is the repository's git directory.
+func (s *Syncer) dotGit() (billy.Filesystem, error) {
+	repo, err := s.openRepo()
+
+	if err != nil {
+		return nil, err
+	}
+
+	storage, ok := repo.Storer.(interface{ Filesystem() billy.Filesystem })
+
+	if !ok {
+		return nil, errors.New("repository isn't on a filesystem")
+	}
+
+	return storage.Filesystem(), nil
+}
+
+// loadSynced finds the branches whose source hasn't moved since they were
+// last synced, and whose target still has them where they were synced to,
+// going by the preflight check's listing of the sources and targets, so the
+// run can skip them. A target reset, force pushed or with the branch
+// deleted behind gitsync's back is synced again. Everything is synced again once the config changes,
+// and a run applying a plan skips nothing it plans to change, nor one
+// applying bundles or patches anything they carry.
+func (s *Syncer) loadSynced() {
+	s.unchanged = map[string]string{}
+	s.synced = map[string]string{}
+
+	if !s.config.SkipUnchanged || s.plan != nil || s.offline() {
+		return
+	}
+
+	var state syncedState
+	dotGit, err := s.dotGit()
+
+	if err == nil {
+		var data []byte
+
+		if data, err = util.ReadFile(dotGit, gsSyncedFile); err == nil {
+			err = json.Unmarshal(data, &state)
+		}
+	}
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return
+	case err != nil:
+		s.warnPrintf("could not read which branches were last synced, syncing them all: %s\n", err)
+		return
+	case state.ConfigChecksum != s.configChecksum:
+		s.debugPrintf("the config has changed since branches were last synced, syncing them all\n")
+		return
+	}
+
+	for _, branch := range state.Branches {
+		ref := plumbing.NewBranchReferenceName(branch.Branch)
+		sourceHash, onSource := s.remoteRefs[preflightCheck{branch.Source, false}][ref]
+		targetHash, onTarget := s.remoteRefs[preflightCheck{branch.Target, true}][ref]
+
+		if onSource && onTarget && sourceHash.String() == branch.SHA && targetHash.String() == branch.SHA {
+			s.unchanged[syncedKey(branch.Source, branch.Target, branch.Branch)] = branch.SHA
+		}
+	}
+}
+
+// recordSynced remembers that branch was synced to target at sha, if that
+// is the tip the preflight check saw on source.
+func (s *Syncer) recordSynced(source, target, branch, sha string) {
+	heads := s.remoteRefs[preflightCheck{source, false}]
+
+	if hash, exists := heads[plumbing.NewBranchReferenceName(branch)]; s.config.SkipUnchanged && exists && hash.String() == sha {
+		s.synced[syncedKey(source, target, branch)] = sha
+	}
+}
+
+// saveSynced writes the branches the run synced, or skipped as unchanged,
+// for the next run. Branches that failed are left out, so they are synced
+// again.
+func (s *Syncer) saveSynced() error {
+	if !s.config.SkipUnchanged {
+		return nil
+	}
+
+	state := syncedState{ConfigChecksum: s.configChecksum, Branches: []syncedBranch{}}
+
+	for _, sync := range s.config.Sync {
+		for _, branch := range sync.Branches {
+			if sha, synced := s.synced[syncedKey(sync.Source, sync.Target, branch)]; synced {
+				state.Branches = append(state.Branches, syncedBranch{Source: sync.Source, Target: sync.Target, Branch: branch, SHA: sha})
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	dotGit, err := s.dotGit()
+
+	if err != nil {
+		return err
+	}
+
+	// Written aside and renamed over, so a run stopped halfway never leaves
+	// a half written file.
+	if err := util.WriteFile(dotGit, gsSyncedFile+".tmp", append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+
+	return dotGit.Rename(gsSyncedFile+".tmp", gsSyncedFile)
+}
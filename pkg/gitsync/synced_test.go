@@ -0,0 +1,65 @@
+package gitsync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestSkipUnchangedChecksTheTarget(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, target *git.Repository, initial plumbing.Hash)
+		status string
+	}{
+		{"untouched", func(*testing.T, *git.Repository, plumbing.Hash) {}, StatusUpToDate},
+		{"reset", func(t *testing.T, target *git.Repository, initial plumbing.Hash) {
+			setTestBranch(t, target, "main", initial)
+		}, StatusSynced},
+		{"deleted", func(t *testing.T, target *git.Repository, _ plumbing.Hash) {
+			if err := target.Storer.RemoveReference(plumbing.NewBranchReferenceName("main")); err != nil {
+				t.Fatal(err)
+			}
+		}, StatusSynced},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, source, target, initial := testRepos(t, "main")
+			next := testCommit(t, source, "next", initial)
+			setTestBranch(t, source, "main", next)
+
+			config := Config{SkipUnchanged: true, Sync: []SyncEntry{{Source: "source", Target: "target", Branches: []string{"main"}}}}
+
+			for run := 0; run < 2; run++ {
+				syncer, err := New(config, Options{RepoDir: dir, Progress: ProgressNone})
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				result, _ := syncer.Run(context.Background())
+				branch := testBranchResult(t, result, "main")
+
+				if run == 0 {
+					if branch.Status != StatusSynced {
+						t.Fatalf("first run got %s (%v)", branch.Status, branch.Err)
+					}
+
+					test.tamper(t, target, initial)
+					continue
+				}
+
+				if branch.Status != test.status {
+					t.Errorf("got %s (%v), want %s", branch.Status, branch.Err, test.status)
+				}
+			}
+
+			if got := testBranchSHA(t, target, "main"); got != next {
+				t.Errorf("target main is %s, want %s", ShortSHA(got.String()), ShortSHA(next.String()))
+			}
+		})
+	}
+}
@@ -0,0 +1,1119 @@
+package gitsync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Version is reported in run reports, traces and error events. The CLI sets
+// it from its build information.
+var Version string
+
+// Config is the gitsync configuration file.
+type Config struct {
+	Remotes        map[string]Remote     `json:"remotes"`
+	URLRewrites    map[string]URLRewrite `json:"url_rewrites"`
+	MetricsPush    *MetricsPush          `json:"metrics_push"`
+	Notifications  []Notification        `json:"notifications"`
+	HealthcheckURL string                `json:"healthcheck_url"`
+	SentryDSN      string                `json:"sentry_dsn"`
+	Hooks          Hooks                 `json:"hooks"`
+	Filters        []ScriptFilter        `json:"filters"`
+	Policy         *Policy               `json:"policy"`
+	OnRewrite      string                `json:"on_rewrite"`
+	MaxChange      *MaxChange            `json:"max_change"`
+	// SharedObjects is a bare repository, created if need be, that branches
+	// are fetched into and whose objects the repository borrows, so
+	// repositories sharing history, like forks, store and fetch it once.
+	SharedObjects string `json:"shared_objects"`
+	// AllowDestructive lets force pushes and ref deletions go ahead when
+	// there is no one to confirm them.
+	AllowDestructive bool `json:"allow_destructive"`
+	// SkipUnchanged remembers the source tip each branch was last synced
+	// at, and skips branches whose source hasn't moved since without
+	// fetching, checking the target or pushing.
+	SkipUnchanged bool `json:"skip_unchanged"`
+	// Memory bounds how much memory syncing takes.
+	Memory *Memory `json:"memory"`
+	// GitLabSystemHook adds GitLab projects to the sync set as they are
+	// created or pushed to.
+	GitLabSystemHook *GitLabSystemHook `json:"gitlab_system_hook"`
+	// Kafka sends an event for every ref updated to a Kafka topic.
+	Kafka *Kafka `json:"kafka"`
+	// Alert pages someone when a sync entry keeps failing or goes stale.
+	Alert *Alert      `json:"alert"`
+	Sync  []SyncEntry `json:"sync"`
+}
+
+// ErrInvalidConfigJSON is returned by ReadConfig for a config file that
+// could be read but isn't valid JSON for a Config.
+var ErrInvalidConfigJSON = errors.New("invalid config JSON")
+
+// ReadConfig reads and parses the config file at path on fs.
+func ReadConfig(fs billy.Basic, path string) (Config, error) {
+	var config Config
+
+	file, err := fs.Open(path)
+
+	if err != nil {
+		return config, err
+	}
+
+	defer file.Close()
+
+	tuples, err := io.ReadAll(file)
+
+	if err != nil {
+		return config, err
+	}
+
+	return parseConfig(tuples)
+}
+
+// SyncEntry mirrors branches from one remote of the repository to another.
+type SyncEntry struct {
+	Source   string         `json:"source_remote"`
+	Target   string         `json:"target_remote"`
+	Branches []string       `json:"branches"`
+	Hooks    Hooks          `json:"hooks"`
+	Filters  []ScriptFilter `json:"filters"`
+	// OnRewrite overrides the global on_rewrite for this entry.
+	OnRewrite string `json:"on_rewrite"`
+	// Atomic makes the entry's branches all or nothing: once one fails,
+	// the rest aren't synced and those already pushed are rolled back.
+	Atomic bool `json:"atomic"`
+	// AllowSameRemote only warns about a source and target that are the
+	// same remote or URL, rather than refusing the entry.
+	AllowSameRemote bool `json:"allow_same_remote"`
+	// ViaPR pushes each branch to a staging branch and opens a pull
+	// request from it to the branch, rather than pushing to the branch.
+	ViaPR *PullRequest `json:"via_pr"`
+	// FailureIssue files an issue on the target once the entry has failed
+	// several runs in a row.
+	FailureIssue *FailureIssue `json:"failure_issue"`
+	// Gerrit pushes each branch to Gerrit for review, rather than to the
+	// branch.
+	Gerrit *Gerrit `json:"gerrit"`
+	// Alert overrides the global alert for this entry.
+	Alert *Alert `json:"alert"`
+}
+
+// Options configures a Syncer beyond what the config file holds. The zero
+// value syncs the working directory with none of the optional outputs.
+type Options struct {
+	// RepoDir is the checkout to sync, defaulting to the working directory.
+	RepoDir string
+	// Filesystem holds the checkout instead of RepoDir on disk, with the
+	// repository in its .git directory, e.g. a memfs in tests. RepoDir
+	// then only names the repository in reports; hooks still run there and
+	// the git backend can't be used.
+	Filesystem billy.Filesystem
+	// AuditLog is a hash-chained log every ref change is appended to.
+	AuditLog string
+	// HistoryDB is a SQLite database every run is recorded in.
+	HistoryDB string
+	// OTLPEndpoint is the collector traces are exported to, defaulting to
+	// $OTEL_EXPORTER_OTLP_ENDPOINT.
+	OTLPEndpoint string
+	// Progress is how fetch and push progress is shown: ProgressAuto (the
+	// default), ProgressBar, ProgressLog or ProgressNone.
+	Progress string
+	// ProgressInterval is how often ProgressLog logs, defaulting to 10s.
+	ProgressInterval time.Duration
+	// FailFast stops a run at the first branch or sync entry that fails,
+	// rather than recording the failure and carrying on.
+	FailFast bool
+	// ConfirmLargeChange lets a run go over the config's max_change.
+	ConfirmLargeChange bool
+	// AllowPushURLs and DenyPushURLs are glob patterns for the targets
+	// gitsync may push to, whatever the config says. They match a remote's
+	// URL as host/path, or any leading part of it.
+	AllowPushURLs []string
+	DenyPushURLs  []string
+	// Confirm is asked before each force push or ref deletion, with what is
+	// about to be done, and returns whether to go ahead. Without it they
+	// need the config's allow_destructive.
+	Confirm func(action string) bool
+	// AssumeYes goes ahead with force pushes and ref deletions without
+	// asking.
+	AssumeYes bool
+	// FetchesPerHost is how many source remotes on the same host are
+	// fetched from at once, defaulting to 2.
+	FetchesPerHost int
+	// Workdir is a directory gitsync keeps its own bare clone of the
+	// config's sources in, created the first time and reused by every run,
+	// instead of syncing the checkout in RepoDir. Every synced remote needs
+	// a url in the config.
+	Workdir string
+}
+
+// Syncer mirrors the branches listed in a Config between the remotes of a
+// repository. It holds all of its own state, so several Syncers, for
+// different repositories or configs, can be used in one process. A Syncer
+// runs one Run or Check at a time.
+type Syncer struct {
+	mu sync.Mutex
+
+	config                Config
+	repoDir               string
+	fs                    billy.Filesystem
+	progressMode          string
+	progressInterval      time.Duration
+	failFast              bool
+	confirmLargeChange    bool
+	allowPushURLs         []string
+	denyPushURLs          []string
+	confirm               func(string) bool
+	assumeYes             bool
+	fetchesPerHost        int
+	workdir               string
+	configChecksum        string
+	configChanged         atomic.Bool
+	remoteTransports      map[string]remoteTransport
+	notificationTemplates map[int]*template.Template
+	notificationSubjects  map[int]*template.Template
+	filters               []*scriptFilter
+	syncFilters           [][]*scriptFilter
+	gitBinary             string
+	opaBinary             string
+	tracer                *tracer
+	sentry                *sentryTarget
+	audit                 *auditLog
+	sharedAudit           bool
+	history               *sql.DB
+	subscribers           []func(Event)
+	projectsMu            sync.Mutex
+
+	// State learnt during the current run.
+	repoRemotes     map[string]string
+	repoBranches    map[string]string
+	repoRemoteURLs  map[string]string
+	urlRules        urlRules
+	remoteAuthCache map[preflightCheck]transport.AuthMethod
+	remoteAuthMu    sync.Mutex
+	sshControlDir   string
+	sshControlMu    sync.Mutex
+	s3Mu            sync.Mutex
+	unreachable     map[preflightCheck]error
+	remoteRefs      map[preflightCheck]map[plumbing.ReferenceName]plumbing.Hash
+	fetched         map[string]*FetchResult
+	unchanged       map[string]string
+	synced          map[string]string
+	plan            map[string]*PlannedChange
+	bundles         map[string][]string
+	patches         map[string][]string
+	rewrittenRefs   int
+	run             *RunResult
+	currentEntry    *SyncEntry
+	currentSync     *SyncResult
+	statsdLines     []string
+	kafkaRecords    []kafkaRecord
+}
+
+var errInvalidConfig = errors.New("invalid configuration")
+
+// New validates config and prepares a Syncer, opening the audit log and
+// history database if options ask for them. Problems with the config are
+// logged as they are found.
+func New(config Config, options Options) (*Syncer, error) {
+	// The repository is named by its absolute path in the history, reports
+	// and the audit log, however it was given, so "." in one run and the
+	// full path in the next are the same repository.
+	repoDir, err := filepath.Abs(options.RepoDir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	options.RepoDir = repoDir
+
+	if options.Progress == "" {
+		options.Progress = ProgressAuto
+	}
+
+	if options.ProgressInterval == 0 {
+		options.ProgressInterval = gsDefaultProgressInterval
+	}
+
+	if options.FetchesPerHost <= 0 {
+		options.FetchesPerHost = gsDefaultFetchesPerHost
+	}
+
+	progressMode, err := resolveProgressMode(options.Progress)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkURLPatterns(options.AllowPushURLs, options.DenyPushURLs); err != nil {
+		return nil, err
+	}
+
+	s := &Syncer{
+		config:             config,
+		repoDir:            options.RepoDir,
+		fs:                 options.Filesystem,
+		progressMode:       progressMode,
+		progressInterval:   options.ProgressInterval,
+		failFast:           options.FailFast,
+		confirmLargeChange: options.ConfirmLargeChange,
+		allowPushURLs:      options.AllowPushURLs,
+		denyPushURLs:       options.DenyPushURLs,
+		confirm:            options.Confirm,
+		assumeYes:          options.AssumeYes,
+		fetchesPerHost:     options.FetchesPerHost,
+		workdir:            options.Workdir,
+		configChecksum:     config.Checksum(),
+		tracer:             newTracer(options.OTLPEndpoint),
+		run:                &RunResult{},
+	}
+
+	s.subscribeBuiltins()
+
+	if !s.checkSyncs() || !s.checkWorkdir() || !s.checkSharedObjects() || !s.checkMemory() || !s.checkPolicy() || !s.checkSystemHook() || !s.loadRemotes() || !s.checkPartialTargets() || !s.checkNotifications() || !s.checkCloudWatch() || !s.checkKafka() || !s.setSentryDSN(config.SentryDSN) {
+		return nil, errInvalidConfig
+	}
+
+	if s.workdir != "" {
+		if err := s.openWorkdir(); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.AuditLog != "" {
+		audit, err := openAuditLog(options.AuditLog)
+
+		if err != nil {
+			return nil, fmt.Errorf("could not open audit log: %w", err)
+		}
+
+		s.audit = audit
+	}
+
+	if options.HistoryDB != "" {
+		history, err := openHistory(options.HistoryDB)
+
+		if err != nil {
+			return nil, fmt.Errorf("could not open history database: %w", err)
+		}
+
+		s.history = history
+	}
+
+	return s, nil
+}
+
+func (s *Syncer) checkSyncs() bool {
+	if !checkHooks("global", s.config.Hooks) || !checkRewritePolicy("config", s.config.OnRewrite) || !checkMaxChange(s.config.MaxChange) || !checkAlert("config", s.config.Alert) {
+		return false
+	}
+
+	filters, ok := loadScriptFilters("global", s.config.Filters)
+
+	if !ok {
+		return false
+	}
+
+	s.filters = filters
+	s.syncFilters = make([][]*scriptFilter, len(s.config.Sync))
+
+	for i, sync := range s.config.Sync {
+		if len(sync.Branches) >= 1 &&
+			len(sync.Source) > 1 &&
+			len(sync.Target) > 1 {
+		} else {
+			errorPrintf("sync entry %d needs a source_remote, target_remote and at least one branch\n", i)
+			return false
+		}
+
+		if !checkSameRemote(i, sync) || !checkHooks(fmt.Sprintf("sync entry %d", i), sync.Hooks) || !checkRewritePolicy(fmt.Sprintf("sync entry %d", i), sync.OnRewrite) {
+			return false
+		}
+
+		if sync.ViaPR != nil && !checkPullRequest(i, sync.ViaPR) {
+			return false
+		}
+
+		if sync.Gerrit != nil && !checkGerrit(i, sync) {
+			return false
+		}
+
+		if sync.FailureIssue != nil && !checkFailureIssue(i, sync.FailureIssue) {
+			return false
+		}
+
+		if !checkAlert(fmt.Sprintf("sync entry %d", i), sync.Alert) {
+			return false
+		}
+
+		// Rolling an atomic group back force pushes and deletes, which have
+		// to be confirmed, and a run that can't would be left half synced.
+		if sync.Atomic && !s.config.AllowDestructive && !s.assumeYes && s.confirm == nil {
+			errorPrintf("sync entry %d is atomic, which needs allow_destructive, -yes or a terminal to roll it back\n", i)
+			return false
+		}
+
+		if s.syncFilters[i], ok = loadScriptFilters(fmt.Sprintf("sync entry %d", i), sync.Filters); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// openRepo opens the repository on disk, or on the Syncer's filesystem if
+// it was given one.
+func (s *Syncer) openRepo() (*git.Repository, error) {
+	if s.fs == nil {
+		repo, err := git.PlainOpen(s.repoDir)
+
+		if err == nil {
+			repo, err = s.boundMemory(repo)
+		}
+
+		if err == nil && s.config.SharedObjects != "" {
+			var shared *git.Repository
+
+			if shared, err = s.openSharedObjects(); err == nil {
+				repo, err = borrowObjects(repo, shared, filepath.Join(s.config.SharedObjects, "objects"))
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("could not open repository %s: %w", s.repoDir, err)
+		}
+
+		return repo, nil
+	}
+
+	dotGit, err := s.fs.Chroot(git.GitDirName)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not open repository %s: %w", s.repoDir, err)
+	}
+
+	repo, err := git.Open(s.openStorage(dotGit), s.fs)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not open repository %s: %w", s.repoDir, err)
+	}
+
+	return repo, nil
+}
+
+// collectRepoInfo forgets everything learnt about the repository and
+// remotes by a previous run, so long-running mode sees fresh state each time,
+// and reads the repository's branches and remotes.
+func (s *Syncer) collectRepoInfo() error {
+	s.repoRemotes = map[string]string{}
+	s.repoBranches = map[string]string{}
+	s.repoRemoteURLs = map[string]string{}
+	s.remoteAuthCache = map[preflightCheck]transport.AuthMethod{}
+
+	repo, err := s.openRepo()
+
+	if err != nil {
+		return err
+	}
+
+	branches, err := repo.Branches()
+
+	if err != nil {
+		return fmt.Errorf("could not list branches: %w", err)
+	}
+
+	err = branches.ForEach(func(b *plumbing.Reference) error {
+		s.repoBranches[b.Name().Short()] = b.Name().String()
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("could not list branches: %w", err)
+	}
+
+	remotes, err := repo.Remotes()
+
+	if err != nil {
+		return fmt.Errorf("could not list remotes: %w", err)
+	}
+
+	for _, remote := range remotes {
+		s.repoRemotes[remote.Config().Name] = remote.Config().Name
+	}
+
+	if err := s.loadURLRewrites(repo); err != nil {
+		return err
+	}
+
+	s.tracePrintf("Repository branches: %v\n", s.repoBranches)
+	s.tracePrintf("Repository remotes: %v\n", s.repoRemotes)
+
+	return nil
+}
+
+func (s *Syncer) remoteExists(remote string) bool {
+	_, exists := s.repoRemotes[remote]
+	return exists
+}
+
+func (s *Syncer) branchExists(branch string) bool {
+	_, exists := s.repoBranches[branch]
+	return exists
+}
+
+// processSyncs syncs every entry in turn. A sync entry or branch that fails
+// is recorded in its result and the next one is tried, unless failing fast,
+// when the rest of the entry's branches are skipped and the run stops after
+// it. Only errors that make carrying on unsafe, such as losing the audit
+// log, ctx's error once it is cancelled, or stopping to fail fast are
+// returned.
+func (s *Syncer) processSyncs(ctx context.Context, runSpan *span) error {
+	for i, sync := range s.config.Sync {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		s.noticeConfigChange()
+
+		if previous := s.run.Syncs; s.failFast && len(previous) > 0 && previous[len(previous)-1].Status != StatusSynced {
+			last := previous[len(previous)-1]
+			return fmt.Errorf("%w: sync from %s to %s %s", errFailFast, last.Source, last.Target, last.Status)
+		}
+
+		// A run applying a plan leaves out the entries it changes nothing in.
+		if sync.Branches = s.plannedBranches(sync); len(sync.Branches) == 0 {
+			continue
+		}
+
+		// So does one applying bundles or patches with what they don't
+		// carry.
+		if sync.Branches = s.carriedBranches(sync); len(sync.Branches) == 0 {
+			continue
+		}
+
+		var skipped []string
+		var started = time.Now()
+
+		result := &SyncResult{ID: randomHex(4), Source: sync.Source, Target: sync.Target, Status: StatusSynced}
+		s.run.Syncs = append(s.run.Syncs, result)
+		s.currentEntry, s.currentSync = &sync, result
+
+		syncSpan := s.tracer.start(runSpan, "sync", "source", sync.Source, "target", sync.Target, "sync_id", result.ID)
+		s.publish(Event{Type: EventSyncStarted, span: syncSpan})
+
+		// Bundles and patches stand in for the source, which needn't be a
+		// remote on this side of the air gap.
+		if !s.remoteExists(sync.Source) && !s.offline() {
+			skipped = append(skipped, fmt.Sprintf("%s source remote doesn't exist", sync.Source))
+		}
+
+		if !s.remoteExists(sync.Target) {
+			skipped = append(skipped, fmt.Sprintf("%s target remote doesn't exist", sync.Target))
+		}
+
+		for _, branch := range sync.Branches {
+			if !s.branchExists(branch) {
+				skipped = append(skipped, fmt.Sprintf("%s branch doesn't exist", branch))
+			}
+		}
+
+		for _, reason := range skipped {
+			s.warnPrintf("%s\n", reason)
+		}
+
+		// Why is kept with every branch, so the history can explain it.
+		if len(skipped) > 0 {
+			s.publish(Event{Type: EventSyncSkipped, span: syncSpan})
+			s.skipSync(sync, result, syncSpan, StatusSkipped, fmt.Errorf("%w: %s", errSyncSkipped, strings.Join(skipped, ", ")))
+			continue
+		}
+
+		if err := s.sameRemoteURL(sync); err != nil {
+			s.publish(Event{Type: EventError, Err: err})
+			s.skipSync(sync, result, syncSpan, StatusFailed, err)
+			continue
+		}
+
+		if err := s.unreachableRemote(sync); err != nil {
+			s.skipSync(sync, result, syncSpan, StatusFailed, err)
+			continue
+		}
+
+		s.debugPrintf("Processing sync\n")
+
+		repo, worktree, err := s.openWorktree()
+
+		if err == nil {
+			err = s.runHooks(ctx, hookPreRun, sync.Hooks.PreRun, syncSpan, result, nil)
+		}
+
+		if err != nil {
+			s.publish(Event{Type: EventError, Err: err})
+			s.skipSync(sync, result, syncSpan, StatusFailed, err)
+			continue
+		}
+
+		filters := append(append([]*scriptFilter{}, s.filters...), s.syncFilters[i]...)
+
+		for _, branch := range sync.Branches {
+			if sync.Atomic && result.Status == StatusFailed {
+				result.Branches = append(result.Branches, &BranchResult{Branch: branch, Status: StatusSkipped, Err: errAtomicGroupFailed})
+				continue
+			}
+
+			if s.failFast && result.Status == StatusFailed {
+				result.Branches = append(result.Branches, &BranchResult{Branch: branch, Status: StatusSkipped, Err: errFailFast})
+				continue
+			}
+
+			branchResult, err := s.processBranch(ctx, repo, worktree, sync, filters, result, branch, syncSpan)
+			result.Branches = append(result.Branches, branchResult)
+
+			if branchResult.Status == StatusFailed {
+				result.Status = StatusFailed
+				result.Err = errBranchesFailed
+			}
+
+			if err != nil {
+				result.Status = StatusFailed
+				result.Err = err
+
+				if sync.Atomic {
+					s.rollBack(context.WithoutCancel(ctx), repo, sync.Target, result)
+				}
+
+				result.Duration = time.Since(started)
+				syncSpan.finish(err)
+				s.currentEntry, s.currentSync = nil, nil
+
+				return err
+			}
+		}
+
+		if sync.Atomic && result.Status == StatusFailed {
+			s.rollBack(context.WithoutCancel(ctx), repo, sync.Target, result)
+		}
+
+		result.Duration = time.Since(started)
+
+		if err := s.runHooks(context.WithoutCancel(ctx), hookPostRun, sync.Hooks.PostRun, syncSpan, result, nil); err != nil {
+			s.publish(Event{Type: EventError, Err: err})
+
+			result.Status = StatusFailed
+			result.Err = err
+		}
+
+		s.publish(Event{Type: EventSyncFinished, span: syncSpan})
+		syncSpan.finish(result.Err)
+	}
+
+	s.currentEntry, s.currentSync = nil, nil
+
+	return nil
+}
+
+// skipSync gives up on a sync entry before any of its branches are synced,
+// skipping each of them with err.
+func (s *Syncer) skipSync(sync SyncEntry, result *SyncResult, syncSpan *span, status string, err error) {
+	result.Status = status
+	result.Err = err
+
+	for _, branch := range sync.Branches {
+		result.Branches = append(result.Branches, &BranchResult{Branch: branch, Status: StatusSkipped, Err: err})
+	}
+
+	syncSpan.finish(result.Err)
+	s.publish(Event{Type: EventSyncFinished, span: syncSpan})
+}
+
+// processBranch syncs a branch between its global and sync entry
+// pre_branch and post_branch hooks. A failing hook set to fail fails the
+// branch, and before the sync also stops it from being synced. Once ctx is
+// cancelled the branch is skipped and ctx's error returned.
+func (s *Syncer) processBranch(ctx context.Context, repo *git.Repository, worktree *git.Worktree, sync SyncEntry, filters []*scriptFilter, result *SyncResult, branch string, syncSpan *span) (*BranchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return &BranchResult{Branch: branch, Status: StatusSkipped}, err
+	}
+
+	preBranch := append(append([]Hook{}, s.config.Hooks.PreBranch...), sync.Hooks.PreBranch...)
+
+	if err := s.runHooks(ctx, hookPreBranch, preBranch, syncSpan, result, &BranchResult{Branch: branch}); err != nil {
+		branchResult := &BranchResult{Branch: branch, Status: StatusFailed, Err: err}
+		s.publish(Event{Type: EventError, Branch: branchResult, Err: err})
+
+		return branchResult, nil
+	}
+
+	branchResult, err := s.syncBranch(ctx, repo, worktree, sync.Source, sync.Target, branch, filters, s.rewritePolicy(sync), syncSpan)
+
+	if err != nil {
+		return branchResult, err
+	}
+
+	postBranch := append(append([]Hook{}, s.config.Hooks.PostBranch...), sync.Hooks.PostBranch...)
+
+	if err := s.runHooks(ctx, hookPostBranch, postBranch, syncSpan, result, branchResult); err != nil {
+		s.publish(Event{Type: EventError, Branch: branchResult, Err: err})
+
+		if branchResult.Err == nil {
+			branchResult.Status = StatusFailed
+			branchResult.Err = err
+		}
+	}
+
+	return branchResult, nil
+}
+
+// runFailureHooks runs on_failure hooks. There is nothing left for them to
+// fail, so their errors are only logged, and they run even once the run has
+// been cancelled.
+func (s *Syncer) runFailureHooks(hooks []Hook, parent *span, sync *SyncResult) {
+	if err := s.runHooks(context.Background(), hookOnFailure, hooks, parent, sync, nil); err != nil {
+		s.errorPrintf("%s\n", err)
+	}
+}
+
+func (s *Syncer) openWorktree() (*git.Repository, *git.Worktree, error) {
+	repo, err := s.openRepo()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	worktree, err := repo.Worktree()
+
+	// A workdir clone is bare, with no checkout to keep up to date.
+	if errors.Is(err, git.ErrIsBareRepository) {
+		return repo, nil, nil
+	}
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open worktree of %s: %w", s.repoDir, err)
+	}
+
+	return repo, worktree, nil
+}
+
+// syncBranch brings a branch up to date with what was fetched from source,
+// passes it through filters and pushes it to target, recording what moved.
+// Failures to update or push fail the branch, and the push only happens if
+// the update worked: pushing a branch that couldn't be brought up to date
+// would sync the wrong commits. The error returned is for failures that
+// should stop the run.
+func (s *Syncer) syncBranch(ctx context.Context, repo *git.Repository, worktree *git.Worktree, source, target, branch string, filters []*scriptFilter, onRewrite string, syncSpan *span) (*BranchResult, error) {
+	var branchRef = plumbing.NewBranchReferenceName(branch)
+	var started = time.Now()
+
+	result := &BranchResult{Branch: branch, Status: StatusSynced}
+	branchSpan := s.tracer.start(syncSpan, "branch", "branch", branch)
+
+	if sha, unchanged := s.unchanged[syncedKey(source, target, branch)]; unchanged {
+		s.debugPrintf("%s hasn't moved on %s since it was synced to %s\n", branch, source, target)
+		s.recordSynced(source, target, branch, sha)
+		result.Status, result.OldSHA, result.NewSHA = StatusUpToDate, sha, sha
+		result.Duration = time.Since(started)
+		s.publish(Event{Type: EventBranchFinished, Branch: result})
+		branchSpan.finish(nil)
+
+		return result, nil
+	}
+
+	result.OldSHA = branchSHA(repo, branchRef)
+
+	receivedBefore, sentBefore := transferredBytes()
+
+	var pushSrc, pushDst = branchRef.String(), branchRef
+	var force, quarantined bool
+
+	s.infoPrintf("updating %s from %s\n", branch, source)
+	pullSpan := s.tracer.start(branchSpan, "pull", "remote", source)
+	phaseStarted := time.Now()
+	pullErr := s.planMoved(ctx, repo, source, target, branchRef)
+
+	if pullErr == nil {
+		pullErr = s.fastForward(repo, worktree, source, branchRef)
+	}
+
+	if errors.Is(pullErr, git.ErrNonFastForwardUpdate) {
+		pushSrc, pushDst, pullErr = s.handleRewrite(repo, source, target, branchRef, onRewrite)
+		force = pullErr == nil
+		quarantined = pushDst != branchRef
+	}
+
+	result.PullDuration = time.Since(phaseStarted)
+	pullSpan.finish(pullErr)
+
+	pulled := pullErr == nil
+	result.NewSHA = branchSHA(repo, branchRef)
+	result.Commits = countCommits(repo, result.OldSHA, result.NewSHA)
+
+	s.publish(Event{Type: EventBranchPulled, Branch: result, Err: pullErr})
+
+	if err := s.audit.refChange(s.repoDir, gsAuditLocalRemote, branchRef.String(), result.OldSHA, result.NewSHA); err != nil {
+		return s.abortBranch(result, branchSpan, err)
+	}
+
+	// A rewritten branch is pushed from its rewritten tip, and the local
+	// branch only follows once the force push has gone through.
+	if force && !quarantined {
+		result.NewSHA = pushSrc
+		result.Commits = countCommits(repo, result.OldSHA, result.NewSHA)
+	}
+
+	if quarantined {
+		result.NewSHA = pushSrc
+	}
+
+	var filterErr, policyErr error
+
+	if pulled && !quarantined && len(filters) > 0 {
+		var decision filterDecision
+		var targetSHA string
+
+		targetSHA, filterErr = s.remoteRefSHA(ctx, target, branchRef)
+
+		if filterErr != nil {
+			filterErr = fmt.Errorf("could not read %s on %s for the filters: %w", branch, target, filterErr)
+		} else {
+			decision, filterErr = s.runFilters(ctx, filters, repo, source, target, targetSHA, result)
+		}
+
+		if filterErr == nil && !decision.allow {
+			result.Status = StatusSkipped
+			result.Err = decision.vetoError()
+			s.infoPrintf("not pushing %s to %s: %s\n", branch, target, result.Err)
+		} else if filterErr == nil {
+			if decision.sha != "" && decision.sha != result.NewSHA {
+				s.infoPrintf("filters chose to push %s of %s\n", ShortSHA(decision.sha), branch)
+				pushSrc = decision.sha
+				result.NewSHA = decision.sha
+				result.Commits = countCommits(repo, result.OldSHA, result.NewSHA)
+			}
+
+			if decision.targetBranch != "" && decision.targetBranch != branch {
+				s.infoPrintf("filters chose to push %s to %s on %s\n", branch, decision.targetBranch, target)
+				pushDst = plumbing.NewBranchReferenceName(decision.targetBranch)
+			}
+		}
+	}
+
+	if pulled && !quarantined && filterErr == nil && result.Err == nil && s.config.Policy != nil {
+		var targetSHA string
+
+		targetSHA, policyErr = s.remoteRefSHA(ctx, target, pushDst)
+
+		if policyErr != nil {
+			policyErr = fmt.Errorf("could not read %s on %s for the policy: %w", pushDst.Short(), target, policyErr)
+		} else {
+			policyErr = s.applyPolicy(ctx, repo, source, target, targetSHA, pushDst.Short(), result)
+		}
+	}
+
+	var pushErr error
+
+	// A branch synced through a pull request is pushed to a staging branch
+	// of gitsync's own, and one synced to Gerrit to refs/for/, neither of
+	// which is ever confirmed, checked for large changes or backed up: the
+	// review is where the change is looked at.
+	viaPR := s.currentEntry.ViaPR != nil && !quarantined
+	viaGerrit := s.currentEntry.Gerrit != nil && !quarantined
+
+	if pulled && filterErr == nil && policyErr == nil && result.Err == nil && (viaPR || viaGerrit) {
+		if viaPR {
+			pushErr = s.pushStaging(ctx, repo, target, pushSrc, pushDst, result, branchSpan)
+		} else {
+			pushErr = s.pushForReview(ctx, repo, target, pushSrc, pushDst, result, branchSpan)
+		}
+
+		if pushErr == nil && result.pushedRef != "" {
+			if err := s.audit.refChange(s.repoDir, target, result.pushedRef.String(), result.targetOldSHA, result.NewSHA); err != nil {
+				return s.abortBranch(result, branchSpan, err)
+			}
+
+			s.publish(Event{Type: EventBranchPushed, Branch: result})
+		}
+
+		if pushErr == nil && viaPR && result.Status != StatusUpToDate {
+			pushErr = s.openPullRequest(ctx, source, target, pushDst, result)
+		}
+	}
+
+	if pulled && filterErr == nil && policyErr == nil && result.Err == nil && !viaPR && !viaGerrit {
+		// The target's tip is read first so a push that would change
+		// nothing isn't made at all. A force push reads it afresh, so what
+		// it backs up is what it replaces.
+		if force {
+			s.forgetRemoteRefs(target)
+		}
+
+		if !quarantined {
+			pushErr = s.offPlan(source, target, branch, pushDst, result.NewSHA)
+		}
+
+		targetOldSHA, err := s.remoteRefSHA(ctx, target, pushDst)
+
+		switch {
+		case pushErr != nil:
+		case err != nil && force:
+			pushErr = fmt.Errorf("could not read %s on %s to back it up: %w", pushDst.Short(), target, err)
+		case err != nil && s.currentEntry.Atomic:
+			pushErr = fmt.Errorf("could not read %s on %s to be able to roll it back: %w", pushDst.Short(), target, err)
+		case err != nil:
+			s.warnPrintf("could not read %s on %s, pushing anyway: %s\n", pushDst.Short(), target, err)
+		case targetOldSHA == result.NewSHA:
+			s.infoPrintf("%s is already up to date on %s\n", pushDst.Short(), target)
+			result.Status = StatusUpToDate
+		case !quarantined:
+			pushErr = s.checkLargeChange(repo, target, pushDst, targetOldSHA, result.NewSHA, force)
+		}
+
+		// A force push can lose commits, so it has to be confirmed and the
+		// target's old tip is backed up first; nothing is pushed if either
+		// fails.
+		if pushErr == nil && force && targetOldSHA != "" && targetOldSHA != result.NewSHA {
+			pushErr = s.confirmDestructive(fmt.Sprintf("force push %s to %s on %s, replacing %s", ShortSHA(result.NewSHA), pushDst.Short(), target, ShortSHA(targetOldSHA)))
+		}
+
+		if pushErr == nil && force && targetOldSHA != "" && targetOldSHA != result.NewSHA {
+			backup, err := s.backupRef(ctx, repo, target, pushDst, targetOldSHA)
+
+			if err != nil {
+				pushErr = err
+			} else if err := s.audit.refChange(s.repoDir, target, backup.String(), "", targetOldSHA); err != nil {
+				return s.abortBranch(result, branchSpan, err)
+			}
+		}
+
+		// What a partial fetch left out is fetched from the source, with the
+		// source's settings, before the push needs it.
+		if pushErr == nil && result.Status != StatusUpToDate && s.partialFilter(source) != "" {
+			pushErr = s.backendFor(source, opPull).(systemGitBackend).backfill(ctx, repo, source, pushSrc, targetOldSHA)
+		}
+
+		if pushErr == nil && result.Status != StatusUpToDate {
+			s.infoPrintf("pushing changes on %s to %s\n", branch, target)
+
+			pushProgress := s.newProgress("push", target, branch)
+			pushSpan := s.tracer.start(branchSpan, "push", "remote", target)
+			phaseStarted = time.Now()
+			refSpec := config.RefSpec(pushSrc + ":" + pushDst.String())
+
+			if force {
+				refSpec = "+" + refSpec
+			}
+
+			pushErr = s.pushTo(ctx, repo, target, refSpec, pushProgress)
+			result.PushDuration = time.Since(phaseStarted)
+			pushSpan.finish(pushErr)
+			pushProgress.finish()
+
+			if pushErr != nil {
+				s.forgetRemoteRefs(target)
+			} else {
+				s.pushedRemoteRef(target, pushDst, result.NewSHA)
+			}
+		}
+
+		if pushErr == nil && result.Status != StatusUpToDate {
+			result.pushedRef, result.targetOldSHA = pushDst, targetOldSHA
+
+			if force && !quarantined && targetOldSHA != "" {
+				s.rewrittenRefs++
+			}
+
+			if err := s.audit.refChange(s.repoDir, target, pushDst.String(), targetOldSHA, result.NewSHA); err != nil {
+				return s.abortBranch(result, branchSpan, err)
+			}
+
+			s.publish(Event{Type: EventBranchPushed, Branch: result})
+		}
+
+		if pushErr == nil && quarantined {
+			result.Status = StatusSkipped
+			result.Err = fmt.Errorf("%w, pushed to %s on %s instead", errHistoryRewritten, pushDst.Short(), target)
+		}
+	}
+
+	if pulled && force && !quarantined && filterErr == nil && policyErr == nil && pushErr == nil && result.Err == nil {
+		if err := moveBranch(repo, worktree, branchRef, plumbing.NewHash(result.NewSHA)); err != nil {
+			pushErr = err
+		} else if err := s.audit.refChange(s.repoDir, gsAuditLocalRemote, branchRef.String(), result.OldSHA, result.NewSHA); err != nil {
+			return s.abortBranch(result, branchSpan, err)
+		}
+	}
+
+	receivedAfter, sentAfter := transferredBytes()
+	result.BytesReceived = receivedAfter - receivedBefore
+	result.BytesSent = sentAfter - sentBefore
+
+	result.Duration = time.Since(started)
+
+	for _, opErr := range []error{pullErr, filterErr, policyErr, pushErr} {
+		if opErr != nil {
+			s.publish(Event{Type: EventError, Branch: result, Err: opErr})
+
+			if result.Err == nil {
+				result.Status = StatusFailed
+				result.Err = opErr
+			}
+		}
+	}
+
+	if result.Err == nil && result.Status != StatusUpToDate {
+		s.setCommitStatus(target, branch, result.NewSHA)
+	}
+
+	if result.Err == nil && !quarantined && !viaPR && !viaGerrit && pushDst == branchRef {
+		s.recordSynced(source, target, branch, result.NewSHA)
+	}
+
+	s.publish(Event{Type: EventBranchFinished, Branch: result})
+	branchSpan.finish(result.Err)
+
+	return result, nil
+}
+
+// abortBranch fails a branch with an error that stops the run.
+func (s *Syncer) abortBranch(result *BranchResult, branchSpan *span, err error) (*BranchResult, error) {
+	result.Status = StatusFailed
+	result.Err = err
+	s.publish(Event{Type: EventError, Branch: result, Err: err})
+	branchSpan.finish(err)
+
+	return result, err
+}
+
+// realError drops go-git's "already up-to-date" sentinel, which is not a
+// failure for a sync.
+func realError(err error) error {
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+
+	return err
+}
+
+// Run syncs every configured branch once, sending notifications and
+// recording the run as configured, and returns what happened. Branches and
+// sync entries that fail are recorded in the result; an error is only
+// returned when the run couldn't start or had to stop early, and is also set
+// as the result's Err. Notifications, metrics and history are still sent for
+// such runs.
+//
+// Cancelling ctx kills in-flight pulls, pushes and hooks and stops the run
+// with ctx's error. post_run and on_failure hooks still run, so they can
+// clean up, and the run is still reported.
+func (s *Syncer) Run(ctx context.Context) (*RunResult, error) {
+	return s.syncOnce(ctx, nil, nil, nil)
+}
+
+// syncOnce runs a sync, of only the branches plan changes if given a plan,
+// or of only the branches bundles or patch series carry commits for, from
+// them rather than their sources, if given bundles or patches.
+func (s *Syncer) syncOnce(ctx context.Context, plan map[string]*PlannedChange, bundles, patches map[string][]string) (*RunResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.plan, s.bundles, s.patches = plan, bundles, patches
+	defer func() { s.plan, s.bundles, s.patches = nil, nil, nil }()
+
+	s.run = &RunResult{ID: randomHex(8), Repository: s.repoDir, ConfigChecksum: s.configChecksum, Started: time.Now()}
+	s.currentEntry, s.currentSync = nil, nil
+	s.rewrittenRefs = 0
+	s.configChanged.Store(false)
+
+	runSpan := s.tracer.start(nil, "run", "repository", s.repoDir, "run_id", s.run.ID)
+	s.publish(Event{Type: EventRunStarted, span: runSpan})
+
+	// The workdir clone stays locked until the run is reported.
+	unlock, err := s.lockWorkdir(ctx)
+
+	if err == nil {
+		defer unlock()
+		err = s.collectRepoInfo()
+	}
+
+	if err == nil {
+		err = s.runHooks(ctx, hookPreRun, s.config.Hooks.PreRun, runSpan, nil, nil)
+	}
+
+	if err == nil {
+		s.preflight(ctx, runSpan)
+		s.loadSynced()
+
+		switch {
+		case s.bundles != nil:
+			s.unbundle(runSpan)
+		case s.patches != nil:
+			s.applyPatchSeries(ctx, runSpan)
+		default:
+			s.fetchSources(ctx, runSpan)
+		}
+
+		if err = s.seedWorkdirBranches(); err == nil {
+			err = s.processSyncs(ctx, runSpan)
+		}
+
+		s.fileFailureIssues(ctx)
+
+		if saveErr := s.saveSynced(); saveErr != nil {
+			s.warnPrintf("could not save which branches were synced: %s\n", saveErr)
+		}
+
+		if gcErr := s.gcWorkdir(ctx); gcErr != nil && ctx.Err() == nil {
+			s.warnPrintf("could not collect garbage in the workdir clone: %s\n", gcErr)
+		}
+
+		s.closeSSHConnections()
+	}
+
+	s.raiseAlerts(ctx)
+	s.run.Err = err
+
+	if hookErr := s.runHooks(context.WithoutCancel(ctx), hookPostRun, s.config.Hooks.PostRun, runSpan, nil, nil); hookErr != nil && err == nil {
+		err = hookErr
+		s.run.Err = err
+	}
+
+	s.noticeConfigChange()
+	s.run.Finished = time.Now()
+	s.publish(Event{Type: EventRunFinished, Err: err, span: runSpan})
+	runSpan.finish(err)
+	s.tracer.flush()
+
+	return s.run, err
+}
+
+// Close releases the audit log, unless it is shared with a NewProject
+// Syncer's parent, and the history database. The Syncer can't be used
+// afterwards.
+func (s *Syncer) Close() error {
+	var err error
+
+	if !s.sharedAudit {
+		err = s.audit.close()
+	}
+
+	if s.history != nil {
+		if historyErr := s.history.Close(); err == nil {
+			err = historyErr
+		}
+	}
+
+	return err
+}
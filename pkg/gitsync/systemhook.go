@@ -0,0 +1,308 @@
+package gitsync
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// gsProjectsFile is where the GitLab projects gitlab_system_hook has added
+// to the sync set are kept, in the repository's git directory.
+const gsProjectsFile string = "gitsync/projects.json"
+
+// GitLab system hook events that gitlab_system_hook acts on.
+const (
+	SystemHookProjectCreate    string = "project_create"
+	SystemHookRepositoryUpdate string = "repository_update"
+)
+
+// GitLabSystemHook adds the projects of a GitLab instance that match
+// patterns to the sync set as its system hooks say they are created or
+// pushed to, so new projects are mirrored without editing the config.
+type GitLabSystemHook struct {
+	// Secret is the system hook's secret token.
+	Secret   string           `json:"secret"`
+	Projects []ProjectPattern `json:"projects"`
+}
+
+// ProjectPattern syncs every GitLab project whose path matches Pattern, a
+// glob such as "mirrors/*", from Source to Target. {path} in their URLs is
+// replaced with the project's path.
+type ProjectPattern struct {
+	Pattern  string   `json:"pattern"`
+	Source   Remote   `json:"source"`
+	Target   Remote   `json:"target"`
+	Branches []string `json:"branches"`
+}
+
+// SystemHookEvent is what a GitLab system hook delivery was about.
+type SystemHookEvent struct {
+	Name    string
+	Project string
+	// Added is set when the delivery added Project to the sync set.
+	Added bool
+	// Sync is set when a project of the sync set, or a remote of the config,
+	// was created or pushed to, so a run would pick up the change.
+	Sync bool
+}
+
+type projectsState struct {
+	Projects []string `json:"projects"`
+}
+
+func (s *Syncer) checkSystemHook() bool {
+	settings := s.config.GitLabSystemHook
+
+	if settings == nil {
+		return true
+	}
+
+	if settings.Secret == "" {
+		errorPrintf("gitlab_system_hook has no secret\n")
+		return false
+	}
+
+	for i, pattern := range settings.Projects {
+		if _, err := path.Match(pattern.Pattern, ""); err != nil || pattern.Pattern == "" {
+			errorPrintf("gitlab_system_hook project %d has a bad pattern: %q\n", i, pattern.Pattern)
+			return false
+		}
+
+		if pattern.Source.URL == "" || pattern.Target.URL == "" || len(pattern.Branches) == 0 {
+			errorPrintf("gitlab_system_hook project %d needs a source and target url and at least one branch\n", i)
+			return false
+		}
+	}
+
+	return true
+}
+
+// HandleSystemHook checks that a GitLab system hook delivery, with header
+// and body, carries gitlab_system_hook's secret, and adds the project it is
+// about to the sync set if the project matches one of its patterns and
+// isn't there yet. An error wrapping ErrWebhookUnauthenticated is returned
+// for a delivery without the secret, or when there is no
+// gitlab_system_hook.
+func (s *Syncer) HandleSystemHook(header http.Header, body []byte) (*SystemHookEvent, error) {
+	settings := s.config.GitLabSystemHook
+
+	if settings == nil {
+		return nil, fmt.Errorf("%w: there is no gitlab_system_hook", ErrWebhookUnauthenticated)
+	}
+
+	secret, err := resolveSecret(settings.Secret)
+
+	if err != nil {
+		return nil, fmt.Errorf("gitlab_system_hook secret: %w", err)
+	}
+
+	if token := header.Get("X-Gitlab-Token"); token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return nil, fmt.Errorf("%w: bad token for the system hook", ErrWebhookUnauthenticated)
+	}
+
+	var delivery struct {
+		EventName         string `json:"event_name"`
+		PathWithNamespace string `json:"path_with_namespace"`
+		Project           struct {
+			PathWithNamespace string `json:"path_with_namespace"`
+			GitHTTPURL        string `json:"git_http_url"`
+			GitSSHURL         string `json:"git_ssh_url"`
+		} `json:"project"`
+	}
+
+	if err := json.Unmarshal(body, &delivery); err != nil {
+		return nil, fmt.Errorf("could not read the system hook delivery: %w", err)
+	}
+
+	event := &SystemHookEvent{Name: delivery.EventName, Project: delivery.PathWithNamespace}
+
+	if event.Project == "" {
+		event.Project = delivery.Project.PathWithNamespace
+	}
+
+	if event.Name != SystemHookProjectCreate && event.Name != SystemHookRepositoryUpdate {
+		return event, nil
+	}
+
+	if s.matchProject(event.Project) != nil {
+		event.Added, err = s.addProject(event.Project)
+
+		if err != nil {
+			return nil, err
+		}
+
+		event.Sync = true
+	}
+
+	for _, remote := range s.config.Remotes {
+		event.Sync = event.Sync || (remote.URL != "" && (remote.URL == delivery.Project.GitHTTPURL || remote.URL == delivery.Project.GitSSHURL))
+	}
+
+	return event, nil
+}
+
+// matchProject is the first of gitlab_system_hook's patterns the project's
+// path matches, or nil.
+func (s *Syncer) matchProject(project string) *ProjectPattern {
+	if s.config.GitLabSystemHook == nil || project == "" {
+		return nil
+	}
+
+	for i, pattern := range s.config.GitLabSystemHook.Projects {
+		if matched, _ := path.Match(pattern.Pattern, project); matched {
+			return &s.config.GitLabSystemHook.Projects[i]
+		}
+	}
+
+	return nil
+}
+
+// Projects are the GitLab projects gitlab_system_hook has added to the sync
+// set, whose configs are made with ProjectConfig. Projects that no longer
+// match any pattern are left out.
+func (s *Syncer) Projects() ([]string, error) {
+	s.projectsMu.Lock()
+	defer s.projectsMu.Unlock()
+
+	state, err := s.readProjects()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var projects []string
+
+	for _, project := range state.Projects {
+		if s.matchProject(project) != nil {
+			projects = append(projects, project)
+		}
+	}
+
+	return projects, nil
+}
+
+// addProject adds the project to the sync set, reporting whether it wasn't
+// there before.
+func (s *Syncer) addProject(project string) (bool, error) {
+	s.projectsMu.Lock()
+	defer s.projectsMu.Unlock()
+
+	state, err := s.readProjects()
+
+	if err != nil {
+		return false, err
+	}
+
+	if slices.Contains(state.Projects, project) {
+		return false, nil
+	}
+
+	state.Projects = append(state.Projects, project)
+	slices.Sort(state.Projects)
+
+	dotGit, err := s.dotGit()
+
+	if err != nil {
+		return false, err
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+
+	if err == nil {
+		err = util.WriteFile(dotGit, gsProjectsFile+".tmp", append(data, '\n'), 0o644)
+	}
+
+	if err == nil {
+		err = dotGit.Rename(gsProjectsFile+".tmp", gsProjectsFile)
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("could not add %s to the sync set: %w", project, err)
+	}
+
+	return true, nil
+}
+
+func (s *Syncer) readProjects() (projectsState, error) {
+	var state projectsState
+
+	dotGit, err := s.dotGit()
+
+	if err != nil {
+		return state, err
+	}
+
+	data, err := util.ReadFile(dotGit, gsProjectsFile)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+
+	if err != nil {
+		return state, fmt.Errorf("could not read the projects gitlab_system_hook added: %w", err)
+	}
+
+	return state, nil
+}
+
+// ProjectConfig is the config that syncs a project gitlab_system_hook
+// added, from the first pattern it matches: the config's own settings, with
+// the pattern's source and target as its only remotes and sync entry. It
+// has no healthcheck_url, metrics_push or gitlab_system_hook, which are the
+// config's own, and needs a workdir to be synced, as the project has no
+// checkout.
+func (s *Syncer) ProjectConfig(project string) (Config, bool) {
+	pattern := s.matchProject(project)
+
+	if pattern == nil {
+		return Config{}, false
+	}
+
+	source, target := pattern.Source, pattern.Target
+	source.URL = strings.ReplaceAll(source.URL, "{path}", project)
+	target.URL = strings.ReplaceAll(target.URL, "{path}", project)
+
+	config := s.config
+	config.Remotes = map[string]Remote{"source": source, "target": target}
+	config.Sync = []SyncEntry{{Source: "source", Target: "target", Branches: pattern.Branches}}
+	config.HealthcheckURL = ""
+	config.MetricsPush = nil
+	config.GitLabSystemHook = nil
+
+	return config, true
+}
+
+// NewProject makes the Syncer for a project gitlab_system_hook added, with
+// its ProjectConfig. Its pushes are appended to this Syncer's audit log, so
+// they are audited in the one hash chain, and options' AuditLog is ignored;
+// the log stays open until this Syncer is closed.
+func (s *Syncer) NewProject(project string, options Options) (*Syncer, error) {
+	config, ok := s.ProjectConfig(project)
+
+	if !ok {
+		return nil, fmt.Errorf("no gitlab_system_hook pattern matches %s", project)
+	}
+
+	options.AuditLog = ""
+	syncer, err := New(config, options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	syncer.audit, syncer.sharedAudit = s.audit, true
+
+	return syncer, nil
+}
@@ -0,0 +1,234 @@
+package gitsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const gsTraceServiceName string = "gitsync"
+
+// OTLP span status codes and kinds, as defined by the OTLP protobuf schema.
+const (
+	otlpStatusOk      = 1
+	otlpStatusError   = 2
+	otlpSpanKindInner = 1
+)
+
+// span is a finished or in-flight unit of work exported over OTLP/HTTP. A nil
+// span is valid and does nothing, which is what a nil tracer starts when
+// tracing is disabled.
+type span struct {
+	tracer   *tracer
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+}
+
+// tracer collects finished spans until they are flushed to the collector.
+type tracer struct {
+	endpoint string
+	mutex    sync.Mutex
+	finished []*span
+}
+
+// newTracer enables tracing, taking the collector from the option or the
+// standard OTEL_EXPORTER_OTLP_ENDPOINT environment variable. It returns nil
+// when neither is set.
+func newTracer(endpoint string) *tracer {
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+
+	if endpoint == "" {
+		return nil
+	}
+
+	return &tracer{endpoint: strings.TrimSuffix(endpoint, "/")}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// start begins a span under parent, or a new trace when parent is nil.
+// attrs are key, value pairs.
+func (t *tracer) start(parent *span, name string, attrs ...string) *span {
+	if t == nil {
+		return nil
+	}
+
+	s := &span{
+		tracer: t,
+		spanID: randomHex(8),
+		name:   name,
+		start:  time.Now(),
+		attrs:  map[string]string{},
+	}
+
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs[attrs[i]] = attrs[i+1]
+	}
+
+	return s
+}
+
+func (s *span) setAttr(key, value string) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// finish ends the span, marking it failed when err is not nil.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+
+	s.end = time.Now()
+	s.err = err
+
+	s.tracer.mutex.Lock()
+	s.tracer.finished = append(s.tracer.finished, s)
+	s.tracer.mutex.Unlock()
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	var out []otlpAttribute
+
+	for key, value := range attrs {
+		attr := otlpAttribute{Key: key}
+		attr.Value.StringValue = value
+		out = append(out, attr)
+	}
+
+	return out
+}
+
+// flush exports every finished span to the collector's /v1/traces endpoint
+// using the OTLP JSON encoding.
+func (t *tracer) flush() {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	spans := t.finished
+	t.finished = nil
+	t.mutex.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+
+	var exported []otlpSpan
+
+	for _, s := range spans {
+		status := otlpStatus{Code: otlpStatusOk}
+
+		if s.err != nil {
+			status = otlpStatus{Code: otlpStatusError, Message: s.err.Error()}
+		}
+
+		exported = append(exported, otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              otlpSpanKindInner,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+			Status:            status,
+		})
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{
+						"service.name":    gsTraceServiceName,
+						"service.version": Version,
+					}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": gsTraceServiceName},
+						"spans": exported,
+					},
+				},
+			},
+		},
+	}
+
+	body, err := json.Marshal(payload)
+
+	if err != nil {
+		warnPrintf("could not encode spans: %s\n", err)
+		return
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(t.endpoint+"/v1/traces", "application/json", bytes.NewReader(body))
+
+	if err != nil {
+		warnPrintf("could not export spans: %s\n", err)
+		return
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		warnPrintf("could not export spans: %s\n", resp.Status)
+		return
+	}
+
+	debugPrintf("exported %d spans to %s\n", len(exported), t.endpoint)
+}
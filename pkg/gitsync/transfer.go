@@ -0,0 +1,213 @@
+package gitsync
+
+import "strconv"
+
+// Transfer tunes how a remote's fetches and pushes talk to the server, for
+// slow or high-latency links. Everything but NoProgress needs the git
+// backend for the operation, since go-git neither sends thin packs nor
+// negotiates in rounds.
+type Transfer struct {
+	// ThinPack sends pushes as thin packs, with deltas against objects the
+	// remote already has, which git does by default.
+	ThinPack *bool `json:"thin_pack"`
+	// NegotiationTips only offers these refs, or globs of them, as common
+	// history when fetching, rather than every ref.
+	NegotiationTips []string `json:"negotiation_tips"`
+	// NegotiationAlgorithm is git's fetch.negotiationAlgorithm; skipping
+	// takes fewer round trips.
+	NegotiationAlgorithm string `json:"negotiation_algorithm"`
+	// PushNegotiate finds out what the remote already has before pushing,
+	// so less is sent.
+	PushNegotiate bool `json:"push_negotiate"`
+	// NoProgress asks the server not to send progress.
+	NoProgress bool `json:"no_progress"`
+	// Filter fetches partially, like git fetch --filter, e.g. blob:none
+	// leaves out file contents until a push needs them.
+	Filter string `json:"filter"`
+	// DeepenBy fetches the branches of a first mirror this many commits of
+	// history at a time, so an interrupted fetch resumes from the last step
+	// fetched rather than from nothing.
+	DeepenBy int `json:"deepen_by"`
+	// ProtocolVersion is the git protocol version to speak: 2, the
+	// default, or 0 or 1 for servers that misbehave on 2.
+	ProtocolVersion *int `json:"protocol_version"`
+	// DisableCapabilities turns off capabilities git would use when the
+	// server offers them.
+	DisableCapabilities []string `json:"disable_capabilities"`
+}
+
+var gsNegotiationAlgorithms = map[string]bool{
+	"consecutive": true,
+	"default":     true,
+	"noop":        true,
+	"skipping":    true,
+}
+
+// gsCapabilityConfig is the git config that stops git using each
+// capability that can be turned off, for fetches or for pushes.
+var gsCapabilityConfig = map[string]struct {
+	push    bool
+	setting [2]string
+}{
+	"bundle-uri":    {false, [2]string{"transfer.bundleURI", "false"}},
+	"side-band-64k": {true, [2]string{"sendpack.sideband", "false"}},
+}
+
+// checkTransfer validates a remote's transfer settings against the
+// backends its operations run with.
+func (s *Syncer) checkTransfer(name string, transfer *Transfer) bool {
+	if transfer == nil {
+		return true
+	}
+
+	if transfer.NegotiationAlgorithm != "" && !gsNegotiationAlgorithms[transfer.NegotiationAlgorithm] {
+		errorPrintf("%s remote has an unknown negotiation_algorithm: %s\n", name, transfer.NegotiationAlgorithm)
+		return false
+	}
+
+	if transfer.DeepenBy < 0 {
+		errorPrintf("%s remote's deepen_by can't be negative\n", name)
+		return false
+	}
+
+	if transfer.ProtocolVersion != nil && (*transfer.ProtocolVersion < 0 || *transfer.ProtocolVersion > 2) {
+		errorPrintf("%s remote's protocol_version must be 0, 1 or 2\n", name)
+		return false
+	}
+
+	for _, capability := range transfer.DisableCapabilities {
+		if _, known := gsCapabilityConfig[capability]; !known {
+			errorPrintf("%s remote can't disable the %s capability, only bundle-uri and side-band-64k\n", name, capability)
+			return false
+		}
+	}
+
+	// go-git only speaks version 0, and uses whatever the server offers.
+	for _, op := range []string{opPull, opPush} {
+		if _, git := s.backendFor(name, op).(systemGitBackend); !git && ((transfer.ProtocolVersion != nil && *transfer.ProtocolVersion != 0) || len(transfer.DisableCapabilities) > 0) {
+			errorPrintf("%s remote's protocol_version and disable_capabilities need the git backend for pulls and pushes\n", name)
+			return false
+		}
+	}
+
+	if _, git := s.backendFor(name, opPull).(systemGitBackend); !git && (len(transfer.NegotiationTips) > 0 || transfer.NegotiationAlgorithm != "" || transfer.DeepenBy > 0 || transfer.Filter != "") {
+		errorPrintf("%s remote's negotiation_tips, negotiation_algorithm, deepen_by and filter need the git backend for pulls\n", name)
+		return false
+	}
+
+	if _, git := s.backendFor(name, opPush).(systemGitBackend); !git && ((transfer.ThinPack != nil && *transfer.ThinPack) || transfer.PushNegotiate) {
+		errorPrintf("%s remote's thin_pack and push_negotiate need the git backend for pushes\n", name)
+		return false
+	}
+
+	return true
+}
+
+// transferArgs are the git fetch or push options for a remote's transfer
+// settings.
+func (s *Syncer) transferArgs(remote string, push bool) []string {
+	transfer := s.config.Remotes[remote].Transfer
+
+	if transfer == nil {
+		return nil
+	}
+
+	var args []string
+
+	if push && transfer.ThinPack != nil {
+		if *transfer.ThinPack {
+			args = append(args, "--thin")
+		} else {
+			args = append(args, "--no-thin")
+		}
+	}
+
+	if !push {
+		for _, tip := range transfer.NegotiationTips {
+			args = append(args, "--negotiation-tip="+tip)
+		}
+	}
+
+	if !push && transfer.Filter != "" {
+		args = append(args, "--filter="+transfer.Filter)
+	}
+
+	return args
+}
+
+// transferConfig is the git config for a remote's transfer settings.
+// Protocol version 2 is asked for unless the remote says otherwise, since
+// git's own config may hold it back.
+func (s *Syncer) transferConfig(remote string, push bool) [][2]string {
+	settings := [][2]string{{"protocol.version", "2"}}
+	transfer := s.config.Remotes[remote].Transfer
+
+	if transfer == nil {
+		return settings
+	}
+
+	if transfer.ProtocolVersion != nil {
+		settings[0][1] = strconv.Itoa(*transfer.ProtocolVersion)
+	}
+
+	if push && transfer.PushNegotiate {
+		settings = append(settings, [2]string{"push.negotiate", "true"})
+	}
+
+	if !push && transfer.NegotiationAlgorithm != "" {
+		settings = append(settings, [2]string{"fetch.negotiationAlgorithm", transfer.NegotiationAlgorithm})
+	}
+
+	for _, capability := range transfer.DisableCapabilities {
+		if config := gsCapabilityConfig[capability]; config.push == push {
+			settings = append(settings, config.setting)
+		}
+	}
+
+	return settings
+}
+
+// checkPartialTargets makes sure branches fetched partially are only pushed
+// with git, which fetches what it needs to push, where go-git fails on the
+// objects the repository doesn't have.
+func (s *Syncer) checkPartialTargets() bool {
+	for _, sync := range s.config.Sync {
+		if s.partialFilter(sync.Source) == "" {
+			continue
+		}
+
+		if _, git := s.backendFor(sync.Target, opPush).(systemGitBackend); !git {
+			errorPrintf("%s remote is fetched with a filter, so %s needs the git backend for pushes\n", sync.Source, sync.Target)
+			return false
+		}
+	}
+
+	return true
+}
+
+// partialFilter is the filter remote is fetched with, or "" when it is
+// fetched in full.
+func (s *Syncer) partialFilter(remote string) string {
+	if transfer := s.config.Remotes[remote].Transfer; transfer != nil {
+		return transfer.Filter
+	}
+
+	return ""
+}
+
+// deepenBy is how many commits of history at a time a first mirror from
+// remote is fetched in, or 0 to fetch it all at once.
+func (s *Syncer) deepenBy(remote string) int {
+	if transfer := s.config.Remotes[remote].Transfer; transfer != nil {
+		return transfer.DeepenBy
+	}
+
+	return 0
+}
+
+// sendsProgress reports whether remote's server should send progress.
+func (s *Syncer) sendsProgress(remote string) bool {
+	transfer := s.config.Remotes[remote].Transfer
+
+	return transfer == nil || !transfer.NoProgress
+}
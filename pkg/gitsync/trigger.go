@@ -0,0 +1,78 @@
+package gitsync
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrWebhookUnauthenticated is returned by VerifyWebhook for a delivery
+// that doesn't prove it was sent by the source's forge.
+var ErrWebhookUnauthenticated = errors.New("webhook delivery isn't authenticated")
+
+// ErrWebhookUnknownSource is returned by VerifyWebhook for an authenticated
+// delivery about a remote that no sync entry syncs from.
+var ErrWebhookUnknownSource = errors.New("not the source of any sync entry")
+
+// VerifyWebhook checks that a webhook delivery, with header and body, about
+// the source remote was sent by its forge, going by the remote's
+// webhook_secret: GitHub, Gitea and Forgejo sign the body with it in
+// X-Hub-Signature-256, and GitLab sends it as is in X-Gitlab-Token.
+// Deliveries to remotes without a webhook_secret never verify. Only once a
+// delivery is authenticated is the remote looked for among the sources, so
+// a caller without the secret can't tell which remotes are.
+func (s *Syncer) VerifyWebhook(source string, header http.Header, body []byte) error {
+	if err := s.authenticateWebhook(source, header, body); err != nil {
+		return err
+	}
+
+	for _, entry := range s.config.Sync {
+		if entry.Source == source {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s: %w", source, ErrWebhookUnknownSource)
+}
+
+// authenticateWebhook checks a delivery's signature or token against the
+// remote's webhook_secret.
+func (s *Syncer) authenticateWebhook(source string, header http.Header, body []byte) error {
+	secret, err := resolveSecret(s.config.Remotes[source].WebhookSecret)
+
+	if err != nil {
+		return fmt.Errorf("%s webhook_secret: %w", source, err)
+	}
+
+	if secret == "" {
+		return fmt.Errorf("%w: %s has no webhook_secret", ErrWebhookUnauthenticated, source)
+	}
+
+	if signature, found := strings.CutPrefix(header.Get("X-Hub-Signature-256"), "sha256="); found {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		expected := mac.Sum(nil)
+		given, err := hex.DecodeString(signature)
+
+		if err != nil || !hmac.Equal(given, expected) {
+			return fmt.Errorf("%w: bad signature for %s", ErrWebhookUnauthenticated, source)
+		}
+
+		return nil
+	}
+
+	if token := header.Get("X-Gitlab-Token"); token != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return fmt.Errorf("%w: bad token for %s", ErrWebhookUnauthenticated, source)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("%w: no signature or token for %s", ErrWebhookUnauthenticated, source)
+}
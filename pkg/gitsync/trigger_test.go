@@ -0,0 +1,66 @@
+package gitsync
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestVerifyWebhook(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	s := &Syncer{config: Config{
+		Remotes: map[string]Remote{
+			"github":  {WebhookSecret: "s3cret"},
+			"unsafe":  {},
+			"target":  {WebhookSecret: "s3cret"},
+			"another": {WebhookSecret: "other"},
+		},
+		Sync: []SyncEntry{
+			{Source: "github", Target: "target"},
+			{Source: "unsafe", Target: "target"},
+			{Source: "another", Target: "target"},
+		},
+	}}
+
+	tests := []struct {
+		name   string
+		source string
+		header map[string]string
+		err    error
+	}{
+		{"signed", "github", map[string]string{"X-Hub-Signature-256": signature}, nil},
+		{"signed with another secret", "another", map[string]string{"X-Hub-Signature-256": signature}, ErrWebhookUnauthenticated},
+		{"bad signature", "github", map[string]string{"X-Hub-Signature-256": "sha256=" + hex.EncodeToString(make([]byte, sha256.Size))}, ErrWebhookUnauthenticated},
+		{"signature not hex", "github", map[string]string{"X-Hub-Signature-256": "sha256=nothex"}, ErrWebhookUnauthenticated},
+		{"sha1 signature", "github", map[string]string{"X-Hub-Signature": "sha1=0000"}, ErrWebhookUnauthenticated},
+		{"token", "github", map[string]string{"X-Gitlab-Token": "s3cret"}, nil},
+		{"bad token", "github", map[string]string{"X-Gitlab-Token": "s3cre"}, ErrWebhookUnauthenticated},
+		{"bad signature and good token", "github", map[string]string{"X-Hub-Signature-256": "sha256=00", "X-Gitlab-Token": "s3cret"}, ErrWebhookUnauthenticated},
+		{"nothing", "github", nil, ErrWebhookUnauthenticated},
+		{"no webhook_secret", "unsafe", map[string]string{"X-Gitlab-Token": ""}, ErrWebhookUnauthenticated},
+		{"not a source", "target", map[string]string{"X-Gitlab-Token": "s3cret"}, ErrWebhookUnknownSource},
+		{"not a source with a bad token", "target", map[string]string{"X-Gitlab-Token": "s3cre"}, ErrWebhookUnauthenticated},
+		{"unknown remote", "gitlab", map[string]string{"X-Gitlab-Token": "s3cret"}, ErrWebhookUnauthenticated},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+
+			for key, value := range test.header {
+				header.Set(key, value)
+			}
+
+			if err := s.VerifyWebhook(test.source, header, body); !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+				t.Errorf("got %v, want %v", err, test.err)
+			}
+		})
+	}
+}
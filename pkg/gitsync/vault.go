@@ -0,0 +1,152 @@
+package gitsync
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+const gsDefaultVaultSSHMount string = "ssh"
+const gsDefaultSSHUser string = "git"
+
+type vaultSignRequest struct {
+	PublicKey       string `json:"public_key"`
+	CertType        string `json:"cert_type"`
+	ValidPrincipals string `json:"valid_principals,omitempty"`
+}
+
+type vaultSignResponse struct {
+	Data struct {
+		SignedKey string `json:"signed_key"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// newVaultSSHAuth generates a throwaway ed25519 key for this run and has
+// Vault's SSH secrets engine sign it, so no long-lived key is ever stored on
+// the mirror host.
+func newVaultSSHAuth(settings *Auth) (transport.AuthMethod, error) {
+	vaultAddr := settings.VaultAddr
+
+	if vaultAddr == "" {
+		vaultAddr = os.Getenv("VAULT_ADDR")
+	}
+
+	if vaultAddr == "" {
+		return nil, errors.New("vault_addr is not set and VAULT_ADDR is empty")
+	}
+
+	vaultToken := os.Getenv("VAULT_TOKEN")
+
+	if settings.VaultToken != "" {
+		var err error
+
+		vaultToken, err = resolveSecret(settings.VaultToken)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mount := settings.Mount
+
+	if mount == "" {
+		mount = gsDefaultVaultSSHMount
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(vaultSignRequest{
+		PublicKey:       string(ssh.MarshalAuthorizedKey(sshPublicKey)),
+		CertType:        "user",
+		ValidPrincipals: settings.Principals,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	signURL := fmt.Sprintf("%s/v1/%s/sign/%s", strings.TrimSuffix(vaultAddr, "/"), mount, settings.Role)
+	req, err := http.NewRequest(http.MethodPost, signURL, bytes.NewReader(body))
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Vault-Token", vaultToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	var signed vaultSignResponse
+
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		return nil, fmt.Errorf("could not decode vault response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault refused to sign key: %s %s", resp.Status, strings.Join(signed.Errors, ", "))
+	}
+
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signed.Data.SignedKey))
+
+	if err != nil {
+		return nil, fmt.Errorf("could not parse signed key: %w", err)
+	}
+
+	cert, ok := parsed.(*ssh.Certificate)
+
+	if !ok {
+		return nil, errors.New("vault did not return an ssh certificate")
+	}
+
+	keySigner, err := ssh.NewSignerFromKey(privateKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, keySigner)
+
+	if err != nil {
+		return nil, err
+	}
+
+	debugPrintf("vault signed ssh certificate %s valid until %s\n", cert.KeyId, time.Unix(int64(cert.ValidBefore), 0))
+
+	username := settings.Username
+
+	if username == "" {
+		username = gsDefaultSSHUser
+	}
+
+	return &gitssh.PublicKeys{User: username, Signer: certSigner}, nil
+}
@@ -0,0 +1,113 @@
+package gitsync
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const gsWebhookSignatureHeader string = "X-Gitsync-Signature"
+const gsWebhookEventHeader string = "X-Gitsync-Event"
+
+type webhookEvent struct {
+	Event     string      `json:"event"`
+	RunID     string      `json:"run_id"`
+	Timestamp time.Time   `json:"timestamp"`
+	Host      string      `json:"host"`
+	Run       *reportRun  `json:"run,omitempty"`
+	Sync      *reportSync `json:"sync,omitempty"`
+}
+
+// webhookNotifier posts every event as signed JSON.
+type webhookNotifier struct{}
+
+func (n webhookNotifier) Check(notification Notification) error {
+	if notification.URL == "" {
+		return errors.New("has no url")
+	}
+
+	return nil
+}
+
+func (n webhookNotifier) Events() []string {
+	return []string{eventRunStarted, eventRunFinished, eventSyncFailed}
+}
+
+func (n webhookNotifier) Send(message *NotificationMessage) error {
+	return postWebhook(message.Notification, eventPayload(message))
+}
+
+// eventPayload is the JSON webhooks, and other notifications that send
+// events as they are, send for message: the sync entry for per-sync events
+// and the run for the rest.
+func eventPayload(message *NotificationMessage) webhookEvent {
+	payload := webhookEvent{Event: message.Event, RunID: message.Run.ID, Timestamp: time.Now(), Host: message.report.Host}
+
+	if message.Event == eventSyncFailed || message.Event == eventSyncFinished {
+		if len(message.report.Syncs) > 0 {
+			payload.Sync = &message.report.Syncs[0]
+		}
+	} else {
+		payload.Run = &message.report
+	}
+
+	return payload
+}
+
+// postWebhook sends the event as JSON, signed with HMAC-SHA256 over the body
+// when a secret is configured, in the same "sha256=<hex>" form GitHub uses.
+func postWebhook(notification Notification, payload webhookEvent) error {
+	webhook, err := resolveSecret(notification.URL)
+
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(payload)
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, webhook, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(gsWebhookEventHeader, payload.Event)
+
+	if notification.Secret != "" {
+		secret, err := resolveSecret(notification.Secret)
+
+		if err != nil {
+			return err
+		}
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set(gsWebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
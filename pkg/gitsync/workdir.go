@@ -0,0 +1,236 @@
+package gitsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// gsWorkdirGCFile is touched in a workdir clone each time it is garbage
+// collected.
+const gsWorkdirGCFile string = "gitsync/gc"
+
+// gsWorkdirGCInterval is how often a workdir clone is garbage collected.
+const gsWorkdirGCInterval = 24 * time.Hour
+
+// gsWorkdirPruneAge is how old the unreachable objects go-git prunes from a
+// workdir clone must be when git itself isn't there to collect garbage, as
+// git gc's default.
+const gsWorkdirPruneAge = 14 * 24 * time.Hour
+
+func (s *Syncer) checkWorkdir() bool {
+	switch {
+	case s.workdir == "":
+		return true
+	case s.fs != nil:
+		errorPrintf("a workdir needs the repository on disk\n")
+		return false
+	case len(s.config.Sync) == 0:
+		errorPrintf("a workdir needs a sync entry to know what to clone\n")
+		return false
+	}
+
+	for i, sync := range s.config.Sync {
+		for _, remote := range []string{sync.Source, sync.Target} {
+			if s.config.Remotes[remote].URL == "" {
+				errorPrintf("sync entry %d: %s remote needs a url to be synced in a workdir\n", i, remote)
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// workdirClone is the directory of the config's clone in the workdir, named
+// after its first source and told apart by its remotes, as each config sets
+// the clone's remotes to its own.
+func (s *Syncer) workdirClone() string {
+	var remotes []string
+
+	for name, remote := range s.config.Remotes {
+		if remote.URL != "" {
+			remotes = append(remotes, name+" "+remote.URL)
+		}
+	}
+
+	slices.Sort(remotes)
+	sum := sha256.Sum256([]byte(strings.Join(remotes, "\n")))
+	source := s.config.Remotes[s.config.Sync[0].Source].URL
+	name := strings.TrimSuffix(path.Base(strings.TrimRight(filepath.ToSlash(source), "/")), ".git")
+
+	return filepath.Join(s.workdir, name+"-"+hex.EncodeToString(sum[:])[:12]+".git")
+}
+
+// openWorkdir creates the config's bare clone in the workdir the first time,
+// points its remotes at the config's URLs and makes it the repository that
+// is synced.
+func (s *Syncer) openWorkdir() error {
+	unlock, err := s.lockWorkdir(context.Background())
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	dir := s.workdirClone()
+	repo, err := git.PlainOpen(dir)
+
+	// Relative paths to local remotes are relative to where gitsync runs,
+	// not to the clone.
+	cwd, _ := os.Getwd()
+	urls := make(map[string]string)
+
+	for name, remote := range s.config.Remotes {
+		if remote.URL != "" {
+			urls[name] = absoluteURL(remote.URL, cwd)
+		}
+	}
+
+	if errors.Is(err, git.ErrRepositoryNotExists) && s.cloneLocalWorkdir(dir, urls[s.config.Sync[0].Source]) {
+		repo, err = git.PlainOpen(dir)
+	} else if errors.Is(err, git.ErrRepositoryNotExists) {
+		s.infoPrintf("creating workdir clone in %s\n", dir)
+		repo, err = git.PlainInit(dir, true)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not open workdir clone %s: %w", dir, err)
+	}
+
+	remotes, err := repo.Remotes()
+
+	if err != nil {
+		return fmt.Errorf("could not list remotes of %s: %w", dir, err)
+	}
+
+	// The clone is gitsync's own, so its remotes are exactly the config's.
+	for _, remote := range remotes {
+		name := remote.Config().Name
+
+		if url, exists := urls[name]; exists && slices.Equal(remote.Config().URLs, []string{url}) {
+			continue
+		}
+
+		if err := repo.DeleteRemote(name); err != nil {
+			return fmt.Errorf("could not remove %s from %s: %w", name, dir, err)
+		}
+	}
+
+	for name, url := range urls {
+		if _, err := repo.Remote(name); err == nil {
+			continue
+		}
+
+		_, err := repo.CreateRemote(&config.RemoteConfig{
+			Name:  name,
+			URLs:  []string{url},
+			Fetch: []config.RefSpec{config.RefSpec("+refs/heads/*:refs/remotes/" + name + "/*")},
+		})
+
+		if err != nil {
+			return fmt.Errorf("could not add %s to %s: %w", name, dir, err)
+		}
+	}
+
+	// The clone is named by its absolute path, as RepoDir is.
+	s.repoDir, err = filepath.Abs(dir)
+
+	return err
+}
+
+// lockWorkdir takes the lock of the workdir clone, which is beside it, as
+// the clone doesn't exist until it is cloned, so gitsyncs sharing the
+// workdir don't clone, fetch into or collect the garbage of it at once.
+func (s *Syncer) lockWorkdir(ctx context.Context) (func(), error) {
+	if s.workdir == "" {
+		return func() {}, nil
+	}
+
+	return s.lock(ctx, s.workdirClone()+".lock")
+}
+
+// seedWorkdirBranches creates the synced branches a workdir clone doesn't
+// have yet at what was fetched for them, so a new clone starts from its
+// sources.
+func (s *Syncer) seedWorkdirBranches() error {
+	if s.workdir == "" {
+		return nil
+	}
+
+	repo, err := s.openRepo()
+
+	if err != nil {
+		return err
+	}
+
+	for _, sync := range s.config.Sync {
+		for _, branch := range sync.Branches {
+			fetched, err := repo.Reference(trackingRef(sync.Source, branch), true)
+
+			if s.branchExists(branch) || err != nil {
+				continue
+			}
+
+			branchRef := plumbing.NewBranchReferenceName(branch)
+
+			if err := repo.Storer.SetReference(plumbing.NewHashReference(branchRef, fetched.Hash())); err != nil {
+				return fmt.Errorf("could not create %s in the workdir clone: %w", branch, err)
+			}
+
+			s.debugPrintf("created %s at %s from %s in the workdir clone\n", branch, ShortSHA(fetched.Hash().String()), sync.Source)
+			s.repoBranches[branch] = branchRef.String()
+		}
+	}
+
+	return nil
+}
+
+// gcWorkdir collects the garbage in the workdir clone once a day: with git
+// gc --auto when git is installed, or otherwise by pruning unreachable loose
+// objects with go-git.
+func (s *Syncer) gcWorkdir(ctx context.Context) error {
+	marker := filepath.Join(s.repoDir, gsWorkdirGCFile)
+
+	if info, err := os.Stat(marker); s.workdir == "" || (err == nil && time.Since(info.ModTime()) < gsWorkdirGCInterval) {
+		return nil
+	}
+
+	s.debugPrintf("collecting garbage in %s\n", s.repoDir)
+
+	if binary, err := exec.LookPath("git"); err == nil {
+		if output, err := commandContext(ctx, binary, "-C", s.repoDir, "gc", "--auto", "--quiet").CombinedOutput(); err != nil {
+			return fmt.Errorf("git gc failed: %w: %s", err, lastLine(string(output)))
+		}
+	} else {
+		repo, err := s.openRepo()
+
+		if err == nil {
+			err = repo.Prune(git.PruneOptions{OnlyObjectsOlderThan: time.Now().Add(-gsWorkdirPruneAge), Handler: repo.DeleteObject})
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(marker), 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(marker, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0o644)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	runtimepprof "runtime/pprof"
+)
+
+// serveProfiling serves the runtime profiles under /debug/pprof/ on addr
+// until the server fails. It is kept apart from the metrics address, as
+// profiles expose far more of the process than metrics do.
+func serveProfiling(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	infoPrintf("serving profiles on %s/debug/pprof/\n", addr)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		errorPrintf("profiling server stopped: %s\n", err)
+	}
+}
+
+// startProfiles starts writing a CPU profile to cpuPath, if set, and
+// returns what stops it and writes a heap profile to memPath, if set, to be
+// called once gitsync is done.
+func startProfiles(cpuPath, memPath string) (func(), error) {
+	var cpuFile *os.File
+
+	if cpuPath != "" {
+		file, err := os.Create(cpuPath)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := runtimepprof.StartCPUProfile(file); err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		cpuFile = file
+	}
+
+	stop := func() {
+		if cpuFile != nil {
+			runtimepprof.StopCPUProfile()
+			cpuFile.Close()
+		}
+
+		if memPath == "" {
+			return
+		}
+
+		file, err := os.Create(memPath)
+
+		if err != nil {
+			errorPrintf("could not write memory profile: %s\n", err)
+			return
+		}
+
+		defer file.Close()
+
+		// The heap profile is as of the last collection, so one is forced
+		// to make it up to date.
+		runtime.GC()
+
+		if err := runtimepprof.WriteHeapProfile(file); err != nil {
+			errorPrintf("could not write memory profile %s: %s\n", memPath, err)
+		}
+	}
+
+	return stop, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+
+	"github.com/rys/gitsync/pkg/gitsync"
+)
+
+// syncProjects syncs every GitLab project gitlab_system_hook has added to
+// the sync set, each in a workdir clone of its own, keeping the Syncer made
+// for each in syncers for the next run. It reports whether they all synced.
+func syncProjects(ctx context.Context, syncer *gitsync.Syncer, options gitsync.Options, syncers map[string]*gitsync.Syncer) bool {
+	names, err := syncer.Projects()
+
+	if err != nil {
+		errorPrintf("%s\n", err)
+		return false
+	}
+
+	if len(names) == 0 {
+		return true
+	}
+
+	if options.Workdir == "" {
+		errorPrintf("the GitLab projects gitlab_system_hook added need -workdir to be synced\n")
+		return false
+	}
+
+	synced := true
+
+	for _, name := range names {
+		if ctx.Err() != nil {
+			break
+		}
+
+		project := syncers[name]
+
+		if project == nil {
+			project, err = syncer.NewProject(name, options)
+
+			if err != nil {
+				errorPrintf("GitLab project %s: %s\n", name, err)
+				synced = false
+				continue
+			}
+
+			syncers[name] = project
+		}
+
+		infoPrintf("syncing GitLab project %s\n", name)
+		run, err := project.Run(ctx)
+
+		if err != nil {
+			errorPrintf("GitLab project %s: %s\n", name, err)
+		}
+
+		printSummary(run)
+		annotateRun(run)
+		synced = synced && err == nil && !run.Failed()
+	}
+
+	return synced
+}
+
+// closeProjects closes and forgets the Syncers of GitLab projects, so they
+// are made afresh from the config next run.
+func closeProjects(syncers map[string]*gitsync.Syncer) {
+	for name, project := range syncers {
+		closeSyncer(project)
+		delete(syncers, name)
+	}
+}
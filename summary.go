@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rys/gitsync/pkg/gitsync"
+)
+
+// printSummary writes a table with the outcome of every branch of every sync
+// entry. Quiet runs only print it when something didn't sync, and runs that
+// stopped before any sync entry have nothing to print.
+func printSummary(run *gitsync.RunResult) {
+	if len(run.Syncs) == 0 || (!gitsync.LogEnabled(gitsync.LevelInfo) && !run.Failed()) {
+		return
+	}
+
+	w := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "SOURCE\tTARGET\tBRANCH\t%s\tOLD\tNEW\tCOMMITS\tDURATION\tPULL\tPUSH\tRECEIVED\tSENT\tERROR\n", colorize(colorDefault, "RESULT"))
+
+	for _, result := range run.Syncs {
+		for _, branch := range result.Branches {
+			errText := ""
+
+			if branch.Err != nil {
+				errText = branch.Err.Error()
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				result.Source, result.Target, branch.Branch, colorStatus(branch.Status),
+				gitsync.ShortSHA(branch.OldSHA), gitsync.ShortSHA(branch.NewSHA), branch.Commits,
+				branch.Duration.Round(time.Millisecond), branch.PullDuration.Round(time.Millisecond), branch.PushDuration.Round(time.Millisecond),
+				gitsync.HumanBytes(branch.BytesReceived), gitsync.HumanBytes(branch.BytesSent), errText)
+		}
+	}
+
+	w.Flush()
+}
+
+// printDrift writes a table with the drift of every branch, returning false
+// if any mirror is stale, missing or couldn't be checked.
+func printDrift(drifts []*gitsync.Drift) bool {
+	inSync := true
+
+	w := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "SOURCE\tTARGET\tBRANCH\t%s\tSOURCE SHA\tTARGET SHA\tERROR\n", colorize(colorDefault, "STATE"))
+
+	for _, drift := range drifts {
+		errText := ""
+
+		if drift.Err != nil {
+			errText = drift.Err.Error()
+		}
+
+		if drift.State != gitsync.DriftInSync {
+			inSync = false
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", drift.Source, drift.Target, drift.Branch, colorStatus(drift.State),
+			gitsync.ShortSHA(drift.SourceSHA), gitsync.ShortSHA(drift.TargetSHA), errText)
+	}
+
+	w.Flush()
+
+	return inSync
+}
+
+// printBench writes a table with how long each phase took against each
+// remote, returning false if any failed.
+func printBench(report *gitsync.BenchReport) bool {
+	succeeded := true
+
+	w := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "PHASE\tREMOTE\tREFS\tROUNDS\tMIN\tMEAN\tMAX\tERROR\n")
+
+	for _, result := range report.Results {
+		remote, errText := result.Remote, ""
+
+		if remote == "" {
+			remote = fmt.Sprintf("all, %d per host", report.FetchesPerHost)
+		}
+
+		if result.Err != nil {
+			succeeded = false
+			errText = result.Err.Error()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n", result.Phase, remote, result.Refs, len(result.Durations),
+			result.Min().Round(time.Millisecond), result.Mean().Round(time.Millisecond), result.Max().Round(time.Millisecond), errText)
+	}
+
+	w.Flush()
+
+	return succeeded
+}
+
+// printPlan writes a table with the change a sync would make to every
+// branch.
+func printPlan(plan *gitsync.Plan) {
+	w := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "SOURCE\tTARGET\tBRANCH\t%s\tOLD\tNEW\tCOMMITS\n", colorize(colorDefault, "ACTION"))
+
+	for _, change := range plan.Changes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n", change.Source, change.Target, change.Branch, colorStatus(change.Action),
+			gitsync.ShortSHA(change.OldSHA), gitsync.ShortSHA(change.NewSHA), change.Commits)
+	}
+
+	w.Flush()
+}
+
+// printBundles writes a table with the bundle written for every sync entry
+// that had something new.
+func printBundles(bundles []*gitsync.BundleResult) {
+	if len(bundles) == 0 {
+		return
+	}
+
+	w := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "SOURCE\tTARGET\tBRANCHES\tOBJECTS\t%s\tBUNDLE\n", colorize(colorDefault, "KIND"))
+
+	for _, bundle := range bundles {
+		kind := "incremental"
+
+		if len(bundle.Prerequisites) == 0 {
+			kind = "full"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", bundle.Source, bundle.Target, len(bundle.Branches), bundle.Objects, colorize(colorDefault, kind), bundle.Path)
+	}
+
+	w.Flush()
+}
+
+// printPatchSeries writes a table with the patch series written for every
+// branch that had new commits.
+func printPatchSeries(series []*gitsync.PatchSeries) {
+	if len(series) == 0 {
+		return
+	}
+
+	w := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "SOURCE\tBRANCH\tBASE\tTIP\tCOMMITS\tSERIES\n")
+
+	for _, patches := range series {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", patches.Source, patches.Branch, gitsync.ShortSHA(patches.Base), gitsync.ShortSHA(patches.Tip), patches.Commits, patches.Path)
+	}
+
+	w.Flush()
+}
+
+// printExplanations writes why a branch was or wasn't synced by each sync
+// entry with it.
+func printExplanations(report *gitsync.ExplainReport) {
+	for i, explanation := range report.Explanations {
+		if i > 0 {
+			fmt.Fprintln(output)
+		}
+
+		entry := explanation.Branch
+
+		if explanation.Source != "" {
+			entry = fmt.Sprintf("%s from %s to %s", explanation.Branch, explanation.Source, explanation.Target)
+		}
+
+		if explanation.Cause != "" {
+			fmt.Fprintf(output, "%s: %s\n", entry, colorize(colorRed, explanation.Cause))
+		} else {
+			fmt.Fprintf(output, "%s: %s\n", entry, colorize(colorGreen, "nothing stops it syncing"))
+		}
+
+		if run := explanation.LastRun; run != nil {
+			result := colorStatus(run.Status)
+
+			if run.Error != "" {
+				result += ": " + run.Error
+			} else if run.Status == gitsync.StatusSkipped {
+				result += ", why wasn't recorded by the gitsync that ran it"
+			}
+
+			fmt.Fprintf(output, "  last run:  %s at %s, %s\n", run.RunID, run.Finished.Local().Format(time.DateTime), result)
+		} else if explanation.Configured {
+			fmt.Fprintf(output, "  last run:  none recorded\n")
+		}
+
+		for _, problem := range explanation.Problems {
+			fmt.Fprintf(output, "  now:       %s\n", problem)
+		}
+
+		if explanation.Hint != "" {
+			fmt.Fprintf(output, "  hint:      %s\n", explanation.Hint)
+		}
+	}
+
+	if !report.History {
+		infoPrintf("no -history-db, so only what would stop the next run syncing it is shown\n")
+	}
+}
+
+// printStatus writes a table with where every branch stands and the last
+// run that synced it.
+func printStatus(report *gitsync.StatusReport) {
+	w := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "SOURCE\tTARGET\tBRANCH\t%s\tSOURCE SHA\tTARGET SHA\tAHEAD\tBEHIND\tLAST RUN\t%s\tERROR\n", colorize(colorDefault, "STATE"), colorize(colorDefault, "RESULT"))
+
+	for _, status := range report.Branches {
+		state := gitsync.DriftInSync
+
+		switch {
+		case status.Err != nil:
+			state = gitsync.DriftError
+		case status.TargetSHA == "":
+			state = gitsync.DriftMissing
+		case status.SourceSHA != status.TargetSHA:
+			state = gitsync.DriftStale
+		}
+
+		ahead, behind := "?", "?"
+
+		if status.Counted {
+			ahead, behind = fmt.Sprint(status.Ahead), fmt.Sprint(status.Behind)
+		} else if status.Err != nil || status.TargetSHA == "" {
+			ahead, behind = "-", "-"
+		}
+
+		lastRun, result, errText := "-", "-", ""
+
+		if run := status.LastRun; run != nil {
+			lastRun, result, errText = run.Finished.Local().Format(time.DateTime), colorStatus(run.Status), run.Error
+		}
+
+		if status.Err != nil {
+			errText = status.Err.Error()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", status.Source, status.Target, status.Branch, colorStatus(state),
+			gitsync.ShortSHA(status.SourceSHA), gitsync.ShortSHA(status.TargetSHA), ahead, behind, lastRun, result, errText)
+	}
+
+	w.Flush()
+
+	if !report.History {
+		infoPrintf("no -history-db, so there are no last runs to show\n")
+	}
+}
@@ -0,0 +1,92 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"strings"
+
+	"github.com/rys/gitsync/pkg/gitsync"
+)
+
+var gsSyslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// syslogWriter sends each log line to syslog at the severity matching its
+// level prefix. Lines without one come from log.Fatal and are critical.
+type syslogWriter struct {
+	writer *syslog.Writer
+}
+
+func newSyslogWriter(facility, tag string) (io.Writer, error) {
+	priority, exists := gsSyslogFacilities[strings.ToLower(facility)]
+
+	if !exists {
+		return nil, fmt.Errorf("unknown syslog facility %s", facility)
+	}
+
+	writer, err := syslog.New(priority|syslog.LOG_INFO, tag)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogWriter{writer: writer}, nil
+}
+
+func (w *syslogWriter) Write(b []byte) (int, error) {
+	line := strings.TrimRight(stripLogTimestamp(string(b)), "\n")
+
+	var err error
+
+	switch {
+	case strings.HasPrefix(line, gitsync.LogPrefix(gitsync.LevelError)):
+		err = w.writer.Err(strings.TrimPrefix(line, gitsync.LogPrefix(gitsync.LevelError)))
+	case strings.HasPrefix(line, gitsync.LogPrefix(gitsync.LevelWarn)):
+		err = w.writer.Warning(strings.TrimPrefix(line, gitsync.LogPrefix(gitsync.LevelWarn)))
+	case strings.HasPrefix(line, gitsync.LogPrefix(gitsync.LevelInfo)):
+		err = w.writer.Info(strings.TrimPrefix(line, gitsync.LogPrefix(gitsync.LevelInfo)))
+	case strings.HasPrefix(line, gitsync.LogPrefix(gitsync.LevelDebug)):
+		err = w.writer.Debug(strings.TrimPrefix(line, gitsync.LogPrefix(gitsync.LevelDebug)))
+	case strings.HasPrefix(line, gitsync.LogPrefix(gitsync.LevelTrace)):
+		err = w.writer.Debug(strings.TrimPrefix(line, gitsync.LogPrefix(gitsync.LevelTrace)))
+	default:
+		err = w.writer.Crit(line)
+	}
+
+	return len(b), err
+}
+
+// stripLogTimestamp removes the date and time the standard logger puts in
+// front of every line, for destinations that add their own.
+func stripLogTimestamp(line string) string {
+	const stamp = "2006/01/02 15:04:05 "
+
+	if len(line) >= len(stamp) && line[4] == '/' && line[7] == '/' && line[13] == ':' {
+		return line[len(stamp):]
+	}
+
+	return line
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/rys/gitsync/pkg/gitsync"
+)
+
+// gsMaxWebhookBody is the most of a webhook delivery that is read. Push
+// events of big pushes are a few megabytes.
+const gsMaxWebhookBody = 25 << 20
+
+// How long a webhook client gets to send its request headers, the whole
+// request, and its next request on a kept alive connection, so slow or idle
+// clients can't hold connections open.
+const (
+	gsWebhookHeaderTimeout = 10 * time.Second
+	gsWebhookReadTimeout   = time.Minute
+	gsWebhookIdleTimeout   = 2 * time.Minute
+)
+
+// serveWebhooks serves POST /webhook/<remote> on addr until the server fails,
+// sending the remote to triggers for every delivery its forge signed with the
+// remote's webhook_secret, and POST /gitlab/system-hook for the config's
+// gitlab_system_hook. A trigger that arrives while another is waiting is
+// folded into it, as one run syncs everything.
+func serveWebhooks(addr string, current *atomic.Pointer[gitsync.Syncer], triggers chan<- string) {
+	trigger := func(from string) {
+		select {
+		case triggers <- from:
+		default:
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /webhook/{remote}", func(w http.ResponseWriter, r *http.Request) {
+		source := r.PathValue("remote")
+		body, ok := readDelivery(w, r)
+
+		if !ok {
+			return
+		}
+
+		// A delivery about a remote that isn't a source is refused just as
+		// an unauthenticated one is, so the answer doesn't give away which
+		// remotes are.
+		if err := current.Load().VerifyWebhook(source, r.Header, body); err != nil {
+			errorPrintf("refused webhook from %s: %s\n", r.RemoteAddr, err)
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+
+		// GitHub pings a webhook when it is added, to check it is set up.
+		if r.Header.Get("X-GitHub-Event") == "ping" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		trigger(source)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("POST /gitlab/system-hook", func(w http.ResponseWriter, r *http.Request) {
+		body, ok := readDelivery(w, r)
+
+		if !ok {
+			return
+		}
+
+		event, err := current.Load().HandleSystemHook(r.Header, body)
+
+		switch {
+		case errors.Is(err, gitsync.ErrWebhookUnauthenticated):
+			errorPrintf("refused system hook from %s: %s\n", r.RemoteAddr, err)
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		case err != nil:
+			errorPrintf("system hook: %s\n", err)
+			http.Error(w, "could not handle the delivery", http.StatusInternalServerError)
+			return
+		}
+
+		if event.Added {
+			infoPrintf("added GitLab project %s to the sync set\n", event.Project)
+		}
+
+		if !event.Sync {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		trigger(event.Project)
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	infoPrintf("serving webhooks on %s/webhook/<remote>\n", addr)
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: gsWebhookHeaderTimeout,
+		ReadTimeout:       gsWebhookReadTimeout,
+		IdleTimeout:       gsWebhookIdleTimeout,
+	}
+
+	if err := server.ListenAndServe(); err != nil {
+		errorPrintf("webhook server stopped: %s\n", err)
+	}
+}
+
+// readDelivery reads a webhook delivery's body, answering the request
+// itself if it can't.
+func readDelivery(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, gsMaxWebhookBody))
+
+	if err != nil {
+		http.Error(w, "could not read the delivery", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	return body, true
+}